@@ -97,25 +97,25 @@ func (s *Slice) initStatisticSlaveBalancer() {
 	}
 }
 
-// getNextSlave return connection pool of calculated ip
+// getNextSlave return connection pool of calculated ip, unavailable slaves are skipped
 func (s *Slice) getNextSlave() (*ConnectionPool, error) {
-	var index int
 	queueLen := len(s.RoundRobinQ)
 	if queueLen == 0 {
 		return nil, errors.ErrNoDatabase
 	}
-	if queueLen == 1 {
-		index = s.RoundRobinQ[0]
-		return s.Slave[index], nil
-	}
 
-	s.LastSlaveIndex = s.LastSlaveIndex % queueLen
-	index = s.RoundRobinQ[s.LastSlaveIndex]
-	if len(s.Slave) <= index {
-		return nil, errors.ErrNoDatabase
+	now := time.Now()
+	for i := 0; i < queueLen; i++ {
+		s.LastSlaveIndex = s.LastSlaveIndex % queueLen
+		index := s.RoundRobinQ[s.LastSlaveIndex]
+		s.LastSlaveIndex++
+		if len(s.Slave) <= index {
+			return nil, errors.ErrNoDatabase
+		}
+		cp := s.Slave[index]
+		if cp.isAvailable(now) {
+			return cp, nil
+		}
 	}
-	cp := s.Slave[index]
-	s.LastSlaveIndex++
-	s.LastSlaveIndex = s.LastSlaveIndex % queueLen
-	return cp, nil
+	return nil, errors.ErrSlaveDown
 }
@@ -3,6 +3,7 @@ package backend
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -37,6 +38,8 @@ type ConnectionPool struct {
 	capacity    int // capacity of pool
 	maxCapacity int // max capacity of pool
 	idleTimeout time.Duration
+
+	health nodeHealth
 }
 
 // NewConnectionPool create connection pool
@@ -83,6 +86,7 @@ func (cp *ConnectionPool) Addr() string {
 
 // Close close connection pool
 func (cp *ConnectionPool) Close() {
+	cp.closeHealth()
 	p := cp.pool()
 	if p == nil {
 		return
@@ -94,6 +98,19 @@ func (cp *ConnectionPool) Close() {
 	return
 }
 
+// KillQuery kill query running on backend connection with thread id connID, a new connection is used
+// because the connection running the query is busy.
+func (cp *ConnectionPool) KillQuery(connID uint32) error {
+	dc, err := NewDirectConnection(cp.addr, cp.user, cp.password, "", cp.charset, cp.collationID)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	_, err = dc.Execute(fmt.Sprintf("KILL QUERY %d", connID))
+	return err
+}
+
 // tryReuse reset params of connection before reuse
 func (cp *ConnectionPool) tryReuse(pc *PooledConnection) error {
 	return pc.directConnection.ResetConnection()
@@ -110,6 +127,10 @@ func (cp *ConnectionPool) Get(ctx context.Context) (*PooledConnection, error) {
 	defer cancel()
 	r, err := p.Get(getCtx)
 	if err != nil {
+		// pool exhausted is not a failure of node
+		if err != util.ErrTimeout {
+			cp.recordResult(err)
+		}
 		return nil, err
 	}
 
@@ -22,7 +22,8 @@ type DirectConnection struct {
 	password string
 	db       string
 
-	capability uint32
+	capability   uint32
+	connectionID uint32 // thread id allocated by backend mysql
 
 	sessionVariables *mysql.SessionVariables
 
@@ -37,8 +38,17 @@ type DirectConnection struct {
 
 	pkgErr error
 	closed sync2.AtomicBool
+
+	stmts    map[string]*Stmt // key: sql, prepared statements on this connection
+	stmtSQLs []string         // prepare order of stmts, used for eviction
+
+	rowChecker RowChecker // check rows of result set while reading, nil means no check
 }
 
+// RowChecker is called for every row of result set read from backend mysql. If error returned,
+// rows left are read and discarded, and the error is returned as result of the query.
+type RowChecker func(row []byte) error
+
 // NewDirectConnection return direct and authorised connection to mysql with real net connection
 func NewDirectConnection(addr string, user string, password string, db string, charset string, collationID mysql.CollationID) (*DirectConnection, error) {
 	dc := &DirectConnection{
@@ -62,6 +72,7 @@ func (dc *DirectConnection) connect() error {
 	if dc.conn != nil {
 		dc.conn.Close()
 	}
+	dc.clearStmts()
 
 	typ := "tcp"
 	if strings.Contains(dc.addr, "/") {
@@ -128,6 +139,7 @@ func (dc *DirectConnection) Close() {
 	dc.conn = nil
 	dc.salt = nil
 	dc.pkgErr = nil
+	dc.clearStmts()
 	dc.closed.Set(true)
 
 	return
@@ -192,10 +204,13 @@ func (dc *DirectConnection) readInitialHandshake() error {
 		return fmt.Errorf("invalid protocol version %d, must >= 10", data[0])
 	}
 
-	//skip mysql version and connection id
+	//skip mysql version
 	//mysql version end with 0x00
+	pos := 1 + bytes.IndexByte(data[1:], 0x00) + 1
+
 	//connection id length is 4
-	pos := 1 + bytes.IndexByte(data[1:], 0x00) + 1 + 4
+	dc.connectionID = binary.LittleEndian.Uint32(data[pos : pos+4])
+	pos += 4
 
 	dc.salt = append(dc.salt, data[pos:pos+8]...)
 
@@ -384,6 +399,11 @@ func (dc *DirectConnection) GetDB() string {
 	return dc.db
 }
 
+// GetConnectionID return thread id of connection in backend mysql
+func (dc *DirectConnection) GetConnectionID() uint32 {
+	return dc.connectionID
+}
+
 // GetAddr return addr of backend mysql
 func (dc *DirectConnection) GetAddr() string {
 	return dc.addr
@@ -647,6 +667,16 @@ func (dc *DirectConnection) readResultRows(result *mysql.Result, isBinary bool)
 		}
 
 		result.RowDatas = append(result.RowDatas, data)
+		if dc.rowChecker != nil {
+			if err = dc.rowChecker(data); err != nil {
+				// keep connection usable for next query
+				if e := dc.discardResultRows(); e != nil {
+					dc.Close()
+				}
+				result.RowDatas = nil
+				return err
+			}
+		}
 	}
 
 	result.Values = make([][]interface{}, len(result.RowDatas))
@@ -662,6 +692,31 @@ func (dc *DirectConnection) readResultRows(result *mysql.Result, isBinary bool)
 	return nil
 }
 
+// discardResultRows read and discard rows left until EOF or error packet,
+// the error packet is sent by backend mysql if query has been killed
+func (dc *DirectConnection) discardResultRows() error {
+	for {
+		data, err := dc.readPacket()
+		if err != nil {
+			return err
+		}
+		if dc.isEOFPacket(data) {
+			if dc.capability&mysql.ClientProtocol41 > 0 {
+				dc.status = binary.LittleEndian.Uint16(data[3:])
+			}
+			return nil
+		}
+		if data[0] == mysql.ErrHeader {
+			return nil
+		}
+	}
+}
+
+// SetRowChecker set checker of rows read by following queries, nil means no check
+func (dc *DirectConnection) SetRowChecker(c RowChecker) {
+	dc.rowChecker = c
+}
+
 func (dc *DirectConnection) isEOFPacket(data []byte) bool {
 	return data[0] == mysql.EOFHeader && len(data) <= 5
 }
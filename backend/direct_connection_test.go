@@ -15,7 +15,11 @@ package backend
 
 import (
 	"bytes"
+	"errors"
+	"net"
 	"testing"
+
+	"github.com/ZzzYtl/MyMask/mysql"
 )
 
 func TestAppendSetVariable(t *testing.T) {
@@ -37,3 +41,41 @@ func TestAppendSetVariable2(t *testing.T) {
 	appendSetVariableToDefault(&buf, "sql_mode")
 	t.Log(buf.String())
 }
+
+func TestReadResultRowsWithChecker(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	dc := &DirectConnection{conn: mysql.NewConn(client)}
+	defer dc.Close()
+
+	go func() {
+		c := mysql.NewConn(server)
+		for _, row := range []string{"\x01a", "\x01b", "\x01c"} {
+			c.WritePacket([]byte(row))
+		}
+		c.WritePacket([]byte{mysql.EOFHeader, 0, 0, 0, 0})
+		c.WritePacket([]byte{mysql.OKHeader, 0, 0, 0, 0, 0, 0})
+	}()
+
+	errLimit := errors.New("limit exceeded")
+	var rows int
+	dc.SetRowChecker(func(row []byte) error {
+		if rows++; rows > 1 {
+			return errLimit
+		}
+		return nil
+	})
+	result := &mysql.Result{Resultset: &mysql.Resultset{}}
+	if err := dc.readResultRows(result, false); err != errLimit {
+		t.Fatalf("error of row checker should be returned, actual: %v", err)
+	}
+	if rows != 2 {
+		t.Errorf("rows should not be checked after limit exceeded, actual: %d", rows)
+	}
+
+	// rows left are discarded, so that next packet is read by next query
+	r, err := dc.readResult(false)
+	if err != nil || r.Resultset != nil {
+		t.Errorf("ok packet should be read after rows discarded, result: %+v, err: %v", r, err)
+	}
+}
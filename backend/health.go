@@ -0,0 +1,391 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/mysql"
+)
+
+// roles of node in slice
+const (
+	NodeRoleMaster = "master"
+	NodeRoleSlave  = "slave"
+)
+
+const (
+	defaultHealthWindow      = 10 * time.Second
+	defaultHealthMinRequests = 10
+	defaultEjectTime         = 10 * time.Second
+	defaultMaxEjectTime      = 300 * time.Second
+
+	// lagUnknown means replication of slave is not running
+	lagUnknown = -1
+)
+
+// healthConfig is runtime health check config converted from models.HealthCheck
+type healthConfig struct {
+	interval          time.Duration
+	checkSQL          string
+	maxReplicationLag int64
+	errorRate         float64
+	minRequests       int64
+	window            time.Duration
+	ejectTime         time.Duration
+	maxEjectTime      time.Duration
+}
+
+func newHealthConfig(cfg *models.HealthCheck) *healthConfig {
+	hc := &healthConfig{
+		minRequests:  defaultHealthMinRequests,
+		window:       defaultHealthWindow,
+		ejectTime:    defaultEjectTime,
+		maxEjectTime: defaultMaxEjectTime,
+	}
+	if cfg == nil {
+		return hc
+	}
+
+	hc.interval = time.Duration(cfg.Interval) * time.Second
+	hc.checkSQL = cfg.CheckSQL
+	hc.maxReplicationLag = int64(cfg.MaxReplicationLag)
+	hc.errorRate = cfg.ErrorRate
+	if cfg.MinRequests > 0 {
+		hc.minRequests = int64(cfg.MinRequests)
+	}
+	if cfg.Window > 0 {
+		hc.window = time.Duration(cfg.Window) * time.Second
+	}
+	if cfg.EjectTime > 0 {
+		hc.ejectTime = time.Duration(cfg.EjectTime) * time.Second
+	}
+	if cfg.MaxEjectTime > 0 {
+		hc.maxEjectTime = time.Duration(cfg.MaxEjectTime) * time.Second
+	}
+	if hc.maxEjectTime < hc.ejectTime {
+		hc.maxEjectTime = hc.ejectTime
+	}
+	return hc
+}
+
+// NodeState means health state of one node, used by admin api and metrics
+type NodeState struct {
+	Addr         string    `json:"addr"`
+	Role         string    `json:"role"`
+	Available    bool      `json:"available"`
+	Ejected      bool      `json:"ejected"`
+	EjectCount   int       `json:"eject_count"`
+	EjectedUntil time.Time `json:"ejected_until"`
+	Lag          int64     `json:"replication_lag"` // seconds behind master, -1 means replication is not running
+	LastCheck    time.Time `json:"last_check"`
+	LastError    string    `json:"last_error"`
+}
+
+// nodeHealth keeps health state of a connection pool
+type nodeHealth struct {
+	sync.Mutex
+	cfg  *healthConfig
+	role string
+
+	ejectCount   int // consecutive ejections, used to calculate ejection time
+	ejectedUntil time.Time
+	lag          int64
+	lastCheck    time.Time
+	lastError    string
+
+	// passive check
+	windowStart time.Time
+	requests    int64
+	errors      int64
+
+	// active check
+	probing   bool
+	closed    bool
+	probeConn *DirectConnection
+}
+
+func (h *nodeHealth) isEjected(now time.Time) bool {
+	return now.Before(h.ejectedUntil)
+}
+
+// eject node with exponential ejection time, return the ejection time
+func (h *nodeHealth) eject(now time.Time, reason string) time.Duration {
+	h.ejectCount++
+	d := h.cfg.ejectTime
+	for i := 1; i < h.ejectCount && d < h.cfg.maxEjectTime; i++ {
+		d *= 2
+	}
+	if d > h.cfg.maxEjectTime {
+		d = h.cfg.maxEjectTime
+	}
+	h.ejectedUntil = now.Add(d)
+	h.lastError = reason
+	h.resetWindow(now)
+	return d
+}
+
+func (h *nodeHealth) resetWindow(now time.Time) {
+	h.windowStart = now
+	h.requests = 0
+	h.errors = 0
+}
+
+// initHealth must be called before the pool is used
+func (cp *ConnectionPool) initHealth(role string, cfg *healthConfig) {
+	cp.health.Lock()
+	cp.health.role = role
+	cp.health.cfg = cfg
+	cp.health.windowStart = time.Now()
+	cp.health.Unlock()
+}
+
+// isAvailable check if node could serve requests, slaves lagging too much are unavailable
+func (cp *ConnectionPool) isAvailable(now time.Time) bool {
+	h := &cp.health
+	h.Lock()
+	defer h.Unlock()
+	if h.cfg == nil {
+		return true
+	}
+	if h.isEjected(now) {
+		return false
+	}
+	if h.role == NodeRoleSlave && h.cfg.maxReplicationLag > 0 {
+		return h.lag != lagUnknown && h.lag <= h.cfg.maxReplicationLag
+	}
+	return true
+}
+
+// recordResult record result of request for passive check, only errors of network or connection are counted,
+// errors returned by mysql such as syntax error are treated as success.
+func (cp *ConnectionPool) recordResult(err error) {
+	h := &cp.health
+	h.Lock()
+	defer h.Unlock()
+	if h.cfg == nil || h.cfg.errorRate == 0 {
+		return
+	}
+
+	now := time.Now()
+	if h.isEjected(now) {
+		return
+	}
+
+	h.requests++
+	if err != nil {
+		if _, ok := err.(*mysql.SQLError); !ok {
+			h.errors++
+			h.lastError = err.Error()
+		}
+	}
+
+	if now.Sub(h.windowStart) < h.cfg.window {
+		return
+	}
+
+	if h.requests >= h.cfg.minRequests {
+		if rate := float64(h.errors) / float64(h.requests); rate >= h.cfg.errorRate {
+			d := h.eject(now, h.lastError)
+			log.Warn("eject backend node by error rate, addr: %s, role: %s, error rate: %.2f, eject time: %v", cp.addr, h.role, rate, d)
+			return
+		}
+		h.ejectCount = 0
+	}
+	h.resetWindow(now)
+}
+
+// probe check node by ping, check sql and replication lag
+func (cp *ConnectionPool) probe() {
+	h := &cp.health
+	h.Lock()
+	if h.probing || h.closed || h.cfg == nil {
+		h.Unlock()
+		return
+	}
+	h.probing = true
+	cfg := h.cfg
+	role := h.role
+	dc := h.probeConn
+	h.probeConn = nil
+	h.Unlock()
+
+	var err error
+	var lag int64
+	if dc == nil || dc.IsClosed() {
+		dc, err = NewDirectConnection(cp.addr, cp.user, cp.password, "", cp.charset, cp.collationID)
+	}
+	if err == nil {
+		err = dc.Ping()
+	}
+	if err == nil && cfg.checkSQL != "" {
+		_, err = dc.Execute(cfg.checkSQL)
+	}
+	if err == nil && role == NodeRoleSlave && cfg.maxReplicationLag > 0 {
+		lag, err = dc.replicationLag()
+	}
+	if err != nil && dc != nil {
+		dc.Close()
+		dc = nil
+	}
+
+	now := time.Now()
+	h.Lock()
+	defer h.Unlock()
+	h.probing = false
+	h.lastCheck = now
+	if h.closed {
+		if dc != nil {
+			dc.Close()
+		}
+		return
+	}
+	h.probeConn = dc
+
+	if err != nil {
+		// ejected node is checked again after ejection time
+		if !h.isEjected(now) {
+			d := h.eject(now, err.Error())
+			log.Warn("eject backend node by health check, addr: %s, role: %s, err: %v, eject time: %v", cp.addr, role, err, d)
+		}
+		return
+	}
+
+	h.lag = lag
+	if !h.isEjected(now) {
+		h.ejectCount = 0
+		h.lastError = ""
+	}
+}
+
+// closeHealth close connection used by active check
+func (cp *ConnectionPool) closeHealth() {
+	cp.health.Lock()
+	defer cp.health.Unlock()
+	cp.health.closed = true
+	if cp.health.probeConn != nil {
+		cp.health.probeConn.Close()
+		cp.health.probeConn = nil
+	}
+}
+
+// NodeState return health state of node
+func (cp *ConnectionPool) NodeState() *NodeState {
+	now := time.Now()
+	available := cp.isAvailable(now)
+
+	h := &cp.health
+	h.Lock()
+	defer h.Unlock()
+	return &NodeState{
+		Addr:         cp.addr,
+		Role:         h.role,
+		Available:    available,
+		Ejected:      h.isEjected(now),
+		EjectCount:   h.ejectCount,
+		EjectedUntil: h.ejectedUntil,
+		Lag:          h.lag,
+		LastCheck:    h.lastCheck,
+		LastError:    h.lastError,
+	}
+}
+
+// replicationLag return seconds behind master, lagUnknown means replication is not running
+func (dc *DirectConnection) replicationLag() (int64, error) {
+	column := "Seconds_Behind_Source"
+	r, err := dc.Execute("SHOW REPLICA STATUS")
+	if _, ok := err.(*mysql.SQLError); ok {
+		// SHOW REPLICA STATUS is supported since mysql 8.0.22
+		column = "Seconds_Behind_Master"
+		r, err = dc.Execute("SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// not a slave
+	if r.Resultset == nil || r.RowNumber() == 0 {
+		return 0, nil
+	}
+
+	isNull, err := r.IsNullByName(0, column)
+	if err != nil {
+		return 0, err
+	}
+	if isNull {
+		return lagUnknown, nil
+	}
+	return r.GetIntByName(0, column)
+}
+
+// SetHealthCheck set health check config, must be called before ParseMaster and ParseSlave
+func (s *Slice) SetHealthCheck(cfg *models.HealthCheck) {
+	s.healthCfg = newHealthConfig(cfg)
+}
+
+// StartHealthCheck start active health check of all nodes, nothing is done if interval is not set
+func (s *Slice) StartHealthCheck() {
+	if s.healthCfg == nil || s.healthCfg.interval == 0 {
+		return
+	}
+
+	s.healthStop = make(chan struct{})
+	go func(interval time.Duration, stop chan struct{}) {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				for _, cp := range s.nodes() {
+					go cp.probe()
+				}
+			}
+		}
+	}(s.healthCfg.interval, s.healthStop)
+}
+
+// NodeStates return health state of master and slaves
+func (s *Slice) NodeStates() []*NodeState {
+	nodes := s.nodes()
+	states := make([]*NodeState, 0, len(nodes))
+	for _, cp := range nodes {
+		states = append(states, cp.NodeState())
+	}
+	return states
+}
+
+func (s *Slice) nodes() []*ConnectionPool {
+	s.RLock()
+	defer s.RUnlock()
+	nodes := make([]*ConnectionPool, 0, len(s.Slave)+1)
+	if s.Master != nil {
+		nodes = append(nodes, s.Master)
+	}
+	nodes = append(nodes, s.Slave...)
+	return nodes
+}
+
+// stopHealthCheck must be called with lock of slice held
+func (s *Slice) stopHealthCheck() {
+	if s.healthStop != nil {
+		close(s.healthStop)
+		s.healthStop = nil
+	}
+}
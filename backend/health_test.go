@@ -0,0 +1,82 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/mysql"
+)
+
+func TestNodeHealthEject(t *testing.T) {
+	h := &nodeHealth{cfg: newHealthConfig(&models.HealthCheck{EjectTime: 10, MaxEjectTime: 30})}
+	now := time.Now()
+	expects := []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, expect := range expects {
+		if d := h.eject(now, "down"); d != expect {
+			t.Errorf("eject %d not equal, expect: %v, actual: %v", i, expect, d)
+		}
+		if !h.isEjected(now) || h.isEjected(now.Add(expect)) {
+			t.Errorf("eject %d, wrong ejection time", i)
+		}
+	}
+}
+
+func TestConnectionPoolRecordResult(t *testing.T) {
+	cp := &ConnectionPool{addr: "127.0.0.1:3306"}
+	cp.initHealth(NodeRoleSlave, newHealthConfig(&models.HealthCheck{ErrorRate: 0.5, MinRequests: 4, Window: 1}))
+
+	// errors returned by mysql are not counted
+	for i := 0; i < 4; i++ {
+		cp.recordResult(mysql.NewDefaultError(mysql.ErrParse, "", "", 1))
+	}
+	cp.health.windowStart = time.Now().Add(-2 * time.Second)
+	cp.recordResult(nil)
+	if !cp.isAvailable(time.Now()) {
+		t.Fatal("node should be available")
+	}
+
+	for i := 0; i < 4; i++ {
+		cp.recordResult(errors.New("connection reset"))
+	}
+	cp.health.windowStart = time.Now().Add(-2 * time.Second)
+	cp.recordResult(nil)
+	if cp.isAvailable(time.Now()) {
+		t.Fatal("node should be ejected")
+	}
+}
+
+func TestConnectionPoolReplicationLag(t *testing.T) {
+	cp := &ConnectionPool{addr: "127.0.0.1:3306"}
+	cp.initHealth(NodeRoleSlave, newHealthConfig(&models.HealthCheck{Interval: 1, MaxReplicationLag: 5}))
+	tests := []struct {
+		lag    int64
+		expect bool
+	}{
+		{0, true},
+		{5, true},
+		{6, false},
+		{lagUnknown, false},
+	}
+	for _, test := range tests {
+		cp.health.lag = test.lag
+		if actual := cp.isAvailable(time.Now()); actual != test.expect {
+			t.Errorf("lag %d not equal, expect: %v, actual: %v", test.lag, test.expect, actual)
+		}
+	}
+}
@@ -12,6 +12,9 @@ type PooledConnection struct {
 
 // Recycle return PooledConnection to the pool
 func (pc *PooledConnection) Recycle() {
+	if pc.directConnection != nil {
+		pc.directConnection.SetRowChecker(nil)
+	}
 	if pc.IsClosed() {
 		pc.pool.Put(nil)
 	} else {
@@ -51,7 +54,9 @@ func (pc *PooledConnection) UseDB(db string) error {
 
 // Execute wrapper of direct connection, execute sql
 func (pc *PooledConnection) Execute(sql string) (*mysql.Result, error) {
-	return pc.directConnection.Execute(sql)
+	r, err := pc.directConnection.Execute(sql)
+	pc.pool.recordResult(err)
+	return r, err
 }
 
 // SetAutoCommit wrapper of direct connection, set autocommit
@@ -89,6 +94,22 @@ func (pc *PooledConnection) GetAddr() string {
 	return pc.directConnection.GetAddr()
 }
 
+// GetConnectionID wrapper of direct connection, return thread id in backend mysql
+func (pc *PooledConnection) GetConnectionID() uint32 {
+	return pc.directConnection.GetConnectionID()
+}
+
+// KillQuery kill query running on backend connection with thread id connID, connID should be got before the query
+// is executed, because this method is called from other goroutines.
+func (pc *PooledConnection) KillQuery(connID uint32) error {
+	return pc.pool.KillQuery(connID)
+}
+
+// SetRowChecker wrapper of direct connection, set checker of rows read by following queries
+func (pc *PooledConnection) SetRowChecker(c RowChecker) {
+	pc.directConnection.SetRowChecker(c)
+}
+
 // SetSessionVariables set pc variables according to session
 func (pc *PooledConnection) SetSessionVariables(frontend *mysql.SessionVariables) (bool, error) {
 	return pc.directConnection.SetSessionVariables(frontend)
@@ -98,3 +119,28 @@ func (pc *PooledConnection) SetSessionVariables(frontend *mysql.SessionVariables
 func (pc *PooledConnection) WriteSetStatement() error {
 	return pc.directConnection.WriteSetStatement()
 }
+
+// Prepare wrapper of direct connection, prepare sql on backend mysql
+func (pc *PooledConnection) Prepare(sql string) (*Stmt, error) {
+	return pc.directConnection.Prepare(sql)
+}
+
+// StmtExecute execute sql prepared on backend mysql, sql is prepared first if not prepared on this connection
+func (pc *PooledConnection) StmtExecute(sql string, args *StmtArgs) (*mysql.Result, error) {
+	s, err := pc.directConnection.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := pc.directConnection.StmtExecute(s, args)
+	if sqlErr, ok := err.(*mysql.SQLError); ok && sqlErr.SQLCode() == mysql.ErrUnknownStmtHandler {
+		// statement released by backend mysql, prepare again and retry once
+		pc.directConnection.removeStmt(sql)
+		if s, err = pc.directConnection.Prepare(sql); err != nil {
+			return nil, err
+		}
+		r, err = pc.directConnection.StmtExecute(s, args)
+	}
+	pc.pool.recordResult(err)
+	return r, err
+}
@@ -34,6 +34,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/ZzzYtl/MyMask/core/errors"
 	"github.com/ZzzYtl/MyMask/log"
 	"github.com/ZzzYtl/MyMask/models"
 	"github.com/ZzzYtl/MyMask/mysql"
@@ -50,6 +51,7 @@ type Slice struct {
 	Cfg models.Slice
 
 	sync.RWMutex
+	Master         *ConnectionPool
 	Slave          []*ConnectionPool
 	LastSlaveIndex int
 	RoundRobinQ    []int
@@ -61,11 +63,25 @@ type Slice struct {
 
 	charset     string
 	collationID mysql.CollationID
+
+	healthCfg  *healthConfig
+	healthStop chan struct{}
 }
 
-// GetConn get backend connection from different node based on fromSlave and userType
-func (s *Slice) GetConn(userType int) (pc *PooledConnection, err error) {
-	pc, err = s.GetSlaveConn()
+// GetConn get backend connection from master or slaves based on fromSlave,
+// master is used if there is no available slave, and slaves are used if slice has no master.
+// caller should reject writes if slice has no master
+func (s *Slice) GetConn(fromSlave bool) (pc *PooledConnection, err error) {
+	if fromSlave || !s.HasMaster() {
+		pc, err = s.GetSlaveConn()
+		if err != nil && s.HasMaster() {
+			log.Debug("get connection from slave failed, try to get from master, error: %s", err.Error())
+			pc, err = s.GetMasterConn()
+		}
+	} else {
+		pc, err = s.GetMasterConn()
+	}
+
 	if err != nil {
 		log.Warn("get connection from backend failed, error: %s", err.Error())
 		return
@@ -73,6 +89,32 @@ func (s *Slice) GetConn(userType int) (pc *PooledConnection, err error) {
 	return
 }
 
+// HasMaster return false if slice has slaves only
+func (s *Slice) HasMaster() bool {
+	return s.Master != nil
+}
+
+// Addrs return addresses of master and slaves without getting connection, master is the first one
+func (s *Slice) Addrs() []string {
+	var addrs []string
+	if s.Master != nil {
+		addrs = append(addrs, s.Master.Addr())
+	}
+	for _, slave := range s.Slave {
+		addrs = append(addrs, slave.Addr())
+	}
+	return addrs
+}
+
+// GetMasterConn return a connection in master pool
+func (s *Slice) GetMasterConn() (*PooledConnection, error) {
+	if s.Master == nil {
+		return nil, errors.ErrNoMasterDB
+	}
+	ctx := context.TODO()
+	return s.Master.Get(ctx)
+}
+
 // GetSlaveConn return a connection in slave pool
 func (s *Slice) GetSlaveConn() (*PooledConnection, error) {
 	s.Lock()
@@ -90,6 +132,13 @@ func (s *Slice) Close() error {
 	s.Lock()
 	defer s.Unlock()
 
+	s.stopHealthCheck()
+
+	// close master
+	if s.Master != nil {
+		s.Master.Close()
+	}
+
 	// close slaves
 	for i := range s.Slave {
 		s.Slave[i].Close()
@@ -97,6 +146,22 @@ func (s *Slice) Close() error {
 	return nil
 }
 
+// ParseMaster create connection pool of master, slice has no master if master is empty
+func (s *Slice) ParseMaster(master string) error {
+	if len(master) == 0 {
+		return nil
+	}
+
+	idleTimeout, err := util.Int2TimeDuration(s.Cfg.IdleTimeout)
+	if err != nil {
+		return err
+	}
+	s.Master = NewConnectionPool(master, s.Cfg.UserName, s.Cfg.Password, "", s.Cfg.Capacity, s.Cfg.MaxCapacity, idleTimeout, s.charset, s.collationID)
+	s.Master.initHealth(NodeRoleMaster, s.healthCfg)
+	s.Master.Open()
+	return nil
+}
+
 // ParseSlave create connection pool of slaves
 // (127.0.0.1:3306@2,192.168.0.12:3306@3)
 func (s *Slice) ParseSlave(slaves []string) error {
@@ -128,6 +193,7 @@ func (s *Slice) ParseSlave(slaves []string) error {
 			return err
 		}
 		cp := NewConnectionPool(addrAndWeight[0], s.Cfg.UserName, s.Cfg.Password, "", s.Cfg.Capacity, s.Cfg.MaxCapacity, idleTimeout, s.charset, s.collationID)
+		cp.initHealth(NodeRoleSlave, s.healthCfg)
 		cp.Open()
 		s.Slave = append(s.Slave, cp)
 	}
@@ -0,0 +1,269 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ZzzYtl/MyMask/mysql"
+)
+
+const (
+	// maxCachedStmts is the max number of prepared statements kept on one backend connection
+	maxCachedStmts = 256
+)
+
+// Stmt means a statement prepared on backend mysql, it belongs to one DirectConnection
+type Stmt struct {
+	id     uint32
+	sql    string
+	params []*mysql.Field
+	fields []*mysql.Field
+}
+
+// ID return statement id allocated by backend mysql
+func (s *Stmt) ID() uint32 {
+	return s.id
+}
+
+// SQL return sql text of the statement
+func (s *Stmt) SQL() string {
+	return s.sql
+}
+
+// ParamCount return number of placeholders in statement
+func (s *Stmt) ParamCount() int {
+	return len(s.params)
+}
+
+// Params return parameter definitions returned by backend mysql
+func (s *Stmt) Params() []*mysql.Field {
+	return s.params
+}
+
+// Fields return column definitions returned by backend mysql
+func (s *Stmt) Fields() []*mysql.Field {
+	return s.fields
+}
+
+// StmtArgs means binary arguments of COM_STMT_EXECUTE sent by client, they are forwarded without conversion
+type StmtArgs struct {
+	NullBitmap  []byte
+	ParamTypes  []byte
+	ParamValues []byte
+	LongData    map[uint16][]byte // key: param id, value: data sent by COM_STMT_SEND_LONG_DATA
+}
+
+// Prepare return prepared statement of sql, statement is prepared on backend mysql only once per connection
+func (dc *DirectConnection) Prepare(sql string) (*Stmt, error) {
+	if s, ok := dc.stmts[sql]; ok {
+		return s, nil
+	}
+
+	if len(dc.stmtSQLs) >= maxCachedStmts {
+		dc.evictStmt()
+	}
+
+	s, err := dc.prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	if dc.stmts == nil {
+		dc.stmts = make(map[string]*Stmt, 16)
+	}
+	dc.stmts[sql] = s
+	dc.stmtSQLs = append(dc.stmtSQLs, sql)
+	return s, nil
+}
+
+// StmtExecute send ComStmtSendLongData and ComStmtExecute to backend mysql, the result set is binary protocol
+func (dc *DirectConnection) StmtExecute(s *Stmt, args *StmtArgs) (*mysql.Result, error) {
+	for paramID, data := range args.LongData {
+		if err := dc.writeComStmtSendLongData(s.id, paramID, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := dc.writeComStmtExecute(s, args); err != nil {
+		return nil, err
+	}
+
+	return dc.readResult(true)
+}
+
+// StmtClose close prepared statement on backend mysql and remove it from cache
+func (dc *DirectConnection) StmtClose(s *Stmt) error {
+	dc.removeStmt(s.sql)
+	return dc.writeComStmtClose(s.id)
+}
+
+// removeStmt remove statement from cache without closing it on backend mysql
+func (dc *DirectConnection) removeStmt(sql string) {
+	if _, ok := dc.stmts[sql]; !ok {
+		return
+	}
+	delete(dc.stmts, sql)
+	for i, s := range dc.stmtSQLs {
+		if s == sql {
+			dc.stmtSQLs = append(dc.stmtSQLs[:i], dc.stmtSQLs[i+1:]...)
+			break
+		}
+	}
+}
+
+// evictStmt close the oldest prepared statement
+func (dc *DirectConnection) evictStmt() {
+	if len(dc.stmtSQLs) == 0 {
+		return
+	}
+	sql := dc.stmtSQLs[0]
+	dc.stmtSQLs = dc.stmtSQLs[1:]
+	s, ok := dc.stmts[sql]
+	if !ok {
+		return
+	}
+	delete(dc.stmts, sql)
+	dc.writeComStmtClose(s.id)
+}
+
+// clearStmts forget all cached statements, they are released by mysql when connection is closed
+func (dc *DirectConnection) clearStmts() {
+	dc.stmts = nil
+	dc.stmtSQLs = nil
+}
+
+// https://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html
+func (dc *DirectConnection) prepare(sql string) (*Stmt, error) {
+	dc.conn.SetSequence(0)
+	data := make([]byte, len(sql)+1)
+	data[0] = mysql.ComStmtPrepare
+	copy(data[1:], sql)
+	if err := dc.writePacket(data); err != nil {
+		return nil, err
+	}
+
+	data, err := dc.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	switch data[0] {
+	case mysql.OKHeader:
+	case mysql.ErrHeader:
+		return nil, dc.handleErrorPacket(data)
+	default:
+		return nil, fmt.Errorf("unexpected prepare response packet type: %d", data[0])
+	}
+
+	if len(data) < 12 {
+		return nil, mysql.ErrMalformPacket
+	}
+
+	s := &Stmt{sql: sql}
+	pos := 1
+	s.id = binary.LittleEndian.Uint32(data[pos:])
+	pos += 4
+	columnCount := binary.LittleEndian.Uint16(data[pos:])
+	pos += 2
+	paramCount := binary.LittleEndian.Uint16(data[pos:])
+
+	if paramCount > 0 {
+		if s.params, err = dc.readStmtFields(int(paramCount)); err != nil {
+			return nil, err
+		}
+	}
+
+	if columnCount > 0 {
+		if s.fields, err = dc.readStmtFields(int(columnCount)); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (dc *DirectConnection) readStmtFields(count int) ([]*mysql.Field, error) {
+	fs := make([]*mysql.Field, 0, count)
+	for {
+		data, err := dc.readPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		// EOF Packet
+		if dc.isEOFPacket(data) {
+			if len(fs) != count {
+				return nil, mysql.ErrMalformPacket
+			}
+			return fs, nil
+		}
+
+		f, err := mysql.FieldData(data).Parse()
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+}
+
+// https://dev.mysql.com/doc/internals/en/com-stmt-execute.html
+// new-params-bound-flag is always set, because the statement may be executed on a connection which never saw the types
+func (dc *DirectConnection) writeComStmtExecute(s *Stmt, args *StmtArgs) error {
+	dc.conn.SetSequence(0)
+	paramCount := len(s.params)
+	length := 1 + // command
+		4 + // statement id
+		1 + // flags
+		4 // iteration count
+	if paramCount > 0 {
+		length += len(args.NullBitmap) + 1 + len(args.ParamTypes) + len(args.ParamValues)
+	}
+
+	data := make([]byte, 0, length)
+	data = append(data, mysql.ComStmtExecute)
+	data = mysql.AppendUint32(data, s.id)
+	data = append(data, mysql.CursorTypeNoCursor)
+	data = mysql.AppendUint32(data, 1)
+	if paramCount > 0 {
+		data = append(data, args.NullBitmap...)
+		data = append(data, 1)
+		data = append(data, args.ParamTypes...)
+		data = append(data, args.ParamValues...)
+	}
+
+	return dc.writePacket(data)
+}
+
+// https://dev.mysql.com/doc/internals/en/com-stmt-send-long-data.html, no response
+func (dc *DirectConnection) writeComStmtSendLongData(stmtID uint32, paramID uint16, value []byte) error {
+	dc.conn.SetSequence(0)
+	data := make([]byte, 0, 1+4+2+len(value))
+	data = append(data, mysql.ComStmtSendLongData)
+	data = mysql.AppendUint32(data, stmtID)
+	data = mysql.AppendUint16(data, paramID)
+	data = append(data, value...)
+	return dc.writePacket(data)
+}
+
+// https://dev.mysql.com/doc/internals/en/com-stmt-close.html, no response
+func (dc *DirectConnection) writeComStmtClose(stmtID uint32) error {
+	dc.conn.SetSequence(0)
+	data := make([]byte, 0, 1+4)
+	data = append(data, mysql.ComStmtClose)
+	data = mysql.AppendUint32(data, stmtID)
+	return dc.writePacket(data)
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/ZzzYtl/MyMask/mysql"
+)
+
+// fakeStmtBackend is backend mysql which handles prepared statements, packets received are sent to packets
+type fakeStmtBackend struct {
+	conn    *mysql.Conn
+	packets chan []byte
+	nextID  uint32
+}
+
+func newFakeStmtBackend() (*DirectConnection, *fakeStmtBackend) {
+	server, client := net.Pipe()
+	dc := &DirectConnection{conn: mysql.NewConn(client)}
+	b := &fakeStmtBackend{conn: mysql.NewConn(server), packets: make(chan []byte, 1024), nextID: 1}
+	return dc, b
+}
+
+// serve read packets until connection closed, handle is called for each packet to write response
+func (b *fakeStmtBackend) serve(handle func(data []byte)) {
+	go func() {
+		defer close(b.packets)
+		for {
+			// every command starts a new sequence
+			b.conn.SetSequence(0)
+			data, err := b.conn.ReadPacket()
+			if err != nil {
+				return
+			}
+			b.packets <- data
+			handle(data)
+		}
+	}()
+}
+
+// writePrepareOK write response of COM_STMT_PREPARE with new statement id, params and columns
+func (b *fakeStmtBackend) writePrepareOK(params, columns []string) {
+	id := b.nextID
+	b.nextID++
+	data := []byte{mysql.OKHeader}
+	data = mysql.AppendUint32(data, id)
+	data = mysql.AppendUint16(data, uint16(len(columns)))
+	data = mysql.AppendUint16(data, uint16(len(params)))
+	data = append(data, 0, 0, 0)
+	b.conn.WritePacket(data)
+	for _, names := range [][]string{params, columns} {
+		if len(names) == 0 {
+			continue
+		}
+		for _, name := range names {
+			b.conn.WritePacket((&mysql.Field{Name: []byte(name), Type: mysql.TypeLonglong}).Dump())
+		}
+		b.conn.WritePacket([]byte{mysql.EOFHeader, 0, 0, 0, 0})
+	}
+}
+
+func (b *fakeStmtBackend) writeOK() {
+	b.conn.WritePacket([]byte{mysql.OKHeader, 0, 0, 0, 0, 0, 0})
+}
+
+func (b *fakeStmtBackend) writeError(code uint16, message string) {
+	data := []byte{mysql.ErrHeader}
+	data = mysql.AppendUint16(data, code)
+	b.conn.WritePacket(append(data, message...))
+}
+
+// received close client connection and return packets received by backend
+func (b *fakeStmtBackend) received(dc *DirectConnection) [][]byte {
+	dc.Close()
+	var packets [][]byte
+	for data := range b.packets {
+		packets = append(packets, data)
+	}
+	return packets
+}
+
+func TestPrepare(t *testing.T) {
+	dc, b := newFakeStmtBackend()
+	b.serve(func(data []byte) {
+		if sql := string(data[1:]); sql == "bad" {
+			b.writeError(mysql.ErrParse, "syntax error")
+		} else {
+			b.writePrepareOK([]string{"?", "?"}, []string{"c1"})
+		}
+	})
+
+	s, err := dc.Prepare("select c1 from t where id = ? and name = ?")
+	if err != nil {
+		t.Fatalf("prepare error: %v", err)
+	}
+	if s.ID() != 1 || s.ParamCount() != 2 || len(s.Fields()) != 1 || string(s.Fields()[0].Name) != "c1" {
+		t.Errorf("stmt not equal, id: %d, params: %d, fields: %v", s.ID(), s.ParamCount(), s.Fields())
+	}
+	// prepared only once per connection
+	if cached, err := dc.Prepare(s.SQL()); err != nil || cached != s {
+		t.Errorf("cached stmt should be returned, err: %v", err)
+	}
+	if _, err := dc.Prepare("bad"); err == nil {
+		t.Errorf("prepare should fail by error packet")
+	} else if sqlErr, ok := err.(*mysql.SQLError); !ok || sqlErr.SQLCode() != mysql.ErrParse {
+		t.Errorf("error of backend should be returned, actual: %v", err)
+	}
+	if _, ok := dc.stmts["bad"]; ok {
+		t.Errorf("failed stmt should not be cached")
+	}
+
+	packets := b.received(dc)
+	if len(packets) != 2 || packets[0][0] != mysql.ComStmtPrepare || string(packets[0][1:]) != s.SQL() {
+		t.Errorf("prepare packets not equal, actual: %q", packets)
+	}
+}
+
+func TestStmtExecute(t *testing.T) {
+	dc, b := newFakeStmtBackend()
+	b.serve(func(data []byte) {
+		if data[0] == mysql.ComStmtExecute {
+			b.writeOK()
+		}
+	})
+
+	s := &Stmt{id: 7, sql: "insert into t values (?, ?)", params: []*mysql.Field{{}, {}}}
+	args := &StmtArgs{
+		NullBitmap:  []byte{0x00},
+		ParamTypes:  []byte{mysql.TypeLonglong, 0, mysql.TypeBlob, 0},
+		ParamValues: []byte{1, 0, 0, 0, 0, 0, 0, 0},
+		LongData:    map[uint16][]byte{1: []byte("long data")},
+	}
+	if _, err := dc.StmtExecute(s, args); err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	// statement without params has no null bitmap and types
+	if _, err := dc.StmtExecute(&Stmt{id: 8, sql: "select 1"}, &StmtArgs{}); err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	expects := [][]byte{
+		// COM_STMT_SEND_LONG_DATA: statement id, param id, data
+		append([]byte{mysql.ComStmtSendLongData, 7, 0, 0, 0, 1, 0}, "long data"...),
+		// COM_STMT_EXECUTE: statement id, flags, iteration count, null bitmap, new params bound flag, types, values
+		{mysql.ComStmtExecute, 7, 0, 0, 0, mysql.CursorTypeNoCursor, 1, 0, 0, 0,
+			0x00, 1, mysql.TypeLonglong, 0, mysql.TypeBlob, 0, 1, 0, 0, 0, 0, 0, 0, 0},
+		{mysql.ComStmtExecute, 8, 0, 0, 0, mysql.CursorTypeNoCursor, 1, 0, 0, 0},
+	}
+	packets := b.received(dc)
+	if len(packets) != len(expects) {
+		t.Fatalf("count of packets not equal, expect: %d, actual: %d", len(expects), len(packets))
+	}
+	for i, expect := range expects {
+		if !bytes.Equal(packets[i], expect) {
+			t.Errorf("packet %d not equal, expect: %v, actual: %v", i, expect, packets[i])
+		}
+	}
+}
+
+func TestStmtCacheEviction(t *testing.T) {
+	dc, b := newFakeStmtBackend()
+	b.serve(func(data []byte) {
+		if data[0] == mysql.ComStmtPrepare {
+			b.writePrepareOK(nil, nil)
+		}
+	})
+
+	sql := func(i int) string { return fmt.Sprintf("select %d", i) }
+	for i := 0; i <= maxCachedStmts; i++ {
+		if _, err := dc.Prepare(sql(i)); err != nil {
+			t.Fatalf("prepare %d error: %v", i, err)
+		}
+	}
+	// the oldest is evicted, and prepared again as the newest
+	if _, err := dc.Prepare(sql(0)); err != nil {
+		t.Fatalf("prepare again error: %v", err)
+	}
+	if len(dc.stmts) != maxCachedStmts || len(dc.stmtSQLs) != maxCachedStmts {
+		t.Errorf("count of cached stmts not equal, stmts: %d, sqls: %d", len(dc.stmts), len(dc.stmtSQLs))
+	}
+	if _, ok := dc.stmts[sql(1)]; ok {
+		t.Errorf("second oldest stmt should be evicted")
+	}
+	if dc.stmtSQLs[0] != sql(2) || dc.stmtSQLs[maxCachedStmts-1] != sql(0) {
+		t.Errorf("order of cached stmts not equal, oldest: %s, newest: %s", dc.stmtSQLs[0], dc.stmtSQLs[maxCachedStmts-1])
+	}
+
+	var closed []uint32
+	for _, data := range b.received(dc) {
+		if data[0] == mysql.ComStmtClose {
+			closed = append(closed, binary.LittleEndian.Uint32(data[1:]))
+		}
+	}
+	if len(closed) != 2 || closed[0] != 1 || closed[1] != 2 {
+		t.Errorf("closed stmts not equal, expect: [1 2], actual: %v", closed)
+	}
+}
+
+func TestStmtExecuteUnknownStmt(t *testing.T) {
+	dc, b := newFakeStmtBackend()
+	b.nextID = 2
+	b.serve(func(data []byte) {
+		switch data[0] {
+		case mysql.ComStmtPrepare:
+			b.writePrepareOK(nil, nil)
+		case mysql.ComStmtExecute:
+			if binary.LittleEndian.Uint32(data[1:]) == 1 {
+				b.writeError(mysql.ErrUnknownStmtHandler, "Unknown prepared statement handler")
+				return
+			}
+			b.writeOK()
+		}
+	})
+
+	// statement 1 is cached, but released by backend mysql
+	sql := "select 1"
+	dc.stmts = map[string]*Stmt{sql: {id: 1, sql: sql}}
+	dc.stmtSQLs = []string{sql}
+	pc := &PooledConnection{directConnection: dc, pool: &ConnectionPool{}}
+	if _, err := pc.StmtExecute(sql, &StmtArgs{}); err != nil {
+		t.Fatalf("execute should succeed after prepared again, err: %v", err)
+	}
+	if s := dc.stmts[sql]; s == nil || s.ID() != 2 || len(dc.stmtSQLs) != 1 {
+		t.Errorf("stmt prepared again should be cached, stmt: %v, sqls: %v", s, dc.stmtSQLs)
+	}
+
+	var commands []byte
+	for _, data := range b.received(dc) {
+		commands = append(commands, data[0])
+	}
+	expect := []byte{mysql.ComStmtExecute, mysql.ComStmtPrepare, mysql.ComStmtExecute}
+	if !bytes.Equal(commands, expect) {
+		t.Errorf("commands not equal, expect: %v, actual: %v", expect, commands)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cc
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ZzzYtl/MyMask/cc/service"
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+)
+
+// DataResp response with data
+type DataResp struct {
+	RetHeader *RetHeader  `json:"ret_header"`
+	Data      interface{} `json:"data"`
+}
+
+// ModifyRuleReq create or modify rule request, file name is <name>.xml if not set
+type ModifyRuleReq struct {
+	Name     string          `json:"name"`
+	FileName string          `json:"file_name"`
+	Filters  []models.Filter `json:"filters"`
+}
+
+// reply write response, ret_code is 0 if err is nil
+func reply(c *gin.Context, data interface{}, err error) {
+	r := &DataResp{RetHeader: &RetHeader{RetCode: -1}}
+	if err != nil {
+		r.RetHeader.RetMessage = err.Error()
+		c.JSON(http.StatusOK, r)
+		return
+	}
+	r.RetHeader.RetCode = 0
+	r.RetHeader.RetMessage = "SUCC"
+	r.Data = data
+	c.JSON(http.StatusOK, r)
+}
+
+// bindJSON bind request body, bad request is replied if failed
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	if err := c.BindJSON(obj); err != nil {
+		log.Warn("%s got invalid data, err: %v", c.Request.URL.Path, err)
+		c.JSON(http.StatusBadRequest, &RetHeader{RetCode: -1, RetMessage: err.Error()})
+		return false
+	}
+	return true
+}
+
+// paramName return trimmed name in path, bad request is replied if empty
+func paramName(c *gin.Context) (string, bool) {
+	name := strings.TrimSpace(c.Param("name"))
+	if name == "" {
+		c.JSON(http.StatusBadRequest, &RetHeader{RetCode: -1, RetMessage: "input name is empty"})
+		return "", false
+	}
+	return name, true
+}
+
+func (s *Server) cluster(c *gin.Context) string {
+	return c.DefaultQuery("cluster", s.cfg.DefaultCluster)
+}
+
+func (s *Server) listRule(c *gin.Context) {
+	data, err := service.ListRules(s.cfg, s.cluster(c))
+	reply(c, data, err)
+}
+
+func (s *Server) queryRule(c *gin.Context) {
+	name, ok := paramName(c)
+	if !ok {
+		return
+	}
+	data, err := service.QueryRule(name, s.cfg, s.cluster(c))
+	reply(c, data, err)
+}
+
+func (s *Server) modifyRule(c *gin.Context) {
+	var req ModifyRuleReq
+	if !bindJSON(c, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		reply(c, nil, errors.New("input name is empty"))
+		return
+	}
+	opts, ok := rolloutOptions(c)
+	if !ok {
+		return
+	}
+	record := models.RuleListRecord{Name: req.Name, FileName: strings.TrimSpace(req.FileName)}
+	err := service.ModifyRule(record, &models.FilterList{Name: req.Name, Filters: req.Filters}, s.cfg, s.cluster(c), opts)
+	if err != nil {
+		log.Warn("modify rule %s failed, err: %v", req.Name, err)
+	}
+	reply(c, nil, err)
+}
+
+func (s *Server) delRule(c *gin.Context) {
+	name, ok := paramName(c)
+	if !ok {
+		return
+	}
+	opts, ok := rolloutOptions(c)
+	if !ok {
+		return
+	}
+	err := service.DelRule(name, s.cfg, s.cluster(c), opts)
+	if err != nil {
+		log.Warn("delete rule %s failed, err: %v", name, err)
+	}
+	reply(c, nil, err)
+}
+
+func (s *Server) listWhiteList(c *gin.Context) {
+	data, err := service.ListWhiteList(s.cfg, s.cluster(c))
+	reply(c, data, err)
+}
+
+func (s *Server) queryWhiteList(c *gin.Context) {
+	name, ok := paramName(c)
+	if !ok {
+		return
+	}
+	data, err := service.QueryWhiteList(name, s.cfg, s.cluster(c))
+	reply(c, data, err)
+}
+
+func (s *Server) modifyWhiteList(c *gin.Context) {
+	var whiteList models.WhiteList
+	if !bindJSON(c, &whiteList) {
+		return
+	}
+	opts, ok := rolloutOptions(c)
+	if !ok {
+		return
+	}
+	err := service.ModifyWhiteList(&whiteList, s.cfg, s.cluster(c), opts)
+	if err != nil {
+		log.Warn("modify white list %s failed, err: %v", whiteList.Name, err)
+	}
+	reply(c, nil, err)
+}
+
+func (s *Server) delWhiteList(c *gin.Context) {
+	name, ok := paramName(c)
+	if !ok {
+		return
+	}
+	opts, ok := rolloutOptions(c)
+	if !ok {
+		return
+	}
+	err := service.DelWhiteList(name, s.cfg, s.cluster(c), opts)
+	if err != nil {
+		log.Warn("delete white list %s failed, err: %v", name, err)
+	}
+	reply(c, nil, err)
+}
+
+func (s *Server) listDataBase(c *gin.Context) {
+	data, err := service.ListDataBases(s.cfg, s.cluster(c))
+	reply(c, data, err)
+}
+
+func (s *Server) modifyDataBase(c *gin.Context) {
+	var db models.DataBase
+	if !bindJSON(c, &db) {
+		return
+	}
+	opts, ok := rolloutOptions(c)
+	if !ok {
+		return
+	}
+	err := service.ModifyDataBase(&db, s.cfg, s.cluster(c), opts)
+	if err != nil {
+		log.Warn("modify database %s failed, err: %v", db.MaskDatabaseName, err)
+	}
+	reply(c, nil, err)
+}
+
+// delDataBase delete entry of databases.xml, entry is identified by namespace, address, port and mask_database_name
+func (s *Server) delDataBase(c *gin.Context) {
+	var db models.DataBase
+	if !bindJSON(c, &db) {
+		return
+	}
+	opts, ok := rolloutOptions(c)
+	if !ok {
+		return
+	}
+	err := service.DelDataBase(&db, s.cfg, s.cluster(c), opts)
+	if err != nil {
+		log.Warn("delete database %s failed, err: %v", db.MaskDatabaseName, err)
+	}
+	reply(c, nil, err)
+}
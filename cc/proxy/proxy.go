@@ -37,6 +37,21 @@ type SQLFingerprint struct {
 	ErrorSQL map[string]string `json:"error_sql"`
 }
 
+// ReloadResult result of last config reload of proxy
+type ReloadResult struct {
+	Committed bool          `json:"committed"`
+	Error     string        `json:"error"`
+	Items     []*ReloadItem `json:"items"`
+}
+
+// ReloadItem reload result of one component
+type ReloadItem struct {
+	Component string `json:"component"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	Error     string `json:"error"`
+}
+
 // GetStats return proxy status
 func GetStats(p *models.ProxyMonitorMetric, cfg *models.CCConfig, timeout time.Duration) *Stats {
 	fmt.Println(string(p.Encode()))
@@ -48,7 +63,7 @@ func GetStats(p *models.ProxyMonitorMetric, cfg *models.CCConfig, timeout time.D
 	go func(host string) {
 		defer close(ch)
 		stats.Host = host
-		_, err := newProxyClient(host, cfg.ProxyUserName, cfg.ProxyPassword)
+		_, err := newProxyClient(host, cfg)
 		if err != nil {
 			stats.Error = err.Error()
 			stats.Closed = true
@@ -65,9 +80,12 @@ func GetStats(p *models.ProxyMonitorMetric, cfg *models.CCConfig, timeout time.D
 	}
 }
 
-func newProxyClient(host, user, password string) (*APIClient, error) {
+func newProxyClient(host string, cfg *models.CCConfig) (*APIClient, error) {
 	log.Debug("call rpc xping to proxy %s", host)
-	c := NewAPIClient(host, user, password)
+	c := NewAPIClient(host, cfg.ProxyUserName, cfg.ProxyPassword)
+	if cfg.ProxyTLS {
+		c = NewTLSAPIClient(host, cfg.ProxyUserName, cfg.ProxyPassword)
+	}
 	if err := c.Ping(); err != nil {
 		log.Fatal("call rpc xping to proxy failed")
 		return c, err
@@ -79,7 +97,7 @@ func newProxyClient(host, user, password string) (*APIClient, error) {
 
 // PrepareConfig prepare phase of config change
 func PrepareConfig(host, name string, cfg *models.CCConfig) error {
-	c, err := newProxyClient(host, cfg.ProxyUserName, cfg.ProxyPassword)
+	c, err := newProxyClient(host, cfg)
 	if err != nil {
 		log.Fatal("create proxy client failed, %v", err)
 		return err
@@ -95,7 +113,7 @@ func PrepareConfig(host, name string, cfg *models.CCConfig) error {
 
 // CommitConfig commit phase of config change
 func CommitConfig(host, name string, cfg *models.CCConfig) error {
-	c, err := newProxyClient(host, cfg.ProxyUserName, cfg.ProxyPassword)
+	c, err := newProxyClient(host, cfg)
 	if err != nil {
 		log.Fatal("create proxy client failed, %v", err)
 		return err
@@ -108,9 +126,84 @@ func CommitConfig(host, name string, cfg *models.CCConfig) error {
 	return nil
 }
 
+// PrepareAllConfig prepare phase of change of rules, white lists or databases
+func PrepareAllConfig(host string, cfg *models.CCConfig) error {
+	c, err := newProxyClient(host, cfg)
+	if err != nil {
+		log.Fatal("create proxy client failed, %v", err)
+		return err
+	}
+	err = c.PrepareAllConfig()
+	if err != nil {
+		log.Fatal("prepare proxy config failed, %v", err)
+		return err
+	}
+	return nil
+}
+
+// CommitAllConfig commit phase of change of rules, white lists or databases
+func CommitAllConfig(host string, cfg *models.CCConfig) error {
+	c, err := newProxyClient(host, cfg)
+	if err != nil {
+		log.Fatal("create proxy client failed, %v", err)
+		return err
+	}
+	err = c.CommitAllConfig()
+	if err != nil {
+		log.Fatal("commit proxy config failed, %v", err)
+		return err
+	}
+	return nil
+}
+
+// AbortConfig abort prepared config, it's called when other proxies failed to prepare
+func AbortConfig(host string, cfg *models.CCConfig) error {
+	c, err := newProxyClient(host, cfg)
+	if err != nil {
+		log.Fatal("create proxy client failed, %v", err)
+		return err
+	}
+	err = c.AbortConfig()
+	if err != nil {
+		log.Warn("abort proxy config failed, %v", err)
+		return err
+	}
+	return nil
+}
+
+// Ping check proxy is alive
+func Ping(host string, cfg *models.CCConfig) error {
+	_, err := newProxyClient(host, cfg)
+	return err
+}
+
+// CheckReloadResult check proxy is alive and last reload has no error, warnings of verify are ignored
+func CheckReloadResult(host string, cfg *models.CCConfig) error {
+	c, err := newProxyClient(host, cfg)
+	if err != nil {
+		return err
+	}
+	r, err := c.GetReloadResult()
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return nil
+	}
+	if r.Error != "" {
+		return fmt.Errorf("reload config failed, %s", r.Error)
+	}
+	for _, item := range r.Items {
+		if item.Error != "" && item.Action != "verify" {
+			return fmt.Errorf("reload %s %s failed, %s", item.Component, item.Name, item.Error)
+		}
+	}
+	return nil
+}
+
 // DelNamespace delete namespace
 func DelNamespace(host, name string, cfg *models.CCConfig) error {
-	c, err := newProxyClient(host, cfg.ProxyUserName, cfg.ProxyPassword)
+	c, err := newProxyClient(host, cfg)
 	if err != nil {
 		log.Fatal("create proxy client failed, %v", err)
 		return err
@@ -125,7 +218,7 @@ func DelNamespace(host, name string, cfg *models.CCConfig) error {
 
 // QueryNamespaceSQLFingerprint return sql fingerprint
 func QueryNamespaceSQLFingerprint(host, name string, cfg *models.CCConfig) (*SQLFingerprint, error) {
-	c, err := newProxyClient(host, cfg.ProxyUserName, cfg.ProxyPassword)
+	c, err := newProxyClient(host, cfg)
 	if err != nil {
 		log.Fatal("create proxy client failed, %v", err)
 		return nil, err
@@ -137,7 +230,7 @@ func QueryNamespaceSQLFingerprint(host, name string, cfg *models.CCConfig) (*SQL
 
 // QueryProxyConfigFingerprint return config fingerprint of proxy
 func QueryProxyConfigFingerprint(host string, cfg *models.CCConfig) (string, error) {
-	c, err := newProxyClient(host, cfg.ProxyUserName, cfg.ProxyPassword)
+	c, err := newProxyClient(host, cfg)
 	if err != nil {
 		return "", err
 	}
@@ -25,11 +25,17 @@ type APIClient struct {
 	addr     string
 	user     string
 	password string
+	scheme   string
 }
 
 // NewAPIClient create api client
 func NewAPIClient(addr, user, password string) *APIClient {
-	return &APIClient{addr: addr, user: user, password: password}
+	return &APIClient{addr: addr, user: user, password: password, scheme: "http"}
+}
+
+// NewTLSAPIClient create api client sending requests by https
+func NewTLSAPIClient(addr, user, password string) *APIClient {
+	return &APIClient{addr: addr, user: user, password: password, scheme: "https"}
 }
 
 // PrepareConfig send prepare config
@@ -44,6 +50,40 @@ func (c *APIClient) CommitConfig(name string) error {
 	return requests.SendPut(url, c.user, c.password)
 }
 
+// PrepareAllConfig send prepare of all config, including rules, white lists and databases
+func (c *APIClient) PrepareAllConfig() error {
+	url := c.encodeURL("/api/proxy/config/prepare")
+	return requests.SendPut(url, c.user, c.password)
+}
+
+// CommitAllConfig send commit of all config
+func (c *APIClient) CommitAllConfig() error {
+	url := c.encodeURL("/api/proxy/config/commit")
+	return requests.SendPut(url, c.user, c.password)
+}
+
+// AbortConfig send abort of prepared config
+func (c *APIClient) AbortConfig() error {
+	url := c.encodeURL("/api/proxy/config/abort")
+	return requests.SendPut(url, c.user, c.password)
+}
+
+// GetReloadResult return result of last config reload
+func (c *APIClient) GetReloadResult() (*ReloadResult, error) {
+	url := c.encodeURL("/api/proxy/config/reload/result")
+	resp, err := requests.SendGet(url, c.user, c.password)
+	if err != nil {
+		return nil, err
+	}
+	var reply *ReloadResult
+	if resp != nil && resp.Body != nil {
+		if err := json.Unmarshal(resp.Body, &reply); err != nil {
+			return nil, err
+		}
+	}
+	return reply, nil
+}
+
 // DelNamespace send delete namespace to proxy
 func (c *APIClient) DelNamespace(name string) error {
 	url := c.encodeURL("/api/proxy/namespace/delete/%s", name)
@@ -88,5 +128,5 @@ func (c *APIClient) Ping() error {
 }
 
 func (c *APIClient) encodeURL(format string, args ...interface{}) string {
-	return requests.EncodeURL(c.addr, format, args...)
+	return requests.EncodeURLWithScheme(c.scheme, c.addr, format, args...)
 }
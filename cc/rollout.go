@@ -0,0 +1,92 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ZzzYtl/MyMask/cc/service"
+	"github.com/ZzzYtl/MyMask/log"
+)
+
+// rolloutOptions parse query canary (count of canary proxies) and canary_wait (seconds),
+// bad request is replied if invalid
+func rolloutOptions(c *gin.Context) (service.RolloutOptions, bool) {
+	var opts service.RolloutOptions
+	parse := func(key string) (int, bool) {
+		v := c.Query(key)
+		if v == "" {
+			return 0, true
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, &RetHeader{RetCode: -1, RetMessage: fmt.Sprintf("invalid %s: %s", key, v)})
+			return 0, false
+		}
+		return n, true
+	}
+
+	canary, ok := parse("canary")
+	if !ok {
+		return opts, false
+	}
+	wait, ok := parse("canary_wait")
+	if !ok {
+		return opts, false
+	}
+	opts.Canary = canary
+	opts.CanaryWait = time.Duration(wait) * time.Second
+	return opts, true
+}
+
+// importConfig replace config of cluster with config tree in canonical schema in request body
+func (s *Server) importConfig(c *gin.Context) {
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &RetHeader{RetCode: -1, RetMessage: err.Error()})
+		return
+	}
+	opts, ok := rolloutOptions(c)
+	if !ok {
+		return
+	}
+	err = service.ImportConfig(data, s.cfg, s.cluster(c), opts)
+	if err != nil {
+		log.Warn("import config failed, err: %v", err)
+	}
+	reply(c, nil, err)
+}
+
+func (s *Server) listRollout(c *gin.Context) {
+	data, err := service.ListRollout(s.cfg, s.cluster(c))
+	reply(c, data, err)
+}
+
+func (s *Server) queryRollout(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		c.JSON(http.StatusBadRequest, &RetHeader{RetCode: -1, RetMessage: "input id is empty"})
+		return
+	}
+	data, err := service.QueryRollout(id, s.cfg, s.cluster(c))
+	reply(c, data, err)
+}
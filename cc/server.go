@@ -71,6 +71,21 @@ func (s *Server) registerURL() {
 	api.PUT("/namespace/delete/:name", s.delNamespace)
 	api.GET("/namespace/sqlfingerprint/:name", s.sqlFingerprint)
 	api.GET("/proxy/config/fingerprint", s.proxyConfigFingerprint)
+
+	api.GET("/rule/list", s.listRule)
+	api.GET("/rule/detail/:name", s.queryRule)
+	api.PUT("/rule/modify", s.modifyRule)
+	api.PUT("/rule/delete/:name", s.delRule)
+	api.GET("/whitelist/list", s.listWhiteList)
+	api.GET("/whitelist/detail/:name", s.queryWhiteList)
+	api.PUT("/whitelist/modify", s.modifyWhiteList)
+	api.PUT("/whitelist/delete/:name", s.delWhiteList)
+	api.GET("/database/list", s.listDataBase)
+	api.PUT("/database/modify", s.modifyDataBase)
+	api.PUT("/database/delete", s.delDataBase)
+	api.PUT("/config/import", s.importConfig)
+	api.GET("/rollout/list", s.listRollout)
+	api.GET("/rollout/detail/:id", s.queryRollout)
 }
 
 // ListNamespaceResp list names of all namespace response
@@ -146,10 +161,15 @@ func (s *Server) modifyNamespace(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, h)
 		return
 	}
+	opts, ok := rolloutOptions(c)
+	if !ok {
+		return
+	}
 	cluster := c.DefaultQuery("cluster", s.cfg.DefaultCluster)
-	err = service.ModifyNamespace(&namespace, s.cfg, cluster)
+	err = service.ModifyNamespace(&namespace, s.cfg, cluster, opts)
 	if err != nil {
 		log.Warn("modifyNamespace failed, err: %v", err)
+		h.RetMessage = err.Error()
 		c.JSON(http.StatusOK, h)
 		return
 	}
@@ -169,8 +189,12 @@ func (s *Server) delNamespace(c *gin.Context) {
 		c.JSON(http.StatusOK, h)
 		return
 	}
+	opts, ok := rolloutOptions(c)
+	if !ok {
+		return
+	}
 	cluster := c.DefaultQuery("cluster", s.cfg.DefaultCluster)
-	err = service.DelNamespace(name, s.cfg, cluster)
+	err = service.DelNamespace(name, s.cfg, cluster, opts)
 	if err != nil {
 		h.RetMessage = fmt.Sprintf("delete namespace faild, %v", err.Error())
 		c.JSON(http.StatusOK, h)
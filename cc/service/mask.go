@@ -0,0 +1,398 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+)
+
+// ListRules return index of rule files
+func ListRules(cfg *models.CCConfig, cluster string) ([]models.RuleListRecord, error) {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	ruleList, err := store.LoadRuleLists()
+	if err != nil {
+		return nil, err
+	}
+	return ruleList.Records, nil
+}
+
+// QueryRule return filters of rule
+func QueryRule(name string, cfg *models.CCConfig, cluster string) (*models.FilterList, error) {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	ruleList, err := store.LoadRuleLists()
+	if err != nil {
+		return nil, err
+	}
+	record := findRule(ruleList, name)
+	if record == nil {
+		return nil, fmt.Errorf("rule %s not found", name)
+	}
+	filterList, err := store.LoadRule(cfg.EncryptKey, record.FileName)
+	if err != nil {
+		return nil, err
+	}
+	filterList.Name = name
+	return filterList, nil
+}
+
+// ModifyRule create or modify rule, file name of existing rule could not be changed
+func ModifyRule(record models.RuleListRecord, filterList *models.FilterList, cfg *models.CCConfig, cluster string, opts RolloutOptions) error {
+	if record.FileName == "" {
+		record.FileName = record.Name + ".xml"
+	}
+	if models.IsReservedName(record.FileName) {
+		return fmt.Errorf("invalid file name of rule %s: %s", record.Name, record.FileName)
+	}
+	if err := filterList.Verify(); err != nil {
+		return fmt.Errorf("verify rule error: %v", err)
+	}
+
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ruleList, err := store.LoadRuleLists()
+	if err != nil {
+		return err
+	}
+	if r := findRule(ruleList, record.Name); r != nil {
+		if r.FileName != record.FileName {
+			return fmt.Errorf("file name of rule %s could not be changed, current: %s", record.Name, r.FileName)
+		}
+	} else {
+		for _, r := range ruleList.Records {
+			if r.FileName == record.FileName {
+				return fmt.Errorf("file %s is used by rule %s", record.FileName, r.Name)
+			}
+		}
+		ruleList.Records = append(ruleList.Records, record)
+	}
+	if err := ruleList.Verify(); err != nil {
+		return fmt.Errorf("verify rule list error: %v", err)
+	}
+
+	change := &configChange{
+		kind:   RolloutKindRule,
+		target: record.Name,
+		action: RolloutActionModify,
+		paths:  []string{store.RuleListPath(record.FileName), store.RuleListPath(models.RuleListsName)},
+		apply: func() error {
+			// rule file is written before index, so that index never refers to missing file
+			if err := store.UpdateRule(record.FileName, filterList); err != nil {
+				log.Warn("update rule %s failed, %v", record.Name, err)
+				return err
+			}
+			if err := store.UpdateRuleLists(ruleList); err != nil {
+				log.Warn("update rule list failed, %v", err)
+				return err
+			}
+			return nil
+		},
+		ops: allConfigOps(cfg),
+	}
+	return rollout(store, opts, change)
+}
+
+// DelRule delete rule, rule used by databases could not be deleted
+func DelRule(name string, cfg *models.CCConfig, cluster string, opts RolloutOptions) error {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ruleList, err := store.LoadRuleLists()
+	if err != nil {
+		return err
+	}
+	record := findRule(ruleList, name)
+	if record == nil {
+		return nil
+	}
+	dbs, err := store.LoadDataBases()
+	if err != nil {
+		return err
+	}
+	for _, d := range dbs {
+		if d.Security.Rule == name {
+			return fmt.Errorf("rule %s is used by database %s", name, dbName(&d))
+		}
+	}
+
+	fileName := record.FileName
+	records := make([]models.RuleListRecord, 0, len(ruleList.Records))
+	for _, r := range ruleList.Records {
+		if r.Name != name {
+			records = append(records, r)
+		}
+	}
+	ruleList.Records = records
+
+	change := &configChange{
+		kind:   RolloutKindRule,
+		target: name,
+		action: RolloutActionDelete,
+		paths:  []string{store.RuleListPath(fileName), store.RuleListPath(models.RuleListsName)},
+		apply: func() error {
+			// index is written before rule file is deleted
+			if err := store.UpdateRuleLists(ruleList); err != nil {
+				log.Warn("update rule list failed, %v", err)
+				return err
+			}
+			if err := store.DelRule(fileName); err != nil {
+				log.Warn("delete rule %s failed, %v", name, err)
+				return err
+			}
+			return nil
+		},
+		ops: allConfigOps(cfg),
+	}
+	return rollout(store, opts, change)
+}
+
+func findRule(ruleList *models.RuleList, name string) *models.RuleListRecord {
+	for i := range ruleList.Records {
+		if ruleList.Records[i].Name == name {
+			return &ruleList.Records[i]
+		}
+	}
+	return nil
+}
+
+// ListWhiteList return names of all white lists
+func ListWhiteList(cfg *models.CCConfig, cluster string) ([]string, error) {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return store.ListWhiteList()
+}
+
+// QueryWhiteList return records of white list
+func QueryWhiteList(name string, cfg *models.CCConfig, cluster string) (*models.WhiteList, error) {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return store.LoadWhiteList(cfg.EncryptKey, name)
+}
+
+// ModifyWhiteList create or modify white list
+func ModifyWhiteList(whiteList *models.WhiteList, cfg *models.CCConfig, cluster string, opts RolloutOptions) error {
+	if err := whiteList.Verify(); err != nil {
+		return fmt.Errorf("verify white list error: %v", err)
+	}
+
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	change := &configChange{
+		kind:   RolloutKindWhiteList,
+		target: whiteList.Name,
+		action: RolloutActionModify,
+		paths:  []string{store.WhiteListPath(whiteList.Name)},
+		apply: func() error {
+			if err := store.UpdateWhiteList(whiteList); err != nil {
+				log.Warn("update white list %s failed, %v", whiteList.Name, err)
+				return err
+			}
+			return nil
+		},
+		ops: allConfigOps(cfg),
+	}
+	return rollout(store, opts, change)
+}
+
+// DelWhiteList delete white list, white list used by databases could not be deleted
+func DelWhiteList(name string, cfg *models.CCConfig, cluster string, opts RolloutOptions) error {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	dbs, err := store.LoadDataBases()
+	if err != nil {
+		return err
+	}
+	for _, d := range dbs {
+		if d.WhiteList.File == name {
+			return fmt.Errorf("white list %s is used by database %s", name, dbName(&d))
+		}
+	}
+
+	change := &configChange{
+		kind:   RolloutKindWhiteList,
+		target: name,
+		action: RolloutActionDelete,
+		paths:  []string{store.WhiteListPath(name)},
+		apply: func() error {
+			if err := store.DelWhiteList(name); err != nil {
+				log.Warn("delete white list %s failed, %v", name, err)
+				return err
+			}
+			return nil
+		},
+		ops: allConfigOps(cfg),
+	}
+	return rollout(store, opts, change)
+}
+
+// ListDataBases return all entries of databases.xml, passwords are not returned
+func ListDataBases(cfg *models.CCConfig, cluster string) ([]models.DataBase, error) {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	dbs, err := store.LoadDataBases()
+	if err != nil {
+		return nil, err
+	}
+	for i := range dbs {
+		dbs[i].PW = ""
+	}
+	return dbs, nil
+}
+
+// ModifyDataBase create or modify entry of databases.xml, entry with the same key is replaced.
+// password of the entry is kept if password of db is empty, so that entry listed could be modified and sent back.
+func ModifyDataBase(db *models.DataBase, cfg *models.CCConfig, cluster string, opts RolloutOptions) error {
+	return updateDataBases(cfg, cluster, opts, RolloutActionModify, db, func(dbs []models.DataBase) ([]models.DataBase, error) {
+		for i := range dbs {
+			if dbs[i].Key() == db.Key() {
+				if db.PW == "" {
+					db.PW = dbs[i].PW
+				}
+				dbs[i] = *db
+				return dbs, nil
+			}
+		}
+		return append(dbs, *db), nil
+	})
+}
+
+// DelDataBase delete entry of databases.xml with the same key as db
+func DelDataBase(db *models.DataBase, cfg *models.CCConfig, cluster string, opts RolloutOptions) error {
+	return updateDataBases(cfg, cluster, opts, RolloutActionDelete, db, func(dbs []models.DataBase) ([]models.DataBase, error) {
+		for i := range dbs {
+			if dbs[i].Key() == db.Key() {
+				return append(dbs[:i], dbs[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("database %s not found", dbName(db))
+	})
+}
+
+// updateDataBases apply change to databases.xml, rules and white lists used by databases must exist
+func updateDataBases(cfg *models.CCConfig, cluster string, opts RolloutOptions, action string, db *models.DataBase,
+	update func([]models.DataBase) ([]models.DataBase, error)) error {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	dbs, err := store.LoadDataBases()
+	if err != nil {
+		return err
+	}
+	dbs, err = update(dbs)
+	if err != nil {
+		return err
+	}
+	p := &models.DataBases{DBS: dbs}
+	if err := p.Verify(); err != nil {
+		return fmt.Errorf("verify databases error: %v", err)
+	}
+	// passwords in plain text are encrypted if encrypt key is configured
+	cipher, err := cfg.Cipher()
+	if err != nil {
+		return err
+	}
+	if err := p.Encrypt(cipher); err != nil {
+		return err
+	}
+	if err := verifyReferences(store, p); err != nil {
+		return err
+	}
+
+	change := &configChange{
+		kind:   RolloutKindDataBase,
+		target: dbName(db),
+		action: action,
+		paths:  []string{store.DBPath(models.DataBasesName)},
+		apply: func() error {
+			if err := store.UpdateDataBases(p); err != nil {
+				log.Warn("update databases failed, %v", err)
+				return err
+			}
+			return nil
+		},
+		ops: allConfigOps(cfg),
+	}
+	return rollout(store, opts, change)
+}
+
+// verifyReferences check rules and white lists used by databases exist
+func verifyReferences(store *models.Store, p *models.DataBases) error {
+	ruleList, err := store.LoadRuleLists()
+	if err != nil {
+		return err
+	}
+	whiteLists, err := store.ListWhiteList()
+	if err != nil {
+		return err
+	}
+	whiteListNames := make(map[string]bool, len(whiteLists))
+	for _, name := range whiteLists {
+		whiteListNames[name] = true
+	}
+
+	for i := range p.DBS {
+		d := &p.DBS[i]
+		if findRule(ruleList, d.Security.Rule) == nil {
+			return fmt.Errorf("rule %s of database %s not found", d.Security.Rule, dbName(d))
+		}
+		if d.WhiteList.File != "" && !whiteListNames[d.WhiteList.File] {
+			return fmt.Errorf("white list %s of database %s not found", d.WhiteList.File, dbName(d))
+		}
+	}
+	return nil
+}
+
+// dbName return readable key of database entry
+func dbName(d *models.DataBase) string {
+	key := d.Key()
+	return fmt.Sprintf("%s(namespace: %s, address: %s)", key.Db, key.Namespace, key.Addr)
+}
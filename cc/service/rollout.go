@@ -0,0 +1,357 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/cc/proxy"
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+)
+
+// kinds and actions of config change
+const (
+	RolloutKindNamespace = "namespace"
+	RolloutKindRule      = "rule"
+	RolloutKindWhiteList = "whitelist"
+	RolloutKindDataBase  = "database"
+	RolloutKindConfig    = "config" // whole config tree imported in canonical schema
+
+	RolloutActionModify = "modify"
+	RolloutActionDelete = "delete"
+)
+
+// MaxRolloutHistory is count of rollout records kept in store
+const MaxRolloutHistory = 100
+
+// RolloutOptions options of rolling out config change to proxies
+type RolloutOptions struct {
+	Canary     int           // count of proxies committed and checked before others, 0 means no canary
+	CanaryWait time.Duration // time to wait after canary proxies committed, before checking them
+}
+
+// proxyOps are operations of rolling out config change on one proxy
+type proxyOps struct {
+	prepare func(host string) error
+	commit  func(host string) error
+	abort   func(host string) error
+	revert  func(host string, snapshot map[string][]byte) error // reload previous config after store restored
+	check   func(host string) error                             // check canary proxy after committed
+}
+
+// configChange is a change of config in store
+type configChange struct {
+	kind   string
+	target string
+	action string
+	paths  []string     // paths written by apply, restored if rollout failed
+	apply  func() error // write new config to store
+	ops    proxyOps
+}
+
+// namespaceOps roll out change of one namespace
+func namespaceOps(name string, cfg *models.CCConfig) proxyOps {
+	return proxyOps{
+		prepare: func(host string) error { return proxy.PrepareConfig(host, name, cfg) },
+		commit:  func(host string) error { return proxy.CommitConfig(host, name, cfg) },
+		abort:   func(host string) error { return proxy.AbortConfig(host, cfg) },
+		revert: func(host string, snapshot map[string][]byte) error {
+			for _, b := range snapshot {
+				if b == nil {
+					// namespace is created by the change
+					return proxy.DelNamespace(host, name, cfg)
+				}
+			}
+			if err := proxy.PrepareConfig(host, name, cfg); err != nil {
+				return err
+			}
+			return proxy.CommitConfig(host, name, cfg)
+		},
+		check: func(host string) error { return proxy.Ping(host, cfg) },
+	}
+}
+
+// delNamespaceOps roll out deletion of one namespace. deletion takes effect in one phase, so proxies are only
+// checked alive in prepare phase and nothing is aborted, committed proxies reload namespace restored in store if reverted
+func delNamespaceOps(name string, cfg *models.CCConfig) proxyOps {
+	ops := namespaceOps(name, cfg)
+	ops.prepare = func(host string) error { return proxy.Ping(host, cfg) }
+	ops.commit = func(host string) error { return proxy.DelNamespace(host, name, cfg) }
+	ops.abort = func(host string) error { return nil }
+	return ops
+}
+
+// allConfigOps roll out change of config shared by namespaces, proxies reload all config
+func allConfigOps(cfg *models.CCConfig) proxyOps {
+	return proxyOps{
+		prepare: func(host string) error { return proxy.PrepareAllConfig(host, cfg) },
+		commit:  func(host string) error { return proxy.CommitAllConfig(host, cfg) },
+		abort:   func(host string) error { return proxy.AbortConfig(host, cfg) },
+		revert: func(host string, _ map[string][]byte) error {
+			if err := proxy.PrepareAllConfig(host, cfg); err != nil {
+				return err
+			}
+			return proxy.CommitAllConfig(host, cfg)
+		},
+		check: func(host string) error { return proxy.CheckReloadResult(host, cfg) },
+	}
+}
+
+// rollout write change to store and let all registered proxies take it in two phases.
+// if any proxy failed to prepare, prepared proxies are aborted; if any proxy failed to commit or canary proxies
+// are unhealthy, previous config is restored in store and committed proxies reload it. record of rollout is saved in store.
+// rollout lock is held during the whole rollout, so rollouts in one cluster are serialized and proxies don't reload
+// the change by watch before they are told to.
+func rollout(store *models.Store, opts RolloutOptions, change *configChange) error {
+	id := time.Now().Format(models.RolloutVersionFormat)
+	if err := store.LockRollout(id); err != nil {
+		log.Warn("lock rollout of %s %s failed, %v", change.kind, change.target, err)
+		return err
+	}
+	defer func() {
+		if err := store.UnlockRollout(id); err != nil {
+			log.Warn("unlock rollout %s failed, %v", id, err)
+		}
+	}()
+
+	if err := store.VerifySchemaVersion(); err != nil {
+		log.Warn("verify schema version failed, %v", err)
+		return err
+	}
+	proxies, err := store.ListProxyMonitorMetrics()
+	if err != nil {
+		log.Warn("list proxies failed, %v", err)
+		return err
+	}
+	snapshot, err := store.Snapshot(change.paths...)
+	if err != nil {
+		log.Warn("read config before change failed, %v", err)
+		return err
+	}
+
+	r := newRollout(id, change, proxies, opts.Canary)
+	saveRollout(store, r)
+
+	if err := change.apply(); err != nil {
+		return rollback(store, snapshot, r, change, nil, err)
+	}
+
+	// prepare phase
+	for _, p := range r.Proxies {
+		if err := change.ops.prepare(p.Addr); err != nil {
+			p.Status, p.Error = models.RolloutProxyFailed, err.Error()
+			return rollback(store, snapshot, r, change, nil, err)
+		}
+		p.Status = models.RolloutProxyPrepared
+	}
+	saveRollout(store, r)
+
+	// commit phase, canary proxies are sorted before others
+	for i, p := range r.Proxies {
+		if err := change.ops.commit(p.Addr); err != nil {
+			p.Status, p.Error = models.RolloutProxyFailed, err.Error()
+			return rollback(store, snapshot, r, change, p, err)
+		}
+		p.Status = models.RolloutProxyCommitted
+
+		if i == r.Canary-1 {
+			saveRollout(store, r)
+			if err := checkCanary(r, change, opts.CanaryWait); err != nil {
+				return rollback(store, snapshot, r, change, nil, err)
+			}
+		}
+	}
+
+	finishRollout(store, r, models.RolloutSucceeded, nil)
+	return nil
+}
+
+func newRollout(id string, change *configChange, proxies map[string]*models.ProxyMonitorMetric, canary int) *models.Rollout {
+	r := &models.Rollout{
+		ID:        id,
+		Kind:      change.kind,
+		Target:    change.target,
+		Action:    change.action,
+		Status:    models.RolloutRunning,
+		StartTime: time.Now().Format(time.RFC3339),
+	}
+	for _, p := range proxies {
+		r.Proxies = append(r.Proxies, &models.RolloutProxy{Token: p.Token, Addr: p.IP + ":" + p.AdminPort, Status: models.RolloutProxyPending})
+	}
+	sort.Slice(r.Proxies, func(i, j int) bool { return r.Proxies[i].Token < r.Proxies[j].Token })
+
+	if canary > len(r.Proxies) {
+		canary = len(r.Proxies)
+	}
+	if canary > 0 {
+		r.Canary = canary
+		for _, p := range r.Proxies[:canary] {
+			p.Canary = true
+		}
+	}
+	return r
+}
+
+// checkCanary wait and check canary proxies after they committed
+func checkCanary(r *models.Rollout, change *configChange, wait time.Duration) error {
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	for _, p := range r.Proxies {
+		if !p.Canary {
+			continue
+		}
+		if err := change.ops.check(p.Addr); err != nil {
+			p.Error = err.Error()
+			return fmt.Errorf("canary proxy %s unhealthy, %v", p.Addr, err)
+		}
+	}
+	return nil
+}
+
+// rollback restore previous config in store, abort prepared proxies and revert committed proxies.
+// failed is the proxy failed to commit, it may or may not run new config, so it's reverted too.
+func rollback(store *models.Store, snapshot map[string][]byte, r *models.Rollout, change *configChange,
+	failed *models.RolloutProxy, cause error) error {
+	status := models.RolloutAborted
+	if err := store.Restore(snapshot); err != nil {
+		log.Warn("rollout %s, restore config failed, %v", r.ID, err)
+		status = models.RolloutFailed
+		cause = fmt.Errorf("%v, restore config failed, %v", cause, err)
+	}
+
+	for _, p := range r.Proxies {
+		switch {
+		case p.Status == models.RolloutProxyCommitted || p == failed:
+			if status == models.RolloutAborted {
+				status = models.RolloutRolledBack
+			}
+			if err := change.ops.revert(p.Addr, snapshot); err != nil {
+				log.Warn("rollout %s, revert proxy %s failed, %v", r.ID, p.Addr, err)
+				p.Status, p.Error = models.RolloutProxyFailed, err.Error()
+				status = models.RolloutFailed
+				continue
+			}
+			p.Status = models.RolloutProxyRolledBack
+		case p.Status == models.RolloutProxyPrepared || p.Status == models.RolloutProxyFailed:
+			if err := change.ops.abort(p.Addr); err != nil {
+				log.Warn("rollout %s, abort proxy %s failed, %v", r.ID, p.Addr, err)
+				p.Status, p.Error = models.RolloutProxyFailed, err.Error()
+				continue
+			}
+			if p.Status == models.RolloutProxyPrepared {
+				p.Status = models.RolloutProxyAborted
+			}
+		}
+	}
+
+	finishRollout(store, r, status, cause)
+	return fmt.Errorf("rollout %s %s, %v", r.ID, status, cause)
+}
+
+func finishRollout(store *models.Store, r *models.Rollout, status string, err error) {
+	r.Status = status
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.EndTime = time.Now().Format(time.RFC3339)
+	saveRollout(store, r)
+	log.Notice("rollout %s of %s %s %s, status: %s, error: %s", r.ID, r.Kind, r.Target, r.Action, r.Status, r.Error)
+
+	ids, err := store.ListRollout()
+	if err != nil {
+		log.Warn("list rollout failed, %v", err)
+		return
+	}
+	for i := 0; i < len(ids)-MaxRolloutHistory; i++ {
+		if err := store.DelRollout(ids[i]); err != nil {
+			log.Warn("delete rollout %s failed, %v", ids[i], err)
+		}
+	}
+}
+
+func saveRollout(store *models.Store, r *models.Rollout) {
+	if err := store.UpdateRollout(r); err != nil {
+		log.Warn("save rollout %s failed, %v", r.ID, err)
+	}
+}
+
+// ListRollout return ids of rollout records, newest first
+func ListRollout(cfg *models.CCConfig, cluster string) ([]string, error) {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	ids, err := store.ListRollout()
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids, nil
+}
+
+// QueryRollout return rollout record with per-proxy status
+func QueryRollout(id string, cfg *models.CCConfig, cluster string) (*models.Rollout, error) {
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return store.LoadRollout(id)
+}
+
+// ImportConfig replace whole config of cluster with config tree in canonical schema and roll it out to proxies,
+// configs not in tree are deleted. proxy config in tree is local config of proxy, it's not imported.
+func ImportConfig(data []byte, cfg *models.CCConfig, cluster string, opts RolloutOptions) error {
+	t, err := models.DecodeConfigTree(data)
+	if err != nil {
+		return fmt.Errorf("decode config tree error: %v", err)
+	}
+	if err := t.Verify(); err != nil {
+		return fmt.Errorf("verify config tree error: %v", err)
+	}
+
+	store, err := newStore(cfg, cluster)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	paths, err := models.ConfigTreePaths(store, t)
+	if err != nil {
+		return err
+	}
+	change := &configChange{
+		kind:   RolloutKindConfig,
+		target: cluster,
+		action: RolloutActionModify,
+		paths:  paths,
+		apply: func() error {
+			if err := models.ImportConfigTree(store, t); err != nil {
+				log.Warn("import config tree failed, %v", err)
+				return err
+			}
+			return nil
+		},
+		ops: allConfigOps(cfg),
+	}
+	return rollout(store, opts, change)
+}
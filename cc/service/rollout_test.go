@@ -0,0 +1,324 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ZzzYtl/MyMask/models"
+)
+
+// fakeProxies record operations on proxies and fail the configured ones
+type fakeProxies struct {
+	ops     []string
+	failOn  map[string]bool // "<op> <addr>" failed
+	running map[string]string
+}
+
+func (f *fakeProxies) do(op, host string) error {
+	f.ops = append(f.ops, op+" "+host)
+	if f.failOn[op+" "+host] {
+		return fmt.Errorf("%s %s failed", op, host)
+	}
+	return nil
+}
+
+func (f *fakeProxies) proxyOps(store *models.Store, path string) proxyOps {
+	return proxyOps{
+		prepare: func(host string) error { return f.do("prepare", host) },
+		commit: func(host string) error {
+			if err := f.do("commit", host); err != nil {
+				return err
+			}
+			b, _ := store.Snapshot(path)
+			f.running[host] = string(b[path])
+			return nil
+		},
+		abort: func(host string) error { return f.do("abort", host) },
+		revert: func(host string, _ map[string][]byte) error {
+			if err := f.do("revert", host); err != nil {
+				return err
+			}
+			b, _ := store.Snapshot(path)
+			f.running[host] = string(b[path])
+			return nil
+		},
+		check: func(host string) error { return f.do("check", host) },
+	}
+}
+
+func newTestStore(t *testing.T, proxies int) (*models.Store, func()) {
+	dir, err := ioutil.TempDir("", "rollout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := models.NewStore(models.NewClient(models.ConfigFile, "", "", "", dir))
+	for _, base := range []string{store.ProxyBase(), store.WhiteListBase()} {
+		if err := os.MkdirAll(base, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < proxies; i++ {
+		p := &models.ProxyMonitorMetric{Token: fmt.Sprintf("p%d", i), IP: "127.0.0.1", AdminPort: fmt.Sprintf("1300%d", i)}
+		if err := ioutil.WriteFile(store.ProxyPath(p.Token), models.JSONEncode(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func testChange(store *models.Store, f *fakeProxies) *configChange {
+	path := store.WhiteListPath("wl")
+	return &configChange{
+		kind:   RolloutKindWhiteList,
+		target: "wl",
+		action: RolloutActionModify,
+		paths:  []string{path},
+		apply:  func() error { return ioutil.WriteFile(path, []byte("v2"), 0644) },
+		ops:    f.proxyOps(store, path),
+	}
+}
+
+func TestRollout(t *testing.T) {
+	tests := []struct {
+		name    string
+		canary  int
+		failOn  string
+		status  string
+		proxies []string // status of p0, p1, p2
+		ops     string
+		running string // config run by proxies after rollout
+	}{
+		{
+			name:    "succeeded",
+			canary:  1,
+			status:  models.RolloutSucceeded,
+			proxies: []string{"committed", "committed", "committed"},
+			ops: "prepare :13000,prepare :13001,prepare :13002," +
+				"commit :13000,check :13000,commit :13001,commit :13002",
+			running: "v2",
+		},
+		{
+			name:    "prepare failed",
+			failOn:  "prepare :13001",
+			status:  models.RolloutAborted,
+			proxies: []string{"aborted", "failed", "pending"},
+			ops:     "prepare :13000,prepare :13001,abort :13000,abort :13001",
+			running: "",
+		},
+		{
+			name:    "commit failed",
+			failOn:  "commit :13001",
+			status:  models.RolloutRolledBack,
+			proxies: []string{"rolled_back", "rolled_back", "aborted"},
+			ops: "prepare :13000,prepare :13001,prepare :13002," +
+				"commit :13000,commit :13001,revert :13000,revert :13001,abort :13002",
+			running: "v1",
+		},
+		{
+			name:    "canary unhealthy",
+			canary:  2,
+			failOn:  "check :13001",
+			status:  models.RolloutRolledBack,
+			proxies: []string{"rolled_back", "rolled_back", "aborted"},
+			ops: "prepare :13000,prepare :13001,prepare :13002," +
+				"commit :13000,commit :13001,check :13000,check :13001,revert :13000,revert :13001,abort :13002",
+			running: "v1",
+		},
+		{
+			name:    "revert failed",
+			failOn:  "commit :13002,revert :13000",
+			status:  models.RolloutFailed,
+			proxies: []string{"failed", "rolled_back", "rolled_back"},
+			ops: "prepare :13000,prepare :13001,prepare :13002," +
+				"commit :13000,commit :13001,commit :13002,revert :13000,revert :13001,revert :13002",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, clean := newTestStore(t, 3)
+			defer clean()
+			if err := ioutil.WriteFile(store.WhiteListPath("wl"), []byte("v1"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			f := &fakeProxies{failOn: make(map[string]bool), running: make(map[string]string)}
+			for _, op := range strings.Split(test.failOn, ",") {
+				f.failOn[strings.Replace(op, ":", "127.0.0.1:", 1)] = true
+			}
+			err := rollout(store, RolloutOptions{Canary: test.canary}, testChange(store, f))
+			if (err == nil) != (test.status == models.RolloutSucceeded) {
+				t.Fatalf("rollout error not expected: %v", err)
+			}
+
+			ids, err := store.ListRollout()
+			if err != nil || len(ids) != 1 {
+				t.Fatalf("rollout history not equal, actual: %v, err: %v", ids, err)
+			}
+			r, err := store.LoadRollout(ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Status != test.status {
+				t.Errorf("status not equal, expect: %s, actual: %s, error: %s", test.status, r.Status, r.Error)
+			}
+			for i, p := range r.Proxies {
+				if p.Status != test.proxies[i] {
+					t.Errorf("status of %s not equal, expect: %s, actual: %s", p.Token, test.proxies[i], p.Status)
+				}
+			}
+			ops := strings.Replace(strings.Join(f.ops, ","), "127.0.0.1:", ":", -1)
+			if ops != test.ops {
+				t.Errorf("operations not equal\nexpect: %s\nactual: %s", test.ops, ops)
+			}
+			if test.running != "" {
+				for host, v := range f.running {
+					if v != test.running {
+						t.Errorf("config of %s not equal, expect: %s, actual: %s", host, test.running, v)
+					}
+				}
+			}
+
+			// config in store is restored if rollout failed
+			b, _ := ioutil.ReadFile(store.WhiteListPath("wl"))
+			expect := "v1"
+			if test.status == models.RolloutSucceeded {
+				expect = "v2"
+			}
+			if string(b) != expect {
+				t.Errorf("config in store not equal, expect: %s, actual: %s", expect, b)
+			}
+		})
+	}
+}
+
+func TestRolloutApplyFailed(t *testing.T) {
+	store, clean := newTestStore(t, 1)
+	defer clean()
+	f := &fakeProxies{running: make(map[string]string)}
+	change := testChange(store, f)
+	change.apply = func() error { return errors.New("write failed") }
+
+	if err := rollout(store, RolloutOptions{}, change); err == nil {
+		t.Fatalf("rollout should fail")
+	}
+	if len(f.ops) != 0 {
+		t.Errorf("no proxy operation expected, actual: %v", f.ops)
+	}
+	// created white list is removed
+	if _, err := os.Stat(store.WhiteListPath("wl")); !os.IsNotExist(err) {
+		t.Errorf("white list should not exist, err: %v", err)
+	}
+}
+
+func TestRolloutHistory(t *testing.T) {
+	store, clean := newTestStore(t, 0)
+	defer clean()
+	for i := 0; i < MaxRolloutHistory+5; i++ {
+		r := &models.Rollout{ID: fmt.Sprintf("20191001000000.%06d", i), Status: models.RolloutSucceeded}
+		if err := store.UpdateRollout(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := &fakeProxies{running: make(map[string]string)}
+	if err := rollout(store, RolloutOptions{}, testChange(store, f)); err != nil {
+		t.Fatalf("rollout error: %v", err)
+	}
+	ids, err := store.ListRollout()
+	if err != nil || len(ids) != MaxRolloutHistory {
+		t.Fatalf("count of history not equal, actual: %d, err: %v", len(ids), err)
+	}
+	if ids[0] != "20191001000000.000006" {
+		t.Errorf("oldest records should be deleted, actual oldest: %s", ids[0])
+	}
+}
+
+func TestRolloutLocked(t *testing.T) {
+	store, clean := newTestStore(t, 1)
+	defer clean()
+	f := &fakeProxies{running: make(map[string]string)}
+
+	// the lock is held by proxies prepared by rollout
+	change := testChange(store, f)
+	prepare := change.ops.prepare
+	change.ops.prepare = func(host string) error {
+		if locked, err := store.RolloutLocked(); err != nil || !locked {
+			t.Errorf("rollout should be locked while proxies prepare, err: %v", err)
+		}
+		// another rollout started meanwhile fails without touching store
+		other := testChange(store, &fakeProxies{running: make(map[string]string)})
+		other.apply = func() error {
+			t.Errorf("config should not be written by concurrent rollout")
+			return nil
+		}
+		if err := rollout(store, RolloutOptions{}, other); err == nil {
+			t.Errorf("concurrent rollout should fail")
+		}
+		return prepare(host)
+	}
+	if err := rollout(store, RolloutOptions{}, change); err != nil {
+		t.Fatalf("rollout error: %v", err)
+	}
+	if locked, _ := store.RolloutLocked(); locked {
+		t.Errorf("rollout lock should be released")
+	}
+
+	// the lock is released after failed rollout too
+	change = testChange(store, f)
+	change.apply = func() error { return errors.New("write failed") }
+	if err := rollout(store, RolloutOptions{}, change); err == nil {
+		t.Fatalf("rollout should fail")
+	}
+	if locked, _ := store.RolloutLocked(); locked {
+		t.Errorf("rollout lock should be released after failure")
+	}
+}
+
+func TestDelNamespaceRollback(t *testing.T) {
+	store, clean := newTestStore(t, 1)
+	defer clean()
+	if err := os.MkdirAll(store.NamespaceBase(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := store.NamespacePath("ns1")
+	if err := ioutil.WriteFile(path, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// proxy is not running, deletion is rolled back before any proxy deletes namespace
+	if err := rollout(store, RolloutOptions{}, delNamespaceChange(store, "ns1", &models.CCConfig{})); err == nil {
+		t.Fatalf("rollout should fail")
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "v1" {
+		t.Errorf("namespace should be restored, actual: %s, err: %v", b, err)
+	}
+	ids, err := store.ListRollout()
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("count of rollout not equal, actual: %d, err: %v", len(ids), err)
+	}
+	r, err := store.LoadRollout(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != RolloutActionDelete || r.Status != models.RolloutAborted {
+		t.Errorf("rollout not equal, action: %s, status: %s", r.Action, r.Status)
+	}
+}
@@ -30,21 +30,38 @@ func getCoordinatorRoot(cluster string) string {
 	return cluster
 }
 
+// newStore create store of config of cluster in etcd
+func newStore(cfg *models.CCConfig, cluster string) (*models.Store, error) {
+	client := models.NewClient(models.ConfigEtcd, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, getCoordinatorRoot(cluster))
+	if client == nil {
+		return nil, fmt.Errorf("create etcd client failed, addr: %s", cfg.CoordinatorAddr)
+	}
+	return models.NewStore(client), nil
+}
+
 // ListNamespace return names of all namespace
 func ListNamespace(cfg *models.CCConfig, cluster string) ([]string, error) {
-	client := models.NewClient(models.ConfigEtcd, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, getCoordinatorRoot(cluster))
-	mConn := models.NewStore(client)
+	mConn, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
 	defer mConn.Close()
 	return mConn.ListNamespace()
 }
 
 // QueryNamespace return information of namespace specified by names
 func QueryNamespace(names []string, cfg *models.CCConfig, cluster string) (data []*models.Namespace, err error) {
-	client := models.NewClient(models.ConfigEtcd, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, getCoordinatorRoot(cluster))
-	mConn := models.NewStore(client)
+	mConn, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
 	defer mConn.Close()
+	cipher, err := cfg.Cipher()
+	if err != nil {
+		return nil, err
+	}
 	for _, v := range names {
-		namespace, err := mConn.LoadNamespace(cfg.EncryptKey, v)
+		namespace, err := mConn.LoadNamespace(cipher, v)
 		if err != nil {
 			log.Warn("load namespace %s failed, %v", v, err.Error())
 			return nil, err
@@ -59,79 +76,70 @@ func QueryNamespace(names []string, cfg *models.CCConfig, cluster string) (data
 	return data, nil
 }
 
-// ModifyNamespace create or modify namespace
-func ModifyNamespace(namespace *models.Namespace, cfg *models.CCConfig, cluster string) (err error) {
+// ModifyNamespace create or modify namespace, the change is rolled back if any proxy failed
+func ModifyNamespace(namespace *models.Namespace, cfg *models.CCConfig, cluster string, opts RolloutOptions) (err error) {
 	if err = namespace.Verify(); err != nil {
 		return fmt.Errorf("verify namespace error: %v", err)
 	}
 
-	// create/modify will save encrypted data default
-	if err = namespace.Encrypt(cfg.EncryptKey); err != nil {
-		return fmt.Errorf("encrypt namespace error: %v", err)
+	// create/modify will save encrypted data if encrypt key is configured
+	cipher, err := cfg.Cipher()
+	if err != nil {
+		return err
 	}
-
-	// sink namespace
-	client := models.NewClient(models.ConfigEtcd, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, getCoordinatorRoot(cluster))
-	storeConn := models.NewStore(client)
-	defer storeConn.Close()
-
-	if err := storeConn.UpdateNamespace(namespace); err != nil {
-		log.Warn("update namespace failed, %s", string(namespace.Encode()))
+	if err = namespace.Encrypt(cipher); err != nil {
 		return err
 	}
 
-	// proxies ready to reload config
-	proxies, err := storeConn.ListProxyMonitorMetrics()
+	// sink namespace
+	storeConn, err := newStore(cfg, cluster)
 	if err != nil {
-		log.Warn("list proxies failed, %v", err)
 		return err
 	}
+	defer storeConn.Close()
 
-	// prepare phase
-	for _, v := range proxies {
-		err := proxy.PrepareConfig(v.IP+":"+v.AdminPort, namespace.Name, cfg)
-		if err != nil {
-			return err
-		}
-	}
-
-	// commit phase
-	for _, v := range proxies {
-		err := proxy.CommitConfig(v.IP+":"+v.AdminPort, namespace.Name, cfg)
-		if err != nil {
-			return err
-		}
+	change := &configChange{
+		kind:   RolloutKindNamespace,
+		target: namespace.Name,
+		action: RolloutActionModify,
+		paths:  []string{storeConn.NamespacePath(namespace.Name)},
+		apply: func() error {
+			if err := storeConn.UpdateNamespace(namespace); err != nil {
+				log.Warn("update namespace failed, %s", string(namespace.Encode()))
+				return err
+			}
+			return nil
+		},
+		ops: namespaceOps(namespace.Name, cfg),
 	}
-
-	return nil
+	return rollout(storeConn, opts, change)
 }
 
-// DelNamespace delete namespace
-func DelNamespace(name string, cfg *models.CCConfig, cluster string) error {
-	client := models.NewClient(models.ConfigEtcd, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, getCoordinatorRoot(cluster))
-	mConn := models.NewStore(client)
-	defer mConn.Close()
-
-	if err := mConn.DelNamespace(name); err != nil {
-		log.Warn("delete namespace %s failed, %s", name, err.Error())
-		return err
-	}
-
-	proxies, err := mConn.ListProxyMonitorMetrics()
+// DelNamespace delete namespace, the namespace is restored if any proxy failed
+func DelNamespace(name string, cfg *models.CCConfig, cluster string, opts RolloutOptions) error {
+	storeConn, err := newStore(cfg, cluster)
 	if err != nil {
-		log.Warn("list proxy failed, %s", err.Error())
 		return err
 	}
+	defer storeConn.Close()
+	return rollout(storeConn, opts, delNamespaceChange(storeConn, name, cfg))
+}
 
-	for _, v := range proxies {
-		err := proxy.DelNamespace(v.IP+":"+v.AdminPort, name, cfg)
-		if err != nil {
-			log.Warn("delete namespace %s in proxy %s failed, err: %s", name, v.IP, err.Error())
-			return err
-		}
+func delNamespaceChange(storeConn *models.Store, name string, cfg *models.CCConfig) *configChange {
+	return &configChange{
+		kind:   RolloutKindNamespace,
+		target: name,
+		action: RolloutActionDelete,
+		paths:  []string{storeConn.NamespacePath(name)},
+		apply: func() error {
+			if err := storeConn.DelNamespace(name); err != nil {
+				log.Warn("delete namespace %s failed, %v", name, err)
+				return err
+			}
+			return nil
+		},
+		ops: delNamespaceOps(name, cfg),
 	}
-
-	return nil
 }
 
 // SQLFingerprint return sql fingerprints of all proxy
@@ -139,8 +147,10 @@ func SQLFingerprint(name string, cfg *models.CCConfig, cluster string) (slowSQLs
 	slowSQLs = make(map[string]string, 16)
 	errSQLs = make(map[string]string, 16)
 	// list proxy
-	client := models.NewClient(models.ConfigEtcd, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, getCoordinatorRoot(cluster))
-	mConn := models.NewStore(client)
+	mConn, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer mConn.Close()
 	proxies, err := mConn.ListProxyMonitorMetrics()
 	if err != nil {
@@ -183,8 +193,10 @@ func SQLFingerprint(name string, cfg *models.CCConfig, cluster string) (slowSQLs
 // ProxyConfigFingerprint return fingerprints of all proxy
 func ProxyConfigFingerprint(cfg *models.CCConfig, cluster string) (r map[string]string, err error) {
 	// list proxy
-	client := models.NewClient(models.ConfigEtcd, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, getCoordinatorRoot(cluster))
-	mConn := models.NewStore(client)
+	mConn, err := newStore(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
 	defer mConn.Close()
 	proxies, err := mConn.ListProxyMonitorMetrics()
 	if err != nil {
@@ -28,6 +28,7 @@ import (
 	"github.com/ZzzYtl/MyMask/log"
 	"github.com/ZzzYtl/MyMask/log/xlog"
 	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/util/requests"
 )
 
 var ccConfigFile = flag.String("c", "./etc/gaea_cc.ini", "gaea cc配置")
@@ -63,6 +64,16 @@ func main() {
 	if err != nil {
 		fmt.Printf("parse cc config failed, %v\n", err)
 	}
+	if err = ccConfig.Verify(); err != nil {
+		fmt.Printf("verify cc config failed, %v\n", err)
+		return
+	}
+	tlsConfig, err := ccConfig.ProxyTLSConfig()
+	if err != nil {
+		fmt.Printf("create proxy tls config failed, %v\n", err)
+		return
+	}
+	requests.SetTLSConfig(tlsConfig)
 
 	// 初始化日志
 	err = initXLog(ccConfig)
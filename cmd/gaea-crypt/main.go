@@ -0,0 +1,179 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// gaea-crypt encrypts passwords in namespace and databases.xml configs and admin accounts file in place,
+// or encrypts them again with the current key after a new key is added.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ZzzYtl/MyMask/models"
+)
+
+const (
+	actionEncrypt = "encrypt" // encrypt passwords in plain text
+	actionRotate  = "rotate"  // encrypt all passwords with the current key
+)
+
+var configFile = flag.String("config", "etc/mymask.ini", "mymask config file, config store and encrypt key are read from it")
+var action = flag.String("action", actionEncrypt, "encrypt: encrypt passwords in plain text; rotate: encrypt all passwords with the current key")
+var dryRun = flag.Bool("dry-run", false, "only print configs to change")
+
+// secretConfig is config containing passwords
+type secretConfig interface {
+	Encrypt(c *models.Cipher) error
+	Rotate(c *models.Cipher) error
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *action != actionEncrypt && *action != actionRotate {
+		return fmt.Errorf("invalid action: %s", *action)
+	}
+	cfg, err := models.ParseProxyConfigFromFile(*configFile)
+	if err != nil {
+		return fmt.Errorf("parse config file error: %v", err)
+	}
+	if err = cfg.Verify(); err != nil {
+		return fmt.Errorf("verify config file error: %v", err)
+	}
+	cipher, err := cfg.Cipher()
+	if err != nil {
+		return err
+	}
+	if !cipher.Enabled() {
+		return fmt.Errorf("encrypt_key_file or encrypt_key_env is required")
+	}
+
+	var client models.Client
+	if cfg.ConfigType == models.ConfigFile {
+		client = models.NewClient(models.ConfigFile, "", "", "", cfg.FileConfigPath)
+	} else {
+		client = models.NewClient(cfg.ConfigType, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, cfg.CoordinatorRoot)
+	}
+	if client == nil {
+		return fmt.Errorf("create client of config type %s failed", cfg.ConfigType)
+	}
+	store := models.NewStore(client)
+	defer store.Close()
+
+	names, err := store.ListNamespace()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("list namespace error: %v", err)
+	}
+	for _, name := range names {
+		err := process(store, cipher, store.NamespacePath(name), json.Unmarshal, &models.Namespace{}, func(c secretConfig) error {
+			return store.UpdateNamespace(c.(*models.Namespace))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = process(store, cipher, store.DBPath(models.DataBasesName), xml.Unmarshal, &models.DataBases{}, func(c secretConfig) error {
+		return store.UpdateDataBases(c.(*models.DataBases))
+	})
+	if err != nil || cfg.AdminAccountsFile == "" {
+		return err
+	}
+	return processAdminAccounts(cfg.AdminAccountsFile, cipher)
+}
+
+// processAdminAccounts encrypt or rotate passwords and tokens in admin accounts file, the file is replaced by rename
+func processAdminAccounts(file string, cipher *models.Cipher) error {
+	a, err := models.ReadAdminAccounts(file)
+	if err != nil {
+		return err
+	}
+	before := a.Encode()
+	if *action == actionRotate {
+		err = a.Rotate(cipher)
+	} else {
+		err = a.Encrypt(cipher)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	after := a.Encode()
+	if bytes.Equal(before, after) {
+		fmt.Printf("%s unchanged\n", file)
+		return nil
+	}
+	if *dryRun {
+		fmt.Printf("%s to be changed\n", file)
+		return nil
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, after, 0600); err != nil {
+		return fmt.Errorf("write %s error: %v", tmp, err)
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write %s error: %v", file, err)
+	}
+	fmt.Printf("%s changed\n", file)
+	return nil
+}
+
+// process read config in path, encrypt or rotate passwords in it and write it back if changed
+func process(store *models.Store, cipher *models.Cipher, path string, unmarshal func([]byte, interface{}) error,
+	c secretConfig, update func(secretConfig) error) error {
+	snapshot, err := store.Snapshot(path)
+	if err != nil {
+		return fmt.Errorf("read %s error: %v", path, err)
+	}
+	b := snapshot[path]
+	if b == nil {
+		return nil
+	}
+	if err = unmarshal(b, c); err != nil {
+		return fmt.Errorf("parse %s error: %v", path, err)
+	}
+
+	before := models.JSONEncode(c)
+	if *action == actionRotate {
+		err = c.Rotate(cipher)
+	} else {
+		err = c.Encrypt(cipher)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if bytes.Equal(before, models.JSONEncode(c)) {
+		fmt.Printf("%s unchanged\n", path)
+		return nil
+	}
+	if *dryRun {
+		fmt.Printf("%s to be changed\n", path)
+		return nil
+	}
+	if err = update(c); err != nil {
+		return fmt.Errorf("write %s error: %v", path, err)
+	}
+	fmt.Printf("%s changed\n", path)
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// gaea-migrate converts config tree (ini, namespace and white list json, rule and databases xml) to one json
+// document in canonical schema, or replaces config tree with it. the result is validated in both directions,
+// config in store is restored if import failed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/models"
+)
+
+const (
+	actionExport = "export" // config tree -> canonical schema
+	actionImport = "import" // canonical schema -> config tree
+)
+
+var configFile = flag.String("config", "etc/mymask.ini", "mymask config file, config store is read from it")
+var action = flag.String("action", actionExport, "export: convert config tree to canonical schema; import: write config tree from canonical schema")
+var output = flag.String("out", "", "export: file of canonical schema, stdout if empty; import: ini file written from proxy config, not written if empty")
+var input = flag.String("in", "", "import: file of canonical schema")
+var allowLoss = flag.Bool("allow-loss", false, "export: continue if some fields in source are not known and would be lost")
+
+func main() {
+	flag.Parse()
+	var err error
+	switch *action {
+	case actionExport:
+		err = export()
+	case actionImport:
+		err = importTree()
+	default:
+		err = fmt.Errorf("invalid action: %s", *action)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func newStore() (*models.Store, error) {
+	cfg, err := models.ParseProxyConfigFromFile(*configFile)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file error: %v", err)
+	}
+	var client models.Client
+	if cfg.ConfigType == models.ConfigFile {
+		client = models.NewClient(models.ConfigFile, "", "", "", cfg.FileConfigPath)
+	} else {
+		client = models.NewClient(cfg.ConfigType, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, cfg.CoordinatorRoot)
+	}
+	if client == nil {
+		return nil, fmt.Errorf("create client of config type %s failed", cfg.ConfigType)
+	}
+	return models.NewStore(client), nil
+}
+
+func export() error {
+	store, err := newStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	t, lost, err := models.LoadConfigTree(store, *configFile)
+	if err != nil {
+		return err
+	}
+	if len(lost) != 0 {
+		fmt.Fprintf(os.Stderr, "fields not known by gaea:\n  %s\n", strings.Join(lost, "\n  "))
+		if !*allowLoss {
+			return fmt.Errorf("%d fields would be lost, use -allow-loss to ignore them", len(lost))
+		}
+	}
+	if err = t.Verify(); err != nil {
+		return fmt.Errorf("verify config error: %v", err)
+	}
+
+	data, err := models.EncodeConfigTree(t)
+	if err != nil {
+		return err
+	}
+	// the result must be decoded to the same config
+	decoded, err := models.DecodeConfigTree(data)
+	if err != nil {
+		return fmt.Errorf("decode result error: %v", err)
+	}
+	if !reflect.DeepEqual(t, decoded) {
+		return fmt.Errorf("config changed after encoding, please report it as a bug")
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	return ioutil.WriteFile(*output, append(data, '\n'), 0600)
+}
+
+func importTree() error {
+	if *input == "" {
+		return fmt.Errorf("-in is required")
+	}
+	data, err := ioutil.ReadFile(*input)
+	if err != nil {
+		return err
+	}
+	t, err := models.DecodeConfigTree(data)
+	if err != nil {
+		return fmt.Errorf("decode %s error: %v", *input, err)
+	}
+
+	store, err := newStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	// proxies don't reload config by watch and cc doesn't change config while importing
+	id := "import-" + time.Now().Format(models.RolloutVersionFormat)
+	if err = store.LockRollout(id); err != nil {
+		return err
+	}
+	err = models.ImportConfigTree(store, t)
+	if e := store.UnlockRollout(id); e != nil {
+		fmt.Fprintf(os.Stderr, "unlock config store error: %v, delete %s manually\n", e, store.RolloutLockPath())
+	}
+	if err != nil {
+		return err
+	}
+
+	if *output != "" && t.Proxy != nil {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return models.EncodeINI(t.Proxy, f)
+	}
+	return nil
+}
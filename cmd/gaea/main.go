@@ -47,6 +47,10 @@ func main() {
 		fmt.Printf("parse config file error:%v\n", err.Error())
 		return
 	}
+	if err = cfg.Verify(); err != nil {
+		fmt.Printf("verify config file error:%v\n", err.Error())
+		return
+	}
 
 	if err = initXLog(cfg.LogOutput, cfg.LogPath, cfg.LogFileName, cfg.LogLevel, cfg.Service); err != nil {
 		fmt.Printf("init xlog error: %v\n", err.Error())
@@ -81,11 +85,22 @@ func main() {
 	go func() {
 		defer wg.Done()
 		for {
-			sig := <-sc
-			if sig == syscall.SIGINT || sig == syscall.SIGTERM || sig == syscall.SIGQUIT {
+			var sig os.Signal
+			select {
+			case sig = <-sc:
+			case <-svr.Done():
+				log.Notice("server shut down, quit")
+				return
+			}
+
+			if sig == syscall.SIGTERM {
+				log.Notice("Got signal %d, drain and quit", sig)
+				svr.Shutdown()
+				return
+			} else if sig == syscall.SIGINT || sig == syscall.SIGQUIT {
 				log.Notice("Got signal %d, quit", sig)
 				svr.Close()
-				break
+				return
 			} else if sig == syscall.SIGPIPE {
 				log.Notice("Ignore broken pipe signal")
 			} else if sig == syscall.SIGUSR1 {
@@ -27,6 +27,8 @@ var (
 	ErrNoDefaultSlice = errors.New("no default slice")
 	// ErrNoMasterDB no master database
 	ErrNoMasterDB = errors.New("no master database")
+	// ErrWriteWithoutMaster write statement on slice of slaves only
+	ErrWriteWithoutMaster = errors.New("no master database, only read statements are allowed on slaves")
 	// ErrNoSlaveDB no slve database
 	ErrNoSlaveDB = errors.New("no slave database")
 	// ErrNoDatabase no database
@@ -0,0 +1,162 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// roles of admin account, every authenticated account could read stats and metrics
+const (
+	AdminRoleReader   = "reader"         // read stats, metrics and config fingerprint
+	AdminRoleOperator = "operator"       // reload config, delete namespace, drain, kill sessions and pprof
+	AdminRoleSecurity = "security_admin" // inspect mask policy and manage sql firewall
+)
+
+// AdminAccounts is accounts and tokens of proxy admin api, loaded from admin_accounts_file
+type AdminAccounts struct {
+	Accounts []*AdminAccount `json:"accounts"`
+	Tokens   []*AdminToken   `json:"tokens"`
+}
+
+// AdminAccount authenticates by basic auth, password could be encrypted
+type AdminAccount struct {
+	User     string   `json:"user"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+// AdminToken authenticates by header "Authorization: Bearer <token>", token could be encrypted
+type AdminToken struct {
+	Name  string   `json:"name"`
+	Token string   `json:"token"`
+	Roles []string `json:"roles"`
+}
+
+// ReadAdminAccounts read admin accounts from json file, encrypted passwords and tokens are not decrypted
+func ReadAdminAccounts(file string) (*AdminAccounts, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	a := &AdminAccounts{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("parse admin accounts file %s error: %v", file, err)
+	}
+	if err := a.Verify(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// LoadAdminAccounts read admin accounts from json file and decrypt passwords and tokens
+func LoadAdminAccounts(file string, c *Cipher) (*AdminAccounts, error) {
+	a, err := ReadAdminAccounts(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Decrypt(c); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Encode encode json
+func (a *AdminAccounts) Encode() []byte {
+	return JSONEncode(a)
+}
+
+// Decrypt decrypt passwords and tokens
+func (a *AdminAccounts) Decrypt(c *Cipher) error {
+	if err := c.apply(c.decrypt, a.secrets()); err != nil {
+		return fmt.Errorf("decrypt admin accounts error: %v", err)
+	}
+	return nil
+}
+
+// Encrypt encrypt passwords and tokens, they are kept in plain text if c has no key
+func (a *AdminAccounts) Encrypt(c *Cipher) error {
+	if err := c.apply(c.encrypt, a.secrets()); err != nil {
+		return fmt.Errorf("encrypt admin accounts error: %v", err)
+	}
+	return nil
+}
+
+// Rotate encrypt passwords and tokens again with current key of c
+func (a *AdminAccounts) Rotate(c *Cipher) error {
+	if err := c.apply(c.rotate, a.secrets()); err != nil {
+		return fmt.Errorf("rotate admin accounts error: %v", err)
+	}
+	return nil
+}
+
+func (a *AdminAccounts) secrets() []*string {
+	var secrets []*string
+	for _, account := range a.Accounts {
+		secrets = append(secrets, &account.Password)
+	}
+	for _, token := range a.Tokens {
+		secrets = append(secrets, &token.Token)
+	}
+	return secrets
+}
+
+// Verify verify admin accounts
+func (a *AdminAccounts) Verify() error {
+	users := make(map[string]bool, len(a.Accounts))
+	for _, account := range a.Accounts {
+		if account.User == "" || account.Password == "" {
+			return errors.New("user and password of admin account could not be empty")
+		}
+		if users[account.User] {
+			return fmt.Errorf("duplicate admin account %s", account.User)
+		}
+		users[account.User] = true
+		if err := verifyAdminRoles(account.Roles); err != nil {
+			return fmt.Errorf("invalid roles of admin account %s, %v", account.User, err)
+		}
+	}
+	names := make(map[string]bool, len(a.Tokens))
+	for _, token := range a.Tokens {
+		if token.Name == "" || token.Token == "" {
+			return errors.New("name and token of admin token could not be empty")
+		}
+		if names[token.Name] {
+			return fmt.Errorf("duplicate admin token %s", token.Name)
+		}
+		names[token.Name] = true
+		if err := verifyAdminRoles(token.Roles); err != nil {
+			return fmt.Errorf("invalid roles of admin token %s, %v", token.Name, err)
+		}
+	}
+	return nil
+}
+
+func verifyAdminRoles(roles []string) error {
+	if len(roles) == 0 {
+		return errors.New("roles is empty")
+	}
+	for _, role := range roles {
+		switch role {
+		case AdminRoleReader, AdminRoleOperator, AdminRoleSecurity:
+		default:
+			return fmt.Errorf("unknown role %s", role)
+		}
+	}
+	return nil
+}
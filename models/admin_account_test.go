@@ -0,0 +1,90 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminAccountsVerify(t *testing.T) {
+	tests := []struct {
+		accounts AdminAccounts
+		valid    bool
+	}{
+		{AdminAccounts{}, true},
+		{AdminAccounts{Accounts: []*AdminAccount{{User: "u1", Password: "p", Roles: []string{AdminRoleReader, AdminRoleSecurity}}}}, true},
+		{AdminAccounts{Accounts: []*AdminAccount{{User: "u1", Password: "", Roles: []string{AdminRoleReader}}}}, false},
+		{AdminAccounts{Accounts: []*AdminAccount{{User: "u1", Password: "p"}}}, false},
+		{AdminAccounts{Accounts: []*AdminAccount{{User: "u1", Password: "p", Roles: []string{"admin"}}}}, false},
+		{AdminAccounts{Accounts: []*AdminAccount{
+			{User: "u1", Password: "p", Roles: []string{AdminRoleReader}},
+			{User: "u1", Password: "p2", Roles: []string{AdminRoleOperator}},
+		}}, false},
+		{AdminAccounts{Tokens: []*AdminToken{{Name: "t1", Token: "x", Roles: []string{AdminRoleOperator}}}}, true},
+		{AdminAccounts{Tokens: []*AdminToken{{Name: "t1", Token: "", Roles: []string{AdminRoleOperator}}}}, false},
+	}
+	for i, test := range tests {
+		if err := test.accounts.Verify(); (err == nil) != test.valid {
+			t.Errorf("verify admin accounts %d not equal, expect valid: %v, err: %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestLoadAdminAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin_accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	os.Setenv("TEST_ADMIN_ACCOUNTS_KEY", "k1:"+key)
+	defer os.Unsetenv("TEST_ADMIN_ACCOUNTS_KEY")
+	c, err := NewCipher("", "TEST_ADMIN_ACCOUNTS_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &AdminAccounts{
+		Accounts: []*AdminAccount{{User: "u1", Password: "p1", Roles: []string{AdminRoleReader}}},
+		Tokens:   []*AdminToken{{Name: "t1", Token: "secret", Roles: []string{AdminRoleOperator}}},
+	}
+	if err := a.Encrypt(c); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "accounts.json")
+	if err := ioutil.WriteFile(file, a.Encode(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(a.Encode()), "secret") {
+		t.Errorf("token should be encrypted: %s", a.Encode())
+	}
+
+	loaded, err := LoadAdminAccounts(file, c)
+	if err != nil {
+		t.Fatalf("load admin accounts error: %v", err)
+	}
+	if loaded.Accounts[0].Password != "p1" || loaded.Tokens[0].Token != "secret" {
+		t.Errorf("secrets not decrypted, actual: %s", loaded.Encode())
+	}
+	if _, err := LoadAdminAccounts(file, &Cipher{}); err == nil {
+		t.Errorf("load encrypted admin accounts without key should fail")
+	}
+}
@@ -15,6 +15,11 @@
 package models
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"strings"
 
 	"github.com/go-ini/ini"
@@ -41,6 +46,15 @@ type CCConfig struct {
 	LogOutput   string `ini:"log_output"`
 
 	EncryptKey string `ini:"encrypt_key"`
+	// 加密配置中密码的主密钥, 文件或环境变量二选一, 都不配置时密码为明文
+	EncryptKeyFile string `ini:"encrypt_key_file"`
+	EncryptKeyEnv  string `ini:"encrypt_key_env"`
+
+	// 通过https访问gaea-proxy管理接口, ca为空时使用系统证书; proxy要求客户端证书时需配置证书及私钥
+	ProxyTLS         bool   `ini:"proxy_tls"`
+	ProxyTLSCAFile   string `ini:"proxy_tls_ca_file"`
+	ProxyTLSCertFile string `ini:"proxy_tls_cert_file"`
+	ProxyTLSKeyFile  string `ini:"proxy_tls_key_file"`
 }
 
 // ParseCCConfig parser gaea cc config from file
@@ -61,5 +75,43 @@ func ParseCCConfig(cfgFile string) (*CCConfig, error) {
 
 // Verify verify cc config
 func (cc *CCConfig) Verify() error {
+	if _, err := cc.Cipher(); err != nil {
+		return fmt.Errorf("invalid encrypt key, %v", err)
+	}
+	if _, err := cc.ProxyTLSConfig(); err != nil {
+		return fmt.Errorf("invalid proxy tls config, %v", err)
+	}
 	return nil
 }
+
+// ProxyTLSConfig create tls config of requests to proxy admin api, nil if proxy_tls is not set
+func (cc *CCConfig) ProxyTLSConfig() (*tls.Config, error) {
+	if !cc.ProxyTLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cc.ProxyTLSCAFile != "" {
+		pem, err := ioutil.ReadFile(cc.ProxyTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in proxy_tls_ca_file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cc.ProxyTLSCertFile != "" || cc.ProxyTLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cc.ProxyTLSCertFile, cc.ProxyTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Cipher create Cipher with configured keys
+func (cc *CCConfig) Cipher() (*Cipher, error) {
+	return NewCipher(cc.EncryptKeyFile, cc.EncryptKeyEnv)
+}
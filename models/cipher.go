@@ -0,0 +1,95 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ZzzYtl/MyMask/util/crypto"
+)
+
+// Cipher encrypt and decrypt secrets in config: passwords of namespace users, slice and databases.xml.
+// nil Cipher or Cipher without keys keeps secrets in plain text and fails to decrypt encrypted ones.
+type Cipher struct {
+	envelope *crypto.Envelope
+}
+
+// NewCipher create Cipher with master keys in key file or environment variable, at most one could be set.
+// secrets are kept in plain text if neither is set
+func NewCipher(keyFile, keyEnv string) (*Cipher, error) {
+	var keys crypto.KeyProvider
+	var err error
+	switch {
+	case keyFile != "" && keyEnv != "":
+		return nil, errors.New("encrypt_key_file and encrypt_key_env could not be both set")
+	case keyFile != "":
+		keys, err = crypto.NewFileKeyProvider(keyFile)
+	case keyEnv != "":
+		keys, err = crypto.NewEnvKeyProvider(keyEnv)
+	default:
+		return &Cipher{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{envelope: crypto.NewEnvelope(keys)}, nil
+}
+
+// Enabled return true if master keys are configured
+func (c *Cipher) Enabled() bool {
+	return c != nil && c.envelope != nil
+}
+
+// encrypt return encrypted secret, secret already encrypted is not changed
+func (c *Cipher) encrypt(secret string) (string, error) {
+	if !c.Enabled() || secret == "" || crypto.IsEncrypted(secret) {
+		return secret, nil
+	}
+	return c.envelope.Encrypt(secret)
+}
+
+// decrypt return plain secret, secret in plain text is not changed
+func (c *Cipher) decrypt(secret string) (string, error) {
+	if !crypto.IsEncrypted(secret) {
+		return secret, nil
+	}
+	if !c.Enabled() {
+		return "", fmt.Errorf("secret is encrypted by key %s but no key is configured", crypto.KeyID(secret))
+	}
+	return c.envelope.Decrypt(secret)
+}
+
+// rotate encrypt secret again with current master key
+func (c *Cipher) rotate(secret string) (string, error) {
+	if !c.Enabled() {
+		return "", errors.New("no key is configured")
+	}
+	if secret == "" {
+		return secret, nil
+	}
+	return c.envelope.Rotate(secret)
+}
+
+func (c *Cipher) apply(f func(string) (string, error), secrets []*string) error {
+	for _, s := range secrets {
+		v, err := f(*s)
+		if err != nil {
+			return err
+		}
+		*s = v
+	}
+	return nil
+}
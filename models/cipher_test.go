@@ -0,0 +1,81 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ZzzYtl/MyMask/util/crypto"
+)
+
+func TestNamespaceSecrets(t *testing.T) {
+	f, err := ioutil.TempFile("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("k1:MTIzNGFiY2Q1Njc4ZWZnKjEyMzRhYmNkNTY3OGVmZyo=\n")
+	f.Close()
+
+	c, err := NewCipher(f.Name(), "")
+	if err != nil || !c.Enabled() {
+		t.Fatalf("create cipher error: %v", err)
+	}
+	if _, err := NewCipher(f.Name(), "GAEA_KEYS"); err == nil {
+		t.Errorf("key file and environment variable could not be both set")
+	}
+
+	n := &Namespace{Name: "ns1", Slice: &Slice{Password: "slice_pw"}, Users: []*User{{Password: "user_pw"}, {Password: ""}}}
+	if err := n.Encrypt(c); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	if !crypto.IsEncrypted(n.Slice.Password) || !crypto.IsEncrypted(n.Users[0].Password) || n.Users[1].Password != "" {
+		t.Fatalf("passwords not encrypted: %s", n.Encode())
+	}
+	encrypted := n.Slice.Password
+	if err := n.Encrypt(c); err != nil || n.Slice.Password != encrypted {
+		t.Errorf("encrypted password should not be changed, err: %v", err)
+	}
+
+	// secrets could not be decrypted without key
+	if err := n.Decrypt(&Cipher{}); err == nil || !strings.Contains(err.Error(), "k1") {
+		t.Errorf("decrypt without key should fail, err: %v", err)
+	}
+	if err := n.Decrypt(c); err != nil {
+		t.Fatalf("decrypt error: %v", err)
+	}
+	if n.Slice.Password != "slice_pw" || n.Users[0].Password != "user_pw" {
+		t.Errorf("decrypted passwords not equal: %s", n.Encode())
+	}
+
+	// passwords are kept in plain text without key
+	var none *Cipher
+	dbs := &DataBases{DBS: []DataBase{{PW: "db_pw"}}}
+	if err := dbs.Encrypt(none); err != nil || dbs.DBS[0].PW != "db_pw" {
+		t.Errorf("password should be kept in plain text, actual: %s, err: %v", dbs.DBS[0].PW, err)
+	}
+	if err := dbs.Rotate(none); err == nil {
+		t.Errorf("rotate without key should fail")
+	}
+	if err := dbs.Rotate(c); err != nil || !crypto.IsEncrypted(dbs.DBS[0].PW) {
+		t.Errorf("rotate should encrypt password, actual: %s, err: %v", dbs.DBS[0].PW, err)
+	}
+	if err := dbs.Decrypt(c); err != nil || dbs.DBS[0].PW != "db_pw" {
+		t.Errorf("decrypted password not equal, actual: %s, err: %v", dbs.DBS[0].PW, err)
+	}
+}
@@ -1,33 +1,43 @@
 package models
 
-import "encoding/xml"
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+)
 
+// DBKey is key of database config, Namespace is empty if database is bound to backend address
 type DBKey struct {
-	Addr string
-	Db   string
+	Namespace string
+	Addr      string
+	Db        string
 }
 
 type DataBases struct {
 	DBS []DataBase `xml:"Database"`
 }
 
+// DataBase binds mask rule and white list to a logical database.
+// if namespace is set, it applies to all backends of the namespace, and address is optional which limits it to
+// the physical cluster; otherwise it applies to the backend with the address.
 type DataBase struct {
-	MaskDatabaseName string     `xml:"mask_database_name,attr"`
-	DatabaseName     string     `xml:database_name,attr`
-	IP               string     `xml:"address,attr"`
-	Port             int        `xml:"port,attr"`
-	UserName         string     `xml:"user_name,attr"`
-	PW               string     `xml:"password,attr"`
-	WhiteList        WhiteListR `xml:"Whitelist"`
-	Security         SecurityR  `xml:"Security"`
+	Namespace        string     `xml:"namespace,attr" json:"namespace"`
+	MaskDatabaseName string     `xml:"mask_database_name,attr" json:"mask_database_name"`
+	DatabaseName     string     `xml:"database_name,attr" json:"database_name"`
+	IP               string     `xml:"address,attr" json:"address"`
+	Port             int        `xml:"port,attr" json:"port"`
+	UserName         string     `xml:"user_name,attr" json:"user_name"`
+	PW               string     `xml:"password,attr" json:"password"`
+	WhiteList        WhiteListR `xml:"Whitelist" json:"whitelist"`
+	Security         SecurityR  `xml:"Security" json:"security"`
 }
 
 type WhiteListR struct {
-	File string `xml:"file,attr"`
+	File string `xml:"file,attr" json:"file"`
 }
 
 type SecurityR struct {
-	Rule string `xml:"rule,attr"`
+	Rule string `xml:"rule,attr" json:"rule"`
 }
 
 // Encode encode json
@@ -39,7 +49,67 @@ func (n *DataBases) Encode() []byte {
 	return bytes
 }
 
+// Key return key of database config
+func (d *DataBase) Key() DBKey {
+	key := DBKey{Namespace: d.Namespace, Db: d.MaskDatabaseName}
+	if d.IP != "" {
+		key.Addr = d.IP + ":" + strconv.Itoa(d.Port)
+	}
+	return key
+}
+
 // Verify verify namespace contents
 func (n *DataBases) Verify() error {
+	keys := make(map[DBKey]bool, len(n.DBS))
+	for _, d := range n.DBS {
+		if d.MaskDatabaseName == "" {
+			return fmt.Errorf("missing mask_database_name of database, namespace: %s, address: %s", d.Namespace, d.IP)
+		}
+		if d.Namespace == "" && d.IP == "" {
+			return fmt.Errorf("database %s must be bound to namespace or address", d.MaskDatabaseName)
+		}
+		if d.WhiteList.File != "" {
+			if err := VerifyConfigName("white list", d.WhiteList.File); err != nil {
+				return fmt.Errorf("invalid white list of database %s: %v", d.MaskDatabaseName, err)
+			}
+		}
+		key := d.Key()
+		if keys[key] {
+			return fmt.Errorf("database duped, namespace: %s, address: %s, database: %s", key.Namespace, key.Addr, key.Db)
+		}
+		keys[key] = true
+	}
+	return nil
+}
+
+func (n *DataBases) secrets() []*string {
+	r := make([]*string, 0, len(n.DBS))
+	for i := range n.DBS {
+		r = append(r, &n.DBS[i].PW)
+	}
+	return r
+}
+
+// Decrypt decrypt passwords of databases
+func (n *DataBases) Decrypt(c *Cipher) error {
+	if err := c.apply(c.decrypt, n.secrets()); err != nil {
+		return fmt.Errorf("decrypt databases error: %v", err)
+	}
+	return nil
+}
+
+// Encrypt encrypt passwords of databases, passwords are kept in plain text if c has no key
+func (n *DataBases) Encrypt(c *Cipher) error {
+	if err := c.apply(c.encrypt, n.secrets()); err != nil {
+		return fmt.Errorf("encrypt databases error: %v", err)
+	}
+	return nil
+}
+
+// Rotate encrypt passwords of databases again with current key of c
+func (n *DataBases) Rotate(c *Cipher) error {
+	if err := c.apply(c.rotate, n.secrets()); err != nil {
+		return fmt.Errorf("rotate databases error: %v", err)
+	}
 	return nil
 }
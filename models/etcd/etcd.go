@@ -0,0 +1,505 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/log"
+)
+
+const (
+	// APIPrefix is path prefix of json gateway of etcd v3 api, it's /v3beta before etcd 3.4
+	APIPrefix = "/v3"
+
+	defaultPrefix        = "/gaea"
+	defaultTimeout       = 3 * time.Second
+	watchRetryInterval   = time.Second
+	watchEventBufferSize = 16
+)
+
+// ErrNodeExists means key to create already exists
+var ErrNodeExists = errors.New("node already exists")
+
+// Client is config client of etcd, it talks to json gateway of etcd v3 api, so no grpc dependency is needed
+type Client struct {
+	Prefix string
+
+	endpoints  []string
+	username   string
+	password   string
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	token string // auth token, got when username is set
+	next  int    // index of endpoint tried first
+}
+
+// New constructor of etcd client, addr is comma separated endpoints like http://127.0.0.1:2379
+func New(addr, username, password, root string) (*Client, error) {
+	if strings.TrimSpace(root) == "" {
+		root = defaultPrefix
+	}
+	var endpoints []string
+	for _, e := range strings.Split(addr, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "://") {
+			e = "http://" + e
+		}
+		endpoints = append(endpoints, strings.TrimRight(e, "/"))
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("invalid etcd address: %s", addr)
+	}
+
+	return &Client{
+		Prefix:     root,
+		endpoints:  endpoints,
+		username:   username,
+		password:   password,
+		httpClient: &http.Client{},
+	}, nil
+}
+
+type responseHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type keyValue struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision int64  `json:"create_revision,string"`
+	ModRevision    int64  `json:"mod_revision,string"`
+}
+
+type rangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type rangeResponse struct {
+	Header responseHeader `json:"header"`
+	Kvs    []*keyValue    `json:"kvs"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+type deleteRangeRequest struct {
+	Key []byte `json:"key"`
+}
+
+type compare struct {
+	Key            []byte `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	CreateRevision int64  `json:"create_revision,string"`
+}
+
+type requestOp struct {
+	RequestPut *putRequest `json:"request_put,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []*compare   `json:"compare"`
+	Success []*requestOp `json:"success"`
+}
+
+type txnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type leaseGrantRequest struct {
+	TTL int64 `json:"TTL,string"`
+}
+
+type leaseGrantResponse struct {
+	ID int64 `json:"ID,string"`
+}
+
+type authenticateRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type authenticateResponse struct {
+	Token string `json:"token"`
+}
+
+type watchCreateRequest struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end,omitempty"`
+	StartRevision int64  `json:"start_revision,string,omitempty"`
+}
+
+type watchRequest struct {
+	CreateRequest *watchCreateRequest `json:"create_request"`
+}
+
+type watchEvent struct {
+	Type string    `json:"type"` // PUT is omitted as default value
+	Kv   *keyValue `json:"kv"`
+}
+
+type watchResult struct {
+	Header          responseHeader `json:"header"`
+	Created         bool           `json:"created"`
+	Canceled        bool           `json:"canceled"`
+	CompactRevision int64          `json:"compact_revision,string"`
+	Events          []*watchEvent  `json:"events"`
+}
+
+// watchResponse is one message of watch stream
+type watchResponse struct {
+	Result *watchResult  `json:"result"`
+	Error  *gatewayError `json:"error"`
+}
+
+// gatewayError is error returned by json gateway
+type gatewayError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *gatewayError) Error() string {
+	return fmt.Sprintf("etcd error, code: %d, message: %s", e.Code, e.Message)
+}
+
+// unauthenticated is code of grpc status, returned when token is invalid or expired
+const unauthenticated = 16
+
+// post send request to endpoints in turn until one of them responses, body of response should be closed by caller
+func (c *Client) post(ctx context.Context, api string, req interface{}) (*http.Response, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	token, next := c.token, c.next
+	c.mu.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(c.endpoints); i++ {
+		index := (next + i) % len(c.endpoints)
+		httpReq, err := http.NewRequest(http.MethodPost, c.endpoints[index]+APIPrefix+api, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		httpReq = httpReq.WithContext(ctx)
+		httpReq.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			httpReq.Header.Set("Authorization", token)
+		}
+
+		resp, err := c.httpClient.Do(httpReq)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if index != next {
+			c.mu.Lock()
+			c.next = index
+			c.mu.Unlock()
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// call send request and decode response, token is refreshed if it's expired
+func (c *Client) call(api string, req, resp interface{}) error {
+	if err := c.authenticate(false); err != nil {
+		return err
+	}
+	err := c.callOnce(api, req, resp)
+	if e, ok := err.(*gatewayError); ok && e.Code == unauthenticated && c.username != "" {
+		if err := c.authenticate(true); err != nil {
+			return err
+		}
+		return c.callOnce(api, req, resp)
+	}
+	return err
+}
+
+func (c *Client) callOnce(api string, req, resp interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	httpResp, err := c.post(ctx, api, req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		e := &gatewayError{}
+		if err := json.NewDecoder(httpResp.Body).Decode(e); err != nil || e.Message == "" {
+			return fmt.Errorf("etcd error, status: %s", httpResp.Status)
+		}
+		return e
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// authenticate get auth token if username is set, token is got again if force is true
+func (c *Client) authenticate(force bool) error {
+	if c.username == "" {
+		return nil
+	}
+	c.mu.Lock()
+	hasToken := c.token != ""
+	c.mu.Unlock()
+	if hasToken && !force {
+		return nil
+	}
+
+	resp := &authenticateResponse{}
+	if err := c.callOnce("/auth/authenticate", &authenticateRequest{Name: c.username, Password: c.password}, resp); err != nil {
+		return fmt.Errorf("authenticate user %s error: %v", c.username, err)
+	}
+	c.mu.Lock()
+	c.token = resp.Token
+	c.mu.Unlock()
+	return nil
+}
+
+// Close do nothing, connections are kept by http client
+func (c *Client) Close() error {
+	return nil
+}
+
+// Create create path with data, ErrNodeExists is returned if path exists
+func (c *Client) Create(path string, data []byte) error {
+	req := &txnRequest{
+		Compare: []*compare{{Key: []byte(path), Target: "CREATE", Result: "EQUAL", CreateRevision: 0}},
+		Success: []*requestOp{{RequestPut: &putRequest{Key: []byte(path), Value: data}}},
+	}
+	resp := &txnResponse{}
+	if err := c.call("/kv/txn", req, resp); err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrNodeExists
+	}
+	return nil
+}
+
+// Update create or update path with data
+func (c *Client) Update(path string, data []byte) error {
+	return c.call("/kv/put", &putRequest{Key: []byte(path), Value: data}, nil)
+}
+
+// UpdateWithTTL update path with data, path is deleted after ttl if not updated again
+func (c *Client) UpdateWithTTL(path string, data []byte, ttl time.Duration) error {
+	seconds := int64(ttl / time.Second)
+	if seconds <= 0 {
+		seconds = 1
+	}
+	lease := &leaseGrantResponse{}
+	if err := c.call("/lease/grant", &leaseGrantRequest{TTL: seconds}, lease); err != nil {
+		return err
+	}
+	return c.call("/kv/put", &putRequest{Key: []byte(path), Value: data, Lease: lease.ID}, nil)
+}
+
+// Delete delete path, it's not an error if path not exists
+func (c *Client) Delete(path string) error {
+	return c.call("/kv/deleterange", &deleteRangeRequest{Key: []byte(path)}, nil)
+}
+
+// Read read value of path, nil is returned if path not exists
+func (c *Client) Read(path string) ([]byte, error) {
+	resp := &rangeResponse{}
+	if err := c.call("/kv/range", &rangeRequest{Key: []byte(path)}, resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// List list path, return full paths of direct children
+func (c *Client) List(dir string) ([]string, error) {
+	prefix := strings.TrimRight(dir, "/") + "/"
+	resp := &rangeResponse{}
+	if err := c.call("/kv/range", &rangeRequest{Key: []byte(prefix), RangeEnd: prefixEnd(prefix), KeysOnly: true}, resp); err != nil {
+		return nil, err
+	}
+
+	r := make([]string, 0, len(resp.Kvs))
+	seen := make(map[string]bool, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		name := strings.SplitN(strings.TrimPrefix(string(kv.Key), prefix), "/", 2)[0]
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		r = append(r, path.Join(prefix, name))
+	}
+	return r, nil
+}
+
+// BasePrefix return base prefix
+func (c *Client) BasePrefix() string {
+	return c.Prefix
+}
+
+// prefixEnd return range end of keys with prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// all keys after prefix
+	return []byte{0}
+}
+
+// Watch send changed paths under dir to the returned channel until stop is closed.
+// watch is created again from the last revision seen if it's interrupted, dir itself is sent if changes may be lost.
+func (c *Client) Watch(dir string, stop <-chan struct{}) (<-chan string, error) {
+	prefix := strings.TrimRight(dir, "/") + "/"
+	resp := &rangeResponse{}
+	if err := c.call("/kv/range", &rangeRequest{Key: []byte(prefix), KeysOnly: true}, resp); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan string, watchEventBufferSize)
+	go func() {
+		defer close(ch)
+		revision := resp.Header.Revision + 1
+		for {
+			var err error
+			revision, err = c.watch(prefix, revision, stop, ch)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			log.Warn("watch etcd %s interrupted, retry from revision %d, err: %v", prefix, revision, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(watchRetryInterval):
+			}
+			if e, ok := err.(*gatewayError); ok && e.Code == unauthenticated {
+				if err := c.authenticate(true); err != nil {
+					log.Warn("watch etcd %s, authenticate error: %v", prefix, err)
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// watch read events from revision until stream is broken, revision to watch from next time is returned
+func (c *Client) watch(prefix string, revision int64, stop <-chan struct{}, ch chan<- string) (int64, error) {
+	if err := c.authenticate(false); err != nil {
+		return revision, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req := &watchRequest{CreateRequest: &watchCreateRequest{Key: []byte(prefix), RangeEnd: prefixEnd(prefix), StartRevision: revision}}
+	httpResp, err := c.post(ctx, "/watch", req)
+	if err != nil {
+		return revision, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return revision, fmt.Errorf("etcd error, status: %s", httpResp.Status)
+	}
+
+	send := func(path string) bool {
+		select {
+		case ch <- path:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	decoder := json.NewDecoder(httpResp.Body)
+	for {
+		resp := &watchResponse{}
+		if err := decoder.Decode(resp); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return revision, err
+		}
+		if resp.Error != nil {
+			return revision, resp.Error
+		}
+		if resp.Result == nil {
+			continue
+		}
+
+		r := resp.Result
+		if r.CompactRevision > 0 {
+			// changes before compact revision are lost, let watcher reload all
+			if !send(strings.TrimRight(prefix, "/")) {
+				return revision, nil
+			}
+			return r.CompactRevision, fmt.Errorf("revision %d has been compacted", revision)
+		}
+		if r.Canceled {
+			return revision, errors.New("watch canceled by server")
+		}
+		for _, e := range r.Events {
+			if e.Kv == nil {
+				continue
+			}
+			if !send(string(e.Kv.Key)) {
+				return revision, nil
+			}
+			if e.Kv.ModRevision >= revision {
+				revision = e.Kv.ModRevision + 1
+			}
+		}
+	}
+}
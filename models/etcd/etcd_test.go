@@ -0,0 +1,365 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd is an in-process server of the subset of etcd v3 json gateway used by client
+type fakeEtcd struct {
+	sync.Mutex
+	revision int64
+	kvs      map[string]*keyValue
+	events   []*watchEvent
+	changed  chan struct{} // closed and replaced when any key changed
+	dropped  chan struct{} // closed and replaced to break watch streams
+	username string
+	password string
+	token    string
+}
+
+func newFakeEtcd(username, password string) (*fakeEtcd, *httptest.Server) {
+	f := &fakeEtcd{
+		revision: 1,
+		kvs:      make(map[string]*keyValue),
+		changed:  make(chan struct{}),
+		dropped:  make(chan struct{}),
+		username: username,
+		password: password,
+	}
+	return f, httptest.NewServer(f)
+}
+
+func inRange(key string, start, end []byte) bool {
+	if len(end) == 0 {
+		return key == string(start)
+	}
+	if bytes.Equal(end, []byte{0}) {
+		return key >= string(start)
+	}
+	return key >= string(start) && key < string(end)
+}
+
+// change must be called with lock held
+func (f *fakeEtcd) change(key string, value []byte, typ string) {
+	f.revision++
+	kv := &keyValue{Key: []byte(key), Value: value, ModRevision: f.revision}
+	if typ == "DELETE" {
+		delete(f.kvs, key)
+	} else {
+		kv.CreateRevision = f.revision
+		if old, ok := f.kvs[key]; ok {
+			kv.CreateRevision = old.CreateRevision
+		}
+		f.kvs[key] = kv
+	}
+	f.events = append(f.events, &watchEvent{Type: typ, Kv: kv})
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeEtcd) dropWatches() {
+	f.Lock()
+	close(f.dropped)
+	f.dropped = make(chan struct{})
+	f.Unlock()
+}
+
+func (f *fakeEtcd) rotateToken() {
+	f.Lock()
+	f.token = ""
+	f.Unlock()
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reply := func(v interface{}) {
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(status, code int, message string) {
+		w.WriteHeader(status)
+		reply(&gatewayError{Code: code, Message: message})
+	}
+
+	if r.URL.Path == APIPrefix+"/auth/authenticate" {
+		req := &authenticateRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		if req.Name != f.username || req.Password != f.password {
+			fail(http.StatusBadRequest, 3, "authentication failed, invalid user ID or password")
+			return
+		}
+		f.Lock()
+		f.token = fmt.Sprintf("token-%d", time.Now().UnixNano())
+		reply(&authenticateResponse{Token: f.token})
+		f.Unlock()
+		return
+	}
+	if f.username != "" {
+		f.Lock()
+		token := f.token
+		f.Unlock()
+		if token == "" || r.Header.Get("Authorization") != token {
+			fail(http.StatusUnauthorized, unauthenticated, "invalid auth token")
+			return
+		}
+	}
+
+	switch r.URL.Path {
+	case APIPrefix + "/kv/range":
+		req := &rangeRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		f.Lock()
+		resp := &rangeResponse{Header: responseHeader{Revision: f.revision}}
+		for key, kv := range f.kvs {
+			if inRange(key, req.Key, req.RangeEnd) {
+				resp.Kvs = append(resp.Kvs, kv)
+			}
+		}
+		f.Unlock()
+		sort.Slice(resp.Kvs, func(i, j int) bool { return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key) })
+		reply(resp)
+	case APIPrefix + "/kv/put":
+		req := &putRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		f.Lock()
+		f.change(string(req.Key), req.Value, "")
+		f.Unlock()
+		reply(struct{}{})
+	case APIPrefix + "/kv/deleterange":
+		req := &deleteRangeRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		f.Lock()
+		if _, ok := f.kvs[string(req.Key)]; ok {
+			f.change(string(req.Key), nil, "DELETE")
+		}
+		f.Unlock()
+		reply(struct{}{})
+	case APIPrefix + "/kv/txn":
+		req := &txnRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		f.Lock()
+		defer f.Unlock()
+		c := req.Compare[0]
+		if _, ok := f.kvs[string(c.Key)]; ok {
+			reply(&txnResponse{Succeeded: false})
+			return
+		}
+		put := req.Success[0].RequestPut
+		f.change(string(put.Key), put.Value, "")
+		reply(&txnResponse{Succeeded: true})
+	case APIPrefix + "/lease/grant":
+		reply(&leaseGrantResponse{ID: 7587})
+	case APIPrefix + "/watch":
+		f.watch(w, r)
+	default:
+		fail(http.StatusNotFound, 5, "not found")
+	}
+}
+
+func (f *fakeEtcd) watch(w http.ResponseWriter, r *http.Request) {
+	req := &watchRequest{}
+	json.NewDecoder(r.Body).Decode(req)
+	c := req.CreateRequest
+	encoder := json.NewEncoder(w)
+	flusher := w.(http.Flusher)
+
+	next := c.StartRevision
+	for {
+		f.Lock()
+		resp := &watchResponse{Result: &watchResult{Header: responseHeader{Revision: f.revision}}}
+		for _, e := range f.events {
+			if e.Kv.ModRevision >= next && inRange(string(e.Kv.Key), c.Key, c.RangeEnd) {
+				resp.Result.Events = append(resp.Result.Events, e)
+			}
+		}
+		next = f.revision + 1
+		changed, dropped := f.changed, f.dropped
+		f.Unlock()
+
+		if len(resp.Result.Events) != 0 {
+			encoder.Encode(resp)
+			flusher.Flush()
+		}
+		select {
+		case <-changed:
+		case <-dropped:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// realEtcdEnv is comma separated endpoints of etcd, like http://127.0.0.1:2379, tests are run against the real
+// server too if it's set. user and password are set by GAEA_TEST_ETCD_USER and GAEA_TEST_ETCD_PASSWORD.
+const realEtcdEnv = "GAEA_TEST_ETCD_ENDPOINTS"
+
+// newRealEtcdClient create client of real etcd with a prefix not used before, test is skipped if etcd is not set
+func newRealEtcdClient(t *testing.T) (*Client, string) {
+	endpoints := os.Getenv(realEtcdEnv)
+	if endpoints == "" {
+		t.Skipf("%s is not set", realEtcdEnv)
+	}
+	root := fmt.Sprintf("/gaea_test_%d", time.Now().UnixNano())
+	c, err := New(endpoints, os.Getenv("GAEA_TEST_ETCD_USER"), os.Getenv("GAEA_TEST_ETCD_PASSWORD"), root)
+	if err != nil {
+		t.Fatalf("create client of real etcd error: %v", err)
+	}
+	return c, root
+}
+
+func TestCRUD(t *testing.T) {
+	_, srv := newFakeEtcd("", "")
+	defer srv.Close()
+	c, err := New(srv.URL, "", "", "")
+	if err != nil {
+		t.Fatalf("create client error: %v", err)
+	}
+	if c.BasePrefix() != defaultPrefix {
+		t.Errorf("default prefix not equal, actual: %s", c.BasePrefix())
+	}
+	testCRUD(t, c, defaultPrefix)
+}
+
+func TestCRUDRealEtcd(t *testing.T) {
+	c, root := newRealEtcdClient(t)
+	testCRUD(t, c, root)
+}
+
+func testCRUD(t *testing.T, c *Client, root string) {
+	path := root + "/namespace/ns1"
+	if err := c.Create(path, []byte("v1")); err != nil {
+		t.Fatalf("create error: %v", err)
+	}
+	if err := c.Create(path, []byte("v1")); err != ErrNodeExists {
+		t.Errorf("create existing key should fail, err: %v", err)
+	}
+	if err := c.Update(path, []byte("v2")); err != nil {
+		t.Fatalf("update error: %v", err)
+	}
+	if err := c.UpdateWithTTL(root+"/namespace/ns2/sub", []byte("v3"), time.Second); err != nil {
+		t.Fatalf("update with ttl error: %v", err)
+	}
+	if data, err := c.Read(path); err != nil || string(data) != "v2" {
+		t.Errorf("data not equal, expect: v2, actual: %s, err: %v", data, err)
+	}
+
+	// only direct children are listed
+	keys, err := c.List(root + "/namespace")
+	if err != nil || len(keys) != 2 || keys[0] != root+"/namespace/ns1" || keys[1] != root+"/namespace/ns2" {
+		t.Errorf("list not equal, actual: %v, err: %v", keys, err)
+	}
+
+	if err := c.Delete(path); err != nil {
+		t.Fatalf("delete error: %v", err)
+	}
+	if data, err := c.Read(path); err != nil || data != nil {
+		t.Errorf("key should be deleted, actual: %s, err: %v", data, err)
+	}
+}
+
+func TestAuthAndFailover(t *testing.T) {
+	f, srv := newFakeEtcd("root", "secret")
+	defer srv.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	c, err := New(down.URL+","+srv.URL, "root", "secret", "/mask")
+	if err != nil {
+		t.Fatalf("create client error: %v", err)
+	}
+	if err := c.Update("/mask/databases.xml", []byte("v1")); err != nil {
+		t.Fatalf("update error: %v", err)
+	}
+
+	// token is got again when it's expired
+	f.rotateToken()
+	if data, err := c.Read("/mask/databases.xml"); err != nil || string(data) != "v1" {
+		t.Errorf("read after token expired not equal, actual: %s, err: %v", data, err)
+	}
+
+	wrong, _ := New(srv.URL, "root", "wrong", "/mask")
+	if _, err := wrong.Read("/mask/databases.xml"); err == nil {
+		t.Errorf("read with wrong password should fail")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	f, srv := newFakeEtcd("", "")
+	defer srv.Close()
+	c, _ := New(srv.URL, "", "", "/mask")
+	testWatch(t, c, "/mask", f.dropWatches)
+}
+
+func TestWatchRealEtcd(t *testing.T) {
+	c, root := newRealEtcdClient(t)
+	testWatch(t, c, root, nil)
+}
+
+// testWatch check changes under root are watched, dropWatches breaks watch streams of server, nil if not supported
+func testWatch(t *testing.T, c *Client, root string, dropWatches func()) {
+	c.Update(root+"/namespace/ns1", []byte("v0"))
+
+	stop := make(chan struct{})
+	events, err := c.Watch(root, stop)
+	if err != nil {
+		t.Fatalf("watch error: %v", err)
+	}
+	expect := func(path string) {
+		select {
+		case p := <-events:
+			if p != path {
+				t.Errorf("changed path not equal, expect: %s, actual: %s", path, p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("wait change of %s timeout", path)
+		}
+	}
+
+	c.Update(root+"/namespace/ns1", []byte("v1"))
+	expect(root + "/namespace/ns1")
+	c.Update(root+"other", []byte("v1"))
+	c.Delete(root + "/namespace/ns1")
+	expect(root + "/namespace/ns1")
+	c.Delete(root + "other")
+
+	// changes when watch is interrupted are not lost
+	if dropWatches != nil {
+		dropWatches()
+	}
+	c.Update(root+"/white_list/wl1", []byte("v1"))
+	expect(root + "/white_list/wl1")
+	c.Delete(root + "/white_list/wl1")
+	expect(root + "/white_list/wl1")
+
+	close(stop)
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Errorf("no more change expected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("channel should be closed after stopped")
+	}
+}
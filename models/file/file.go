@@ -16,9 +16,13 @@ package file
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ZzzYtl/MyMask/log"
@@ -26,11 +30,26 @@ import (
 
 const (
 	defaultFilePath = "./etc/file"
+
+	// DefaultHistorySize is default count of history versions kept for each file
+	DefaultHistorySize = 10
+
+	historyDir    = ".history" // history versions of files in a directory are kept in it
+	lockFile      = ".lock"    // lock file in root directory, held by writers
+	versionFormat = "20060102150405.000000000"
 )
 
-// Client used to test with config from file
+// ErrNodeExists means file to create already exists
+var ErrNodeExists = errors.New("node already exists")
+
+// Client used to test with config from file.
+// writes are atomic by write-then-rename, and serialized by lock of root directory among processes,
+// old version of file is kept in .history directory before it's updated or deleted.
 type Client struct {
-	Prefix string
+	Prefix      string
+	HistorySize int // count of history versions kept for each file, 0 means no history
+
+	mu sync.Mutex
 }
 
 // New constructor of EtcdClient
@@ -42,7 +61,7 @@ func New(path string) (*Client, error) {
 		log.Warn("check file config directory failed, %v", err)
 		return nil, err
 	}
-	return &Client{Prefix: path}, nil
+	return &Client{Prefix: path, HistorySize: DefaultHistorySize}, nil
 }
 
 func checkDir(path string) error {
@@ -66,23 +85,225 @@ func (c *Client) Close() error {
 	return nil
 }
 
-// Create do nothing
+// lock serialize writers in this process and other processes sharing the directory
+func (c *Client) lock() (func(), error) {
+	c.mu.Lock()
+	f, err := os.OpenFile(filepath.Join(c.Prefix, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	if err := lockFd(f); err != nil {
+		f.Close()
+		c.mu.Unlock()
+		return nil, fmt.Errorf("lock %s error: %v", c.Prefix, err)
+	}
+	return func() {
+		unlockFd(f)
+		f.Close()
+		c.mu.Unlock()
+	}, nil
+}
+
+// Create create file with data, ErrNodeExists is returned if file exists
 func (c *Client) Create(path string, data []byte) error {
-	return nil
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return ErrNodeExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(path, data)
 }
 
-// Update do nothing
+// Update create or replace file with data, old version is kept in history
 func (c *Client) Update(path string, data []byte) error {
-	return nil
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := c.backup(path); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
 }
 
-// UpdateWithTTL update path with data and ttl
+// UpdateWithTTL update path with data, file never expires so ttl is ignored
 func (c *Client) UpdateWithTTL(path string, data []byte, ttl time.Duration) error {
-	return nil
+	return c.Update(path, data)
 }
 
-// Delete delete path
+// Delete delete path, old version is kept in history. it's not an error if path not exists
 func (c *Client) Delete(path string) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := c.backup(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// History return versions of path kept in history, the newest is the first
+func (c *Client) History(path string) ([]string, error) {
+	files, err := ioutil.ReadDir(historyPath(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	versions := make([]string, 0, len(files))
+	for _, f := range files {
+		versions = append(versions, f.Name())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	return versions, nil
+}
+
+// ReadVersion read data of path in history
+func (c *Client) ReadVersion(path, version string) ([]byte, error) {
+	if err := checkVersion(version); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(historyPath(path), version))
+}
+
+// Rollback restore path to version in history, the current version is kept in history too
+func (c *Client) Rollback(path, version string) error {
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := ioutil.ReadFile(filepath.Join(historyPath(path), version))
+	if err != nil {
+		return err
+	}
+	if err := c.backup(path); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func checkVersion(version string) error {
+	if _, err := time.Parse(versionFormat, version); err != nil {
+		return fmt.Errorf("invalid version: %s", version)
+	}
+	return nil
+}
+
+// historyPath return directory of history versions of path
+func historyPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, historyDir, name)
+}
+
+// backup copy current version of path to history and remove the oldest versions, nothing to do if path not exists
+func (c *Client) backup(path string) error {
+	if c.HistorySize <= 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	dir := historyPath(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	version := time.Now().UTC().Format(versionFormat)
+	if err := writeFileAtomic(filepath.Join(dir, version), data); err != nil {
+		return fmt.Errorf("backup %s error: %v", path, err)
+	}
+
+	versions, err := c.History(path)
+	if err != nil {
+		return err
+	}
+	for i := c.HistorySize; i < len(versions); i++ {
+		if err := os.Remove(filepath.Join(dir, versions[i])); err != nil {
+			log.Warn("remove history version of %s error, version: %s, err: %v", path, versions[i], err)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic write data to temp file in the same directory then rename it to path,
+// so readers get either old or new content
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no effect after renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir make rename or remove in directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		// some platforms don't support sync of directory
+		log.Debug("sync directory %s error: %v", dir, err)
+	}
 	return nil
 }
 
@@ -104,6 +325,10 @@ func (c *Client) List(path string) ([]string, error) {
 	}
 
 	for _, f := range files {
+		// skip history, lock and temp files
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
 		r = append(r, f.Name())
 	}
 
@@ -0,0 +1,185 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "gaea_file_client")
+	if err != nil {
+		t.Fatalf("create temp dir error: %v", err)
+	}
+	c, err := New(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("create client error: %v", err)
+	}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+func TestCreateUpdateDelete(t *testing.T) {
+	c, clean := newTestClient(t)
+	defer clean()
+
+	path := filepath.Join(c.Prefix, "namespace", "ns1")
+	if err := c.Create(path, []byte("v1")); err != nil {
+		t.Fatalf("create error: %v", err)
+	}
+	if err := c.Create(path, []byte("v1")); err != ErrNodeExists {
+		t.Errorf("create existing file should fail, err: %v", err)
+	}
+	if err := c.Update(path, []byte("v2")); err != nil {
+		t.Fatalf("update error: %v", err)
+	}
+	if data, _ := c.Read(path); string(data) != "v2" {
+		t.Errorf("data not equal, expect: v2, actual: %s", data)
+	}
+
+	// history, lock and temp files are not listed
+	files, err := c.List(filepath.Join(c.Prefix, "namespace"))
+	if err != nil || len(files) != 1 || files[0] != "ns1" {
+		t.Errorf("list not equal, actual: %v, err: %v", files, err)
+	}
+
+	if err := c.Delete(path); err != nil {
+		t.Fatalf("delete error: %v", err)
+	}
+	if _, err := c.Read(path); !os.IsNotExist(err) {
+		t.Errorf("file should be deleted, err: %v", err)
+	}
+	if err := c.Delete(path); err != nil {
+		t.Errorf("delete not existing file error: %v", err)
+	}
+
+	versions, err := c.History(path)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("history not equal, actual: %v, err: %v", versions, err)
+	}
+	if data, _ := c.ReadVersion(path, versions[0]); string(data) != "v2" {
+		t.Errorf("newest version not equal, expect: v2, actual: %s", data)
+	}
+	if data, _ := c.ReadVersion(path, versions[1]); string(data) != "v1" {
+		t.Errorf("oldest version not equal, expect: v1, actual: %s", data)
+	}
+}
+
+func TestHistoryAndRollback(t *testing.T) {
+	c, clean := newTestClient(t)
+	defer clean()
+	c.HistorySize = 3
+
+	path := filepath.Join(c.Prefix, "databases.xml")
+	for i := 0; i < 6; i++ {
+		if err := c.Update(path, []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("update error: %v", err)
+		}
+	}
+	versions, err := c.History(path)
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("history should be limited, actual: %v, err: %v", versions, err)
+	}
+
+	// versions[2] is v2
+	if err := c.Rollback(path, versions[2]); err != nil {
+		t.Fatalf("rollback error: %v", err)
+	}
+	if data, _ := c.Read(path); string(data) != "v2" {
+		t.Errorf("data not equal after rollback, expect: v2, actual: %s", data)
+	}
+	versions, _ = c.History(path)
+	if data, _ := c.ReadVersion(path, versions[0]); string(data) != "v5" {
+		t.Errorf("version before rollback should be kept, actual: %s", data)
+	}
+
+	if err := c.Rollback(path, "../../etc/passwd"); err == nil {
+		t.Errorf("rollback to invalid version should fail")
+	}
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	c, clean := newTestClient(t)
+	defer clean()
+
+	// another client of the same directory, like another process
+	other, err := New(c.Prefix)
+	if err != nil {
+		t.Fatalf("create client error: %v", err)
+	}
+
+	path := filepath.Join(c.Prefix, "white_list", "wl1")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := c
+			if i%2 == 0 {
+				client = other
+			}
+			if err := client.Update(path, []byte(fmt.Sprintf("value-%02d", i))); err != nil {
+				t.Errorf("update error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := c.Read(path)
+	if err != nil || len(data) != len("value-00") {
+		t.Errorf("data should be written completely, actual: %s, err: %v", data, err)
+	}
+	versions, _ := c.History(path)
+	if len(versions) != DefaultHistorySize {
+		t.Errorf("history size not equal, expect: %d, actual: %d", DefaultHistorySize, len(versions))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	c, clean := newTestClient(t)
+	defer clean()
+	if err := os.MkdirAll(filepath.Join(c.Prefix, "namespace"), 0755); err != nil {
+		t.Fatalf("create dir error: %v", err)
+	}
+
+	stop := make(chan struct{})
+	events, err := c.Watch(c.Prefix, stop)
+	if err != nil {
+		t.Fatalf("watch error: %v", err)
+	}
+
+	// history and temp files written by update are not sent
+	path := filepath.Join(c.Prefix, "namespace", "ns1")
+	c.Update(path, []byte("v1"))
+	c.Update(path, []byte("v2"))
+	select {
+	case p := <-events:
+		if filepath.Base(p) != "ns1" {
+			t.Errorf("changed path not equal, actual: %s", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait change timeout")
+	}
+
+	close(stop)
+	for range events {
+	}
+}
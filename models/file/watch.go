@@ -0,0 +1,80 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/howeyc/fsnotify"
+)
+
+const watchEventBufferSize = 16
+
+// Watch send changed files under dir to the returned channel until stop is closed.
+// only directories existing when watch starts are watched, history, lock and temp files are ignored.
+func (c *Client) Watch(dir string, stop <-chan struct{}) (<-chan string, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// 只需监控目录即可, 目录下的文件也在监控范围内
+		if !info.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		path, err = filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		return watcher.Watch(path)
+	})
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	ch := make(chan string, watchEventBufferSize)
+	go func() {
+		defer close(ch)
+		defer watcher.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			case e := <-watcher.Event:
+				if e == nil || strings.HasPrefix(filepath.Base(e.Name), ".") {
+					continue
+				}
+				select {
+				case ch <- e.Name:
+				case <-stop:
+					return
+				}
+			case err := <-watcher.Error:
+				log.Warn("watch %s error: %v", dir, err)
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -1,35 +1,39 @@
 package models
 
-import "encoding/xml"
+import (
+	"encoding/xml"
+	"fmt"
+)
 
 type FilterList struct {
-	Name    string
-	Filters []Filter `xml:"Filter"`
+	Name     string   `xml:"-" json:"name"`                // name in index of rule files
+	FileName string   `xml:"-" json:"file_name,omitempty"` // file name in index of rule files
+	Filters  []Filter `xml:"Filter" json:"filters"`
 }
 
 type Filter struct {
-	Name   string `xml:"name,attr"`
-	Action Action `xml:"Action"`
+	Name   string `xml:"name,attr" json:"name"`
+	Action Action `xml:"Action" json:"action"`
 }
 
 type Action struct {
-	Mask Mask `xml:"Mask"`
+	Mask Mask `xml:"Mask" json:"mask"`
 }
 
 //<Mask useTemplate="0" function="MASK_CELLPHONE_NUMBER_OPERATOR" dataType="手机号"
 //template="常量替换手机号码前4-7位" column_name=""mobile"" databasename="test"
 //table_name=""customer"" schemaName=""test""/>
 type Mask struct {
-	Function     string `xml:"function,attr"`
-	SchemaName   string `xml:"schemaName,attr"`
-	DataBaseName string `xml:"databasename,attr"`
-	TableName    string `xml:"table_name,attr"`
-	ColName      string `xml:"column_name,attr"`
+	Function     string `xml:"function,attr" json:"function"`
+	SchemaName   string `xml:"schemaName,attr" json:"schema_name"`
+	DataBaseName string `xml:"databasename,attr" json:"database_name"`
+	TableName    string `xml:"table_name,attr" json:"table_name"`
+	ColName      string `xml:"column_name,attr" json:"column_name"`
 }
 
 // Encode encode json
 func (n *FilterList) Encode() []byte {
-	bytes, err := xml.Marshal(n.Filters)
+	bytes, err := xml.Marshal(n)
 	if err != nil {
 		return nil
 	}
@@ -38,5 +42,18 @@ func (n *FilterList) Encode() []byte {
 
 // Verify verify namespace contents
 func (n *FilterList) Verify() error {
+	cols := make(map[string]bool, len(n.Filters))
+	for _, f := range n.Filters {
+		m := f.Action.Mask
+		if m.TableName == "" || m.ColName == "" || m.Function == "" {
+			return fmt.Errorf("table_name, column_name and function of filter %s are required", f.Name)
+		}
+		// one column could only be masked by one function in a rule file
+		col := m.TableName + "." + m.ColName
+		if cols[col] {
+			return fmt.Errorf("column %s.%s duped in filter %s", m.TableName, m.ColName, f.Name)
+		}
+		cols[col] = true
+	}
 	return nil
 }
@@ -0,0 +1,151 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// types of firewall rule
+const (
+	FirewallRuleFingerprint = "fingerprint" // sql指纹与pattern的指纹相同
+	FirewallRuleRegex       = "regex"       // 原始sql匹配正则表达式
+	FirewallRuleCheck       = "check"       // 内置检查, 见FirewallCheckXXX
+)
+
+// builtin checks of firewall rule
+const (
+	FirewallCheckNoWhere        = "no_where"        // UPDATE/DELETE没有WHERE条件
+	FirewallCheckSelectStar     = "select_star"     // 对tables中的表执行SELECT *, tables为空时检查所有表
+	FirewallCheckIntoOutfile    = "into_outfile"    // SELECT ... INTO OUTFILE/DUMPFILE
+	FirewallCheckLoadFile       = "load_file"       // 调用LOAD_FILE函数
+	FirewallCheckSleep          = "sleep"           // 调用SLEEP或BENCHMARK函数
+	FirewallCheckStackedComment = "stacked_comment" // 包含多个注释或/*! */可执行注释
+)
+
+// actions of firewall rule
+const (
+	FirewallActionAllow = "allow" // 放行, 不再检查后续规则和用户白名单
+	FirewallActionDeny  = "deny"  // 拒绝执行
+	FirewallActionLog   = "log"   // 只记录日志和监控, 继续检查后续规则
+)
+
+// modes of user allowlist, like mysql enterprise firewall
+const (
+	FirewallModeRecording  = "recording"  // 学习模式, 记录用户执行的sql指纹, 不拦截
+	FirewallModeProtecting = "protecting" // 拒绝不在白名单中的sql
+	FirewallModeDetecting  = "detecting"  // 只记录不在白名单中的sql, 不拦截
+)
+
+// Firewall means sql firewall config of namespace
+type Firewall struct {
+	Rules []*FirewallRule `json:"rules"` // 按顺序匹配
+	Users []*FirewallUser `json:"users"` // 用户白名单
+}
+
+// FirewallRule means one rule of sql firewall
+type FirewallRule struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`    // fingerprint, regex或check
+	Pattern string   `json:"pattern"` // fingerprint时为sql, regex时为正则表达式, check时为检查项名称
+	Tables  []string `json:"tables"`  // select_star检查的表名, 可以带db, 如db1.user
+	Users   []string `json:"users"`   // 规则作用的用户, 为空时作用于所有用户
+	Action  string   `json:"action"`  // allow, deny或log
+}
+
+// FirewallUser means allowlist of user
+type FirewallUser struct {
+	User      string   `json:"user"`
+	Mode      string   `json:"mode"`      // recording, protecting或detecting
+	Allowlist []string `json:"allowlist"` // 允许执行的sql, 按指纹匹配
+}
+
+func (f *Firewall) verify() error {
+	if f == nil {
+		return nil
+	}
+
+	names := make(map[string]bool, len(f.Rules))
+	for _, r := range f.Rules {
+		if err := r.verify(); err != nil {
+			return err
+		}
+		if names[r.Name] {
+			return fmt.Errorf("firewall rule duped: %s", r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	users := make(map[string]bool, len(f.Users))
+	for _, u := range f.Users {
+		if u.User == "" {
+			return errors.New("missing user of firewall allowlist")
+		}
+		if users[u.User] {
+			return fmt.Errorf("firewall allowlist duped, user: %s", u.User)
+		}
+		users[u.User] = true
+		switch u.Mode {
+		case FirewallModeRecording, FirewallModeProtecting, FirewallModeDetecting:
+		default:
+			return fmt.Errorf("invalid firewall mode, user: %s, mode: %s", u.User, u.Mode)
+		}
+	}
+	return nil
+}
+
+func (r *FirewallRule) verify() error {
+	if r == nil {
+		return errors.New("empty firewall rule")
+	}
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return errors.New("missing name of firewall rule")
+	}
+	if strings.TrimSpace(r.Pattern) == "" {
+		return fmt.Errorf("missing pattern of firewall rule: %s", r.Name)
+	}
+
+	switch r.Type {
+	case FirewallRuleFingerprint:
+	case FirewallRuleRegex:
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("invalid regex of firewall rule: %s, err: %v", r.Name, err)
+		}
+	case FirewallRuleCheck:
+		switch r.Pattern {
+		case FirewallCheckNoWhere, FirewallCheckSelectStar, FirewallCheckIntoOutfile,
+			FirewallCheckLoadFile, FirewallCheckSleep, FirewallCheckStackedComment:
+		default:
+			return fmt.Errorf("invalid check of firewall rule: %s, check: %s", r.Name, r.Pattern)
+		}
+	default:
+		return fmt.Errorf("invalid type of firewall rule: %s, type: %s", r.Name, r.Type)
+	}
+
+	if len(r.Tables) != 0 && (r.Type != FirewallRuleCheck || r.Pattern != FirewallCheckSelectStar) {
+		return fmt.Errorf("tables is only valid for select_star check, firewall rule: %s", r.Name)
+	}
+
+	switch r.Action {
+	case FirewallActionAllow, FirewallActionDeny, FirewallActionLog:
+	default:
+		return fmt.Errorf("invalid action of firewall rule: %s, action: %s", r.Name, r.Action)
+	}
+	return nil
+}
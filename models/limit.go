@@ -0,0 +1,58 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"fmt"
+)
+
+// Limits means resource limits of namespace or user, 0 means no limit
+type Limits struct {
+	MaxSessions      int   `json:"max_sessions"`       // 最大会话数
+	MaxQueries       int   `json:"max_queries"`        // 最大并发执行的语句数
+	QPS              int   `json:"qps"`                // 每秒执行的语句数
+	Burst            int   `json:"burst"`              // 令牌桶容量, 默认与qps相同
+	MaxRows          int64 `json:"max_rows"`           // 结果集最大行数
+	MaxResultBytes   int64 `json:"max_result_bytes"`   // 结果集最大字节数
+	MaxExecutionTime int64 `json:"max_execution_time"` // 语句最大执行时间, 单位毫秒, 超时后kill后端语句
+}
+
+func (l *Limits) verify() error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxSessions < 0 {
+		return fmt.Errorf("invalid max_sessions: %d", l.MaxSessions)
+	}
+	if l.MaxQueries < 0 {
+		return fmt.Errorf("invalid max_queries: %d", l.MaxQueries)
+	}
+	if l.QPS < 0 {
+		return fmt.Errorf("invalid qps: %d", l.QPS)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("invalid burst: %d", l.Burst)
+	}
+	if l.MaxRows < 0 {
+		return fmt.Errorf("invalid max_rows: %d", l.MaxRows)
+	}
+	if l.MaxResultBytes < 0 {
+		return fmt.Errorf("invalid max_result_bytes: %d", l.MaxResultBytes)
+	}
+	if l.MaxExecutionTime < 0 {
+		return fmt.Errorf("invalid max_execution_time: %d", l.MaxExecutionTime)
+	}
+	return nil
+}
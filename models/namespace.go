@@ -15,15 +15,15 @@
 package models
 
 import (
-	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"strconv"
 	"strings"
 
 	"github.com/ZzzYtl/MyMask/mysql"
 	"github.com/ZzzYtl/MyMask/util"
-	"github.com/ZzzYtl/MyMask/util/crypto"
 )
 
 // Namespace means namespace model stored in etcd
@@ -43,8 +43,36 @@ type Namespace struct {
 	//GlobalSequences  []*GlobalSequence `json:"global_sequences"`
 	DefaultCharset   string `json:"default_charset"`
 	DefaultCollation string `json:"default_collation"`
+	BackendPrepare   bool   `json:"backend_prepare"` // 为true时预处理语句在后端mysql上执行, 否则由proxy模拟
+
+	// 监听配置, 为空时监听所有ipv4地址的proxyPort端口
+	ListenNetwork string `json:"listen_network"` // tcp(同时监听ipv4和ipv6), tcp4, tcp6或unix
+	ListenAddr    string `json:"listen_addr"`    // 监听的ip, unix时为socket文件路径
+	SocketMode    string `json:"socket_mode"`    // unix socket文件权限, 八进制, 如0660
+
+	Limits   *Limits   `json:"limits"`   // namespace整体的资源限制, 用户级别的限制在users中配置
+	Firewall *Firewall `json:"firewall"` // sql防火墙, black_sql之后检查
+
+	RewriteRules []*RewriteRule `json:"rewrite_rules"` // sql改写规则, 按顺序匹配, 第一个匹配的规则生效
+
+	OnPolicyError string `json:"on_policy_error"` // 脱敏规则无法获取时的处理方式: deny(默认), mask_all或allow
 }
 
+// network types of listener
+const (
+	ListenNetworkTCP  = "tcp"
+	ListenNetworkTCP4 = "tcp4"
+	ListenNetworkTCP6 = "tcp6"
+	ListenNetworkUnix = "unix"
+)
+
+// actions when mask rule of database could not be resolved
+const (
+	PolicyErrorDeny    = "deny"     // 拒绝切换到该库, 当前库的规则失效时拒绝执行sql
+	PolicyErrorMaskAll = "mask_all" // 使用所有脱敏规则文件中的规则, 不应用白名单
+	PolicyErrorAllow   = "allow"    // 不脱敏执行, 记录告警日志
+)
+
 // Encode encode json
 func (n *Namespace) Encode() []byte {
 	return JSONEncode(n)
@@ -84,13 +112,40 @@ func (n *Namespace) Verify() error {
 		return err
 	}
 
+	if err := n.verifyListen(); err != nil {
+		return err
+	}
+
+	if err := n.Limits.verify(); err != nil {
+		return fmt.Errorf("verify limits error: %v", err)
+	}
+
+	if err := n.Firewall.verify(); err != nil {
+		return fmt.Errorf("verify firewall error: %v", err)
+	}
+
+	if err := verifyRewriteRules(n.RewriteRules); err != nil {
+		return fmt.Errorf("verify rewrite rules error: %v", err)
+	}
+
+	if err := n.verifyOnPolicyError(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// verifyName check name of namespace, which is used as file name or key in store like names of rule files and white lists
 func (n *Namespace) verifyName() error {
 	if !n.isNameExists() {
 		return fmt.Errorf("must specify namespace name")
 	}
+	if err := VerifyConfigName("namespace", n.Name); err != nil {
+		return err
+	}
+	if IsReservedName(n.Name) {
+		return fmt.Errorf("namespace name %s is reserved", n.Name)
+	}
 	return nil
 }
 
@@ -201,6 +256,48 @@ func (n *Namespace) verifyAllowIps() error {
 	return nil
 }
 
+func (n *Namespace) verifyListen() error {
+	switch n.ListenNetwork {
+	case "", ListenNetworkTCP, ListenNetworkTCP4, ListenNetworkTCP6:
+		if n.SocketMode != "" {
+			return fmt.Errorf("socket_mode is only valid for unix listener")
+		}
+		if n.ListenAddr != "" && net.ParseIP(strings.Trim(n.ListenAddr, "[]")) == nil {
+			return fmt.Errorf("invalid listen_addr: %s", n.ListenAddr)
+		}
+	case ListenNetworkUnix:
+		if n.ListenAddr == "" {
+			return fmt.Errorf("must specify socket path in listen_addr for unix listener")
+		}
+		if _, err := n.GetSocketMode(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid listen_network: %s", n.ListenNetwork)
+	}
+	return nil
+}
+
+// GetSocketMode return permission of unix socket file, 0 means not specified
+func (n *Namespace) GetSocketMode() (os.FileMode, error) {
+	if n.SocketMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(n.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket_mode: %s", n.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (n *Namespace) verifyOnPolicyError() error {
+	switch n.OnPolicyError {
+	case "", PolicyErrorDeny, PolicyErrorMaskAll, PolicyErrorAllow:
+		return nil
+	}
+	return fmt.Errorf("invalid on_policy_error: %s", n.OnPolicyError)
+}
+
 func (n *Namespace) verifyCharset() error {
 	if err := mysql.VerifyCharset(n.DefaultCharset, n.DefaultCollation); err != nil {
 		return fmt.Errorf("verify charset error: %v", err)
@@ -232,78 +329,38 @@ func (n *Namespace) verifyEachSlice() error {
 	return nil
 }
 
-// Decrypt decrypt user/password in namespace
-func (n *Namespace) Decrypt(key string) (err error) {
-	return nil
-	// Users
-	for i := range n.Users {
-		n.Users[i].UserName, err = decrypt(key, n.Users[i].UserName)
-		if err != nil {
-			return
-		}
-		n.Users[i].Password, err = decrypt(key, n.Users[i].Password)
-		if err != nil {
-			return
-		}
+// secrets return passwords of users and slice
+func (n *Namespace) secrets() []*string {
+	var r []*string
+	for _, u := range n.Users {
+		r = append(r, &u.Password)
 	}
-	// Slices
-	//for i := range n.Slices {
-	//	n.Slices[i].UserName, err = decrypt(key, n.Slices[i].UserName)
-	//	if err != nil {
-	//		return
-	//	}
-	//	n.Slices[i].Password, err = decrypt(key, n.Slices[i].Password)
-	//	if err != nil {
-	//		return
-	//	}
-	//}
-
-	return nil
+	if n.Slice != nil {
+		r = append(r, &n.Slice.Password)
+	}
+	return r
 }
 
-// Encrypt encrypt user/password in namespace
-func (n *Namespace) Encrypt(key string) (err error) {
-	//n.IsEncrypt = true
-	//// Users
-	//for i := range n.Users {
-	//	n.Users[i].UserName, err = encrypt(key, n.Users[i].UserName)
-	//	if err != nil {
-	//		return
-	//	}
-	//	n.Users[i].Password, err = encrypt(key, n.Users[i].Password)
-	//	if err != nil {
-	//		return
-	//	}
-	//}
-	//// Slices
-	//for i := range n.Slices {
-	//	n.Slices[i].UserName, err = encrypt(key, n.Slices[i].UserName)
-	//	if err != nil {
-	//		return
-	//	}
-	//	n.Slices[i].Password, err = encrypt(key, n.Slices[i].Password)
-	//	if err != nil {
-	//		return
-	//	}
-	//}
-
+// Decrypt decrypt passwords of users and slice in namespace
+func (n *Namespace) Decrypt(c *Cipher) error {
+	if err := c.apply(c.decrypt, n.secrets()); err != nil {
+		return fmt.Errorf("decrypt namespace %s error: %v", n.Name, err)
+	}
 	return nil
 }
 
-func decrypt(key, data string) (string, error) {
-	t, _ := base64.StdEncoding.DecodeString(data)
-	origin, err := crypto.DecryptECB(key, t)
-	if err != nil {
-		return "", err
+// Encrypt encrypt passwords of users and slice in namespace, passwords are kept in plain text if c has no key
+func (n *Namespace) Encrypt(c *Cipher) error {
+	if err := c.apply(c.encrypt, n.secrets()); err != nil {
+		return fmt.Errorf("encrypt namespace %s error: %v", n.Name, err)
 	}
-	return string(origin), nil
+	return nil
 }
 
-func encrypt(key, data string) (string, error) {
-	tmp, err := crypto.EncryptECB(key, []byte(data))
-	if err != nil {
-		return "", err
+// Rotate encrypt passwords of users and slice in namespace again with current key of c
+func (n *Namespace) Rotate(c *Cipher) error {
+	if err := c.apply(c.rotate, n.secrets()); err != nil {
+		return fmt.Errorf("rotate namespace %s error: %v", n.Name, err)
 	}
-	base64Str := base64.StdEncoding.EncodeToString(tmp)
-	return base64Str, nil
+	return nil
 }
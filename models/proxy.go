@@ -15,6 +15,9 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/go-ini/ini"
 )
 
@@ -24,12 +27,18 @@ const (
 
 // Proxy means proxy structure of proxy config
 type Proxy struct {
-	// config type
-	ConfigType string
+	// config type, file or etcd
+	ConfigType string `ini:"config_type"`
 
 	// 文件配置类型内容
 	FileConfigPath string `ini:"file_config_path"`
 
+	// etcd配置类型内容, 逗号分隔的etcd地址及配置所在的key前缀
+	CoordinatorAddr string `ini:"coordinator_addr"`
+	CoordinatorRoot string `ini:"coordinator_root"`
+	UserName        string `ini:"username"`
+	Password        string `ini:"password"`
+
 	// 服务相关信息
 	Service string `ini:"service_name"`
 
@@ -45,12 +54,30 @@ type Proxy struct {
 	AdminPassword  string `ini:"admin_password"`
 	SlowSQLTime    int64  `ini:"slow_sql_time"`
 	SessionTimeout int    `ini:"session_timeout"`
+	DrainTimeout   int    `ini:"drain_timeout"` // max seconds to wait for running sessions when shutting down gracefully
+
+	// 可信的负载均衡地址, 逗号分隔的ip或cidr, 来自这些地址的连接必须以PROXY protocol头开始
+	ProxyProtocolTrustedCIDRs string `ini:"proxy_protocol_trusted_cidrs"`
 
 	// 监控配置
 	StatsEnabled  string `ini:"stats_enabled"`  // set true to enable stats
 	StatsInterval int    `ini:"stats_interval"` // set stats interval of connect pool
 
 	EncryptKey string `ini:"encrypt_key"`
+	// 加密配置中密码的主密钥, 文件或环境变量二选一, 都不配置时密码为明文
+	EncryptKeyFile string `ini:"encrypt_key_file"`
+	EncryptKeyEnv  string `ini:"encrypt_key_env"`
+
+	// 管理接口的证书及私钥, 配置后管理接口使用https; 配置client ca后要求客户端证书
+	AdminTLSCertFile     string `ini:"admin_tls_cert_file"`
+	AdminTLSKeyFile      string `ini:"admin_tls_key_file"`
+	AdminTLSClientCAFile string `ini:"admin_tls_client_ca_file"`
+	// 管理接口的账号及token, json格式, admin_user拥有全部角色
+	AdminAccountsFile string `ini:"admin_accounts_file"`
+	// pprof单独监听的地址, 为空时使用管理接口的地址
+	AdminPprofAddr string `ini:"admin_pprof_addr"`
+	// 管理接口修改操作的审计日志文件, 为空时写入proxy日志
+	AdminAuditFile string `ini:"admin_audit_file"`
 }
 
 // ParseProxyConfigFromFile parser proxy config from file
@@ -72,9 +99,38 @@ func ParseProxyConfigFromFile(cfgFile string) (*Proxy, error) {
 
 // Verify verify proxy config
 func (p *Proxy) Verify() error {
+	switch p.ConfigType {
+	case ConfigFile:
+	case ConfigEtcd:
+		if p.CoordinatorAddr == "" {
+			return fmt.Errorf("coordinator_addr is required by config type %s", p.ConfigType)
+		}
+	default:
+		return fmt.Errorf("invalid config type: %s", p.ConfigType)
+	}
+	cipher, err := p.Cipher()
+	if err != nil {
+		return fmt.Errorf("invalid encrypt key, %v", err)
+	}
+	if (p.AdminTLSCertFile == "") != (p.AdminTLSKeyFile == "") {
+		return errors.New("admin_tls_cert_file and admin_tls_key_file should be set together")
+	}
+	if p.AdminTLSClientCAFile != "" && p.AdminTLSCertFile == "" {
+		return errors.New("admin_tls_client_ca_file requires admin_tls_cert_file")
+	}
+	if p.AdminAccountsFile != "" {
+		if _, err := LoadAdminAccounts(p.AdminAccountsFile, cipher); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Cipher create Cipher with configured keys, keys are loaded again on each call so that new keys take effect on reloading
+func (p *Proxy) Cipher() (*Cipher, error) {
+	return NewCipher(p.EncryptKeyFile, p.EncryptKeyEnv)
+}
+
 // ProxyInfo for report proxy information
 type ProxyInfo struct {
 	Token     string `json:"token"`
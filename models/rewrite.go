@@ -0,0 +1,70 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// match types of rewrite rule
+const (
+	RewriteMatchFingerprint = "fingerprint" // sql指纹与pattern的指纹相同, 不需要解析sql
+	RewriteMatchPattern     = "pattern"     // sql语法树与pattern相同, pattern中的?匹配任意常量
+)
+
+// RewriteRule means rule to rewrite sql before it's planned and masked
+type RewriteRule struct {
+	Name        string `json:"name"`
+	Match       string `json:"match"`       // fingerprint或pattern
+	DB          string `json:"db"`          // 只改写该逻辑库下的sql, 为空时不限制
+	Pattern     string `json:"pattern"`     // 匹配的sql
+	Replacement string `json:"replacement"` // 改写后的sql, 其中的?依次替换为匹配到的常量
+}
+
+func (r *RewriteRule) verify() error {
+	if r == nil {
+		return errors.New("empty rewrite rule")
+	}
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return errors.New("missing name of rewrite rule")
+	}
+	if r.Match != RewriteMatchFingerprint && r.Match != RewriteMatchPattern {
+		return fmt.Errorf("invalid match of rewrite rule: %s, match: %s", r.Name, r.Match)
+	}
+	if strings.TrimSpace(r.Pattern) == "" {
+		return fmt.Errorf("missing pattern of rewrite rule: %s", r.Name)
+	}
+	if strings.TrimSpace(r.Replacement) == "" {
+		return fmt.Errorf("missing replacement of rewrite rule: %s", r.Name)
+	}
+	return nil
+}
+
+func verifyRewriteRules(rules []*RewriteRule) error {
+	names := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if err := r.verify(); err != nil {
+			return err
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rewrite rule duped: %s", r.Name)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import "time"
+
+// status of rollout
+const (
+	RolloutRunning    = "running"
+	RolloutSucceeded  = "succeeded"
+	RolloutAborted    = "aborted"     // failed before any proxy committed, prepared proxies are aborted
+	RolloutRolledBack = "rolled_back" // failed after some proxies committed, they run previous config again
+	RolloutFailed     = "failed"      // rollback failed, proxies may run different config
+)
+
+// status of proxy in rollout
+const (
+	RolloutProxyPending    = "pending"
+	RolloutProxyPrepared   = "prepared"
+	RolloutProxyCommitted  = "committed"
+	RolloutProxyAborted    = "aborted"
+	RolloutProxyRolledBack = "rolled_back"
+	RolloutProxyFailed     = "failed"
+)
+
+// RolloutVersionFormat is time format of rollout id, ids are sorted by time
+const RolloutVersionFormat = "20060102150405.000000"
+
+// Rollout is record of one config change rolled out to proxies
+type Rollout struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`   // namespace, rule, whitelist or database
+	Target    string          `json:"target"` // name of changed config
+	Action    string          `json:"action"` // modify or delete
+	Status    string          `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	Canary    int             `json:"canary"` // count of proxies committed and checked before others
+	StartTime string          `json:"start_time"`
+	EndTime   string          `json:"end_time,omitempty"`
+	Proxies   []*RolloutProxy `json:"proxies"`
+}
+
+// RolloutProxy is status of one proxy in rollout
+type RolloutProxy struct {
+	Token  string `json:"token"`
+	Addr   string `json:"addr"`
+	Canary bool   `json:"canary"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Encode encode json
+func (r *Rollout) Encode() []byte {
+	return JSONEncode(r)
+}
+
+// RolloutLockExpire is time after which rollout lock is treated as left by crashed cc and could be taken over
+const RolloutLockExpire = 30 * time.Minute
+
+// RolloutLock is held by cc while rolling out config change, only one rollout runs at a time in a cluster,
+// and proxies don't reload config by watch while it's held
+type RolloutLock struct {
+	ID   string `json:"id"`   // id of rollout holding the lock
+	Time string `json:"time"` // time the lock is taken, in RFC3339
+}
+
+// Encode encode json
+func (l *RolloutLock) Encode() []byte {
+	return JSONEncode(l)
+}
+
+// expired return true if lock is taken before expire
+func (l *RolloutLock) expired(now time.Time) bool {
+	t, err := time.Parse(time.RFC3339, l.Time)
+	return err != nil || now.Sub(t) > RolloutLockExpire
+}
@@ -10,9 +10,9 @@ type RuleList struct {
 }
 
 type RuleListRecord struct {
-	ID       int    `xml:"id,attr"`
-	Name     string `xml:"name,attr"`
-	FileName string `xml:"file_name,attr"`
+	ID       int    `xml:"id,attr" json:"id"`
+	Name     string `xml:"name,attr" json:"name"`
+	FileName string `xml:"file_name,attr" json:"file_name"`
 }
 
 // Encode encode json
@@ -30,6 +30,9 @@ func (n *RuleList) Verify() error {
 		if len(v.Name) == 0 || len(v.FileName) == 0 {
 			return errors.New("name or file name is nil")
 		}
+		if err := VerifyConfigName("rule file", v.FileName); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,764 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/go-ini/ini"
+)
+
+// SchemaVersion is version of canonical config schema
+const SchemaVersion = 1
+
+// ConfigTree is the whole config in canonical schema: local config of proxy (ini) and config in store
+// (namespaces in json, white lists in json, rules and databases in xml). it's encoded as one json document,
+// all keys are in snake case.
+type ConfigTree struct {
+	Version    int               `json:"version"`
+	Proxy      map[string]string `json:"proxy,omitempty"` // keys of ini, keys not in default section are <section>.<key>
+	Namespaces []*Namespace      `json:"namespaces"`
+	WhiteLists []*WhiteList      `json:"white_lists"`
+	Rules      []*Rule           `json:"rules"`
+	DataBases  []DataBase        `json:"databases"`
+}
+
+// Rule is a record in index of rule files and filters in the rule file
+type Rule struct {
+	RuleListRecord
+	Filters []Filter `json:"filters"`
+}
+
+// configTreeType is used to convert keys between canonical schema and json tags of models
+var configTreeType = reflect.TypeOf(ConfigTree{})
+
+// EncodeConfigTree encode config tree in canonical schema
+func EncodeConfigTree(t *ConfigTree) ([]byte, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(convertKeys(v, configTreeType, true, "", nil), "", "    ")
+}
+
+// DecodeConfigTree decode config tree in canonical schema, unknown keys and other versions are rejected
+func DecodeConfigTree(data []byte) (*ConfigTree, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config tree should be a json object")
+	}
+	if version, _ := doc["version"].(float64); int(version) != SchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %v, supported: %d", doc["version"], SchemaVersion)
+	}
+
+	var unknown []string
+	b, err := json.Marshal(convertKeys(v, configTreeType, false, "", &unknown))
+	if err != nil {
+		return nil, err
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown keys: %s", strings.Join(unknown, ", "))
+	}
+	t := &ConfigTree{}
+	if err = json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// canonicalKey return key in canonical schema of json tag, e.g. proxyPort -> proxy_port, DatabaseName -> database_name
+func canonicalKey(tag string) string {
+	var b strings.Builder
+	runes := []rune(tag)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// an upper case letter starts a word unless it follows another one in an acronym
+			if i > 0 && runes[i-1] != '_' && (!unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// jsonFields return json keys of fields of struct type t, embedded structs are flattened like encoding/json
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for k, v := range jsonFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// convertKeys rename keys of json objects decoded from struct type t, between json tags and canonical keys.
+// keys of maps are data, they are never renamed. paths of keys not known are appended to unknown
+func convertKeys(v interface{}, t reflect.Type, toCanonical bool, path string, unknown *[]string) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		keys := make(map[string]string)
+		types := make(map[string]reflect.Type)
+		for name, ft := range jsonFields(t) {
+			from, to := name, canonicalKey(name)
+			if !toCanonical {
+				from, to = to, from
+			}
+			keys[from], types[from] = to, ft
+		}
+		r := make(map[string]interface{}, len(obj))
+		for k, value := range obj {
+			to, ok := keys[k]
+			if !ok {
+				if unknown != nil {
+					*unknown = append(*unknown, path+"/"+k)
+				}
+				r[k] = value
+				continue
+			}
+			r[to] = convertKeys(value, types[k], toCanonical, path+"/"+k, unknown)
+		}
+		return r
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for k, value := range obj {
+			obj[k] = convertKeys(value, t.Elem(), toCanonical, path+"/"+k, unknown)
+		}
+		return obj
+	case reflect.Slice, reflect.Array:
+		arr, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+		for i := range arr {
+			arr[i] = convertKeys(arr[i], t.Elem(), toCanonical, fmt.Sprintf("%s/%d", path, i), unknown)
+		}
+		return arr
+	}
+	return v
+}
+
+// LoadConfigTree load config tree from store and local config file of proxy, iniFile is optional.
+// secrets are kept as they are stored. lost is json keys, xml elements and attributes in source which are not
+// known by models, they are not kept in config tree
+func LoadConfigTree(store *Store, iniFile string) (t *ConfigTree, lost []string, err error) {
+	if err = store.VerifySchemaVersion(); err != nil {
+		return nil, nil, err
+	}
+	t = &ConfigTree{Version: SchemaVersion}
+	if iniFile != "" {
+		if t.Proxy, err = loadINI(iniFile); err != nil {
+			return nil, nil, fmt.Errorf("load %s error: %v", iniFile, err)
+		}
+	}
+
+	load := func(path string, decode func([]byte) (interface{}, error), lostFields func(src, dst []byte) ([]string, error)) error {
+		snapshot, err := store.Snapshot(path)
+		if err != nil {
+			return err
+		}
+		src := snapshot[path]
+		if src == nil {
+			return fmt.Errorf("node %s not exists", path)
+		}
+		v, err := decode(src)
+		if err != nil {
+			return fmt.Errorf("decode %s error: %v", path, err)
+		}
+		dst, err := encodeSource(v)
+		if err != nil {
+			return err
+		}
+		fields, err := lostFields(src, dst)
+		if err != nil {
+			return fmt.Errorf("compare %s error: %v", path, err)
+		}
+		for _, f := range fields {
+			lost = append(lost, path+": "+f)
+		}
+		return nil
+	}
+
+	names, err := listNames(store.ListNamespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range names {
+		n := &Namespace{}
+		err := load(store.NamespacePath(name), func(b []byte) (interface{}, error) { return n, json.Unmarshal(b, n) }, lostJSONFields)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.Namespaces = append(t.Namespaces, n)
+	}
+
+	names, err = listNames(store.ListWhiteList)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range names {
+		w := &WhiteList{Name: name}
+		err := load(store.WhiteListPath(name), func(b []byte) (interface{}, error) { return &w.Records, json.Unmarshal(b, &w.Records) }, lostJSONFields)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.WhiteLists = append(t.WhiteLists, w)
+	}
+
+	ruleList := &RuleList{}
+	err = load(store.RuleListPath(RuleListsName), func(b []byte) (interface{}, error) { return ruleList, xml.Unmarshal(b, ruleList) }, lostXMLFields)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, record := range ruleList.Records {
+		f := &FilterList{}
+		err := load(store.RuleListPath(record.FileName), func(b []byte) (interface{}, error) { return f, xml.Unmarshal(b, f) }, lostXMLFields)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.Rules = append(t.Rules, &Rule{RuleListRecord: record, Filters: f.Filters})
+	}
+
+	dbs := &DataBases{}
+	err = load(store.DBPath(DataBasesName), func(b []byte) (interface{}, error) { return dbs, xml.Unmarshal(b, dbs) }, lostXMLFields)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.DataBases = dbs.DBS
+	return t, lost, nil
+}
+
+// listNames return names listed, missing directory means no names
+func listNames(list func() ([]string, error)) ([]string, error) {
+	names, err := list()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// encodeSource encode model in format of source file
+func encodeSource(v interface{}) ([]byte, error) {
+	switch v.(type) {
+	case *RuleList, *FilterList, *DataBases:
+		return xml.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// ConfigTreePaths return paths in store written or deleted by importing t: configs in tree, configs in store
+// not in tree, index of rule files, databases and schema version
+func ConfigTreePaths(store *Store, t *ConfigTree) ([]string, error) {
+	seen := make(map[string]bool)
+	var paths []string
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	namespaces, err := listNames(store.ListNamespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range namespaces {
+		add(store.NamespacePath(name))
+	}
+	for _, n := range t.Namespaces {
+		add(store.NamespacePath(n.Name))
+	}
+
+	whiteLists, err := listNames(store.ListWhiteList)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range whiteLists {
+		add(store.WhiteListPath(name))
+	}
+	for _, w := range t.WhiteLists {
+		add(store.WhiteListPath(w.Name))
+	}
+
+	files, err := storedRuleFiles(store)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		add(store.RuleListPath(file))
+	}
+	for _, r := range t.Rules {
+		add(store.RuleListPath(r.FileName))
+	}
+
+	add(store.RuleListPath(RuleListsName))
+	add(store.DBPath(DataBasesName))
+	add(store.SchemaVersionPath())
+	return paths, nil
+}
+
+// storedRuleFiles return file names of rules in index of rule files in store, missing index means no rules
+func storedRuleFiles(store *Store) ([]string, error) {
+	path := store.RuleListPath(RuleListsName)
+	snapshot, err := store.Snapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot[path] == nil {
+		return nil, nil
+	}
+	ruleList := &RuleList{}
+	if err := xml.Unmarshal(snapshot[path], ruleList); err != nil {
+		return nil, fmt.Errorf("decode %s error: %v", path, err)
+	}
+	files := make([]string, 0, len(ruleList.Records))
+	for _, r := range ruleList.Records {
+		files = append(files, r.FileName)
+	}
+	return files, nil
+}
+
+// ImportConfigTree replace config in store with config tree, configs in store not in tree are deleted.
+// config is loaded again after written and must be the same as tree, if any write failed or config is not the same,
+// config in store is restored. proxy config in tree is not written to store.
+func ImportConfigTree(store *Store, t *ConfigTree) error {
+	if err := t.Verify(); err != nil {
+		return fmt.Errorf("verify config error: %v", err)
+	}
+	expected, err := normalizeConfigTree(t)
+	if err != nil {
+		return err
+	}
+	paths, err := ConfigTreePaths(store, t)
+	if err != nil {
+		return err
+	}
+	snapshot, err := store.Snapshot(paths...)
+	if err != nil {
+		return fmt.Errorf("read config before import error: %v", err)
+	}
+
+	err = writeConfigTree(store, t)
+	if err == nil {
+		err = verifyWrittenConfigTree(store, expected)
+	}
+	if err == nil {
+		return nil
+	}
+	if e := store.Restore(snapshot); e != nil {
+		return fmt.Errorf("%v, restore config error: %v", err, e)
+	}
+	return fmt.Errorf("%v, config is restored", err)
+}
+
+// verifyWrittenConfigTree load config written and compare it with expected one
+func verifyWrittenConfigTree(store *Store, expected *ConfigTree) error {
+	written, _, err := LoadConfigTree(store, "")
+	if err != nil {
+		return fmt.Errorf("load written config error: %v", err)
+	}
+	written.Proxy = expected.Proxy
+	if written, err = normalizeConfigTree(written); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(expected, written) {
+		return fmt.Errorf("config loaded after written is not the same as config imported")
+	}
+	return nil
+}
+
+// normalizeConfigTree return copy of t in form returned by LoadConfigTree: namespaces and white lists are
+// sorted by name, empty slices and maps are nil
+func normalizeConfigTree(t *ConfigTree) (*ConfigTree, error) {
+	b, err := EncodeConfigTree(t)
+	if err != nil {
+		return nil, err
+	}
+	c, err := DecodeConfigTree(b)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(c.Namespaces, func(i, j int) bool { return c.Namespaces[i].Name < c.Namespaces[j].Name })
+	sort.Slice(c.WhiteLists, func(i, j int) bool { return c.WhiteLists[i].Name < c.WhiteLists[j].Name })
+	nilEmpty(reflect.ValueOf(c))
+	return c, nil
+}
+
+// nilEmpty set empty slices and maps reachable from v to nil, json and xml decoders don't agree on them
+func nilEmpty(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			nilEmpty(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				nilEmpty(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			nilEmpty(v.Index(i))
+		}
+	case reflect.Map:
+		if v.Len() == 0 {
+			v.Set(reflect.Zero(v.Type()))
+		}
+	}
+}
+
+// writeConfigTree write config in store from config tree and delete configs in store not in tree.
+// rule files are written before index of rule files, and databases are written last, so that references are valid;
+// configs not in tree are deleted after that
+func writeConfigTree(store *Store, t *ConfigTree) error {
+	namespaces, err := listNames(store.ListNamespace)
+	if err != nil {
+		return err
+	}
+	whiteLists, err := listNames(store.ListWhiteList)
+	if err != nil {
+		return err
+	}
+	files, err := storedRuleFiles(store)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	for _, n := range t.Namespaces {
+		if err := store.UpdateNamespace(n); err != nil {
+			return fmt.Errorf("write namespace %s error: %v", n.Name, err)
+		}
+		keep[store.NamespacePath(n.Name)] = true
+	}
+	for _, w := range t.WhiteLists {
+		if err := store.UpdateWhiteList(w); err != nil {
+			return fmt.Errorf("write white list %s error: %v", w.Name, err)
+		}
+		keep[store.WhiteListPath(w.Name)] = true
+	}
+	ruleList := &RuleList{}
+	for _, r := range t.Rules {
+		if err := store.UpdateRule(r.FileName, &FilterList{Filters: r.Filters}); err != nil {
+			return fmt.Errorf("write rule %s error: %v", r.Name, err)
+		}
+		ruleList.Records = append(ruleList.Records, r.RuleListRecord)
+		keep[store.RuleListPath(r.FileName)] = true
+	}
+	if err := store.UpdateRuleLists(ruleList); err != nil {
+		return fmt.Errorf("write index of rule files error: %v", err)
+	}
+	if err := store.UpdateDataBases(&DataBases{DBS: t.DataBases}); err != nil {
+		return fmt.Errorf("write databases error: %v", err)
+	}
+
+	for _, name := range namespaces {
+		if !keep[store.NamespacePath(name)] {
+			if err := store.DelNamespace(name); err != nil {
+				return fmt.Errorf("delete namespace %s error: %v", name, err)
+			}
+		}
+	}
+	for _, name := range whiteLists {
+		if !keep[store.WhiteListPath(name)] {
+			if err := store.DelWhiteList(name); err != nil {
+				return fmt.Errorf("delete white list %s error: %v", name, err)
+			}
+		}
+	}
+	for _, file := range files {
+		if !keep[store.RuleListPath(file)] {
+			if err := store.DelRule(file); err != nil {
+				return fmt.Errorf("delete rule file %s error: %v", file, err)
+			}
+		}
+	}
+	if err := store.UpdateSchemaVersion(); err != nil {
+		return fmt.Errorf("write schema version error: %v", err)
+	}
+	return nil
+}
+
+// Verify verify all configs in tree and references between them
+func (t *ConfigTree) Verify() error {
+	if t.Version != SchemaVersion {
+		return fmt.Errorf("unsupported schema version %d, supported: %d", t.Version, SchemaVersion)
+	}
+	if t.Proxy != nil {
+		if _, err := parseINI(t.Proxy); err != nil {
+			return fmt.Errorf("proxy config error: %v", err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, n := range t.Namespaces {
+		if names[n.Name] {
+			return fmt.Errorf("namespace %s duped", n.Name)
+		}
+		names[n.Name] = true
+		if err := n.Verify(); err != nil {
+			return fmt.Errorf("namespace %s error: %v", n.Name, err)
+		}
+	}
+
+	whiteLists := make(map[string]bool)
+	for _, w := range t.WhiteLists {
+		if whiteLists[w.Name] {
+			return fmt.Errorf("white list %s duped", w.Name)
+		}
+		whiteLists[w.Name] = true
+		if err := w.Verify(); err != nil {
+			return err
+		}
+	}
+
+	ruleList := &RuleList{}
+	rules := make(map[string]bool)
+	files := make(map[string]bool)
+	for _, r := range t.Rules {
+		if rules[r.Name] || files[r.FileName] {
+			return fmt.Errorf("rule %s or file %s duped", r.Name, r.FileName)
+		}
+		rules[r.Name], files[r.FileName] = true, true
+		if IsReservedName(r.FileName) {
+			return fmt.Errorf("invalid file name of rule %s: %s", r.Name, r.FileName)
+		}
+		if err := (&FilterList{Name: r.Name, Filters: r.Filters}).Verify(); err != nil {
+			return fmt.Errorf("rule %s error: %v", r.Name, err)
+		}
+		ruleList.Records = append(ruleList.Records, r.RuleListRecord)
+	}
+	if err := ruleList.Verify(); err != nil {
+		return fmt.Errorf("index of rule files error: %v", err)
+	}
+
+	dbs := &DataBases{DBS: t.DataBases}
+	if err := dbs.Verify(); err != nil {
+		return err
+	}
+	for _, d := range t.DataBases {
+		if d.Namespace != "" && !names[d.Namespace] {
+			return fmt.Errorf("namespace %s of database %s not found", d.Namespace, d.MaskDatabaseName)
+		}
+		if !rules[d.Security.Rule] {
+			return fmt.Errorf("rule %s of database %s not found", d.Security.Rule, d.MaskDatabaseName)
+		}
+		if d.WhiteList.File != "" && !whiteLists[d.WhiteList.File] {
+			return fmt.Errorf("white list %s of database %s not found", d.WhiteList.File, d.MaskDatabaseName)
+		}
+	}
+	return nil
+}
+
+// loadINI return keys of ini file, keys not in default section are <section>.<key>
+func loadINI(file string) (map[string]string, error) {
+	cfg, err := ini.Load(file)
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[string]string)
+	for _, section := range cfg.Sections() {
+		prefix := ""
+		if section.Name() != ini.DEFAULT_SECTION {
+			prefix = section.Name() + "."
+		}
+		for _, key := range section.Keys() {
+			r[prefix+key.Name()] = key.Value()
+		}
+	}
+	return r, nil
+}
+
+// EncodeINI encode keys of ini in config tree as ini file
+func EncodeINI(keys map[string]string, w io.Writer) error {
+	cfg := ini.Empty()
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		section, key := ini.DEFAULT_SECTION, name
+		if i := strings.LastIndex(name, "."); i > 0 {
+			section, key = name[:i], name[i+1:]
+		}
+		if _, err := cfg.Section(section).NewKey(key, keys[name]); err != nil {
+			return err
+		}
+	}
+	_, err := cfg.WriteTo(w)
+	return err
+}
+
+// parseINI map keys of ini in config tree to proxy config
+func parseINI(keys map[string]string) (*Proxy, error) {
+	var buf bytes.Buffer
+	if err := EncodeINI(keys, &buf); err != nil {
+		return nil, err
+	}
+	cfg, err := ini.Load(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{}
+	if err = cfg.MapTo(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// lostJSONFields return paths of keys in src json which are not in dst json
+func lostJSONFields(src, dst []byte) ([]string, error) {
+	var s, d interface{}
+	if err := json.Unmarshal(src, &s); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(dst, &d); err != nil {
+		return nil, err
+	}
+	var lost []string
+	var walk func(path string, s, d interface{})
+	walk = func(path string, s, d interface{}) {
+		switch sv := s.(type) {
+		case map[string]interface{}:
+			dv, _ := d.(map[string]interface{})
+			for k, v := range sv {
+				dvv, ok := dv[k]
+				if !ok {
+					lost = append(lost, path+"/"+k)
+					continue
+				}
+				walk(path+"/"+k, v, dvv)
+			}
+		case []interface{}:
+			dv, _ := d.([]interface{})
+			for i, v := range sv {
+				if i < len(dv) {
+					walk(fmt.Sprintf("%s/%d", path, i), v, dv[i])
+				}
+			}
+		}
+	}
+	walk("", s, d)
+	sort.Strings(lost)
+	return lost, nil
+}
+
+// lostXMLFields return paths of elements and attributes in src xml which are not in dst xml, root element is
+// not compared since its name is not kept by models
+func lostXMLFields(src, dst []byte) ([]string, error) {
+	s, err := xmlFields(src)
+	if err != nil {
+		return nil, err
+	}
+	d, err := xmlFields(dst)
+	if err != nil {
+		return nil, err
+	}
+	var lost []string
+	for f := range s {
+		if !d[f] {
+			lost = append(lost, f)
+		}
+	}
+	sort.Strings(lost)
+	return lost, nil
+}
+
+// xmlFields return paths of elements and attributes, e.g. /Filter/Action/Mask@function. elements with text are
+// returned with suffix #text
+func xmlFields(data []byte) (map[string]bool, error) {
+	fields := make(map[string]bool)
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var path []string
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch e := tok.(type) {
+		case xml.StartElement:
+			path = append(path, e.Name.Local)
+			p := "/" + strings.Join(path[1:], "/")
+			if len(path) > 1 {
+				fields[p] = true
+			}
+			for _, a := range e.Attr {
+				fields[p+"@"+a.Name.Local] = true
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+		case xml.CharData:
+			if len(path) > 1 && len(bytes.TrimSpace(e)) > 0 {
+				fields["/"+strings.Join(path[1:], "/")+"#text"] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var legacyTree = map[string]string{
+	"namespace/ns1": `{"name": "ns1", "proxyPort": 13306, "allowedDbs": {"db1": true}, "default_phy_dbs": {"db1": "db1"},
+		"slow_sql_time": "1000", "db": {"userName": "root", "password": "root", "master": "127.0.0.1:3306", "capacity": 16, "maxCapacity": 32, "idleTimeout": 60},
+		"users": [{"userName": "u1", "password": "p1", "Namespace": "ns1", "rw_flag": 2}], "default_charset": "utf8", "default_collation": "utf8_general_ci"}`,
+	"white_list/wl1":  `[{"ipList": ["127.0.0.1"], "user": "u1", "fromTime": "2019-01-01 00:00:00", "toTime": "2029-01-01 00:00:00", "rules": ""}]`,
+	"mysql_rules.xml": `<Rules><Rule id="1" name="r1" file_name="r1.xml"/></Rules>`,
+	"r1.xml": `<FilterList><Filter name="f1"><Action><Mask useTemplate="0" function="MASK_ALL" schemaName="db1" databasename="db1"
+		table_name="t1" column_name="c1"/></Action></Filter></FilterList>`,
+	"databases.xml": `<Databases><Database namespace="ns1" mask_database_name="db1" database_name="db1" address="" port="0" user_name="" password="">
+		<Whitelist file="wl1"/><Security rule="r1"/></Database></Databases>`,
+}
+
+func newLegacyTree(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range legacyTree {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ini := filepath.Join(dir, "mymask.ini")
+	ioutil.WriteFile(ini, []byte("config_type=file\nfile_config_path="+dir+"\nadmin_addr=0.0.0.0:13307\n"), 0644)
+	return NewStore(NewClient(ConfigFile, "", "", "", dir)), dir
+}
+
+func TestCanonicalKey(t *testing.T) {
+	tests := map[string]string{
+		"proxyPort":       "proxy_port",
+		"default_phy_dbs": "default_phy_dbs",
+		"DatabaseName":    "database_name",
+		"ipList":          "ip_list",
+		"ID":              "id",
+		"maxCapacity":     "max_capacity",
+		"Namespace":       "namespace",
+	}
+	for tag, expect := range tests {
+		if actual := canonicalKey(tag); actual != expect {
+			t.Errorf("canonical key of %s not equal, expect: %s, actual: %s", tag, expect, actual)
+		}
+	}
+
+	// canonical keys of fields in the same struct must be unique, otherwise they could not be converted back
+	visited := make(map[reflect.Type]bool)
+	var check func(typ reflect.Type)
+	check = func(typ reflect.Type) {
+		for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Map {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct || visited[typ] {
+			return
+		}
+		visited[typ] = true
+		keys := make(map[string]string)
+		for name, ft := range jsonFields(typ) {
+			key := canonicalKey(name)
+			if other, ok := keys[key]; ok {
+				t.Errorf("fields %s and %s of %s have the same canonical key %s", name, other, typ, key)
+			}
+			keys[key] = name
+			check(ft)
+		}
+	}
+	check(configTreeType)
+}
+
+func TestConfigTree(t *testing.T) {
+	store, dir := newLegacyTree(t)
+	defer os.RemoveAll(dir)
+
+	tree, lost, err := LoadConfigTree(store, filepath.Join(dir, "mymask.ini"))
+	if err != nil {
+		t.Fatalf("load config tree error: %v", err)
+	}
+	if len(lost) != 1 || lost[0] != filepath.Join(dir, "r1.xml")+": /Filter/Action/Mask@useTemplate" {
+		t.Errorf("lost fields not equal, actual: %v", lost)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatalf("verify config tree error: %v", err)
+	}
+	if tree.Proxy["config_type"] != "file" || tree.DataBases[0].DatabaseName != "db1" || tree.Rules[0].Filters[0].Action.Mask.TableName != "t1" {
+		t.Errorf("config tree not equal: %+v", tree)
+	}
+
+	data, err := EncodeConfigTree(tree)
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	for _, key := range []string{`"proxy_port"`, `"allowed_dbs"`, `"max_capacity"`, `"ip_list"`, `"database_name"`, `"file_name"`, `"db1": true`} {
+		if !bytes.Contains(data, []byte(key)) {
+			t.Errorf("%s not found in canonical schema", key)
+		}
+	}
+	for _, key := range []string{`"proxyPort"`, `"userName"`, `"DatabaseName"`} {
+		if bytes.Contains(data, []byte(key)) {
+			t.Errorf("%s should not be in canonical schema", key)
+		}
+	}
+
+	decoded, err := DecodeConfigTree(data)
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if !reflect.DeepEqual(tree, decoded) {
+		t.Errorf("config tree changed after encoding\nexpect: %s\nactual: %s", JSONEncode(tree), JSONEncode(decoded))
+	}
+
+	if _, err := DecodeConfigTree(bytes.Replace(data, []byte(`"version": 1`), []byte(`"version": 2`), 1)); err == nil {
+		t.Errorf("decode other version should fail")
+	}
+	if _, err := DecodeConfigTree(bytes.Replace(data, []byte(`"proxy_port"`), []byte(`"proxyPort"`), 1)); err == nil ||
+		!strings.Contains(err.Error(), "proxyPort") {
+		t.Errorf("decode unknown key should fail, err: %v", err)
+	}
+
+	// write to another tree and load it again
+	target, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(target)
+	for _, sub := range []string{"namespace", "white_list"} {
+		os.MkdirAll(filepath.Join(target, sub), 0755)
+	}
+	written := NewStore(NewClient(ConfigFile, "", "", "", target))
+	if err := ImportConfigTree(written, decoded); err != nil {
+		t.Fatalf("write config tree error: %v", err)
+	}
+	loaded, lost, err := LoadConfigTree(written, "")
+	if err != nil || len(lost) != 0 {
+		t.Fatalf("load written config tree error: %v, lost: %v", err, lost)
+	}
+	loaded.Proxy = decoded.Proxy
+	if !reflect.DeepEqual(decoded, loaded) {
+		t.Errorf("written config tree not equal\nexpect: %s\nactual: %s", JSONEncode(decoded), JSONEncode(loaded))
+	}
+
+	// references are verified
+	decoded.DataBases[0].Security.Rule = "r2"
+	if err := decoded.Verify(); err == nil {
+		t.Errorf("verify database with missing rule should fail")
+	}
+}
+
+func TestImportConfigTree(t *testing.T) {
+	store, dir := newLegacyTree(t)
+	defer os.RemoveAll(dir)
+	tree, _, err := LoadConfigTree(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stale configs are deleted, schema version is written
+	stale := map[string]string{
+		"namespace/ns2":   strings.Replace(legacyTree["namespace/ns1"], `"ns1"`, `"ns2"`, -1),
+		"white_list/wl2":  legacyTree["white_list/wl1"],
+		"r2.xml":          legacyTree["r1.xml"],
+		"mysql_rules.xml": `<Rules><Rule id="1" name="r1" file_name="r1.xml"/><Rule id="2" name="r2" file_name="r2.xml"/></Rules>`,
+	}
+	for path, data := range stale {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ImportConfigTree(store, tree); err != nil {
+		t.Fatalf("import config tree error: %v", err)
+	}
+	for _, path := range []string{"namespace/ns2", "white_list/wl2", "r2.xml"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("stale config %s should be deleted, err: %v", path, err)
+		}
+	}
+	if version, err := store.LoadSchemaVersion(); err != nil || version != SchemaVersion {
+		t.Errorf("schema version not equal, actual: %d, err: %v", version, err)
+	}
+
+	// config is restored if any write failed
+	before, err := store.Snapshot(store.NamespacePath("ns1"), store.RuleListPath(RuleListsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, _, _ := LoadConfigTree(store, "")
+	changed.Namespaces[0].SlowSQLTime = "2000"
+	// stale white list of invalid name could not be deleted, it's deleted after all configs written
+	if err := ioutil.WriteFile(filepath.Join(dir, "white_list", "bad name"), []byte(legacyTree["white_list/wl1"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportConfigTree(store, changed); err == nil || !strings.Contains(err.Error(), "restored") {
+		t.Fatalf("import should fail and be restored if stale white list could not be deleted, err: %v", err)
+	}
+	after, _ := store.Snapshot(store.NamespacePath("ns1"), store.RuleListPath(RuleListsName))
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("config should be restored after import failed")
+	}
+	os.Remove(filepath.Join(dir, "white_list", "bad name"))
+
+	// written config must be the same as imported
+	expected, err := normalizeConfigTree(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyWrittenConfigTree(store, expected); err == nil {
+		t.Errorf("config not written should not be verified")
+	}
+
+	// config of other schema version is not loaded
+	ioutil.WriteFile(store.SchemaVersionPath(), []byte(`{"version": 2}`), 0644)
+	if _, _, err := LoadConfigTree(store, ""); err == nil {
+		t.Errorf("load config of other schema version should fail")
+	}
+}
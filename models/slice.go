@@ -26,6 +26,36 @@ type Slice struct {
 	Capacity    int `json:"capacity"`    // connection pool capacity
 	MaxCapacity int `json:"maxCapacity"` // max connection pool capacity
 	IdleTimeout int `json:"idleTimeout"` // close backend direct connection after idle_timeout,unit: seconds
+
+	HealthCheck *HealthCheck `json:"health_check"` // optional, nodes are never ejected if not set
+}
+
+// HealthCheck means health check config of nodes in slice
+type HealthCheck struct {
+	Interval          int     `json:"interval"`            // active check interval, 0 means active check is disabled, unit: seconds
+	CheckSQL          string  `json:"check_sql"`           // sql executed after ping in active check, optional
+	MaxReplicationLag int     `json:"max_replication_lag"` // slave lagging more is not used for read, 0 means no limit, unit: seconds
+	ErrorRate         float64 `json:"error_rate"`          // node is ejected if error rate in window exceeds it, 0 means passive check is disabled
+	MinRequests       int     `json:"min_requests"`        // min requests in window to calculate error rate
+	Window            int     `json:"window"`              // window of passive check, unit: seconds
+	EjectTime         int     `json:"eject_time"`          // ejection time, doubled for each consecutive ejection, unit: seconds
+	MaxEjectTime      int     `json:"max_eject_time"`      // max ejection time, unit: seconds
+}
+
+func (h *HealthCheck) verify() error {
+	if h.Interval < 0 || h.MaxReplicationLag < 0 || h.MinRequests < 0 || h.Window < 0 || h.EjectTime < 0 || h.MaxEjectTime < 0 {
+		return errors.New("health check config should be >= 0")
+	}
+
+	if h.ErrorRate < 0 || h.ErrorRate > 1 {
+		return errors.New("health check error rate should be in [0, 1]")
+	}
+
+	if h.MaxReplicationLag > 0 && h.Interval == 0 {
+		return errors.New("max replication lag needs active health check, interval should be > 0")
+	}
+
+	return nil
 }
 
 func (s *Slice) verify() error {
@@ -33,8 +63,9 @@ func (s *Slice) verify() error {
 		return errors.New("missing user")
 	}
 
-	if len(s.Slaves) == 0 && len(s.Master) == 0 {
-		return errors.New("slaves empty")
+	// slice of slaves only is valid, reads go to slaves and writes are rejected
+	if len(s.Master) == 0 && len(s.Slaves) == 0 {
+		return errors.New("missing master and slaves")
 	}
 
 	for _, slave := range s.Slaves {
@@ -51,5 +82,11 @@ func (s *Slice) verify() error {
 		return errors.New("max connection pool capactiy should be > 0")
 	}
 
+	if s.HealthCheck != nil {
+		if err := s.HealthCheck.verify(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
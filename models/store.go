@@ -17,20 +17,69 @@ package models
 import (
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/ZzzYtl/MyMask/log"
+	etcdclient "github.com/ZzzYtl/MyMask/models/etcd"
 	fileclient "github.com/ZzzYtl/MyMask/models/file"
 )
 
 // config type
 const (
 	ConfigFile = "file"
+	ConfigEtcd = "etcd"
 )
 
+// names of config documents in root directory
+const (
+	RuleListsName     = "mysql_rules.xml"
+	DataBasesName     = "databases.xml"
+	RolloutLockName   = "rollout.lock"
+	SchemaVersionName = "schema_version"
+)
+
+// IsReservedName return true if name is used by documents or directories in root directory,
+// so it could not be file name of rule
+func IsReservedName(name string) bool {
+	switch name {
+	case RuleListsName, DataBasesName, RolloutLockName, SchemaVersionName, "namespace", "white_list", "proxy", "rollout":
+		return true
+	}
+	return false
+}
+
+// maxConfigNameLen is max length of names of rule files and white lists
+const maxConfigNameLen = 128
+
+// VerifyConfigName check name of rule file or white list, which is used as file name or key in store,
+// so it must be one path segment of letters, digits, '_', '-' and '.', and could not start with '.'
+func VerifyConfigName(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s name is empty", kind)
+	}
+	if len(name) > maxConfigNameLen || name[0] == '.' {
+		return fmt.Errorf("invalid %s name: %q", kind, name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return fmt.Errorf("invalid %s name: %q", kind, name)
+		}
+	}
+	return nil
+}
+
+// ErrRolloutLocked means another rollout is running in the cluster
+var ErrRolloutLocked = errors.New("another rollout is running")
+
+// ErrNoHistory means client doesn't keep history versions of config
+var ErrNoHistory = errors.New("history is not supported by config client")
+
 // Client client interface
 type Client interface {
 	Create(path string, data []byte) error
@@ -43,6 +92,19 @@ type Client interface {
 	BasePrefix() string
 }
 
+// VersionedClient is client keeping history versions of config, such as file client
+type VersionedClient interface {
+	History(path string) ([]string, error)
+	ReadVersion(path, version string) ([]byte, error)
+	Rollback(path, version string) error
+}
+
+// WatchClient is client notifying changes of config
+type WatchClient interface {
+	// Watch send changed paths under dir to the returned channel until stop is closed, the channel is closed then
+	Watch(dir string, stop <-chan struct{}) (<-chan string, error)
+}
+
 // Store means exported client to use
 type Store struct {
 	client Client
@@ -50,13 +112,35 @@ type Store struct {
 }
 
 // NewClient constructor to create client by case etcd/file/zk etc.
-func NewClient(configType, root string) Client {
-	c, err := fileclient.New(root)
-	if err != nil {
-		log.Warn("create fileclient failed")
-		return nil
+// root is directory of config files if config type is file, or key prefix of config in etcd.
+func NewClient(configType, addr, username, password, root string) Client {
+	switch configType {
+	case ConfigFile:
+		c, err := fileclient.New(root)
+		if err != nil {
+			log.Warn("create fileclient failed, root: %s, err: %v", root, err)
+			return nil
+		}
+		return c
+	case ConfigEtcd:
+		c, err := etcdclient.New(addr, username, password, root)
+		if err != nil {
+			log.Warn("create etcdclient failed, addr: %s, err: %v", addr, err)
+			return nil
+		}
+		return c
+	}
+	log.Warn("invalid config type: %s", configType)
+	return nil
+}
+
+// Watch send changed paths of config to the returned channel until stop is closed
+func (s *Store) Watch(stop <-chan struct{}) (<-chan string, error) {
+	w, ok := s.client.(WatchClient)
+	if !ok {
+		return nil, fmt.Errorf("watch is not supported by config client")
 	}
-	return c
+	return w.Watch(s.prefix, stop)
 }
 
 // NewStore constructor of Store
@@ -115,8 +199,11 @@ func (s *Store) ListNamespace() ([]string, error) {
 	return files, nil
 }
 
-// LoadNamespace load namespace value
-func (s *Store) LoadNamespace(key, name string) (*Namespace, error) {
+// LoadNamespace load namespace value, secrets are decrypted by c
+func (s *Store) LoadNamespace(c *Cipher, name string) (*Namespace, error) {
+	if err := VerifyConfigName("namespace", name); err != nil {
+		return nil, err
+	}
 	b, err := s.client.Read(s.NamespacePath(name))
 	if err != nil {
 		return nil, err
@@ -135,7 +222,7 @@ func (s *Store) LoadNamespace(key, name string) (*Namespace, error) {
 		return nil, err
 	}
 
-	if err = p.Decrypt(key); err != nil {
+	if err = p.Decrypt(c); err != nil {
 		return nil, err
 	}
 
@@ -144,14 +231,278 @@ func (s *Store) LoadNamespace(key, name string) (*Namespace, error) {
 
 // UpdateNamespace update namespace path with data
 func (s *Store) UpdateNamespace(p *Namespace) error {
+	if err := p.verifyName(); err != nil {
+		return err
+	}
 	return s.client.Update(s.NamespacePath(p.Name), p.Encode())
 }
 
 // DelNamespace delete namespace
 func (s *Store) DelNamespace(name string) error {
+	if err := (&Namespace{Name: name}).verifyName(); err != nil {
+		return err
+	}
 	return s.client.Delete(s.NamespacePath(name))
 }
 
+// History return history versions of config in path, the newest is the first
+func (s *Store) History(path string) ([]string, error) {
+	c, ok := s.client.(VersionedClient)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	return c.History(path)
+}
+
+// ReadVersion read history version of config in path
+func (s *Store) ReadVersion(path, version string) ([]byte, error) {
+	c, ok := s.client.(VersionedClient)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	return c.ReadVersion(path, version)
+}
+
+// Rollback restore config in path to history version
+func (s *Store) Rollback(path, version string) error {
+	c, ok := s.client.(VersionedClient)
+	if !ok {
+		return ErrNoHistory
+	}
+	return c.Rollback(path, version)
+}
+
+// RolloutBase return base path of rollout history
+func (s *Store) RolloutBase() string {
+	return filepath.Join(s.prefix, "rollout")
+}
+
+// RolloutPath concat rollout path
+func (s *Store) RolloutPath(id string) string {
+	return filepath.Join(s.prefix, "rollout", id)
+}
+
+// UpdateRollout create or update rollout record
+func (s *Store) UpdateRollout(r *Rollout) error {
+	return s.client.Update(s.RolloutPath(r.ID), r.Encode())
+}
+
+// ListRollout list ids of rollout records, oldest first
+func (s *Store) ListRollout() ([]string, error) {
+	files, err := s.client.List(s.RolloutBase())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for i := 0; i < len(files); i++ {
+		files[i] = filepath.Base(files[i])
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// LoadRollout load rollout record
+func (s *Store) LoadRollout(id string) (*Rollout, error) {
+	b, err := s.client.Read(s.RolloutPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("node %s not exists", s.RolloutPath(id))
+	}
+	r := &Rollout{}
+	if err := JSONDecode(r, b); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// DelRollout delete rollout record
+func (s *Store) DelRollout(id string) error {
+	return s.client.Delete(s.RolloutPath(id))
+}
+
+// SchemaVersionPath return path of schema version of config in store
+func (s *Store) SchemaVersionPath() string {
+	return filepath.Join(s.prefix, SchemaVersionName)
+}
+
+// LoadSchemaVersion return schema version of config in store, config without schema version is written
+// before versioning, which is version 1
+func (s *Store) LoadSchemaVersion() (int, error) {
+	b, err := s.client.Read(s.SchemaVersionPath())
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if b == nil {
+		return 1, nil
+	}
+	v := &struct {
+		Version int `json:"version"`
+	}{}
+	if err := JSONDecode(v, b); err != nil {
+		return 0, fmt.Errorf("decode schema version error: %v", err)
+	}
+	return v.Version, nil
+}
+
+// UpdateSchemaVersion write current schema version
+func (s *Store) UpdateSchemaVersion() error {
+	v := &struct {
+		Version int `json:"version"`
+	}{Version: SchemaVersion}
+	return s.client.Update(s.SchemaVersionPath(), JSONEncode(v))
+}
+
+// VerifySchemaVersion return error if config in store is in schema version not supported, e.g. written by newer gaea
+func (s *Store) VerifySchemaVersion() error {
+	version, err := s.LoadSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version != SchemaVersion {
+		return fmt.Errorf("config in store is in schema version %d, supported: %d", version, SchemaVersion)
+	}
+	return nil
+}
+
+// RolloutLockPath return path of rollout lock
+func (s *Store) RolloutLockPath() string {
+	return filepath.Join(s.prefix, RolloutLockName)
+}
+
+// LockRollout take rollout lock for rollout id, ErrRolloutLocked is returned if it's held by another rollout.
+// lock held longer than RolloutLockExpire is left by crashed cc, it's taken over.
+func (s *Store) LockRollout(id string) error {
+	lock := &RolloutLock{ID: id, Time: time.Now().Format(time.RFC3339)}
+	err := s.client.Create(s.RolloutLockPath(), lock.Encode())
+	if !isNodeExists(err) {
+		return err
+	}
+	held, err := s.loadRolloutLock()
+	if err != nil {
+		return err
+	}
+	if held != nil && !held.expired(time.Now()) {
+		return fmt.Errorf("%v, rollout %s holds the lock since %s", ErrRolloutLocked, held.ID, held.Time)
+	}
+	if held != nil {
+		log.Warn("rollout lock of %s taken at %s is expired, take it over", held.ID, held.Time)
+		if err := s.client.Delete(s.RolloutLockPath()); err != nil {
+			return err
+		}
+	}
+	err = s.client.Create(s.RolloutLockPath(), lock.Encode())
+	if isNodeExists(err) {
+		return ErrRolloutLocked
+	}
+	return err
+}
+
+// UnlockRollout release rollout lock if it's held by rollout id
+func (s *Store) UnlockRollout(id string) error {
+	held, err := s.loadRolloutLock()
+	if err != nil {
+		return err
+	}
+	if held == nil || held.ID != id {
+		return nil
+	}
+	return s.client.Delete(s.RolloutLockPath())
+}
+
+// RolloutLocked return true if rollout lock is held and not expired
+func (s *Store) RolloutLocked() (bool, error) {
+	held, err := s.loadRolloutLock()
+	if err != nil {
+		return false, err
+	}
+	return held != nil && !held.expired(time.Now()), nil
+}
+
+// loadRolloutLock return nil if lock is not held
+func (s *Store) loadRolloutLock() (*RolloutLock, error) {
+	b, err := s.client.Read(s.RolloutLockPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+	l := &RolloutLock{}
+	if err := JSONDecode(l, b); err != nil {
+		return nil, fmt.Errorf("decode rollout lock error: %v", err)
+	}
+	return l, nil
+}
+
+func isNodeExists(err error) bool {
+	return err == fileclient.ErrNodeExists || err == etcdclient.ErrNodeExists
+}
+
+// IsConfigPath return false if changed path sent by Watch is rollout lock, rollout record or proxy registration,
+// which are written by cc and proxies themselves and needn't config reloading
+func (s *Store) IsConfigPath(path string) bool {
+	if s.IsRolloutLockPath(path) {
+		return false
+	}
+	path = absPath(path)
+	for _, base := range []string{s.ProxyBase(), s.RolloutBase()} {
+		base = absPath(base)
+		if path == base || strings.HasPrefix(path, base+string(filepath.Separator)) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsRolloutLockPath return true if changed path sent by Watch is rollout lock
+func (s *Store) IsRolloutLockPath(path string) bool {
+	return absPath(path) == absPath(s.RolloutLockPath())
+}
+
+// absPath make paths sent by file client, which are absolute, comparable with paths of store
+func absPath(path string) string {
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return filepath.Clean(path)
+}
+
+// Snapshot read raw content of paths, content of path not exists is nil
+func (s *Store) Snapshot(paths ...string) (map[string][]byte, error) {
+	snapshot := make(map[string][]byte, len(paths))
+	for _, path := range paths {
+		b, err := s.client.Read(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		snapshot[path] = b
+	}
+	return snapshot, nil
+}
+
+// Restore write snapshot back, path not exists in snapshot is deleted
+func (s *Store) Restore(snapshot map[string][]byte) error {
+	for path, b := range snapshot {
+		var err error
+		if b == nil {
+			err = s.client.Delete(path)
+		} else {
+			err = s.client.Update(path, b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ListProxyMonitorMetrics list proxies in proxy register path
 func (s *Store) ListProxyMonitorMetrics() (map[string]*ProxyMonitorMetric, error) {
 	files, err := s.client.List(s.ProxyBase())
@@ -160,7 +511,8 @@ func (s *Store) ListProxyMonitorMetrics() (map[string]*ProxyMonitorMetric, error
 	}
 	proxy := make(map[string]*ProxyMonitorMetric)
 	for _, path := range files {
-		b, err := s.client.Read(path)
+		// file client lists names, etcd client lists full paths
+		b, err := s.client.Read(filepath.Join(s.ProxyBase(), filepath.Base(path)))
 		if err != nil {
 			return nil, err
 		}
@@ -198,6 +550,9 @@ func (s *Store) ListWhiteList() ([]string, error) {
 
 // LoadNamespace load namespace value
 func (s *Store) LoadWhiteList(key, name string) (*WhiteList, error) {
+	if err := VerifyConfigName("white list", name); err != nil {
+		return nil, err
+	}
 	b, err := s.client.Read(s.WhiteListPath(name))
 	if err != nil {
 		return nil, err
@@ -219,6 +574,22 @@ func (s *Store) LoadWhiteList(key, name string) (*WhiteList, error) {
 	return p, nil
 }
 
+// UpdateWhiteList update white list with records
+func (s *Store) UpdateWhiteList(p *WhiteList) error {
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	return s.client.Update(s.WhiteListPath(p.Name), p.Encode())
+}
+
+// DelWhiteList delete white list
+func (s *Store) DelWhiteList(name string) error {
+	if err := VerifyConfigName("white list", name); err != nil {
+		return err
+	}
+	return s.client.Delete(s.WhiteListPath(name))
+}
+
 // NamespaceBase return namespace path base
 func (s *Store) RuleListBase() string {
 	return filepath.Join(s.prefix, "")
@@ -231,7 +602,7 @@ func (s *Store) RuleListPath(name string) string {
 
 // LoadNamespace load namespace value
 func (s *Store) LoadRuleLists() (*RuleList, error) {
-	name := "mysql_rules.xml"
+	name := RuleListsName
 	b, err := s.client.Read(s.RuleListPath(name))
 	if err != nil {
 		return nil, err
@@ -254,6 +625,9 @@ func (s *Store) LoadRuleLists() (*RuleList, error) {
 
 // LoadNamespace load namespace value
 func (s *Store) LoadRule(key, name string) (*FilterList, error) {
+	if err := VerifyConfigName("rule file", name); err != nil {
+		return nil, err
+	}
 	b, err := s.client.Read(s.RuleListPath(name))
 	if err != nil {
 		return nil, err
@@ -275,6 +649,33 @@ func (s *Store) LoadRule(key, name string) (*FilterList, error) {
 	return p, nil
 }
 
+// UpdateRuleLists update index of rule files
+func (s *Store) UpdateRuleLists(p *RuleList) error {
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	return s.client.Update(s.RuleListPath(RuleListsName), p.Encode())
+}
+
+// UpdateRule update rule file, the file should be in index of rule files
+func (s *Store) UpdateRule(fileName string, p *FilterList) error {
+	if err := VerifyConfigName("rule file", fileName); err != nil {
+		return err
+	}
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	return s.client.Update(s.RuleListPath(fileName), p.Encode())
+}
+
+// DelRule delete rule file
+func (s *Store) DelRule(fileName string) error {
+	if err := VerifyConfigName("rule file", fileName); err != nil {
+		return err
+	}
+	return s.client.Delete(s.RuleListPath(fileName))
+}
+
 // NamespaceBase return namespace path base
 func (s *Store) DBBase() string {
 	return filepath.Join(s.prefix, "")
@@ -287,7 +688,7 @@ func (s *Store) DBPath(name string) string {
 
 // LoadNamespace load namespace value
 func (s *Store) LoadDataBases() ([]DataBase, error) {
-	name := "databases.xml"
+	name := DataBasesName
 	b, err := s.client.Read(s.DBPath(name))
 	if err != nil {
 		return nil, err
@@ -307,3 +708,11 @@ func (s *Store) LoadDataBases() ([]DataBase, error) {
 
 	return p.DBS, nil
 }
+
+// UpdateDataBases update database configs
+func (s *Store) UpdateDataBases(p *DataBases) error {
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	return s.client.Update(s.DBPath(DataBasesName), p.Encode())
+}
@@ -15,7 +15,12 @@
 package models
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func newTestStore() *Store {
@@ -49,3 +54,129 @@ func TestNamespacePath(t *testing.T) {
 		t.Fatalf("test NamespacePath failed, %v", path)
 	}
 }
+
+func TestVerifyConfigName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"r1.xml", true},
+		{"white_list-1", true},
+		{"", false},
+		{".hidden", false},
+		{"..", false},
+		{"../namespace/ns1", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a b", false},
+	}
+	for _, test := range tests {
+		if err := VerifyConfigName("rule file", test.name); (err == nil) != test.valid {
+			t.Errorf("verify name %q not equal, expect valid: %v, err: %v", test.name, test.valid, err)
+		}
+	}
+
+	// names are checked again before joined into path
+	store := newTestStore()
+	defer store.Close()
+	if err := store.DelWhiteList("../namespace/ns1"); err == nil {
+		t.Errorf("delete white list with invalid name should fail")
+	}
+	if err := store.UpdateRule("../databases.xml", &FilterList{}); err == nil {
+		t.Errorf("update rule with invalid file name should fail")
+	}
+	for _, name := range []string{"../databases.xml", "../mysql_rules.xml", DataBasesName, "proxy"} {
+		if err := store.DelNamespace(name); err == nil {
+			t.Errorf("delete namespace %q should fail", name)
+		}
+		if err := (&Namespace{Name: name}).verifyName(); err == nil {
+			t.Errorf("namespace name %q should be invalid", name)
+		}
+	}
+}
+
+func TestRolloutLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollout_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(NewClient(ConfigFile, "", "", "", dir))
+
+	// only one of concurrent rollouts takes the lock
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var owners []string
+	for _, id := range []string{"r1", "r2", "r3", "r4"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := store.LockRollout(id); err == nil {
+				mu.Lock()
+				owners = append(owners, id)
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+	if len(owners) != 1 {
+		t.Fatalf("lock should be taken by one rollout, actual: %v", owners)
+	}
+	if locked, err := store.RolloutLocked(); err != nil || !locked {
+		t.Errorf("rollout should be locked, err: %v", err)
+	}
+
+	// lock is not released by other rollout
+	if err := store.UnlockRollout("other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LockRollout("other"); err == nil {
+		t.Errorf("lock should be held by %s", owners[0])
+	}
+	if err := store.UnlockRollout(owners[0]); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := store.RolloutLocked(); locked {
+		t.Errorf("rollout should be unlocked")
+	}
+
+	// expired lock is taken over
+	stale := &RolloutLock{ID: "crashed", Time: time.Now().Add(-RolloutLockExpire - time.Minute).Format(time.RFC3339)}
+	if err := ioutil.WriteFile(store.RolloutLockPath(), stale.Encode(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := store.RolloutLocked(); locked {
+		t.Errorf("expired lock should not be treated as locked")
+	}
+	if err := store.LockRollout("r5"); err != nil {
+		t.Errorf("expired lock should be taken over, err: %v", err)
+	}
+}
+
+func TestIsConfigPath(t *testing.T) {
+	// file client sends absolute paths of relative root
+	store := NewStore(NewClient(ConfigFile, "", "", "", "."))
+	abs, _ := filepath.Abs(".")
+	tests := []struct {
+		path   string
+		config bool
+	}{
+		{store.NamespacePath("ns1"), true},
+		{store.RuleListPath(RuleListsName), true},
+		{filepath.Join(abs, "white_list", "wl"), true},
+		{filepath.Join(abs, "proxy_rules.xml"), true},
+		{store.ProxyPath("p1"), false},
+		{filepath.Join(abs, "proxy", "proxy-p1"), false},
+		{store.RolloutBase(), false},
+		{filepath.Join(abs, "rollout", "20191001000000.000000"), false},
+		{filepath.Join(abs, RolloutLockName), false},
+	}
+	for _, test := range tests {
+		if actual := store.IsConfigPath(test.path); actual != test.config {
+			t.Errorf("config path of %s not equal, expect: %v, actual: %v", test.path, test.config, actual)
+		}
+	}
+	if !store.IsRolloutLockPath(filepath.Join(abs, RolloutLockName)) {
+		t.Errorf("rollout lock path not matched")
+	}
+}
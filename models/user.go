@@ -44,11 +44,21 @@ type User struct {
 	UserName  string `json:"userName"`
 	Password  string `json:"password"`
 	Namespace string
-	//RWFlag        int    `json:"rw_flag"`        //1: 只读 2:读写
-	//RWSplit       int    `json:"rw_split"`       //0: 不采用读写分离 1:读写分离
+	RWFlag    int     `json:"rw_flag"`  //1: 只读 2:读写, 默认读写
+	RWSplit   *int    `json:"rw_split"` //0: 不采用读写分离 1:读写分离, 默认读写分离
+	Limits    *Limits `json:"limits"`   // 用户的资源限制, 为空时不限制
 	//OtherProperty int    `json:"other_property"` // 1:统计用户
 }
 
+// GetRWSplit return rw_split of user. reads go to slaves if rw_split is not set,
+// it keeps compatible with old config, whose reads always go to slaves before master is supported
+func (p *User) GetRWSplit() int {
+	if p.RWSplit == nil {
+		return ReadWriteSplit
+	}
+	return *p.RWSplit
+}
+
 func (p *User) verify() error {
 	if p.UserName == "" {
 		return errors.New("missing user name")
@@ -65,13 +75,22 @@ func (p *User) verify() error {
 	}
 	p.Password = strings.TrimSpace(p.Password)
 
-	//if p.RWFlag != ReadOnly && p.RWFlag != ReadWrite {
-	//	return fmt.Errorf("invalid RWFlag, user: %s, rwflag: %d", p.UserName, p.RWFlag)
-	//}
-	//
-	//if p.RWSplit != NoReadWriteSplit && p.RWSplit != ReadWriteSplit {
-	//	return fmt.Errorf("invalid RWSplit, user: %s, rwsplit: %d", p.UserName, p.RWSplit)
-	//}
+	// rw_flag is not set, keep compatible with old config
+	if p.RWFlag == 0 {
+		p.RWFlag = ReadWrite
+	}
+
+	if p.RWFlag != ReadOnly && p.RWFlag != ReadWrite {
+		return fmt.Errorf("invalid RWFlag, user: %s, rwflag: %d", p.UserName, p.RWFlag)
+	}
+
+	if p.RWSplit != nil && *p.RWSplit != NoReadWriteSplit && *p.RWSplit != ReadWriteSplit {
+		return fmt.Errorf("invalid RWSplit, user: %s, rwsplit: %d", p.UserName, *p.RWSplit)
+	}
+
+	if err := p.Limits.verify(); err != nil {
+		return fmt.Errorf("invalid limits, user: %s, err: %v", p.UserName, err)
+	}
 
 	//if p.OtherProperty != StatisticUser && p.OtherProperty != 0 {
 	//	return fmt.Errorf("invalid other property, user: %s, %d", p.UserName, p.OtherProperty)
@@ -0,0 +1,62 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"testing"
+)
+
+func TestUserRWSplit(t *testing.T) {
+	split := func(v int) *int { return &v }
+	tests := []struct {
+		rwSplit *int
+		valid   bool
+		expect  int
+	}{
+		{nil, true, ReadWriteSplit}, // not set in old config, reads go to slaves as before
+		{split(NoReadWriteSplit), true, NoReadWriteSplit},
+		{split(ReadWriteSplit), true, ReadWriteSplit},
+		{split(2), false, 2},
+	}
+	for i, test := range tests {
+		u := &User{UserName: "u1", Password: "p1", Namespace: "ns1", RWSplit: test.rwSplit}
+		if err := u.verify(); (err == nil) != test.valid {
+			t.Errorf("test %d verify not equal, expect valid: %v, err: %v", i, test.valid, err)
+		}
+		if actual := u.GetRWSplit(); actual != test.expect {
+			t.Errorf("test %d rw_split not equal, expect: %d, actual: %d", i, test.expect, actual)
+		}
+	}
+}
+
+func TestSliceVerify(t *testing.T) {
+	tests := []struct {
+		master string
+		slaves []string
+		valid  bool
+	}{
+		{"127.0.0.1:3306", nil, true},
+		{"127.0.0.1:3306", []string{"127.0.0.1:3307"}, true},
+		{"", []string{"127.0.0.1:3307"}, true}, // slaves only, writes are rejected by proxy
+		{"", nil, false},
+		{"", []string{""}, false},
+	}
+	for i, test := range tests {
+		s := &Slice{UserName: "root", Master: test.master, Slaves: test.slaves, Capacity: 16, MaxCapacity: 32}
+		if err := s.verify(); (err == nil) != test.valid {
+			t.Errorf("test %d verify not equal, expect valid: %v, err: %v", i, test.valid, err)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package models
 
+import (
+	"fmt"
+	"time"
+)
+
 type WhiteList struct {
-	Name    string
-	Records []WhiteListRecord
+	Name    string            `json:"name"`
+	Records []WhiteListRecord `json:"records"`
 }
 
 type WhiteListRecord struct {
@@ -18,7 +23,35 @@ func (n *WhiteList) Encode() []byte {
 	return JSONEncode(n.Records)
 }
 
+// WhiteListTimeFormat is format of fromTime and toTime of white list record
+const WhiteListTimeFormat = "2006-01-02 15:04:05"
+
 // Verify verify namespace contents
 func (n *WhiteList) Verify() error {
+	if err := VerifyConfigName("white list", n.Name); err != nil {
+		return err
+	}
+	users := make(map[string]bool, len(n.Records))
+	for _, r := range n.Records {
+		if r.User == "" {
+			return fmt.Errorf("user of white list %s is empty", n.Name)
+		}
+		if users[r.User] {
+			return fmt.Errorf("user %s duped in white list %s", r.User, n.Name)
+		}
+		users[r.User] = true
+
+		from, err := time.ParseInLocation(WhiteListTimeFormat, r.FromTime, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid fromTime of user %s in white list %s: %v", r.User, n.Name, err)
+		}
+		to, err := time.ParseInLocation(WhiteListTimeFormat, r.ToTime, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid toTime of user %s in white list %s: %v", r.User, n.Name, err)
+		}
+		if to.Before(from) {
+			return fmt.Errorf("toTime is before fromTime of user %s in white list %s", r.User, n.Name)
+		}
+	}
 	return nil
 }
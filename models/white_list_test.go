@@ -0,0 +1,65 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"testing"
+)
+
+func TestWhiteListVerify(t *testing.T) {
+	record := func(user, from, to string) WhiteListRecord {
+		return WhiteListRecord{User: user, FromTime: from, ToTime: to}
+	}
+	tests := []struct {
+		records []WhiteListRecord
+		valid   bool
+	}{
+		{[]WhiteListRecord{record("u1", "2019-01-01 00:00:00", "2019-12-31 23:59:59")}, true},
+		{[]WhiteListRecord{record("", "2019-01-01 00:00:00", "2019-12-31 23:59:59")}, false},
+		{[]WhiteListRecord{record("u1", "2019-01-01", "2019-12-31 23:59:59")}, false},
+		{[]WhiteListRecord{record("u1", "2019-12-31 23:59:59", "2019-01-01 00:00:00")}, false},
+		{[]WhiteListRecord{
+			record("u1", "2019-01-01 00:00:00", "2019-12-31 23:59:59"),
+			record("u1", "2020-01-01 00:00:00", "2020-12-31 23:59:59"),
+		}, false},
+	}
+	for i, test := range tests {
+		w := &WhiteList{Name: "wl1", Records: test.records}
+		if err := w.Verify(); (err == nil) != test.valid {
+			t.Errorf("test %d verify not equal, expect valid: %v, err: %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestFilterListVerify(t *testing.T) {
+	filter := func(table, col, function string) Filter {
+		return Filter{Name: "f", Action: Action{Mask: Mask{TableName: table, ColName: col, Function: function}}}
+	}
+	tests := []struct {
+		filters []Filter
+		valid   bool
+	}{
+		{[]Filter{filter("user", "phone", "MASK_PHONE"), filter("user", "email", "MASK_EMAIL")}, true},
+		{[]Filter{filter("user", "phone", "")}, false},
+		{[]Filter{filter("", "phone", "MASK_PHONE")}, false},
+		{[]Filter{filter("user", "phone", "MASK_PHONE"), filter("user", "phone", "MASK_ALL")}, false},
+	}
+	for i, test := range tests {
+		f := &FilterList{Filters: test.filters}
+		if err := f.Verify(); (err == nil) != test.valid {
+			t.Errorf("test %d verify not equal, expect valid: %v, err: %v", i, test.valid, err)
+		}
+	}
+}
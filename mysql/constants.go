@@ -39,6 +39,8 @@ const (
 )
 
 const (
+	// CursorTypeNoCursor no cursor
+	CursorTypeNoCursor = 0x00
 	// CursorTypeReadOnly readonly cursor
 	CursorTypeReadOnly = 0x01
 )
@@ -67,6 +69,12 @@ const (
 	ServerPSOutParams              uint16 = 0x1000
 )
 
+// Options of ComSetOption
+const (
+	OptionMultiStatementsOn  uint16 = 0
+	OptionMultiStatementsOff uint16 = 1
+)
+
 // ErrTextLength error text length limit.
 const ErrTextLength = 80
 
@@ -246,6 +246,7 @@ var MySQLState = map[uint16]string{
 	ErrAlterOperationNotSupported:          "0A000",
 	ErrAlterOperationNotSupportedReason:    "0A000",
 	ErrDupUnknownInIndex:                   "23000",
+	ErrQueryTimeout:                        "HY000",
 	ErrBadGeneratedColumn:                  "HY000",
 	ErrUnsupportedOnGeneratedColumn:        "HY000",
 	ErrGeneratedColumnNonPrior:             "HY000",
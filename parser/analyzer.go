@@ -43,6 +43,7 @@ const (
 	StmtOther
 	StmtUnknown
 	StmtComment
+	StmtKill
 )
 
 // Preview analyzes the beginning of the query using a simpler and faster
@@ -94,6 +95,8 @@ func Preview(sql string) int {
 		return StmtShow
 	case "use":
 		return StmtUse
+	case "kill":
+		return StmtKill
 	case "analyze", "describe", "desc", "explain", "repair", "optimize":
 		return StmtOther
 	}
@@ -134,6 +137,8 @@ func StmtType(stmtType int) string {
 		return "USE"
 	case StmtOther:
 		return "OTHER"
+	case StmtKill:
+		return "KILL"
 	default:
 		return "UNKNOWN"
 	}
@@ -0,0 +1,82 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ParameterizeSQL replace string and number literals in sql with '?', so sqls which differ only in literals
+// share the same normalized sql, whitespace between tokens is collapsed as well.
+// params are the replaced literals in order, strings are escaped again in the same way as Restore,
+// so they could be put back into restored sql safely.
+// ok is false if sql can't be parameterized, e.g. it contains '?', optimizer hints or mysql specific comments.
+func ParameterizeSQL(sql string) (normalized string, params []string, ok bool) {
+	s := NewScanner(sql)
+	b := &strings.Builder{}
+	last := 0
+	prevText := ""
+	for {
+		tok, pos, lit := s.scan()
+		if s.specialComment != nil {
+			return "", nil, false
+		}
+		switch tok {
+		case 0:
+			// trailing whitespace and comments are dropped
+			return b.String(), params, true
+		case unicode.ReplacementChar, paramMarker:
+			return "", nil, false
+		}
+		if len(s.errs) != 0 {
+			return "", nil, false
+		}
+
+		// keep comments between tokens, collapse whitespace
+		gap := sql[last:pos.Offset]
+		if strings.TrimSpace(gap) != "" {
+			b.WriteString(gap)
+		} else if gap != "" && b.Len() != 0 {
+			b.WriteByte(' ')
+		}
+
+		end := s.r.pos().Offset
+		switch {
+		case tok == stringLit && !isCharsetIntroducer(prevText):
+			params = append(params, restoreString(lit))
+			b.WriteByte('?')
+		case tok == intLit, tok == floatLit, tok == decLit:
+			params = append(params, sql[pos.Offset:end])
+			b.WriteByte('?')
+		default:
+			b.WriteString(sql[pos.Offset:end])
+		}
+		last = end
+		prevText = sql[pos.Offset:end]
+	}
+}
+
+// isCharsetIntroducer check if string literal is led by charset like _utf8'abc' or N'abc'
+func isCharsetIntroducer(text string) bool {
+	return strings.HasPrefix(text, "_") || text == "N" || text == "n"
+}
+
+// restoreString quote str like RestoreCtx.WriteString with format.EscapeRestoreFlags
+func restoreString(str string) string {
+	str = strings.Replace(str, `\`, `\\`, -1)
+	str = strings.Replace(str, `'`, `''`, -1)
+	return "'" + str + "'"
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParameterizeSQL(t *testing.T) {
+	tests := []struct {
+		sql        string
+		normalized string
+		params     []string
+		ok         bool
+	}{
+		{"select * from t where a = 1 and b='x\\'y'  limit 10", "select * from t where a = ? and b=? limit ?", []string{"1", `'x''y'`, "10"}, true},
+		{"select a from t1 where c in (1, -2.5, 1e3) and d=\"q\\\\\"", "select a from t1 where c in (?, -?, ?) and d=?", []string{"1", "2.5", "1e3", `'q\\'`}, true},
+		{"select a from t /* comment */ where b = 2 ", "select a from t /* comment */ where b = ?", []string{"2"}, true},
+		{"select _utf8'x', N'y', x'ab', 0x1f from t2", "select _utf8'x', N'y', x'ab', 0x1f from t2", nil, true},
+		{"select /*+ MAX_EXECUTION_TIME(10) */ 1", "", nil, false},
+		{"select /*!40001 SQL_NO_CACHE */ 1", "", nil, false},
+		{"select ?", "", nil, false},
+		{"select 'abc", "", nil, false},
+	}
+	for _, test := range tests {
+		normalized, params, ok := ParameterizeSQL(test.sql)
+		if ok != test.ok {
+			t.Errorf("sql %q, ok not equal, expect: %v, actual: %v", test.sql, test.ok, ok)
+			continue
+		}
+		if normalized != test.normalized || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("sql %q, expect: %q %q, actual: %q %q", test.sql, test.normalized, test.params, normalized, params)
+		}
+	}
+}
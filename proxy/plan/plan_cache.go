@@ -0,0 +1,167 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ZzzYtl/MyMask/parser/ast"
+	driver "github.com/ZzzYtl/MyMask/parser/tidb-types/parser_driver"
+	"github.com/ZzzYtl/MyMask/util"
+)
+
+// params are replaced by string literal like '\x00{index}\x00' before restoring,
+// NUL byte never appears in restored sql otherwise.
+const paramSentinel = "\x00"
+
+// CachedPlan is parameterized plan shared by sqls which differ only in literals,
+// sql sent to backend is generated by putting literals back into the template.
+type CachedPlan struct {
+	db       string
+	phyDBs   map[string]string
+	stmt     ast.StmtNode
+	parts    []string // pieces of template, len(parts) == len(params) + 1
+	params   []int    // index of param between parts[i] and parts[i+1]
+	paramLen int
+}
+
+// Size implement cache.Value
+func (p *CachedPlan) Size() int {
+	return 1
+}
+
+// paramReplacer replace param markers with sentinel string literals
+type paramReplacer struct {
+	index map[*driver.ParamMarkerExpr]int
+}
+
+func (r *paramReplacer) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	return n, false
+}
+
+func (r *paramReplacer) Leave(n ast.Node) (node ast.Node, ok bool) {
+	if pm, ok := n.(*driver.ParamMarkerExpr); ok {
+		if i, ok := r.index[pm]; ok {
+			return ast.NewValueExpr(paramSentinel + strconv.Itoa(i) + paramSentinel), true
+		}
+	}
+	return n, true
+}
+
+// paramCollector collect param markers
+type paramCollector struct {
+	markers []*driver.ParamMarkerExpr
+}
+
+func (c *paramCollector) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if pm, ok := n.(*driver.ParamMarkerExpr); ok {
+		c.markers = append(c.markers, pm)
+	}
+	return n, false
+}
+
+func (c *paramCollector) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+// BuildCachedPlan build parameterized plan, stmt is parsed from sql parameterized by parser.ParameterizeSQL,
+// paramLen is count of params. Only unshard plan could be cached.
+func BuildCachedPlan(stmt ast.StmtNode, paramLen int, phyDBs map[string]string, db string,
+	maskRule *map[util.RuleKey]string, tableDesc *map[string][]string) (*CachedPlan, error) {
+	// params are numbered by position in sql, it's the same order as literals
+	if n := replaceParamMarkers(stmt); n != paramLen {
+		return nil, fmt.Errorf("param count not match, expect: %d, actual: %d", paramLen, n)
+	}
+
+	p, err := BuildPlan(stmt, phyDBs, db, "", maskRule, tableDesc)
+	if err != nil {
+		return nil, err
+	}
+	up, ok := p.(*UnshardPlan)
+	if !ok {
+		return nil, fmt.Errorf("plan could not be cached, type: %T", p)
+	}
+
+	parts, params, err := parseTemplate(up.sql, paramLen)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedPlan{db: up.db, phyDBs: up.phyDBs, stmt: up.stmt, parts: parts, params: params, paramLen: paramLen}, nil
+}
+
+// replaceParamMarkers replace param markers in stmt with sentinels, markers are numbered by position in sql.
+// It returns count of param markers.
+func replaceParamMarkers(stmt ast.StmtNode) int {
+	collector := &paramCollector{}
+	stmt.Accept(collector)
+
+	sort.Slice(collector.markers, func(i, j int) bool {
+		return collector.markers[i].Offset < collector.markers[j].Offset
+	})
+	replacer := &paramReplacer{index: make(map[*driver.ParamMarkerExpr]int, len(collector.markers))}
+	for i, pm := range collector.markers {
+		replacer.index[pm] = i
+	}
+	stmt.Accept(replacer)
+	return len(collector.markers)
+}
+
+// parseTemplate split sql restored from stmt with sentinels into pieces and index of params
+func parseTemplate(sql string, paramLen int) (parts []string, params []int, err error) {
+	start := "'" + paramSentinel
+	end := paramSentinel + "'"
+	for {
+		i := strings.Index(sql, start)
+		if i < 0 {
+			parts = append(parts, sql)
+			return parts, params, nil
+		}
+		j := strings.Index(sql[i+len(start):], end)
+		if j < 0 {
+			return nil, nil, fmt.Errorf("invalid template: %q", sql)
+		}
+		index, err := strconv.Atoi(sql[i+len(start) : i+len(start)+j])
+		if err != nil || index >= paramLen {
+			return nil, nil, fmt.Errorf("invalid template: %q", sql)
+		}
+		parts = append(parts, sql[:i])
+		params = append(params, index)
+		sql = sql[i+len(start)+j+len(end):]
+	}
+}
+
+// fillTemplate put values of params back into template
+func fillTemplate(parts []string, params []int, values []string) string {
+	b := &strings.Builder{}
+	for i, part := range parts {
+		b.WriteString(part)
+		if i < len(params) {
+			b.WriteString(values[params[i]])
+		}
+	}
+	return b.String()
+}
+
+// CreatePlan create plan with params, which are returned by parser.ParameterizeSQL
+func (p *CachedPlan) CreatePlan(params []string) (Plan, error) {
+	if len(params) != p.paramLen {
+		return nil, fmt.Errorf("param count not match, expect: %d, actual: %d", p.paramLen, len(params))
+	}
+
+	return &UnshardPlan{db: p.db, phyDBs: p.phyDBs, stmt: p.stmt, sql: fillTemplate(p.parts, p.params, params)}, nil
+}
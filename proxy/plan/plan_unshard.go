@@ -222,6 +222,11 @@ func CreateSelectLastInsertIDPlan() *SelectLastInsertIDPlan {
 	return &SelectLastInsertIDPlan{}
 }
 
+// GetSQL return sql rewritten by plan, which is sent to backend mysql
+func (p *UnshardPlan) GetSQL() string {
+	return p.sql
+}
+
 // ExecuteIn implement Plan
 func (p *UnshardPlan) ExecuteIn(reqCtx *util.RequestContext, se Executor) (*mysql.Result, error) {
 	r, err := se.ExecuteSQL(reqCtx, backend.DefaultSlice, p.db, p.sql)
@@ -0,0 +1,246 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/mysql"
+	"github.com/ZzzYtl/MyMask/parser"
+	"github.com/ZzzYtl/MyMask/parser/ast"
+	"github.com/ZzzYtl/MyMask/parser/format"
+	driver "github.com/ZzzYtl/MyMask/parser/tidb-types/parser_driver"
+)
+
+// RewriteRule rewrite sql matched by pattern into replacement
+type RewriteRule struct {
+	name  string
+	match string
+	db    string
+
+	md5       string        // md5 of fingerprint of pattern, for fingerprint match
+	canonical string        // pattern restored with every literal as '?', for pattern match
+	slots     []literalSlot // literals of pattern in visiting order, for pattern match
+
+	parts    []string // template of replacement
+	params   []int
+	paramLen int // count of '?' in replacement
+}
+
+// literalSlot is a literal or param marker in sql
+type literalSlot struct {
+	capture int    // index of param marker in pattern ordered by position, -1 means literal which must be equal
+	text    string // restored literal
+}
+
+// literalReplacer replace literals and param markers with param markers, so sqls differ only in literals
+// are restored to the same canonical sql
+type literalReplacer struct {
+	slots   []literalSlot
+	offsets []int // offsets of param markers, index is the same as slots
+}
+
+func (r *literalReplacer) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	return n, false
+}
+
+func (r *literalReplacer) Leave(n ast.Node) (node ast.Node, ok bool) {
+	switch x := n.(type) {
+	case *driver.ParamMarkerExpr:
+		r.slots = append(r.slots, literalSlot{capture: -1})
+		r.offsets = append(r.offsets, x.Offset)
+		return x, true
+	case *driver.ValueExpr:
+		r.slots = append(r.slots, literalSlot{capture: -1, text: restoreNode(x)})
+		r.offsets = append(r.offsets, -1)
+		return ast.NewParamMarkerExpr(0), true
+	}
+	return n, true
+}
+
+// markerCount number param markers in slots by offset, and return count of param markers
+func (r *literalReplacer) markerCount() int {
+	var markers []int
+	for i, offset := range r.offsets {
+		if offset >= 0 {
+			markers = append(markers, i)
+		}
+	}
+	sort.Slice(markers, func(i, j int) bool {
+		return r.offsets[markers[i]] < r.offsets[markers[j]]
+	})
+	for index, i := range markers {
+		r.slots[i].capture = index
+	}
+	return len(markers)
+}
+
+func restoreNode(n ast.Node) string {
+	s := &strings.Builder{}
+	_ = n.Restore(format.NewRestoreCtx(format.EscapeRestoreFlags, s))
+	return s.String()
+}
+
+// NewRewriteRule create rewrite rule, pattern and replacement are parsed and checked
+func NewRewriteRule(cfg *models.RewriteRule) (*RewriteRule, error) {
+	p := parser.New()
+	r := &RewriteRule{name: cfg.Name, match: cfg.Match, db: cfg.DB}
+
+	captures := 0
+	switch cfg.Match {
+	case models.RewriteMatchFingerprint:
+		r.md5 = mysql.GetMd5(mysql.GetFingerprint(cfg.Pattern))
+	case models.RewriteMatchPattern:
+		stmt, err := p.ParseOneStmt(cfg.Pattern, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("parse pattern of rewrite rule: %s error: %v", cfg.Name, err)
+		}
+		replacer := &literalReplacer{}
+		stmt.Accept(replacer)
+		captures = replacer.markerCount()
+		r.slots = replacer.slots
+		r.canonical = restoreNode(stmt)
+	default:
+		return nil, fmt.Errorf("invalid match of rewrite rule: %s, match: %s", cfg.Name, cfg.Match)
+	}
+
+	stmt, err := p.ParseOneStmt(cfg.Replacement, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("parse replacement of rewrite rule: %s error: %v", cfg.Name, err)
+	}
+	r.paramLen = replaceParamMarkers(stmt)
+	if cfg.Match == models.RewriteMatchPattern && r.paramLen > captures {
+		return nil, fmt.Errorf("too many '?' in replacement of rewrite rule: %s, pattern: %d, replacement: %d", cfg.Name, captures, r.paramLen)
+	}
+	r.parts, r.params, err = parseTemplate(restoreNode(stmt), r.paramLen)
+	if err != nil {
+		return nil, fmt.Errorf("parse replacement of rewrite rule: %s error: %v", cfg.Name, err)
+	}
+	return r, nil
+}
+
+// GetName return name of rule
+func (r *RewriteRule) GetName() string {
+	return r.name
+}
+
+// rewriteQuery is sql to be rewritten, it's parsed only if some pattern rule needs it
+type rewriteQuery struct {
+	sql   string
+	parse func(sql string) (ast.StmtNode, error)
+
+	md5 string
+
+	parsed    bool
+	canonical string
+	slots     []literalSlot
+	markers   int // count of param markers in sql of prepared statement
+}
+
+func (q *rewriteQuery) getMd5() string {
+	if q.md5 == "" {
+		q.md5 = mysql.GetMd5(mysql.GetFingerprint(q.sql))
+	}
+	return q.md5
+}
+
+// getCanonical return canonical sql and literals, canonical sql is empty if sql can't be parsed
+func (q *rewriteQuery) getCanonical() (string, []literalSlot) {
+	if !q.parsed {
+		q.parsed = true
+		stmt, err := q.parse(q.sql)
+		if err != nil {
+			return "", nil
+		}
+		replacer := &literalReplacer{}
+		stmt.Accept(replacer)
+		q.markers = replacer.markerCount()
+		q.canonical = restoreNode(stmt)
+		q.slots = replacer.slots
+	}
+	return q.canonical, q.slots
+}
+
+// rewrite return rewritten sql, ok is false if rule not matched
+func (r *RewriteRule) rewrite(db string, q *rewriteQuery) (string, bool) {
+	if r.db != "" && r.db != db {
+		return "", false
+	}
+
+	var values []string
+	switch r.match {
+	case models.RewriteMatchFingerprint:
+		if q.getMd5() != r.md5 {
+			return "", false
+		}
+		if r.paramLen != 0 {
+			if strings.Contains(q.sql, "?") {
+				// values of param markers in prepared statement are unknown
+				return "", false
+			}
+			_, params, ok := parser.ParameterizeSQL(q.sql)
+			if !ok || len(params) < r.paramLen {
+				return "", false
+			}
+			values = params
+		}
+	case models.RewriteMatchPattern:
+		canonical, slots := q.getCanonical()
+		if canonical == "" || canonical != r.canonical || len(slots) != len(r.slots) {
+			return "", false
+		}
+		values = make([]string, r.paramLen)
+		// captures of param markers in sql, ordered by position of markers
+		markerCaptures := make([]int, q.markers)
+		for i, s := range r.slots {
+			if slots[i].capture >= 0 {
+				markerCaptures[slots[i].capture] = s.capture
+			}
+			if s.capture < 0 {
+				if s.text != slots[i].text || slots[i].capture >= 0 {
+					return "", false
+				}
+			} else if s.capture < r.paramLen {
+				if slots[i].capture >= 0 {
+					values[s.capture] = "?"
+				} else {
+					values[s.capture] = slots[i].text
+				}
+			}
+		}
+		// params of prepared statement are bound by position, so param markers must be kept in the same order
+		for i, capture := range markerCaptures {
+			if capture >= r.paramLen || (i > 0 && capture <= markerCaptures[i-1]) {
+				return "", false
+			}
+		}
+	}
+	return fillTemplate(r.parts, r.params, values), true
+}
+
+// RewriteSQL rewrite sql by the first matched rule, rule is nil if no rule matched.
+// parse is called at most once and only when pattern rule exists.
+func RewriteSQL(rules []*RewriteRule, db, sql string, parse func(sql string) (ast.StmtNode, error)) (string, *RewriteRule) {
+	q := &rewriteQuery{sql: sql, parse: parse}
+	for _, r := range rules {
+		if rewritten, ok := r.rewrite(db, q); ok {
+			return rewritten, r
+		}
+	}
+	return sql, nil
+}
@@ -32,3 +32,8 @@ func NewDB(config *models.DataBase) (*DataBase, error) {
 	db.Rule = config.Security.Rule
 	return db, nil
 }
+
+// samePolicy check if mask rule and white list are the same
+func (db *DataBase) samePolicy(other *DataBase) bool {
+	return db.Rule == other.Rule && db.WhiteList == other.WhiteList
+}
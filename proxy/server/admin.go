@@ -15,11 +15,13 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,9 +51,11 @@ type AdminServer struct {
 	model *models.ProxyInfo
 
 	listener      net.Listener
-	adminUser     string
-	adminPassword string
+	pprofListener net.Listener // nil if pprof shares admin listener
 	engine        *gin.Engine
+	pprofEngine   *gin.Engine
+	auth          *adminAuth
+	auditor       *adminAuditor
 
 	configType string
 }
@@ -68,24 +72,41 @@ func NewAdminServer(proxy *Server, cfg *models.Proxy) (*AdminServer, error) {
 		}
 
 		if err != nil {
+			s.closeListeners()
 			s.Close()
 		}
 	}()
 
 	s.exit.C = make(chan struct{})
 	s.proxy = proxy
-	s.adminUser = cfg.AdminUser
-	s.adminPassword = cfg.AdminPassword
 	s.configType = cfg.ConfigType
 
-	s.engine = gin.New()
-	l, err := net.Listen(cfg.ProtoType, cfg.AdminAddr)
+	if s.auth, err = newAdminAuth(cfg); err != nil {
+		return nil, err
+	}
+	if s.auditor, err = newAdminAuditor(cfg.AdminAuditFile); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newAdminTLSConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
-	s.listener = l
+
+	s.engine = gin.New()
+	s.engine.Use(s.audit)
+	if s.listener, err = newAdminListener(cfg.ProtoType, cfg.AdminAddr, tlsConfig); err != nil {
+		return nil, err
+	}
 	s.registerURL()
 	s.registerMetric()
+	s.pprofEngine = s.engine
+	if cfg.AdminPprofAddr != "" {
+		s.pprofEngine = gin.New()
+		s.pprofEngine.Use(s.audit)
+		if s.pprofListener, err = newAdminListener(cfg.ProtoType, cfg.AdminPprofAddr, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
 	s.registerProf()
 
 	proxyInfo, err := NewProxyInfo(cfg, s.proxy.cfg.ProxyAddr)
@@ -98,21 +119,51 @@ func NewAdminServer(proxy *Server, cfg *models.Proxy) (*AdminServer, error) {
 		return nil, err
 	}
 
-	log.Notice("[server] NewAdminServer, Api Server running, netProto: http, addr: %s", cfg.AdminAddr)
+	netProto := "http"
+	if tlsConfig != nil {
+		netProto = "https"
+	}
+	log.Notice("[server] NewAdminServer, Api Server running, netProto: %s, addr: %s, pprof addr: %s", netProto, cfg.AdminAddr, cfg.AdminPprofAddr)
 	return s, nil
 }
 
+func (s *AdminServer) closeListeners() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.pprofListener != nil {
+		s.pprofListener.Close()
+	}
+}
+
+// newAdminListener listen on addr, connections are wrapped by tls if tlsConfig is not nil
+func newAdminListener(protoType, addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	l, err := net.Listen(protoType, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
+
 // Run run admin server
 func (s *AdminServer) Run() {
 	defer s.listener.Close()
 
-	eh := make(chan error, 1)
-	go func(l net.Listener) {
+	eh := make(chan error, 2)
+	serve := func(l net.Listener, engine *gin.Engine) {
 		h := http.NewServeMux()
-		h.Handle("/", s.engine)
+		h.Handle("/", engine)
 		hs := &http.Server{Handler: h}
-		eh <- hs.Serve(s.listener)
-	}(s.listener)
+		eh <- hs.Serve(l)
+	}
+	go serve(s.listener, s.engine)
+	if s.pprofListener != nil {
+		defer s.pprofListener.Close()
+		go serve(s.pprofListener, s.pprofEngine)
+	}
 
 	select {
 	case <-s.exit.C:
@@ -125,6 +176,9 @@ func (s *AdminServer) Run() {
 // Close close admin server
 func (s *AdminServer) Close() error {
 	close(s.exit.C)
+	if s.auditor != nil {
+		s.auditor.Close()
+	}
 	if err := s.unregisterProxy(); err != nil {
 		log.Fatal("unregister proxy failed, %v", err)
 		return err
@@ -132,16 +186,35 @@ func (s *AdminServer) Close() error {
 	return nil
 }
 
+// registerURL register admin api, every api requires role, see models.AdminRoleXXX
 func (s *AdminServer) registerURL() {
-	adminGroup := s.engine.Group("/api/proxy", gin.BasicAuth(gin.Accounts{s.adminUser: s.adminPassword}))
-	adminGroup.GET("/ping", s.ping)
-	adminGroup.PUT("/config/prepare/:name", s.prepareConfig)
-	adminGroup.PUT("/config/commit/:name", s.commitConfig)
-	adminGroup.PUT("/namespace/delete/:name", s.deleteNamespace)
-	adminGroup.GET("/config/fingerprint", s.configFingerprint)
-
-	adminGroup.GET("/stats/sessionsqlfingerprint/:namespace", s.getNamespaceSessionSQLFingerprint)
-	adminGroup.GET("/stats/backendsqlfingerprint/:namespace", s.getNamespaceBackendSQLFingerprint)
+	adminGroup := s.engine.Group("/api/proxy")
+	readGroup := adminGroup.Group("", s.authorize(models.AdminRoleReader))
+	operateGroup := adminGroup.Group("", s.authorize(models.AdminRoleOperator))
+	securityGroup := adminGroup.Group("", s.authorize(models.AdminRoleSecurity))
+
+	readGroup.GET("/ping", s.ping)
+	operateGroup.PUT("/config/prepare", s.prepareAllConfig)
+	operateGroup.PUT("/config/commit", s.commitAllConfig)
+	operateGroup.PUT("/config/abort", s.abortConfig)
+	operateGroup.PUT("/config/prepare/:name", s.prepareConfig)
+	operateGroup.PUT("/config/commit/:name", s.commitConfig)
+	operateGroup.PUT("/namespace/delete/:name", s.deleteNamespace)
+	operateGroup.PUT("/drain", s.drain)
+	readGroup.GET("/config/fingerprint", s.configFingerprint)
+	readGroup.GET("/config/reload/result", s.getReloadResult)
+
+	readGroup.GET("/stats/sessionsqlfingerprint/:namespace", s.getNamespaceSessionSQLFingerprint)
+	readGroup.GET("/stats/backendsqlfingerprint/:namespace", s.getNamespaceBackendSQLFingerprint)
+	readGroup.GET("/backend/nodes/:namespace", s.getNamespaceBackendNodes)
+	readGroup.GET("/plancache/stats/:namespace", s.getNamespacePlanCacheStats)
+	securityGroup.GET("/firewall/recorded/:namespace/:user", s.getFirewallRecorded)
+	securityGroup.PUT("/firewall/recorded/clear/:namespace/:user", s.clearFirewallRecorded)
+	operateGroup.GET("/session/list", s.getProcessList)
+	operateGroup.PUT("/session/kill/:id", s.killSession)
+	operateGroup.PUT("/session/killquery/:id", s.killQuery)
+	securityGroup.GET("/policy/explain/:namespace", s.explainMaskPolicy)
+	securityGroup.GET("/policy/dump", s.dumpMaskConfig)
 
 	adminGroup.Use(gzip.Gzip(gzip.DefaultCompression))
 	adminGroup.Use(gin.Recovery())
@@ -151,15 +224,16 @@ func (s *AdminServer) registerURL() {
 }
 
 func (s *AdminServer) registerMetric() {
-	metricGroup := s.engine.Group("/api/metric", gin.BasicAuth(gin.Accounts{s.adminUser: s.adminPassword}))
+	metricGroup := s.engine.Group("/api/metric", s.authorize(models.AdminRoleReader))
 	for path, handler := range s.proxy.manager.GetStatisticManager().GetHandlers() {
 		log.Debug("[server] AdminServer got metric handler, path: %s", path)
 		metricGroup.GET(path, gin.WrapH(handler))
 	}
 }
 
+// registerProf register pprof on admin listener or the separate pprof listener
 func (s *AdminServer) registerProf() {
-	profGroup := s.engine.Group("/debug/pprof", gin.BasicAuth(gin.Accounts{s.adminUser: s.adminPassword}))
+	profGroup := s.pprofEngine.Group("/debug/pprof", s.authorize(models.AdminRoleOperator))
 	profGroup.GET("/", gin.WrapF(pprof.Index))
 	profGroup.GET("/cmdline", gin.WrapF(pprof.Cmdline))
 	profGroup.GET("/profile", gin.WrapF(pprof.Profile))
@@ -217,21 +291,76 @@ func generateToken(protoType, addr string) (string, error) {
 	return ipPort, nil
 }
 
+// registerProxy register proxy in config store, so that gaea-cc could find it
 func (s *AdminServer) registerProxy() error {
 	if s.configType == models.ConfigFile {
 		return nil
 	}
-	return nil
+	client := newConfigClient(s.proxy.cfg)
+	if client == nil {
+		return fmt.Errorf("create client of config type %s failed", s.configType)
+	}
+	store := models.NewStore(client)
+	defer store.Close()
+	return store.CreateProxy(s.model)
 }
 
 func (s *AdminServer) unregisterProxy() error {
-	if s.configType == models.ConfigFile {
+	if s.configType == models.ConfigFile || s.model == nil {
 		return nil
 	}
-	return nil
+	client := newConfigClient(s.proxy.cfg)
+	if client == nil {
+		return fmt.Errorf("create client of config type %s failed", s.configType)
+	}
+	store := models.NewStore(client)
+	defer store.Close()
+	return store.DeleteProxy(s.model.Token)
 }
 
 func (s *AdminServer) ping(c *gin.Context) {
+	// let load balancer remove the proxy when draining
+	if s.proxy.IsDraining() {
+		c.JSON(http.StatusServiceUnavailable, "proxy is draining")
+		return
+	}
+	c.JSON(http.StatusOK, "OK")
+}
+
+// drain shutdown proxy gracefully in background, the process exits when drain finished
+func (s *AdminServer) drain(c *gin.Context) {
+	if s.proxy.IsDraining() {
+		c.JSON(selfDefinedInternalError, "proxy is draining")
+		return
+	}
+	go s.proxy.Shutdown()
+	c.JSON(http.StatusOK, "OK")
+}
+
+// prepareAllConfig load all config from config store and prepare them, they take effect after commitAllConfig
+func (s *AdminServer) prepareAllConfig(c *gin.Context) {
+	if err := s.proxy.ReloadCfgPrepare(); err != nil {
+		log.Warn("prepare config of all failed, err: %v", err)
+		c.JSON(selfDefinedInternalError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, "OK")
+}
+
+func (s *AdminServer) commitAllConfig(c *gin.Context) {
+	if err := s.proxy.ReloadCfgCommit(); err != nil {
+		c.JSON(selfDefinedInternalError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, "OK")
+}
+
+// abortConfig discard config prepared by prepareConfig or prepareAllConfig
+func (s *AdminServer) abortConfig(c *gin.Context) {
+	if err := s.proxy.ReloadCfgAbort(); err != nil {
+		c.JSON(selfDefinedInternalError, err.Error())
+		return
+	}
 	c.JSON(http.StatusOK, "OK")
 }
 
@@ -241,7 +370,11 @@ func (s *AdminServer) prepareConfig(c *gin.Context) {
 		c.JSON(selfDefinedInternalError, "missing namespace name")
 		return
 	}
-	client := models.NewClient(models.ConfigFile, "")
+	client := newConfigClient(s.proxy.cfg)
+	if client == nil {
+		c.JSON(selfDefinedInternalError, "create config client failed")
+		return
+	}
 	defer client.Close()
 	err := s.proxy.ReloadNamespacePrepare(name, client)
 	if err != nil {
@@ -285,6 +418,11 @@ func (s *AdminServer) configFingerprint(c *gin.Context) {
 	c.JSON(http.StatusOK, s.proxy.manager.ConfigFingerprint())
 }
 
+// getReloadResult return result of last config reload, including reload result of every changed component
+func (s *AdminServer) getReloadResult(c *gin.Context) {
+	c.JSON(http.StatusOK, s.proxy.manager.GetReloadResult())
+}
+
 // getNamespaceSessionSQLFingerprint return namespace sql fingerprint information
 func (s *AdminServer) getNamespaceSessionSQLFingerprint(c *gin.Context) {
 	ns := strings.TrimSpace(c.Param("namespace"))
@@ -315,3 +453,107 @@ func (s *AdminServer) getNamespaceBackendSQLFingerprint(c *gin.Context) {
 
 	c.JSON(http.StatusOK, ret)
 }
+
+// getNamespaceBackendNodes return health state of backend nodes in namespace
+func (s *AdminServer) getNamespaceBackendNodes(c *gin.Context) {
+	ns := strings.TrimSpace(c.Param("namespace"))
+	namespace := s.proxy.manager.GetNamespaceByName(ns)
+	if namespace == nil {
+		c.JSON(selfDefinedInternalError, "namespace not found")
+		return
+	}
+
+	slice := namespace.GetSlice()
+	if slice == nil {
+		c.JSON(selfDefinedInternalError, "slice not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, slice.NodeStates())
+}
+
+// getNamespacePlanCacheStats return size and hit rate of plan cache of namespace
+// getFirewallRecorded return sql fingerprints recorded for user in recording mode, they could be used as allowlist
+func (s *AdminServer) getFirewallRecorded(c *gin.Context) {
+	ns := strings.TrimSpace(c.Param("namespace"))
+	user := strings.TrimSpace(c.Param("user"))
+	c.JSON(http.StatusOK, s.proxy.manager.GetFirewallRecorder().get(ns, user))
+}
+
+func (s *AdminServer) clearFirewallRecorded(c *gin.Context) {
+	ns := strings.TrimSpace(c.Param("namespace"))
+	user := strings.TrimSpace(c.Param("user"))
+	s.proxy.manager.GetFirewallRecorder().clear(ns, user)
+	c.JSON(http.StatusOK, "OK")
+}
+
+// explainMaskPolicy return effective mask policy of user from ip on db at time, specified by query parameters
+// user, ip, db and time, time is formatted as "2006-01-02 15:04:05" and defaults to now
+func (s *AdminServer) explainMaskPolicy(c *gin.Context) {
+	ns := strings.TrimSpace(c.Param("namespace"))
+	user := strings.TrimSpace(c.Query("user"))
+	if user == "" {
+		c.JSON(selfDefinedInternalError, "missing user")
+		return
+	}
+	now := time.Now()
+	if t := strings.TrimSpace(c.Query("time")); t != "" {
+		var err error
+		if now, err = time.ParseInLocation(models.WhiteListTimeFormat, t, time.Local); err != nil {
+			c.JSON(selfDefinedInternalError, "invalid time")
+			return
+		}
+	}
+	e, err := s.proxy.manager.ExplainMaskPolicy(ns, user, strings.TrimSpace(c.Query("ip")), strings.TrimSpace(c.Query("db")), now)
+	if err != nil {
+		c.JSON(selfDefinedInternalError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+// dumpMaskConfig return rule lists, white lists and database bindings in use with their source and version
+func (s *AdminServer) dumpMaskConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, s.proxy.manager.DumpMaskConfig())
+}
+
+func (s *AdminServer) getNamespacePlanCacheStats(c *gin.Context) {
+	ns := strings.TrimSpace(c.Param("namespace"))
+	namespace := s.proxy.manager.GetNamespaceByName(ns)
+	if namespace == nil {
+		c.JSON(selfDefinedInternalError, "namespace not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, namespace.GetPlanCacheStats())
+}
+
+// getProcessList return sessions like SHOW PROCESSLIST, filtered by query parameter namespace
+func (s *AdminServer) getProcessList(c *gin.Context) {
+	ns := strings.TrimSpace(c.Query("namespace"))
+	c.JSON(http.StatusOK, s.proxy.ProcessList(ns))
+}
+
+// killSession kill running query of session and close the session
+func (s *AdminServer) killSession(c *gin.Context) {
+	s.kill(c, false)
+}
+
+// killQuery kill running query of session, the session is kept
+func (s *AdminServer) killQuery(c *gin.Context) {
+	s.kill(c, true)
+}
+
+func (s *AdminServer) kill(c *gin.Context, query bool) {
+	id, err := strconv.ParseUint(strings.TrimSpace(c.Param("id")), 10, 32)
+	if err != nil {
+		c.JSON(selfDefinedInternalError, "invalid session id")
+		return
+	}
+
+	if err := s.proxy.KillSession(uint32(id), query); err != nil {
+		c.JSON(selfDefinedInternalError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, "OK")
+}
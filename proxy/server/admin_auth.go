@@ -0,0 +1,264 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/gin-gonic/gin"
+)
+
+// methods of admin authentication
+const (
+	adminAuthBasic = "basic"
+	adminAuthToken = "token"
+)
+
+// key of authenticated principal in gin context
+const adminPrincipalKey = "admin_principal"
+
+// adminPrincipal is authenticated account or token of admin request
+type adminPrincipal struct {
+	name   string
+	method string
+	roles  map[string]bool
+}
+
+// hasRole check if principal has role, every principal is reader
+func (p *adminPrincipal) hasRole(role string) bool {
+	return role == models.AdminRoleReader || p.roles[role]
+}
+
+type adminCredential struct {
+	secret string
+	roles  map[string]bool
+}
+
+// adminAuth authenticates admin requests by basic auth or bearer token
+type adminAuth struct {
+	accounts map[string]*adminCredential // key: user
+	tokens   map[string]*adminCredential // key: token name
+}
+
+// newAdminAuth create adminAuth with admin_user, which has all roles, and accounts in admin_accounts_file
+func newAdminAuth(cfg *models.Proxy) (*adminAuth, error) {
+	a := &adminAuth{
+		accounts: make(map[string]*adminCredential),
+		tokens:   make(map[string]*adminCredential),
+	}
+	if cfg.AdminUser != "" {
+		a.accounts[cfg.AdminUser] = &adminCredential{
+			secret: cfg.AdminPassword,
+			roles:  newAdminRoles([]string{models.AdminRoleReader, models.AdminRoleOperator, models.AdminRoleSecurity}),
+		}
+	}
+	if cfg.AdminAccountsFile == "" {
+		return a, nil
+	}
+
+	cipher, err := cfg.Cipher()
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := models.LoadAdminAccounts(cfg.AdminAccountsFile, cipher)
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts.Accounts {
+		if _, ok := a.accounts[account.User]; ok {
+			return nil, fmt.Errorf("admin account %s conflicts with admin_user", account.User)
+		}
+		a.accounts[account.User] = &adminCredential{secret: account.Password, roles: newAdminRoles(account.Roles)}
+	}
+	for _, token := range accounts.Tokens {
+		a.tokens[token.Name] = &adminCredential{secret: token.Token, roles: newAdminRoles(token.Roles)}
+	}
+	return a, nil
+}
+
+func newAdminRoles(roles []string) map[string]bool {
+	m := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		m[role] = true
+	}
+	return m
+}
+
+// authenticate return principal of request, nil if authentication failed
+func (a *adminAuth) authenticate(req *http.Request) *adminPrincipal {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		// compare with all tokens, so that time doesn't depend on which token matches
+		var found *adminPrincipal
+		for name, c := range a.tokens {
+			if secretEqual(c.secret, token) {
+				found = &adminPrincipal{name: name, method: adminAuthToken, roles: c.roles}
+			}
+		}
+		return found
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return nil
+	}
+	c, ok := a.accounts[user]
+	if !ok || !secretEqual(c.secret, password) {
+		return nil
+	}
+	return &adminPrincipal{name: user, method: adminAuthBasic, roles: c.roles}
+}
+
+func secretEqual(secret, input string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(input)) == 1
+}
+
+// authorize return middleware which authenticates request and checks role of principal
+func (s *AdminServer) authorize(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := s.auth.authenticate(c.Request)
+		if p == nil {
+			c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set(adminPrincipalKey, p)
+		if !p.hasRole(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, fmt.Sprintf("role %s is required", role))
+			return
+		}
+		c.Next()
+	}
+}
+
+// newAdminTLSConfig create tls config of admin listener, nil if tls is not configured
+func newAdminTLSConfig(cfg *models.Proxy) (*tls.Config, error) {
+	if cfg.AdminTLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.AdminTLSCertFile, cfg.AdminTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load admin tls certificate error: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.AdminTLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.AdminTLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in admin_tls_client_ca_file")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// adminAuditRecord is audit record of mutating admin call
+type adminAuditRecord struct {
+	Time       string `json:"time"`
+	User       string `json:"user,omitempty"` // empty if authentication failed
+	Auth       string `json:"auth,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	Method     string `json:"method"`
+	URI        string `json:"uri"`
+	Status     int    `json:"status"`
+	Duration   int64  `json:"duration_ms"`
+}
+
+// adminAuditor writes audit records to file as json lines, or to log if file is not configured
+type adminAuditor struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func newAdminAuditor(file string) (*adminAuditor, error) {
+	a := &adminAuditor{}
+	if file == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open admin audit file error: %v", err)
+	}
+	a.file = f
+	return a, nil
+}
+
+func (a *adminAuditor) record(r *adminAuditRecord) {
+	b, _ := json.Marshal(r)
+	if a.file == nil {
+		log.Notice("[AUDIT] admin %s", b)
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		log.Warn("write admin audit record failed, %v, record: %s", err, b)
+	}
+}
+
+// Close close audit file
+func (a *adminAuditor) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+// audit return middleware which records every mutating admin call, including calls failed to authenticate
+func (s *AdminServer) audit(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+
+	start := time.Now()
+	c.Next()
+	r := &adminAuditRecord{
+		Time:       start.Format(time.RFC3339),
+		RemoteAddr: c.Request.RemoteAddr,
+		Method:     c.Request.Method,
+		URI:        c.Request.URL.RequestURI(),
+		Status:     c.Writer.Status(),
+		Duration:   int64(time.Since(start) / time.Millisecond),
+	}
+	if v, ok := c.Get(adminPrincipalKey); ok {
+		p := v.(*adminPrincipal)
+		r.User, r.Auth = p.name, p.method
+	}
+	s.auditor.record(r)
+}
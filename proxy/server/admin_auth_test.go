@@ -0,0 +1,133 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	accountsFile := filepath.Join(dir, "accounts.json")
+	accounts := `{
+		"accounts": [
+			{"user": "r", "password": "rp", "roles": ["reader"]},
+			{"user": "o", "password": "op", "roles": ["operator"]}
+		],
+		"tokens": [
+			{"name": "deploy", "token": "t1", "roles": ["security_admin"]}
+		]
+	}`
+	if err := ioutil.WriteFile(accountsFile, []byte(accounts), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auditFile := filepath.Join(dir, "audit.log")
+	cfg := &models.Proxy{AdminUser: "admin", AdminPassword: "admin", AdminAccountsFile: accountsFile, AdminAuditFile: auditFile}
+
+	s := &AdminServer{proxy: &Server{manager: NewManager()}}
+	if s.auth, err = newAdminAuth(cfg); err != nil {
+		t.Fatalf("create admin auth error: %v", err)
+	}
+	if s.auditor, err = newAdminAuditor(cfg.AdminAuditFile); err != nil {
+		t.Fatalf("create admin auditor error: %v", err)
+	}
+	defer s.auditor.Close()
+	s.engine = gin.New()
+	s.engine.Use(s.audit)
+	s.registerURL()
+
+	tests := []struct {
+		method, path string
+		user, pass   string
+		token        string
+		status       int
+	}{
+		{"GET", "/api/proxy/ping", "", "", "", http.StatusUnauthorized},
+		{"GET", "/api/proxy/ping", "r", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/api/proxy/ping", "r", "rp", "", http.StatusOK},
+		{"GET", "/api/proxy/ping", "", "", "t1", http.StatusOK},
+		{"PUT", "/api/proxy/drain", "", "", "", http.StatusUnauthorized},
+		{"PUT", "/api/proxy/drain", "r", "rp", "", http.StatusForbidden},
+		{"PUT", "/api/proxy/session/kill/abc", "o", "op", "", selfDefinedInternalError},
+		{"GET", "/api/proxy/policy/dump", "o", "op", "", http.StatusForbidden},
+		{"GET", "/api/proxy/policy/dump", "", "", "wrong", http.StatusUnauthorized},
+		{"GET", "/api/proxy/policy/dump", "", "", "t1", http.StatusOK},
+		{"GET", "/api/proxy/policy/dump", "admin", "admin", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.pass)
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		s.engine.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s %s as %s%s, status not equal, expect: %d, actual: %d", test.method, test.path, test.user, test.token, test.status, w.Code)
+		}
+	}
+
+	// only mutating calls are audited
+	data, err := ioutil.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	expect := []struct {
+		user   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"r", http.StatusForbidden},
+		{"o", selfDefinedInternalError},
+	}
+	if len(lines) != len(expect) {
+		t.Fatalf("count of audit records not equal, actual: %s", data)
+	}
+	for i, line := range lines {
+		r := &adminAuditRecord{}
+		if err := json.Unmarshal([]byte(line), r); err != nil {
+			t.Fatalf("parse audit record error: %v", err)
+		}
+		if r.User != expect[i].user || r.Status != expect[i].status || r.Method != "PUT" {
+			t.Errorf("audit record not equal, expect: %v, actual: %s", expect[i], line)
+		}
+	}
+
+	// account in file could not replace admin_user
+	if err := ioutil.WriteFile(accountsFile, []byte(`{"accounts": [{"user": "admin", "password": "p", "roles": ["reader"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAdminAuth(cfg); err == nil {
+		t.Errorf("admin account conflicting with admin_user should fail")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/util/proxyproto"
+)
+
+// clientCheckInterval is interval of checking if client is still connected while query is running
+const clientCheckInterval = time.Second
+
+// rawClientConn unwrap connection accepted by listener to the socket, nil if the socket could not be got
+func rawClientConn(co net.Conn) syscall.Conn {
+	for {
+		switch c := co.(type) {
+		case *proxyproto.Conn:
+			co = c.Conn
+		case *unixConn:
+			co = c.Conn
+		case syscall.Conn:
+			return c
+		default:
+			return nil
+		}
+	}
+}
+
+// watchClient kill query running on backend when client goes away before query finished.
+// the returned function must be called to stop watching when query finished.
+func (cc *Session) watchClient() func() {
+	if cc.rawConn == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(clientCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if isClientAlive(cc.rawConn) {
+					continue
+				}
+				log.Warn("client disconnected while query running, kill backend query, connId: %d", cc.c.GetConnectionID())
+				if err := cc.executor.process.killQuery(); err != nil {
+					log.Warn("kill query error after client disconnected, connId: %d, err: %v", cc.c.GetConnectionID(), err)
+				}
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,46 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package server
+
+import (
+	"syscall"
+)
+
+// isClientAlive peek the socket without blocking, client is gone if EOF or connection reset.
+// pipelined data sent by client is not consumed.
+func isClientAlive(c syscall.Conn) bool {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return true
+	}
+
+	alive := true
+	buf := make([]byte, 1)
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		if (n == 0 && err == nil) || err == syscall.ECONNRESET {
+			alive = false
+		}
+		return true
+	})
+	if err != nil {
+		// socket has been closed by proxy
+		return false
+	}
+	return alive
+}
@@ -25,7 +25,8 @@ import (
 type ClientConn struct {
 	*mysql.Conn
 
-	salt []byte
+	salt       []byte
+	capability uint32 // capability flags sent by client in handshake response
 
 	manager *Manager
 
@@ -34,6 +35,7 @@ type ClientConn struct {
 
 // HandshakeResponseInfo handshake response information
 type HandshakeResponseInfo struct {
+	Capability   uint32
 	CollationID  mysql.CollationID
 	User         string
 	AuthResponse []byte
@@ -148,6 +150,8 @@ func (cc *ClientConn) readHandshakeResponse() (HandshakeResponseInfo, error) {
 	if capability&mysql.ClientProtocol41 == 0 {
 		return info, fmt.Errorf("readHandshakeResponse: only support protocol 4.1")
 	}
+	info.Capability = capability
+	cc.capability = capability
 
 	// Max packet size. Don't do anything with this now.
 	_, pos, ok = mysql.ReadUint32(data, pos)
@@ -201,6 +205,59 @@ func (cc *ClientConn) readHandshakeResponse() (HandshakeResponseInfo, error) {
 	return info, nil
 }
 
+// https://dev.mysql.com/doc/internals/en/com-change-user.html
+// the auth response is calculated with salt sent in initial handshake
+func (cc *ClientConn) readChangeUser(data []byte) (HandshakeResponseInfo, error) {
+	info := HandshakeResponseInfo{
+		Capability: cc.capability,
+		Salt:       cc.salt,
+	}
+
+	pos := 0
+	var ok bool
+	info.User, pos, ok = mysql.ReadNullString(data, pos)
+	if !ok {
+		return info, fmt.Errorf("readChangeUser: can't read username")
+	}
+
+	if cc.capability&mysql.ClientSecureConnection > 0 {
+		var l byte
+		l, pos, ok = mysql.ReadByte(data, pos)
+		if !ok {
+			return info, fmt.Errorf("readChangeUser: can't read auth-response length")
+		}
+		info.AuthResponse, pos, ok = mysql.ReadBytesCopy(data, pos, int(l))
+		if !ok {
+			return info, fmt.Errorf("readChangeUser: can't read auth-response")
+		}
+	} else {
+		var auth string
+		auth, pos, ok = mysql.ReadNullString(data, pos)
+		if !ok {
+			return info, fmt.Errorf("readChangeUser: can't read auth-response")
+		}
+		info.AuthResponse = []byte(auth)
+	}
+
+	info.Database, pos, ok = mysql.ReadNullString(data, pos)
+	if !ok {
+		return info, fmt.Errorf("readChangeUser: can't read db")
+	}
+
+	// character set is optional, 0 means not changed
+	if pos < len(data) {
+		var collationID uint16
+		collationID, pos, ok = mysql.ReadUint16(data, pos)
+		if !ok {
+			return info, fmt.Errorf("readChangeUser: can't read characterSet")
+		}
+		info.CollationID = mysql.CollationID(collationID)
+	}
+
+	// TODO auth plugin name、client conn attrs .etc
+	return info, nil
+}
+
 func (cc *ClientConn) writeOK(status uint16) error {
 	err := cc.WriteOKPacket(0, 0, status, 0)
 	if err != nil {
@@ -404,24 +461,36 @@ func (cc *ClientConn) writePrepareResponse(status uint16, s *Stmt) error {
 
 	if s.paramCount > 0 {
 		for i := 0; i < s.paramCount; i++ {
-			err = cc.writeColumnDefinition(p)
+			f := p
+			if i < len(s.params) {
+				f = s.params[i]
+			}
+			err = cc.writeColumnDefinition(f)
 			if err != nil {
 				return err
 			}
 		}
 		err = cc.writeEOFPacket(status)
-		return err
+		if err != nil {
+			return err
+		}
 	}
 
 	if s.columnCount > 0 {
 		for i := 0; i < s.columnCount; i++ {
-			err = cc.writeColumnDefinition(c)
+			f := c
+			if i < len(s.columns) {
+				f = s.columns[i]
+			}
+			err = cc.writeColumnDefinition(f)
 			if err != nil {
 				return err
 			}
 		}
 		err = cc.writeEOFPacket(status)
-		return err
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
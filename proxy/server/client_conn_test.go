@@ -0,0 +1,58 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ZzzYtl/MyMask/mysql"
+)
+
+func TestReadChangeUser(t *testing.T) {
+	salt := []byte("12345678901234567890")
+	auth := mysql.CalcPassword(salt, []byte("pwd"))
+
+	data := []byte("user1\x00")
+	data = append(data, byte(len(auth)))
+	data = append(data, auth...)
+	data = append(data, []byte("db1\x00")...)
+	data = mysql.AppendUint16(data, uint16(mysql.DefaultCollationID))
+
+	cc := &ClientConn{salt: salt, capability: DefaultCapability}
+	info, err := cc.readChangeUser(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.User != "user1" || info.Database != "db1" || info.CollationID != mysql.DefaultCollationID {
+		t.Errorf("parse change user error, info: %+v", info)
+	}
+	if !bytes.Equal(info.AuthResponse, auth) {
+		t.Errorf("auth response not equal, expect: %v, actual: %v", auth, info.AuthResponse)
+	}
+
+	// without character set
+	info, err = cc.readChangeUser(data[:len(data)-2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CollationID != 0 {
+		t.Errorf("collation should not be set, actual: %v", info.CollationID)
+	}
+
+	if _, err = cc.readChangeUser([]byte("user1")); err == nil {
+		t.Errorf("malformed packet should return error")
+	}
+}
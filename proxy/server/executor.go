@@ -15,11 +15,13 @@
 package server
 
 import (
+	"encoding/binary"
 	"fmt"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/ZzzYtl/MyMask/backend"
 	"github.com/ZzzYtl/MyMask/core/errors"
@@ -47,6 +49,7 @@ type SessionExecutor struct {
 	user             string
 	db               string
 	maskRule         *map[util.RuleKey]string
+	maskPolicyErr    error // mask rule of db could not be resolved, sqls are refused until db switched
 	tableDesc        *map[string][]string
 	status           uint16
 	lastInsertID     uint64
@@ -61,6 +64,20 @@ type SessionExecutor struct {
 	stmtID uint32
 	stmts  map[uint32]*Stmt //prepare相关,client端到proxy的stmt
 
+	multiStatements bool // client enables CLIENT_MULTI_STATEMENTS
+
+	process processState // state shown in process list
+
+	sessionLimiters  []*limiter       // limiters holding session slots, released when session closed
+	maxExecutionTime int64            // set by SET max_execution_time, millisecond, 0 means no limit
+	queryGuard       *queryGuard      // limits of running query command, nil if no limit applied
+	sessions         *sessionRegistry // sessions of proxy, used by KILL statement
+
+	// digest of mask rule and table desc used as part of plan cache key, it's rebuilt if they are changed
+	planContext     string
+	planContextRule *map[util.RuleKey]string
+	planContextDesc *map[string][]string
+
 	parser *parser.Parser
 }
 
@@ -86,6 +103,8 @@ const (
 	RespEOF
 	// RespNoop means empty message
 	RespNoop
+	// RespMulti means responses of multi statements
+	RespMulti
 )
 
 // CreateOKResponse create ok response
@@ -140,6 +159,15 @@ func CreateEOFResponse(status uint16) Response {
 	}
 }
 
+// CreateMultiResponse create response of multi statements, every sub response is a result or an error
+func CreateMultiResponse(status uint16, rs []Response) Response {
+	return Response{
+		RespType: RespMulti,
+		Status:   status,
+		Data:     rs,
+	}
+}
+
 // CreateNoopResponse no op response, for ComStmtClose
 func CreateNoopResponse() Response {
 	return Response{
@@ -239,7 +267,7 @@ func (se *SessionExecutor) SetCharset(charset string) {
 }
 
 // SetNamespaceDefaultCharset set session default charset
-func (se SessionExecutor) SetNamespaceDefaultCharset() {
+func (se *SessionExecutor) SetNamespaceDefaultCharset() {
 	se.charset = se.manager.GetNamespaceByName(se.namespace).GetDefaultCharset()
 }
 
@@ -260,6 +288,10 @@ func (se *SessionExecutor) GetDatabase() string {
 
 // ExecuteCommand execute command
 func (se *SessionExecutor) ExecuteCommand(cmd byte, data []byte) Response {
+	if err := se.checkMaskPolicy(cmd, data); err != nil {
+		return CreateErrorResponse(se.status, err)
+	}
+
 	switch cmd {
 	case mysql.ComQuit:
 		se.handleRollback()
@@ -268,6 +300,15 @@ func (se *SessionExecutor) ExecuteCommand(cmd byte, data []byte) Response {
 		return CreateNoopResponse()
 	case mysql.ComQuery: // data type: string[EOF]
 		sql := string(data)
+		if se.multiStatements && isMultiStatements(sql) {
+			sqls, err := se.splitMultiStatements(sql)
+			if err != nil {
+				return CreateErrorResponse(se.status, err)
+			}
+			if len(sqls) > 1 {
+				return se.handleMultiQuery(sqls)
+			}
+		}
 		// handle phase
 		r, err := se.handleQuery(sql)
 		if err != nil {
@@ -276,6 +317,11 @@ func (se *SessionExecutor) ExecuteCommand(cmd byte, data []byte) Response {
 		return CreateResultResponse(se.status, r)
 	case mysql.ComPing:
 		return CreateOKResponse(se.status)
+	case mysql.ComResetConnection:
+		if err := se.handleResetConnection(); err != nil {
+			return CreateErrorResponse(se.status, err)
+		}
+		return CreateOKResponse(se.status)
 	case mysql.ComInitDB:
 		db := string(data)
 		// handle phase
@@ -322,7 +368,26 @@ func (se *SessionExecutor) ExecuteCommand(cmd byte, data []byte) Response {
 			return CreateErrorResponse(se.status, err)
 		}
 		return CreateOKResponse(se.status)
+	case mysql.ComProcessKill: // data type: int<4> connection id
+		if len(data) < 4 {
+			return CreateErrorResponse(se.status, mysql.ErrMalformPacket)
+		}
+		if err := se.handleKill(binary.LittleEndian.Uint32(data), false); err != nil {
+			return CreateErrorResponse(se.status, err)
+		}
+		return CreateOKResponse(se.status)
 	case mysql.ComSetOption:
+		if len(data) < 2 {
+			return CreateErrorResponse(se.status, mysql.ErrMalformPacket)
+		}
+		switch binary.LittleEndian.Uint16(data) {
+		case mysql.OptionMultiStatementsOn:
+			se.multiStatements = true
+		case mysql.OptionMultiStatementsOff:
+			se.multiStatements = false
+		default:
+			return CreateErrorResponse(se.status, mysql.NewDefaultError(mysql.ErrUnknownCom))
+		}
 		return CreateEOFResponse(se.status)
 	default:
 		msg := fmt.Sprintf("command %d not supported now", cmd)
@@ -347,13 +412,12 @@ func (se *SessionExecutor) getBackendConns(sqls map[string]map[string][]string,
 func (se *SessionExecutor) getBackendConn(fromSlave bool) (pc *backend.PooledConnection, err error) {
 	if !se.isInTransaction() {
 		slice := se.GetNamespace().GetSlice()
-		return slice.GetConn(se.GetNamespace().GetUserProperty(se.user))
+		return slice.GetConn(fromSlave)
 	}
-	//return se.getTransactionConn(sliceName)
-	return nil, errors.ErrNoMasterDB
+	return se.getTransactionConn(backend.DefaultSlice)
 }
 
-/*
+// getTransactionConn return master connection bound to the transaction, it's recycled when transaction finished
 func (se *SessionExecutor) getTransactionConn(sliceName string) (pc *backend.PooledConnection, err error) {
 	se.txLock.Lock()
 	defer se.txLock.Unlock()
@@ -362,19 +426,20 @@ func (se *SessionExecutor) getTransactionConn(sliceName string) (pc *backend.Poo
 	pc, ok = se.txConns[sliceName]
 
 	if !ok {
-		slice := se.GetNamespace().GetSlice(sliceName) // returns nil only when the conf is error (fatal) so panic is correct
-		if pc, err = slice.GetMasterConn(); err != nil {
+		// slice of slaves only runs read-only transaction on slave, writes are rejected before
+		slice := se.GetNamespace().GetSlice()
+		if pc, err = slice.GetConn(false); err != nil {
 			return
 		}
 
 		if !se.isAutoCommit() {
-			if err = pc.SetAutoCommit(0); err != nil {
-				return
-			}
+			err = pc.SetAutoCommit(0)
 		} else {
-			if err = pc.Begin(); err != nil {
-				return
-			}
+			err = pc.Begin()
+		}
+		if err != nil {
+			pc.Recycle()
+			return nil, err
 		}
 
 		se.txConns[sliceName] = pc
@@ -382,11 +447,15 @@ func (se *SessionExecutor) getTransactionConn(sliceName string) (pc *backend.Poo
 
 	return
 }
-*/
 
 func (se *SessionExecutor) executeInSlice(reqCtx *util.RequestContext, pc *backend.PooledConnection, sql string) ([]*mysql.Result, error) {
 	startTime := time.Now()
+	if err := se.process.setBackend(pc); err != nil {
+		return nil, err
+	}
+	pc.SetRowChecker(se.queryGuard.rowChecker(pc))
 	r, err := pc.Execute(sql)
+	se.process.setBackend(nil)
 	se.manager.RecordBackendSQLMetrics(reqCtx, se.namespace, sql, pc.GetAddr(), startTime, err)
 
 	if err != nil {
@@ -486,7 +555,14 @@ func (se *SessionExecutor) executeInMultiSlices(reqCtx *util.RequestContext, pcs
 			}
 			for _, v := range sqls {
 				startTime := time.Now()
+				if err := se.process.setBackend(pc); err != nil {
+					rs[i] = err
+					i++
+					continue
+				}
+				pc.SetRowChecker(se.queryGuard.rowChecker(pc))
 				r, err := pc.Execute(v)
+				se.process.setBackend(nil)
 				se.manager.RecordBackendSQLMetrics(reqCtx, se.namespace, v, pc.GetAddr(), startTime, err)
 				if err != nil {
 					rs[i] = err
@@ -531,7 +607,8 @@ func canHandleWithoutPlan(stmtType int) bool {
 		stmtType == parser.StmtBegin ||
 		stmtType == parser.StmtCommit ||
 		stmtType == parser.StmtRollback ||
-		stmtType == parser.StmtUse
+		stmtType == parser.StmtUse ||
+		stmtType == parser.StmtKill
 }
 
 const variableRestoreFlag = format.RestoreKeyWordLowercase | format.RestoreNameLowercase
@@ -567,16 +644,101 @@ func canExecuteFromSlave(c *SessionExecutor, sql string) bool {
 		fromSlave = false
 	}
 
+	// locking read must be executed in master
+	if fromSlave && isLockingRead(sql) {
+		fromSlave = false
+	}
+
 	return fromSlave
 }
 
-// 如果是只读用户, 且SQL是INSERT, UPDATE, DELETE, 则拒绝执行, 返回true
-func isSQLNotAllowedByUser(c *SessionExecutor, stmtType int) bool {
-	//if c.GetNamespace().IsAllowWrite(c.user) {
-	//	return false
-	//}
+// isLockingRead check if sql is SELECT ... FOR UPDATE or SELECT ... LOCK IN SHARE MODE,
+// literals are replaced in fingerprint so they are not matched
+func isLockingRead(sql string) bool {
+	fingerprint := mysql.GetFingerprint(sql)
+	return strings.HasSuffix(fingerprint, " for update") || strings.HasSuffix(fingerprint, " lock in share mode")
+}
+
+// checkWriteWithoutMaster return error if sql is not read statement but slice has slaves only
+func checkWriteWithoutMaster(c *SessionExecutor, stmtType int, sql string) error {
+	if c.GetNamespace().GetSlice().HasMaster() || isReadOnlySQL(stmtType, sql) {
+		return nil
+	}
+	return errors.ErrWriteWithoutMaster
+}
+
+// 如果是只读用户, 只允许执行读语句: 不带INTO的SELECT, SHOW, USE, SET, BEGIN/COMMIT/ROLLBACK, DESCRIBE/EXPLAIN,
+// 其余语句(DML, DDL, GRANT, LOCK TABLES, CALL等)拒绝执行, 返回true
+func isSQLNotAllowedByUser(c *SessionExecutor, stmtType int, sql string) bool {
+	if c.GetNamespace().IsAllowWrite(c.user) {
+		return false
+	}
+	return !isReadOnlySQL(stmtType, sql)
+}
+
+// isReadOnlySQL check if sql is in allowlist of statements for read user
+func isReadOnlySQL(stmtType int, sql string) bool {
+	switch stmtType {
+	case parser.StmtSelect:
+		// SELECT ... INTO OUTFILE/DUMPFILE writes files on backend
+		return !strings.Contains(mysql.GetFingerprint(sql), " into ")
+	case parser.StmtShow, parser.StmtUse, parser.StmtSet, parser.StmtBegin, parser.StmtCommit, parser.StmtRollback:
+		return true
+	case parser.StmtOther:
+		// StmtOther also includes ANALYZE, REPAIR and OPTIMIZE, which modify tables
+		word, rest := splitFirstWord(sql)
+		switch word {
+		case "describe", "desc", "explain":
+			return isReadOnlyExplain(rest)
+		}
+	}
 	return false
-	return stmtType == parser.StmtDelete || stmtType == parser.StmtInsert || stmtType == parser.StmtUpdate
+}
+
+// isReadOnlyExplain check statement after EXPLAIN, DESCRIBE or DESC. EXPLAIN ANALYZE executes the statement
+// on MySQL 8.0.18+, so it's rejected; explained statement must be read only select, or it's a table name of DESCRIBE
+// or EXPLAIN FOR CONNECTION
+func isReadOnlyExplain(sql string) bool {
+	word, rest := splitFirstWord(sql)
+	for {
+		switch word {
+		case "analyze":
+			return false
+		case "extended", "partitions":
+			word, rest = splitFirstWord(rest)
+			continue
+		case "format":
+			// FORMAT = TRADITIONAL|JSON|TREE
+			rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+			if !strings.HasPrefix(rest, "=") {
+				return false
+			}
+			_, rest = splitFirstWord(rest[1:])
+			word, rest = splitFirstWord(rest)
+			continue
+		}
+		break
+	}
+
+	explained := strings.TrimSpace(word + " " + rest)
+	switch stmtType := parser.Preview(explained); stmtType {
+	case parser.StmtSelect:
+		return isReadOnlySQL(stmtType, explained)
+	case parser.StmtUnknown:
+		// WITH may be followed by UPDATE or DELETE
+		return word != "" && word != "with"
+	}
+	return false
+}
+
+// splitFirstWord return lower case first word of sql after leading comments, and the rest of sql
+func splitFirstWord(sql string) (string, string) {
+	trimmed := parser.StripLeadingComments(sql)
+	end := strings.IndexFunc(trimmed, func(r rune) bool { return unicode.IsSpace(r) || r == '=' || r == '(' })
+	if end == -1 {
+		return strings.ToLower(trimmed), ""
+	}
+	return strings.ToLower(trimmed[:end]), trimmed[end:]
 }
 
 func modifyResultStatus(r *mysql.Result, cc *SessionExecutor) {
@@ -648,6 +810,44 @@ func (se *SessionExecutor) handleRollback() (err error) {
 	return se.rollback()
 }
 
+// handleResetConnection reset session state without re-authentication, the database is kept
+func (se *SessionExecutor) handleResetConnection() error {
+	if err := se.resetSession(); err != nil {
+		log.Warn("reset session error, namespace: %s, user: %s, err: %v", se.namespace, se.user, err)
+	}
+	return se.refreshMaskRule()
+}
+
+// resetSession rollback transaction, clear session variables, prepared statements and mask rule
+func (se *SessionExecutor) resetSession() error {
+	err := se.rollback()
+
+	se.status = initClientConnStatus
+	se.sessionVariables = mysql.NewSessionVariables()
+	se.stmts = make(map[uint32]*Stmt)
+	se.lastInsertID = 0
+	se.maxExecutionTime = 0
+	se.maskRule = nil
+	se.maskPolicyErr = nil
+	se.tableDesc = nil
+	return err
+}
+
+// refreshMaskRule rebuild mask rule of current user and database,
+// sqls are refused if mask rule could not be resolved and on_policy_error is deny
+func (se *SessionExecutor) refreshMaskRule() error {
+	if se.db == "" {
+		se.maskPolicyErr = nil
+		return nil
+	}
+	if err := se.handleUseDB(se.db); err != nil {
+		se.maskRule = nil
+		se.maskPolicyErr = err
+		return err
+	}
+	return nil
+}
+
 func (se *SessionExecutor) commit() (err error) {
 	se.txLock.Lock()
 	defer se.txLock.Unlock()
@@ -18,7 +18,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -60,13 +62,8 @@ func (se *SessionExecutor) handleQuery(sql string) (r *mysql.Result, err error)
 	sql = strings.TrimRight(sql, ";") //删除sql语句最后的分号
 
 	reqCtx := util.NewRequestContext()
-	// check black sql
-	ns := se.GetNamespace()
-	if !ns.IsSQLAllowed(reqCtx, sql) {
-		fingerprint := mysql.GetFingerprint(sql)
-		log.Warn("catch black sql, sql: %s", sql)
-		se.manager.GetStatisticManager().RecordSQLForbidden(fingerprint, se.GetNamespace().GetName())
-		err := mysql.NewError(mysql.ErrUnknown, "sql in blacklist")
+	// check black sql and firewall
+	if err := se.checkSQL(reqCtx, sql); err != nil {
 		return nil, err
 	}
 
@@ -80,11 +77,48 @@ func (se *SessionExecutor) handleQuery(sql string) (r *mysql.Result, err error)
 	return r, err
 }
 
+// isMultiStatements is a cheap check before parsing, sql without ';' in middle is a single statement
+func isMultiStatements(sql string) bool {
+	return strings.Contains(strings.TrimRight(sql, "; \t\r\n"), ";")
+}
+
+// splitMultiStatements parse sql and return text of every statement
+func (se *SessionExecutor) splitMultiStatements(sql string) ([]string, error) {
+	stmts, _, err := se.parser.Parse(sql, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("parse sql error, sql: %s, err: %v", sql, err)
+	}
+
+	sqls := make([]string, 0, len(stmts))
+	for _, stmt := range stmts {
+		sqls = append(sqls, strings.TrimRight(strings.TrimSpace(stmt.Text()), "; \t\r\n"))
+	}
+	return sqls, nil
+}
+
+// handleMultiQuery execute statements one by one, every statement is checked, planned and masked independently.
+// like mysql, execution stops at the first failed statement.
+func (se *SessionExecutor) handleMultiQuery(sqls []string) Response {
+	rs := make([]Response, 0, len(sqls))
+	for _, sql := range sqls {
+		r, err := se.handleQuery(sql)
+		if err != nil {
+			rs = append(rs, CreateErrorResponse(se.status, err))
+			break
+		}
+		rs = append(rs, CreateResultResponse(se.status, r))
+	}
+	return CreateMultiResponse(se.status, rs)
+}
+
 func (se *SessionExecutor) doQuery(reqCtx *util.RequestContext, sql string) (*mysql.Result, error) {
 	stmtType := reqCtx.Get(util.StmtType).(int)
 
-	if isSQLNotAllowedByUser(se, stmtType) {
-		return nil, fmt.Errorf("write DML is now allowed by read user")
+	if isSQLNotAllowedByUser(se, stmtType, sql) {
+		return nil, fmt.Errorf("statement is not allowed by read user")
+	}
+	if err := checkWriteWithoutMaster(se, stmtType, sql); err != nil {
+		return nil, err
 	}
 
 	if canHandleWithoutPlan(stmtType) {
@@ -93,7 +127,10 @@ func (se *SessionExecutor) doQuery(reqCtx *util.RequestContext, sql string) (*my
 
 	db := se.db
 
-	p, err := se.getPlan(se.GetNamespace(), db, sql)
+	ns := se.GetNamespace()
+	// rewrite before planning, so rewritten sql is still masked
+	sql = se.rewriteSQL(ns, db, sql)
+	p, err := se.getCachedPlan(ns, db, sql)
 	if err != nil {
 		return nil, fmt.Errorf("get plan error, db: %s, sql: %s, err: %v", db, sql, err)
 	}
@@ -110,9 +147,56 @@ func (se *SessionExecutor) doQuery(reqCtx *util.RequestContext, sql string) (*my
 
 	modifyResultStatus(r, se)
 
+	// schema may be changed, plans built with old table desc are useless
+	if stmtType == parser.StmtDDL {
+		ns.ClearPlanCache()
+		if se.db != "" {
+			if err := se.ScanDB(); err != nil {
+				log.Warn("scan db after ddl error, db: %s, err: %v", se.db, err)
+			}
+		}
+	}
+
 	return r, nil
 }
 
+// handleKill kill query or connection of session with proxy connection id, like mysql,
+// only sessions of the same user in the namespace could be killed
+func (se *SessionExecutor) handleKill(id uint32, query bool) error {
+	if se.sessions == nil {
+		return mysql.NewDefaultError(mysql.ErrNoSuchThread, id)
+	}
+	cc := se.sessions.get(id)
+	if cc == nil || cc.namespace != se.namespace {
+		return mysql.NewDefaultError(mysql.ErrNoSuchThread, id)
+	}
+	if cc.ProcessInfo().User != se.user {
+		return mysql.NewDefaultError(mysql.ErrKillDenied, id)
+	}
+
+	if query {
+		log.Notice("kill query of session by client, namespace: %s, user: %s, connId: %d", se.namespace, se.user, id)
+		return cc.KillQuery()
+	}
+	log.Notice("kill session by client, namespace: %s, user: %s, connId: %d", se.namespace, se.user, id)
+	return cc.Kill()
+}
+
+// rewriteSQL rewrite sql by rewrite rules of namespace, sql is returned as it is if no rule matched
+func (se *SessionExecutor) rewriteSQL(ns *Namespace, db, sql string) string {
+	rules := ns.GetRewriteRules()
+	if len(rules) == 0 {
+		return sql
+	}
+	rewritten, rule := plan.RewriteSQL(rules, db, sql, se.Parse)
+	if rule == nil {
+		return sql
+	}
+	log.Debug("sql rewritten by rule: %s, sql: %s, rewritten: %s", rule.GetName(), sql, rewritten)
+	se.manager.GetStatisticManager().RecordRewrite(ns.GetName(), rule.GetName())
+	return rewritten
+}
+
 // 处理逻辑较简单的SQL, 不走执行计划部分
 func (se *SessionExecutor) handleQueryWithoutPlan(reqCtx *util.RequestContext, sql string) (*mysql.Result, error) {
 	n, err := se.Parse(sql)
@@ -133,34 +217,59 @@ func (se *SessionExecutor) handleQueryWithoutPlan(reqCtx *util.RequestContext, s
 		return nil, se.handleRollback()
 	case *ast.UseStmt:
 		return nil, se.handleUseDB(stmt.DBName)
+	case *ast.KillStmt:
+		if stmt.ConnectionID > math.MaxUint32 {
+			return nil, mysql.NewDefaultError(mysql.ErrNoSuchThread, stmt.ConnectionID)
+		}
+		return nil, se.handleKill(uint32(stmt.ConnectionID), stmt.Query)
 	default:
 		return nil, fmt.Errorf("cannot handle sql without plan, ns: %s, sql: %s", se.namespace, sql)
 	}
 }
 
+// ScanDB load columns of all tables in current db, which are used to expand select * in masking.
+// table desc of session is kept unchanged if failed.
 func (se *SessionExecutor) ScanDB() error {
-	var err error
-	all_tables, err := se.handleQuery("show tables")
+	tableDesc, err := se.scanTables(se.db)
 	if err != nil {
 		return err
 	}
+	se.tableDesc = tableDesc
+	return nil
+}
+
+// scanTables load columns of all tables in db, queries are internal,
+// so they are executed on backend directly without firewall, rewrite and limits.
+func (se *SessionExecutor) scanTables(db string) (*map[string][]string, error) {
+	allTables, err := se.scanQuery(db, "show tables")
+	if err != nil {
+		return nil, err
+	}
 	tableDesc := make(map[string][]string)
-	se.tableDesc = &tableDesc
-	for _, table := range all_tables.Values {
+	for _, table := range allTables.Values {
 		tableName := table[0].(string)
 		tableMap := make([]string, 0)
-		sql := fmt.Sprintf("show columns in %s", tableName)
-		tableDesc, err := se.handleQuery(sql)
+		sql := fmt.Sprintf("show columns in `%s`", strings.Replace(tableName, "`", "``", -1))
+		columns, err := se.scanQuery(db, sql)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		for _, field := range tableDesc.Values {
+		for _, field := range columns.Values {
 			fieldName := field[0].(string)
 			tableMap = append(tableMap, fieldName)
 		}
-		(*se.tableDesc)[strings.ToUpper(tableName)] = tableMap
+		tableDesc[strings.ToUpper(tableName)] = tableMap
 	}
-	return err
+	return &tableDesc, nil
+}
+
+// scanQuery execute internal query of ScanDB on backend, it's not checked by firewall, rewritten by rules,
+// learned into allowlist or limited by result limits of user
+func (se *SessionExecutor) scanQuery(db, sql string) (*mysql.Result, error) {
+	guard := se.queryGuard
+	se.queryGuard = nil
+	defer func() { se.queryGuard = guard }()
+	return se.ExecuteSQL(util.NewRequestContext(), backend.DefaultSlice, db, sql)
 }
 
 func (se *SessionExecutor) handleUseDB(dbName string) error {
@@ -169,11 +278,21 @@ func (se *SessionExecutor) handleUseDB(dbName string) error {
 	}
 
 	if se.GetNamespace().IsAllowedDB(dbName) {
-		se.db = dbName
-		if rule, err := se.manager.GetMaskRule(se.namespace, se.db, se.user); err == nil {
-			se.maskRule = rule
+		rule, err := se.resolveMaskRule(dbName)
+		if err != nil {
+			return err
 		}
-		se.ScanDB()
+		tableDesc, err := se.scanTables(dbName)
+		if err != nil {
+			// select * could not be masked without columns of tables
+			if rule, tableDesc, err = se.resolveScanError(dbName, rule, err); err != nil {
+				return err
+			}
+		}
+		se.db = dbName
+		se.maskRule = rule
+		se.tableDesc = tableDesc
+		se.maskPolicyErr = nil
 		return nil
 	}
 
@@ -310,6 +429,18 @@ func (se *SessionExecutor) handleSetVariable(v *ast.VariableAssignment) error {
 		return nil
 	case "sql_select_limit":
 		return nil
+	case "max_execution_time": // enforced by proxy, not sent to backend
+		value := getVariableExprResult(v.Value)
+		if value == mysql.KeywordDefault {
+			se.maxExecutionTime = 0
+			return nil
+		}
+		t, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return mysql.NewDefaultError(mysql.ErrWrongValueForVar, name, value)
+		}
+		se.maxExecutionTime = int64(t)
+		return nil
 
 		// unsupported
 	case "transaction":
@@ -360,8 +491,21 @@ func (se *SessionExecutor) handleStmtPrepare(sql string) (*Stmt, error) {
 
 	stmt.paramCount = paramCount
 	stmt.offsets = offsets
-	stmt.id = se.stmtID
 	stmt.columnCount = 0
+
+	if se.GetNamespace().IsBackendPrepare() {
+		// check black sql and firewall, emulated prepare checks it in handleQuery
+		if err := se.checkSQL(util.NewRequestContext(), sql); err != nil {
+			return nil, err
+		}
+
+		if err := se.prepareOnBackend(stmt); err != nil {
+			log.Warn("prepare on backend failed, namespace: %s, sql: %s, err: %v", se.GetNamespace().GetName(), sql, err)
+			return nil, err
+		}
+	}
+
+	stmt.id = se.stmtID
 	se.stmtID++
 
 	stmt.ResetParams()
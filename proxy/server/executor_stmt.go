@@ -34,8 +34,12 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"time"
 
+	"github.com/ZzzYtl/MyMask/backend"
 	"github.com/ZzzYtl/MyMask/mysql"
+	"github.com/ZzzYtl/MyMask/parser"
+	"github.com/ZzzYtl/MyMask/proxy/plan"
 	"github.com/ZzzYtl/MyMask/util"
 )
 
@@ -93,6 +97,13 @@ type Stmt struct {
 	paramCount  int
 	paramTypes  []byte
 	offsets     []int
+
+	// fields below are used when prepared statement is executed on backend mysql
+	backendSQL string                   // sql rewritten by plan, empty means prepare is emulated by proxy
+	db         string                   // database used to build backendSQL
+	maskRule   *map[util.RuleKey]string // mask rule used to build backendSQL
+	params     []*mysql.Field           // param definitions returned by backend mysql
+	columns    []*mysql.Field           // column definitions returned by backend mysql
 }
 
 // ResetParams reset args
@@ -161,6 +172,36 @@ func (se *SessionExecutor) handleStmtExecute(data []byte) (*mysql.Result, error)
 
 	paramNum := s.paramCount
 
+	if s.backendSQL != "" {
+		defer s.ResetParams()
+		if paramNum > 0 {
+			nullBitmapLen := (s.paramCount + 7) >> 3
+			if len(data) < (pos + nullBitmapLen + 1) {
+				return nil, mysql.ErrMalformPacket
+			}
+			nullBitmaps = data[pos : pos+nullBitmapLen]
+			pos += nullBitmapLen
+
+			//new param bound flag
+			if data[pos] == 1 {
+				pos++
+				if len(data) < (pos + (paramNum << 1)) {
+					return nil, mysql.ErrMalformPacket
+				}
+				s.SetParamTypes(data[pos : pos+(paramNum<<1)])
+				pos += (paramNum << 1)
+				paramValues = data[pos:]
+			} else {
+				paramValues = data[pos+1:]
+			}
+
+			if len(s.GetParamTypes()) != (paramNum << 1) {
+				return nil, mysql.ErrMalformPacket
+			}
+		}
+		return se.handleBackendStmtExecute(s, nullBitmaps, s.GetParamTypes(), paramValues)
+	}
+
 	var executeSQL string
 	var err error
 	if paramNum > 0 {
@@ -219,6 +260,147 @@ func (se *SessionExecutor) handleStmtExecute(data []byte) (*mysql.Result, error)
 	return r, nil
 }
 
+// prepareOnBackend build plan of s and prepare the rewritten sql on backend mysql.
+// s is left emulated if the statement can not be executed by UnshardPlan, such as SET or SELECT LAST_INSERT_ID().
+func (se *SessionExecutor) prepareOnBackend(s *Stmt) error {
+	stmtType := parser.Preview(s.sql)
+	if isSQLNotAllowedByUser(se, stmtType, s.sql) {
+		return fmt.Errorf("statement is not allowed by read user")
+	}
+	if err := checkWriteWithoutMaster(se, stmtType, s.sql); err != nil {
+		return err
+	}
+
+	if canHandleWithoutPlan(stmtType) {
+		return nil
+	}
+
+	p, err := se.getStmtPlan(se.GetNamespace(), s)
+	if err != nil {
+		return err
+	}
+
+	up, ok := p.(*plan.UnshardPlan)
+	if !ok {
+		return nil
+	}
+
+	pc, err := se.getBackendConn(canExecuteFromSlave(se, s.sql))
+	defer se.recycleBackendConn(pc, false)
+	if err != nil {
+		return err
+	}
+
+	phyDB, err := se.GetNamespace().GetDefaultPhyDB(se.db)
+	if err != nil {
+		return err
+	}
+
+	if err = initBackendConn(pc, phyDB, se.charset, se.collation, se.sessionVariables); err != nil {
+		return err
+	}
+
+	bs, err := pc.Prepare(up.GetSQL())
+	if err != nil {
+		return err
+	}
+
+	if bs.ParamCount() != s.paramCount {
+		return mysql.NewError(mysql.ErrUnknown,
+			fmt.Sprintf("param count of backend statement not match, expect: %d, actual: %d", s.paramCount, bs.ParamCount()))
+	}
+
+	s.backendSQL = up.GetSQL()
+	s.db = se.db
+	s.maskRule = se.maskRule
+	s.params = bs.Params()
+	s.columns = bs.Fields()
+	s.columnCount = len(s.columns)
+	return nil
+}
+
+// getStmtPlan rewrite sql of s by rewrite rules before planning like doQuery, so rewritten sql is still masked
+func (se *SessionExecutor) getStmtPlan(ns *Namespace, s *Stmt) (plan.Plan, error) {
+	sql := se.rewriteSQL(ns, se.db, s.sql)
+	p, err := se.getPlan(ns, se.db, sql)
+	if err != nil {
+		return nil, fmt.Errorf("get plan error, db: %s, sql: %s, err: %v", se.db, sql, err)
+	}
+	return p, nil
+}
+
+// handleBackendStmtExecute execute s on backend mysql using ComStmtExecute, the binary params of client are forwarded
+func (se *SessionExecutor) handleBackendStmtExecute(s *Stmt, nullBitmap, paramTypes, paramValues []byte) (*mysql.Result, error) {
+	// database or mask rule of session changed after prepare, the rewritten sql must be rebuilt
+	if s.db != se.db || s.maskRule != se.maskRule {
+		if err := se.prepareOnBackend(s); err != nil {
+			return nil, err
+		}
+	}
+
+	args := &backend.StmtArgs{
+		NullBitmap:  nullBitmap,
+		ParamTypes:  paramTypes,
+		ParamValues: paramValues,
+	}
+	for i, arg := range s.args {
+		if b, ok := arg.([]byte); ok {
+			if args.LongData == nil {
+				args.LongData = make(map[uint16][]byte, 1)
+			}
+			args.LongData[uint16(i)] = b
+		}
+	}
+
+	reqCtx := util.NewRequestContext()
+	stmtType := parser.Preview(s.sql)
+	reqCtx.Set(util.StmtType, stmtType)
+	if canExecuteFromSlave(se, s.sql) {
+		reqCtx.Set(util.FromSlave, 1)
+	}
+
+	startTime := time.Now()
+	r, err := se.executeStmtInSlice(reqCtx, s, args)
+	se.manager.RecordSessionSQLMetrics(reqCtx, se.namespace, s.sql, startTime, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if stmtType == parser.StmtInsert && r.InsertID != 0 {
+		se.SetLastInsertID(r.InsertID)
+	}
+
+	modifyResultStatus(r, se)
+	return r, nil
+}
+
+func (se *SessionExecutor) executeStmtInSlice(reqCtx *util.RequestContext, s *Stmt, args *backend.StmtArgs) (*mysql.Result, error) {
+	pc, err := se.getBackendConn(getFromSlave(reqCtx))
+	defer se.recycleBackendConn(pc, false)
+	if err != nil {
+		return nil, err
+	}
+
+	phyDB, err := se.GetNamespace().GetDefaultPhyDB(s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = initBackendConn(pc, phyDB, se.charset, se.collation, se.sessionVariables); err != nil {
+		return nil, err
+	}
+
+	startTime := time.Now()
+	if err := se.process.setBackend(pc); err != nil {
+		return nil, err
+	}
+	pc.SetRowChecker(se.queryGuard.rowChecker(pc))
+	r, err := pc.StmtExecute(s.backendSQL, args)
+	se.process.setBackend(nil)
+	se.manager.RecordBackendSQLMetrics(reqCtx, se.namespace, s.backendSQL, pc.GetAddr(), startTime, err)
+	return r, err
+}
+
 // long data and generic args are all in s.args
 func (se *SessionExecutor) bindStmtArgs(s *Stmt, nullBitmap, paramTypes, paramValues []byte) error {
 	args := s.args
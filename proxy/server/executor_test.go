@@ -18,6 +18,8 @@ import (
 
 	"fmt"
 
+	"github.com/ZzzYtl/MyMask/backend"
+	"github.com/ZzzYtl/MyMask/models"
 	"github.com/ZzzYtl/MyMask/parser"
 	"github.com/ZzzYtl/MyMask/parser/ast"
 )
@@ -51,3 +53,162 @@ func TestGetVariableExprResult(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitMultiStatements(t *testing.T) {
+	tests := []struct {
+		sql    string
+		multi  bool
+		expect []string
+	}{
+		{"select 1", false, []string{"select 1"}},
+		{"select 1;", false, []string{"select 1"}},
+		{"select 1; select 2", true, []string{"select 1", "select 2"}},
+		{"select ';'", true, []string{"select ';'"}},
+		{"use db1;select * from t where a = 'x;y';", true, []string{"use db1", "select * from t where a = 'x;y'"}},
+	}
+	se := &SessionExecutor{parser: parser.New()}
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			if actual := isMultiStatements(test.sql); actual != test.multi {
+				t.Errorf("isMultiStatements not equal, expect: %v, actual: %v", test.multi, actual)
+			}
+			sqls, err := se.splitMultiStatements(test.sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sqls) != len(test.expect) {
+				t.Fatalf("statement count not equal, expect: %v, actual: %v", test.expect, sqls)
+			}
+			for i := range sqls {
+				if sqls[i] != test.expect[i] {
+					t.Errorf("not equal, expect: %v, actual: %v", test.expect[i], sqls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIsLockingRead(t *testing.T) {
+	tests := []struct {
+		sql    string
+		expect bool
+	}{
+		{"select * from t where id = 1", false},
+		{"select * from t where id = 1 for update", true},
+		{"SELECT * FROM t WHERE id = 1 FOR   UPDATE", true},
+		{"select * from t where id = 1 lock in share mode", true},
+		{"select * from t where name = 'for update'", false},
+	}
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			if actual := isLockingRead(test.sql); actual != test.expect {
+				t.Errorf("not equal, expect: %v, actual: %v", test.expect, actual)
+			}
+		})
+	}
+}
+
+func TestIsSQLNotAllowedByUser(t *testing.T) {
+	m := NewManager()
+	current, _, _ := m.switchIndex.Get()
+	m.namespaces[current] = NewNamespaceManager()
+	m.namespaces[current].namespaces[3306] = &Namespace{name: "ns1", userProperties: map[string]*UserProperty{
+		"reader": {RWFlag: models.ReadOnly},
+		"writer": {RWFlag: models.ReadWrite},
+	}}
+
+	tests := []struct {
+		sql     string
+		allowed bool // allowed for read user
+	}{
+		{"select * from t", true},
+		{"/* comment */ select * from t where id = 1", true},
+		{"select * from t where name = 'into'", true},
+		{"select * from t into outfile '/tmp/t.txt'", false},
+		{"select * into dumpfile '/tmp/t' from t", false},
+		{"show tables", true},
+		{"use db1", true},
+		{"set autocommit = 1", true},
+		{"begin", true},
+		{"commit", true},
+		{"rollback", true},
+		{"describe t", true},
+		{"desc t", true},
+		{"explain select * from t", true},
+		{"EXPLAIN FORMAT=JSON select * from t", true},
+		{"explain format = tree (select * from t)", true},
+		{"explain extended select * from t", true},
+		{"describe db1.t c1", true},
+		{"explain for connection 10", true},
+		{"explain analyze select * from t", false},
+		{"EXPLAIN ANALYZE DELETE t1 FROM t1 JOIN t2 ON t1.id = t2.id", false},
+		{"explain format=tree analyze select 1", false},
+		{"explain delete from t", false},
+		{"explain update t set a = 1", false},
+		{"explain select * from t into outfile '/tmp/t.txt'", false},
+		{"explain with c as (select 1) delete from t", false},
+		{"insert into t values (1)", false},
+		{"update t set a = 1", false},
+		{"delete from t", false},
+		{"replace into t values (1)", false},
+		{"drop table t", false},
+		{"truncate table t", false},
+		{"alter table t add column c int", false},
+		{"create table t2 (id int)", false},
+		{"rename table t to t2", false},
+		{"grant select on *.* to u", false},
+		{"lock tables t write", false},
+		{"call p()", false},
+		{"optimize table t", false},
+		{"repair table t", false},
+		{"analyze table t", false},
+		{"/*!40101 drop table t */", false},
+	}
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmtType := parser.Preview(test.sql)
+			reader := &SessionExecutor{manager: m, namespace: "ns1", connectProxyPort: 3306, user: "reader"}
+			if actual := !isSQLNotAllowedByUser(reader, stmtType, test.sql); actual != test.allowed {
+				t.Errorf("read user not equal, expect allowed: %v, actual: %v", test.allowed, actual)
+			}
+			writer := &SessionExecutor{manager: m, namespace: "ns1", connectProxyPort: 3306, user: "writer"}
+			if isSQLNotAllowedByUser(writer, stmtType, test.sql) {
+				t.Errorf("write user should be allowed")
+			}
+		})
+	}
+}
+
+func TestCheckWriteWithoutMaster(t *testing.T) {
+	m := NewManager()
+	current, _, _ := m.switchIndex.Get()
+	m.namespaces[current] = NewNamespaceManager()
+	m.namespaces[current].namespaces[3306] = &Namespace{name: "ns1", slice: &backend.Slice{}}
+	m.namespaces[current].namespaces[3307] = &Namespace{name: "ns2", slice: &backend.Slice{Master: &backend.ConnectionPool{}}}
+
+	tests := []struct {
+		sql     string
+		allowed bool // allowed on slice of slaves only
+	}{
+		{"select * from t", true},
+		{"show tables", true},
+		{"begin", true},
+		{"select * from t into outfile '/tmp/t.txt'", false},
+		{"insert into t values (1)", false},
+		{"update t set a = 1", false},
+		{"drop table t", false},
+	}
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmtType := parser.Preview(test.sql)
+			slaves := &SessionExecutor{manager: m, namespace: "ns1", connectProxyPort: 3306}
+			if err := checkWriteWithoutMaster(slaves, stmtType, test.sql); (err == nil) != test.allowed {
+				t.Errorf("slaves only not equal, expect allowed: %v, err: %v", test.allowed, err)
+			}
+			master := &SessionExecutor{manager: m, namespace: "ns2", connectProxyPort: 3307}
+			if err := checkWriteWithoutMaster(master, stmtType, test.sql); err != nil {
+				t.Errorf("slice with master should allow all, err: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/mysql"
+	"github.com/ZzzYtl/MyMask/parser/ast"
+	"github.com/ZzzYtl/MyMask/util"
+)
+
+// name of pseudo rule used in metrics when sql is not in allowlist of user
+const firewallRuleAllowlist = "allowlist"
+
+// max count of fingerprints recorded for one user in recording mode
+const maxRecordedFingerprints = 1000
+
+// Firewall is sql firewall of namespace, it's rebuilt with namespace when config is reloaded
+type Firewall struct {
+	rules []*firewallRule
+	users map[string]*firewallUser
+}
+
+type firewallRule struct {
+	name   string
+	typ    string
+	check  string
+	action string
+	md5    string         // md5 of fingerprint, for fingerprint rule
+	regex  *regexp.Regexp // for regex rule
+	tables map[string]bool
+	users  map[string]bool // nil means all users
+}
+
+type firewallUser struct {
+	mode      string
+	allowlist map[string]bool // key: md5 of fingerprint
+}
+
+// firewallMatch means a rule matched by sql
+type firewallMatch struct {
+	rule   string
+	action string
+}
+
+// NewFirewall create firewall from config, nil config means no firewall
+func NewFirewall(cfg *models.Firewall) (*Firewall, error) {
+	if cfg == nil || (len(cfg.Rules) == 0 && len(cfg.Users) == 0) {
+		return nil, nil
+	}
+
+	f := &Firewall{users: make(map[string]*firewallUser, len(cfg.Users))}
+	for _, r := range cfg.Rules {
+		rule := &firewallRule{name: r.Name, typ: r.Type, action: r.Action}
+		switch r.Type {
+		case models.FirewallRuleFingerprint:
+			rule.md5 = mysql.GetMd5(mysql.GetFingerprint(r.Pattern))
+		case models.FirewallRuleRegex:
+			regex, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("compile regex of firewall rule: %s error: %v", r.Name, err)
+			}
+			rule.regex = regex
+		case models.FirewallRuleCheck:
+			rule.check = r.Pattern
+		}
+		if len(r.Tables) != 0 {
+			rule.tables = make(map[string]bool, len(r.Tables))
+			for _, t := range r.Tables {
+				rule.tables[strings.ToLower(strings.TrimSpace(t))] = true
+			}
+		}
+		if len(r.Users) != 0 {
+			rule.users = make(map[string]bool, len(r.Users))
+			for _, u := range r.Users {
+				rule.users[u] = true
+			}
+		}
+		f.rules = append(f.rules, rule)
+	}
+
+	for _, u := range cfg.Users {
+		fu := &firewallUser{mode: u.Mode, allowlist: make(map[string]bool, len(u.Allowlist))}
+		for _, sql := range u.Allowlist {
+			if sql = strings.TrimSpace(sql); sql != "" {
+				fu.allowlist[mysql.GetMd5(mysql.GetFingerprint(sql))] = true
+			}
+		}
+		f.users[u.User] = fu
+	}
+	return f, nil
+}
+
+// firewallSQL is sql being checked, fingerprint and ast are built only if some rule needs them
+type firewallSQL struct {
+	sql   string
+	db    string
+	parse func(sql string) (ast.StmtNode, error)
+
+	fingerprint string
+	md5         string
+
+	parsed  bool
+	stmt    ast.StmtNode
+	visitor *firewallVisitor
+
+	scanned  bool
+	words    []string
+	comments []string
+}
+
+func (q *firewallSQL) getMd5() string {
+	if q.md5 == "" {
+		q.fingerprint = mysql.GetFingerprint(q.sql)
+		q.md5 = mysql.GetMd5(q.fingerprint)
+	}
+	return q.md5
+}
+
+func (q *firewallSQL) getFingerprint() string {
+	q.getMd5()
+	return q.fingerprint
+}
+
+// getStmt return ast of sql, nil if sql can't be parsed
+func (q *firewallSQL) getStmt() (ast.StmtNode, *firewallVisitor) {
+	if !q.parsed {
+		q.parsed = true
+		stmt, err := q.parse(q.sql)
+		if err != nil {
+			log.Debug("parse sql error in firewall, sql: %s, err: %v", q.sql, err)
+			return nil, nil
+		}
+		q.stmt = stmt
+		q.visitor = &firewallVisitor{funcs: make(map[string]bool)}
+		stmt.Accept(q.visitor)
+	}
+	return q.stmt, q.visitor
+}
+
+func (q *firewallSQL) scan() {
+	if !q.scanned {
+		q.scanned = true
+		q.words, q.comments = scanWordsAndComments(q.sql)
+	}
+}
+
+// firewallVisitor collect tables, functions and wildcards used in sql
+type firewallVisitor struct {
+	wildcard bool
+	tables   []*ast.TableName
+	funcs    map[string]bool
+}
+
+func (v *firewallVisitor) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	switch x := n.(type) {
+	case *ast.WildCardField:
+		v.wildcard = true
+	case *ast.TableName:
+		v.tables = append(v.tables, x)
+	case *ast.FuncCallExpr:
+		v.funcs[x.FnName.L] = true
+	}
+	return n, false
+}
+
+func (v *firewallVisitor) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+// check return matched rules in order, it stops at the first allow or deny rule
+func (f *Firewall) check(user string, q *firewallSQL) []firewallMatch {
+	var matches []firewallMatch
+	for _, r := range f.rules {
+		if r.users != nil && !r.users[user] {
+			continue
+		}
+		if !r.match(q) {
+			continue
+		}
+		matches = append(matches, firewallMatch{rule: r.name, action: r.action})
+		if r.action != models.FirewallActionLog {
+			break
+		}
+	}
+	return matches
+}
+
+func (r *firewallRule) match(q *firewallSQL) bool {
+	switch r.typ {
+	case models.FirewallRuleFingerprint:
+		return q.getMd5() == r.md5
+	case models.FirewallRuleRegex:
+		return r.regex.MatchString(q.sql)
+	}
+
+	switch r.check {
+	case models.FirewallCheckIntoOutfile:
+		q.scan()
+		for i := 0; i+1 < len(q.words); i++ {
+			if q.words[i] == "into" && (q.words[i+1] == "outfile" || q.words[i+1] == "dumpfile") {
+				return true
+			}
+		}
+		return false
+	case models.FirewallCheckStackedComment:
+		q.scan()
+		if len(q.comments) > 1 {
+			return true
+		}
+		return len(q.comments) == 1 && strings.HasPrefix(q.comments[0], "/*!")
+	}
+
+	stmt, v := q.getStmt()
+	if stmt == nil {
+		return false
+	}
+	switch r.check {
+	case models.FirewallCheckNoWhere:
+		switch s := stmt.(type) {
+		case *ast.UpdateStmt:
+			return s.Where == nil
+		case *ast.DeleteStmt:
+			return s.Where == nil
+		}
+	case models.FirewallCheckSelectStar:
+		if _, ok := stmt.(*ast.DeleteStmt); ok || !v.wildcard {
+			return false
+		}
+		if r.tables == nil {
+			return true
+		}
+		for _, t := range v.tables {
+			if r.tables[t.Name.L] {
+				return true
+			}
+			db := t.Schema.L
+			if db == "" {
+				db = strings.ToLower(q.db)
+			}
+			if r.tables[db+"."+t.Name.L] {
+				return true
+			}
+		}
+	case models.FirewallCheckLoadFile:
+		return v.funcs[ast.LoadFile]
+	case models.FirewallCheckSleep:
+		return v.funcs[ast.Sleep] || v.funcs[ast.Benchmark]
+	}
+	return false
+}
+
+// getUser return allowlist of user, nil if not configured
+func (f *Firewall) getUser(user string) *firewallUser {
+	return f.users[user]
+}
+
+// scanWordsAndComments return lower case words and comments in sql, quoted strings and identifiers are skipped
+func scanWordsAndComments(sql string) (words []string, comments []string) {
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			i++
+			for i < len(sql) && sql[i] != c {
+				if sql[i] == '\\' && c != '`' {
+					i++
+				}
+				i++
+			}
+			i++
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				comments = append(comments, sql[i:])
+				return
+			}
+			comments = append(comments, sql[i:i+2+end+2])
+			i += 2 + end + 2
+		case c == '#' || (c == '-' && strings.HasPrefix(sql[i:], "--") && (i+2 == len(sql) || sql[i+2] <= ' ')):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				comments = append(comments, sql[i:])
+				return
+			}
+			comments = append(comments, sql[i:i+end])
+			i += end
+		case isWordChar(c):
+			start := i
+			for i < len(sql) && isWordChar(sql[i]) {
+				i++
+			}
+			words = append(words, strings.ToLower(sql[start:i]))
+		default:
+			i++
+		}
+	}
+	return
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// firewallRecorder keeps fingerprints recorded in recording mode, it lives in manager so records survive config reloading
+type firewallRecorder struct {
+	sync.Mutex
+	records map[string]map[string]string // key: namespace and user, value: md5-fingerprint
+}
+
+func newFirewallRecorder() *firewallRecorder {
+	return &firewallRecorder{records: make(map[string]map[string]string)}
+}
+
+func (r *firewallRecorder) record(namespace, user, md5, fingerprint string) {
+	key := namespace + "\x00" + user
+	r.Lock()
+	defer r.Unlock()
+	fingerprints, ok := r.records[key]
+	if !ok {
+		fingerprints = make(map[string]string, 16)
+		r.records[key] = fingerprints
+	}
+	if _, ok := fingerprints[md5]; ok || len(fingerprints) >= maxRecordedFingerprints {
+		return
+	}
+	fingerprints[md5] = fingerprint
+}
+
+// get return sorted fingerprints recorded for user, they could be put into allowlist directly
+func (r *firewallRecorder) get(namespace, user string) []string {
+	r.Lock()
+	defer r.Unlock()
+	fingerprints := r.records[namespace+"\x00"+user]
+	ret := make([]string, 0, len(fingerprints))
+	for _, f := range fingerprints {
+		ret = append(ret, f)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (r *firewallRecorder) clear(namespace, user string) {
+	r.Lock()
+	delete(r.records, namespace+"\x00"+user)
+	r.Unlock()
+}
+
+// checkSQL check sql by black sql and firewall of namespace, error is returned if sql is denied
+func (se *SessionExecutor) checkSQL(reqCtx *util.RequestContext, sql string) error {
+	ns := se.GetNamespace()
+	if !ns.IsSQLAllowed(reqCtx, sql) {
+		fingerprint := mysql.GetFingerprint(sql)
+		log.Warn("catch black sql, sql: %s", sql)
+		se.manager.GetStatisticManager().RecordSQLForbidden(fingerprint, ns.GetName())
+		return mysql.NewError(mysql.ErrUnknown, "sql in blacklist")
+	}
+
+	f := ns.GetFirewall()
+	if f == nil {
+		return nil
+	}
+
+	q := &firewallSQL{sql: sql, db: se.db, parse: se.Parse}
+	for _, m := range f.check(se.user, q) {
+		se.manager.GetStatisticManager().RecordFirewall(ns.GetName(), m.rule, m.action)
+		switch m.action {
+		case models.FirewallActionAllow:
+			return nil
+		case models.FirewallActionDeny:
+			log.Warn("sql denied by firewall, namespace: %s, user: %s, rule: %s, sql: %s", ns.GetName(), se.user, m.rule, sql)
+			return mysql.NewError(mysql.ErrUnknown, fmt.Sprintf("sql denied by firewall rule: %s", m.rule))
+		default:
+			log.Warn("sql matched firewall rule, namespace: %s, user: %s, rule: %s, sql: %s", ns.GetName(), se.user, m.rule, sql)
+		}
+	}
+
+	u := f.getUser(se.user)
+	if u == nil {
+		return nil
+	}
+	if u.mode == models.FirewallModeRecording {
+		se.manager.GetFirewallRecorder().record(ns.GetName(), se.user, q.getMd5(), q.getFingerprint())
+		return nil
+	}
+	if u.allowlist[q.getMd5()] {
+		return nil
+	}
+	if u.mode == models.FirewallModeDetecting {
+		se.manager.GetStatisticManager().RecordFirewall(ns.GetName(), firewallRuleAllowlist, models.FirewallActionLog)
+		log.Warn("sql not in firewall allowlist, namespace: %s, user: %s, sql: %s", ns.GetName(), se.user, sql)
+		return nil
+	}
+	se.manager.GetStatisticManager().RecordFirewall(ns.GetName(), firewallRuleAllowlist, models.FirewallActionDeny)
+	log.Warn("sql denied by firewall allowlist, namespace: %s, user: %s, sql: %s", ns.GetName(), se.user, sql)
+	return mysql.NewError(mysql.ErrUnknown, "sql denied by firewall allowlist")
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ZzzYtl/MyMask/models"
+)
+
+func TestFirewallCheck(t *testing.T) {
+	cfg := &models.Firewall{
+		Rules: []*models.FirewallRule{
+			{Name: "allow_admin", Type: models.FirewallRuleRegex, Pattern: "(?i)^select", Users: []string{"admin"}, Action: models.FirewallActionAllow},
+			{Name: "no_where", Type: models.FirewallRuleCheck, Pattern: models.FirewallCheckNoWhere, Action: models.FirewallActionDeny},
+			{Name: "select_star", Type: models.FirewallRuleCheck, Pattern: models.FirewallCheckSelectStar, Tables: []string{"db1.user"}, Action: models.FirewallActionLog},
+			{Name: "outfile", Type: models.FirewallRuleCheck, Pattern: models.FirewallCheckIntoOutfile, Action: models.FirewallActionDeny},
+			{Name: "load_file", Type: models.FirewallRuleCheck, Pattern: models.FirewallCheckLoadFile, Action: models.FirewallActionDeny},
+			{Name: "sleep", Type: models.FirewallRuleCheck, Pattern: models.FirewallCheckSleep, Action: models.FirewallActionDeny},
+			{Name: "comment", Type: models.FirewallRuleCheck, Pattern: models.FirewallCheckStackedComment, Action: models.FirewallActionDeny},
+			{Name: "fingerprint", Type: models.FirewallRuleFingerprint, Pattern: "select name from t where id = 1", Action: models.FirewallActionDeny},
+		},
+	}
+	f, err := NewFirewall(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	se := newSessionExecutor(nil)
+	tests := []struct {
+		user   string
+		sql    string
+		expect []string
+	}{
+		{"u", "update t set a = 1", []string{"no_where"}},
+		{"u", "delete from t where id = 1", nil},
+		{"u", "select * from user where id = 1", []string{"select_star"}},
+		{"u", "select * from db2.user", nil},
+		{"u", "select id from user", nil},
+		{"admin", "select * from user into outfile '/tmp/a'", []string{"allow_admin"}},
+		{"u", "select * from t into outfile '/tmp/a'", []string{"outfile"}},
+		{"u", "select 'into outfile' from t", nil},
+		{"u", "select load_file('/etc/passwd')", []string{"load_file"}},
+		{"u", "select benchmark(1000000, md5('a'))", []string{"sleep"}},
+		{"u", "select id from t where id = 1 or sleep(5)", []string{"sleep"}},
+		{"u", "select id/**/from/**/t", []string{"comment"}},
+		{"u", "select /*!50000 id */ from t", []string{"comment"}},
+		{"u", "select /*master*/ id from t", nil},
+		{"u", "select name from t where id = 100", []string{"fingerprint"}},
+	}
+	for _, test := range tests {
+		q := &firewallSQL{sql: test.sql, db: "db1", parse: se.Parse}
+		var actual []string
+		for _, m := range f.check(test.user, q) {
+			actual = append(actual, m.rule)
+		}
+		if !reflect.DeepEqual(actual, test.expect) {
+			t.Errorf("sql: %s, expect: %v, actual: %v", test.sql, test.expect, actual)
+		}
+	}
+}
+
+func TestFirewallRecorder(t *testing.T) {
+	r := newFirewallRecorder()
+	for _, sql := range []string{"select id from t where id = 1", "select id from t where id = 2", "select 1"} {
+		q := &firewallSQL{sql: sql}
+		r.record("ns", "u", q.getMd5(), q.getFingerprint())
+	}
+	expect := []string{"select ?", "select id from t where id = ?"}
+	if actual := r.get("ns", "u"); !reflect.DeepEqual(actual, expect) {
+		t.Errorf("recorded fingerprints not equal, expect: %v, actual: %v", expect, actual)
+	}
+
+	// recorded fingerprints could be used as allowlist directly
+	f, err := NewFirewall(&models.Firewall{Users: []*models.FirewallUser{{User: "u", Mode: models.FirewallModeProtecting, Allowlist: expect}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &firewallSQL{sql: "select id from t where id = 3"}
+	if !f.getUser("u").allowlist[q.getMd5()] {
+		t.Errorf("sql should be allowed by recorded fingerprint")
+	}
+
+	r.clear("ns", "u")
+	if len(r.get("ns", "u")) != 0 {
+		t.Errorf("recorded fingerprints should be cleared")
+	}
+}
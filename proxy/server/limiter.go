@@ -0,0 +1,364 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/backend"
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/mysql"
+	"github.com/ZzzYtl/MyMask/util/sync2"
+)
+
+// names of limits, used in error message and metrics
+const (
+	limitMaxSessions      = "max_sessions"
+	limitMaxQueries       = "max_queries"
+	limitQPS              = "qps"
+	limitMaxRows          = "max_rows"
+	limitMaxResultBytes   = "max_result_bytes"
+	limitMaxExecutionTime = "max_execution_time"
+
+	namespaceLimitPrefix = "namespace_" // prefix of limits of namespace, e.g. namespace_qps
+)
+
+// tokenBucket is used to limit qps, it's not safe for concurrent use
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take take one token from bucket, burst is capacity of bucket and equals to qps if not set
+func (b *tokenBucket) take(now time.Time, qps, burst int) bool {
+	if burst <= 0 {
+		burst = qps
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * float64(qps)
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limiter counts sessions and queries of a namespace or user
+type limiter struct {
+	sync.Mutex
+	sessions int
+	queries  int
+	bucket   tokenBucket
+}
+
+func (l *limiter) acquireSession(maxSessions int) bool {
+	l.Lock()
+	defer l.Unlock()
+	if maxSessions > 0 && l.sessions >= maxSessions {
+		return false
+	}
+	l.sessions++
+	return true
+}
+
+func (l *limiter) releaseSession() {
+	l.Lock()
+	l.sessions--
+	l.Unlock()
+}
+
+// acquireQuery return name of exceeded limit if query is not allowed
+func (l *limiter) acquireQuery(limits *models.Limits, now time.Time) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	if limits.MaxQueries > 0 && l.queries >= limits.MaxQueries {
+		return limitMaxQueries, false
+	}
+	if limits.QPS > 0 && !l.bucket.take(now, limits.QPS, limits.Burst) {
+		return limitQPS, false
+	}
+	l.queries++
+	return "", true
+}
+
+func (l *limiter) releaseQuery() {
+	l.Lock()
+	l.queries--
+	l.Unlock()
+}
+
+// limiterRegistry keeps limiters by namespace and user, it lives in manager so counters survive config reloading
+type limiterRegistry struct {
+	sync.Mutex
+	limiters map[string]*limiter
+}
+
+func newLimiterRegistry() *limiterRegistry {
+	return &limiterRegistry{limiters: make(map[string]*limiter, 16)}
+}
+
+func (r *limiterRegistry) get(key string) *limiter {
+	r.Lock()
+	defer r.Unlock()
+	l, ok := r.limiters[key]
+	if !ok {
+		l = &limiter{}
+		r.limiters[key] = l
+	}
+	return l
+}
+
+func (r *limiterRegistry) getNamespaceLimiter(namespace string) *limiter {
+	return r.get(namespace)
+}
+
+func (r *limiterRegistry) getUserLimiter(namespace, user string) *limiter {
+	return r.get(namespace + "\x00" + user)
+}
+
+// minLimit return the smaller one of limits of namespace and user, 0 means no limit
+func minLimit(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// acquireSessionLimit check limits of sessions after user is authenticated, slots are released in releaseSessionLimit
+func (se *SessionExecutor) acquireSessionLimit() error {
+	ns := se.GetNamespace()
+	limiters := se.manager.GetLimiters()
+
+	if limits := ns.GetLimits(); limits != nil {
+		l := limiters.getNamespaceLimiter(ns.GetName())
+		if !l.acquireSession(limits.MaxSessions) {
+			se.manager.GetStatisticManager().RecordLimitExceeded(ns.GetName(), namespaceLimitPrefix+limitMaxSessions)
+			return mysql.NewDefaultError(mysql.ErrConCount)
+		}
+		se.sessionLimiters = append(se.sessionLimiters, l)
+	}
+
+	if limits := ns.GetUserLimits(se.user); limits != nil {
+		l := limiters.getUserLimiter(ns.GetName(), se.user)
+		if !l.acquireSession(limits.MaxSessions) {
+			se.releaseSessionLimit()
+			se.manager.GetStatisticManager().RecordLimitExceeded(ns.GetName(), limitMaxSessions)
+			return mysql.NewDefaultError(mysql.ErrTooManyUserConnections, se.user)
+		}
+		se.sessionLimiters = append(se.sessionLimiters, l)
+	}
+	return nil
+}
+
+func (se *SessionExecutor) releaseSessionLimit() {
+	for _, l := range se.sessionLimiters {
+		l.releaseSession()
+	}
+	se.sessionLimiters = nil
+}
+
+// queryGuard enforces limits on one query command
+type queryGuard struct {
+	se             *SessionExecutor
+	namespace      string
+	user           string
+	limiters       []*limiter
+	maxRows        int64
+	maxResultBytes int64
+	timer          *time.Timer
+	timedOut       sync2.AtomicBool
+}
+
+// beginQuery check limits of concurrent queries and qps, and start timer of max execution time,
+// backend query is killed when timer fires.
+// guard.end must be called when query finished.
+func (se *SessionExecutor) beginQuery() (*queryGuard, error) {
+	ns := se.GetNamespace()
+	nsLimits, userLimits := ns.GetLimits(), ns.GetUserLimits(se.user)
+	g := &queryGuard{se: se, namespace: ns.GetName(), user: se.user}
+
+	now := time.Now()
+	limiters := se.manager.GetLimiters()
+	var maxExecutionTime int64
+	if nsLimits != nil {
+		l := limiters.getNamespaceLimiter(ns.GetName())
+		if name, ok := l.acquireQuery(nsLimits, now); !ok {
+			return nil, g.limitExceeded(namespaceLimitPrefix+name, limitValue(nsLimits, name))
+		}
+		g.limiters = append(g.limiters, l)
+		g.maxRows, g.maxResultBytes, maxExecutionTime = nsLimits.MaxRows, nsLimits.MaxResultBytes, nsLimits.MaxExecutionTime
+	}
+	if userLimits != nil {
+		l := limiters.getUserLimiter(ns.GetName(), se.user)
+		if name, ok := l.acquireQuery(userLimits, now); !ok {
+			g.release()
+			return nil, g.limitExceeded(name, limitValue(userLimits, name))
+		}
+		g.limiters = append(g.limiters, l)
+		g.maxRows = minLimit(g.maxRows, userLimits.MaxRows)
+		g.maxResultBytes = minLimit(g.maxResultBytes, userLimits.MaxResultBytes)
+		maxExecutionTime = minLimit(maxExecutionTime, userLimits.MaxExecutionTime)
+	}
+
+	// SET max_execution_time could lower the limit of config but not raise it
+	maxExecutionTime = minLimit(maxExecutionTime, se.maxExecutionTime)
+	if maxExecutionTime > 0 {
+		g.timer = time.AfterFunc(time.Duration(maxExecutionTime)*time.Millisecond, g.onTimeout)
+	}
+	return g, nil
+}
+
+func limitValue(limits *models.Limits, name string) int64 {
+	switch name {
+	case limitMaxQueries:
+		return int64(limits.MaxQueries)
+	case limitQPS:
+		return int64(limits.QPS)
+	}
+	return 0
+}
+
+// onTimeout kill query running on backend, the client gets error of timeout
+func (g *queryGuard) onTimeout() {
+	g.timedOut.Set(true)
+	if err := g.se.process.killQuery(); err != nil {
+		log.Warn("kill query error when max execution time exceeded, namespace: %s, user: %s, err: %v", g.namespace, g.user, err)
+	}
+}
+
+func (g *queryGuard) limitExceeded(name string, value int64) error {
+	g.se.manager.GetStatisticManager().RecordLimitExceeded(g.namespace, name)
+	return mysql.NewDefaultError(mysql.ErrUserLimitReached, g.user, name, value)
+}
+
+// rowChecker return checker of rows read from backend connection pc, the query is killed when limit of rows
+// or bytes is exceeded, so that result set too large is not buffered in proxy. nil if there is no limit.
+func (g *queryGuard) rowChecker(pc *backend.PooledConnection) backend.RowChecker {
+	if g == nil || (g.maxRows <= 0 && g.maxResultBytes <= 0) {
+		return nil
+	}
+	connID := pc.GetConnectionID()
+	var rows, size int64
+	return func(row []byte) error {
+		rows++
+		size += int64(len(row))
+		var err error
+		if g.maxRows > 0 && rows > g.maxRows {
+			err = g.limitExceeded(limitMaxRows, g.maxRows)
+		} else if g.maxResultBytes > 0 && size > g.maxResultBytes {
+			err = g.limitExceeded(limitMaxResultBytes, g.maxResultBytes)
+		}
+		if err != nil {
+			if e := pc.KillQuery(connID); e != nil {
+				log.Warn("kill query error when result limit exceeded, namespace: %s, user: %s, err: %v", g.namespace, g.user, e)
+			}
+		}
+		return err
+	}
+}
+
+// checkResult check limits of rows and bytes of result set, result sets read from backend are checked
+// while reading by rowChecker, this check is for result sets merged in proxy
+func (g *queryGuard) checkResult(r *mysql.Result) error {
+	if r == nil || r.Resultset == nil {
+		return nil
+	}
+	if g.maxRows > 0 && int64(r.RowNumber()) > g.maxRows {
+		return g.limitExceeded(limitMaxRows, g.maxRows)
+	}
+	if g.maxResultBytes > 0 {
+		var size int64
+		for _, row := range r.RowDatas {
+			size += int64(len(row))
+		}
+		if size > g.maxResultBytes {
+			return g.limitExceeded(limitMaxResultBytes, g.maxResultBytes)
+		}
+	}
+	return nil
+}
+
+// end check result and release limits of query, response is replaced by error if any limit exceeded
+func (g *queryGuard) end(rs Response) Response {
+	g.release()
+
+	if g.timedOut.Get() {
+		g.se.manager.GetStatisticManager().RecordLimitExceeded(g.namespace, limitMaxExecutionTime)
+		return CreateErrorResponse(rs.Status, mysql.NewDefaultError(mysql.ErrQueryTimeout))
+	}
+
+	switch rs.RespType {
+	case RespResult:
+		if err := g.checkResult(rs.Data.(*mysql.Result)); err != nil {
+			return CreateErrorResponse(rs.Status, err)
+		}
+	case RespMulti:
+		multi := rs.Data.([]Response)
+		for i, r := range multi {
+			if r.RespType != RespResult {
+				continue
+			}
+			if err := g.checkResult(r.Data.(*mysql.Result)); err != nil {
+				// results after the failed one are dropped like failed statement in multi query
+				multi[i] = CreateErrorResponse(r.Status, err)
+				rs.Data = multi[:i+1]
+				break
+			}
+		}
+	}
+	return rs
+}
+
+// release stop timer and release limits, it could be called more than once
+func (g *queryGuard) release() {
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	for _, l := range g.limiters {
+		l.releaseQuery()
+	}
+	g.limiters = nil
+}
+
+// isQueryCommand check if command executes statement, limits of queries are applied on it
+func isQueryCommand(cmd byte) bool {
+	return cmd == mysql.ComQuery || cmd == mysql.ComStmtExecute
+}
+
+// ExecuteCommandWithLimits execute command with resource limits of namespace and user
+func (se *SessionExecutor) ExecuteCommandWithLimits(cmd byte, data []byte) Response {
+	if !isQueryCommand(cmd) {
+		return se.ExecuteCommand(cmd, data)
+	}
+
+	g, err := se.beginQuery()
+	if err != nil {
+		return CreateErrorResponse(se.status, err)
+	}
+	defer g.release()
+	se.queryGuard = g
+	defer func() { se.queryGuard = nil }()
+	return g.end(se.ExecuteCommand(cmd, data))
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/backend"
+	"github.com/ZzzYtl/MyMask/models"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := &tokenBucket{}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if !b.take(now, 1, 2) {
+			t.Fatalf("take token %d should succeed in burst", i)
+		}
+	}
+	if b.take(now, 1, 2) {
+		t.Errorf("take token should fail when bucket is empty")
+	}
+	if b.take(now.Add(500*time.Millisecond), 1, 2) {
+		t.Errorf("take token should fail before refilled")
+	}
+	if !b.take(now.Add(time.Second), 1, 2) {
+		t.Errorf("take token should succeed after refilled")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{}
+	if !l.acquireSession(1) {
+		t.Fatalf("acquire session should succeed")
+	}
+	if l.acquireSession(1) {
+		t.Errorf("acquire session should fail when max_sessions exceeded")
+	}
+	l.releaseSession()
+	if !l.acquireSession(1) {
+		t.Errorf("acquire session should succeed after released")
+	}
+
+	limits := &models.Limits{MaxQueries: 1}
+	now := time.Now()
+	if _, ok := l.acquireQuery(limits, now); !ok {
+		t.Fatalf("acquire query should succeed")
+	}
+	if name, ok := l.acquireQuery(limits, now); ok || name != limitMaxQueries {
+		t.Errorf("acquire query should fail by max_queries, actual: %s", name)
+	}
+	l.releaseQuery()
+
+	limits = &models.Limits{QPS: 1}
+	if _, ok := l.acquireQuery(limits, now); !ok {
+		t.Fatalf("acquire query should succeed")
+	}
+	l.releaseQuery()
+	if name, ok := l.acquireQuery(limits, now); ok || name != limitQPS {
+		t.Errorf("acquire query should fail by qps, actual: %s", name)
+	}
+}
+
+func TestMinLimit(t *testing.T) {
+	tests := []struct{ a, b, expect int64 }{
+		{0, 0, 0},
+		{0, 10, 10},
+		{10, 0, 10},
+		{10, 5, 5},
+		{5, 10, 5},
+	}
+	for _, test := range tests {
+		if actual := minLimit(test.a, test.b); actual != test.expect {
+			t.Errorf("minLimit(%d, %d) expect: %d, actual: %d", test.a, test.b, test.expect, actual)
+		}
+	}
+}
+
+func TestKillQueryRecycledConnection(t *testing.T) {
+	defer func(f func(*backend.PooledConnection, uint32) error) { killBackendQuery = f }(killBackendQuery)
+
+	pc := &backend.PooledConnection{}
+	owner, other := newTestSession(1), newTestSession(2)
+	owner.executor.process.backendConn, owner.executor.process.backendConnID = pc, 7
+
+	// query of owner times out, and finishes while KILL QUERY is being sent,
+	// its connection is recycled and taken by other session
+	var killed []string
+	taken := make(chan struct{})
+	killBackendQuery = func(_ *backend.PooledConnection, connID uint32) error {
+		killed = append(killed, "kill")
+		go func() {
+			owner.executor.process.setBackend(nil)
+			other.executor.process.Lock()
+			other.executor.process.backendConn, other.executor.process.backendConnID = pc, 7
+			other.executor.process.Unlock()
+			close(taken)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		select {
+		case <-taken:
+			t.Errorf("connection should not be recycled before query is killed")
+		default:
+		}
+		killed = append(killed, "killed")
+		return nil
+	}
+	g := &queryGuard{se: owner.executor}
+	g.onTimeout()
+	<-taken
+	if len(killed) != 2 || !g.timedOut.Get() {
+		t.Fatalf("query should be killed once on timeout, actual: %v", killed)
+	}
+
+	// client KILL QUERY of owner doesn't kill query of other session on the same connection
+	if err := owner.KillQuery(); err != nil || len(killed) != 2 {
+		t.Errorf("query of other session should not be killed, err: %v, killed: %v", err, killed)
+	}
+	killBackendQuery = func(_ *backend.PooledConnection, connID uint32) error {
+		killed = append(killed, "other")
+		return nil
+	}
+	if err := other.KillQuery(); err != nil || len(killed) != 3 {
+		t.Errorf("query of other session should be killed, err: %v, killed: %v", err, killed)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/util/sync2"
+)
+
+// ReloadComponentListener means listener of namespace, it's opened after config is committed
+const ReloadComponentListener = "listener"
+
+// unixClientAddr is address of clients connected by unix socket, they are treated as local host
+var unixClientAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// listenSpec means where namespace listens on
+type listenSpec struct {
+	network string
+	address string // host:port, or socket file path of unix listener
+	mode    os.FileMode
+}
+
+func (spec listenSpec) String() string {
+	return spec.network + "://" + spec.address
+}
+
+// Listener is listener of one namespace, connections are routed to the namespace by port
+type Listener struct {
+	listener net.Listener
+	port     uint32
+	spec     listenSpec
+	closed   sync2.AtomicBool
+}
+
+// Close close the listener, accept loop exits without warning
+func (l *Listener) Close() error {
+	l.closed.Set(true)
+	return l.listener.Close()
+}
+
+// getListenSpec return listen spec of namespace, tcp4 on all interfaces is used if not specified
+func getListenSpec(ns *Namespace) listenSpec {
+	network, addr, mode := ns.GetListen()
+	if network == "" {
+		network = models.ListenNetworkTCP4
+	}
+	if network == models.ListenNetworkUnix {
+		return listenSpec{network: network, address: addr, mode: mode}
+	}
+
+	host := strings.Trim(addr, "[]")
+	if host == "" && network == models.ListenNetworkTCP4 {
+		host = "0.0.0.0"
+	}
+	return listenSpec{network: network, address: net.JoinHostPort(host, strconv.Itoa(int(ns.GetProxyPort())))}
+}
+
+func openListener(port uint32, spec listenSpec) (*Listener, error) {
+	if spec.network != models.ListenNetworkUnix {
+		l, err := net.Listen(spec.network, spec.address)
+		if err != nil {
+			return nil, err
+		}
+		return &Listener{listener: l, port: port, spec: spec}, nil
+	}
+
+	// socket file may be left by last process if it's killed
+	if fi, err := os.Lstat(spec.address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen unix %s: file exists and is not a socket", spec.address)
+		}
+		if c, err := net.Dial(spec.network, spec.address); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", spec.address)
+		}
+		if err := os.Remove(spec.address); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen(spec.network, spec.address)
+	if err != nil {
+		return nil, err
+	}
+	if spec.mode != 0 {
+		if err := os.Chmod(spec.address, spec.mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return &Listener{listener: l, port: port, spec: spec}, nil
+}
+
+// unixConn reports client connected by unix socket as local host, so that allowed ip and logs work as tcp
+type unixConn struct {
+	net.Conn
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return unixClientAddr
+}
+
+// NewListeners open listeners of all namespaces
+func (s *Server) NewListeners() error {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+
+	s.listeners = make(map[uint32]*Listener)
+	for port, ns := range s.manager.GetNamespaces() {
+		lis, err := openListener(port, getListenSpec(ns))
+		if err != nil {
+			return fmt.Errorf("open listener of namespace %s error: %v", ns.GetName(), err)
+		}
+		s.listeners[port] = lis
+	}
+	return nil
+}
+
+// CheckListener make listeners consistent with namespaces, listeners of deleted namespaces are closed,
+// listeners of added namespaces or namespaces with changed listen config are opened.
+// namespaces whose listener failed to open are returned, they are retried in next check.
+func (s *Server) CheckListener() []*ReloadItem {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	if s.closed.Get() {
+		return nil
+	}
+
+	namespaces := s.manager.GetNamespaces()
+	changed := make(map[uint32]bool)
+	for port, lis := range s.listeners {
+		if ns, ok := namespaces[port]; ok {
+			if getListenSpec(ns) == lis.spec {
+				continue
+			}
+			changed[port] = true
+		}
+		log.Notice("[server] close listener, port: %d, addr: %s", port, lis.spec)
+		if err := lis.Close(); err != nil {
+			log.Warn("[server] close listener error, port: %d, addr: %s, err: %v", port, lis.spec, err)
+		}
+		delete(s.listeners, port)
+	}
+
+	var failed []*ReloadItem
+	for port, ns := range namespaces {
+		if _, ok := s.listeners[port]; ok {
+			continue
+		}
+		spec := getListenSpec(ns)
+		lis, err := openListener(port, spec)
+		if err != nil {
+			log.Warn("[server] open listener error, namespace: %s, addr: %s, err: %v", ns.GetName(), spec, err)
+			action := ReloadActionAdd
+			if changed[port] {
+				action = ReloadActionUpdate
+			}
+			failed = append(failed, &ReloadItem{Component: ReloadComponentListener, Name: ns.GetName(), Action: action, Error: err.Error()})
+			continue
+		}
+		log.Notice("[server] open listener, namespace: %s, addr: %s", ns.GetName(), spec)
+		s.listeners[port] = lis
+		go s.serve(lis)
+	}
+	return failed
+}
+
+func (s *Server) serve(lis *Listener) {
+	for !s.closed.Get() {
+		conn, err := lis.listener.Accept()
+		if err != nil {
+			if !s.closed.Get() && !lis.closed.Get() {
+				log.Warn("[server] listener accept error: %s", err.Error())
+			}
+			return
+		}
+		if lis.spec.network == models.ListenNetworkUnix {
+			conn = &unixConn{Conn: conn}
+		}
+		go s.onConn(conn, lis.port)
+	}
+}
+
+func (s *Server) closeListeners() {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+
+	s.closed.Set(true)
+	for _, v := range s.listeners {
+		if err := v.Close(); err != nil {
+			log.Warn("[server] close listener error: %v", err)
+		}
+	}
+}
+
+func listenerError(items []*ReloadItem) error {
+	msgs := make([]string, 0, len(items))
+	for _, item := range items {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", item.Name, item.Error))
+	}
+	return fmt.Errorf("open listener failed, %s", strings.Join(msgs, "; "))
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetListenSpec(t *testing.T) {
+	tests := []struct {
+		network string
+		addr    string
+		expect  string
+	}{
+		{"", "", "tcp4://0.0.0.0:13306"},
+		{"tcp4", "127.0.0.1", "tcp4://127.0.0.1:13306"},
+		{"tcp6", "", "tcp6://:13306"},
+		{"tcp6", "[::1]", "tcp6://[::1]:13306"},
+		{"tcp", "", "tcp://:13306"},
+		{"unix", "/tmp/gaea.sock", "unix:///tmp/gaea.sock"},
+	}
+	for _, test := range tests {
+		ns := &Namespace{proxyPort: 13306, listenNetwork: test.network, listenAddr: test.addr}
+		if actual := getListenSpec(ns).String(); actual != test.expect {
+			t.Errorf("listen spec not equal, expect: %s, actual: %s", test.expect, actual)
+		}
+	}
+}
+
+func TestOpenUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := listenSpec{network: "unix", address: filepath.Join(dir, "gaea.sock"), mode: 0660}
+	// stale socket file left by killed process
+	stale, err := net.Listen("unix", spec.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	lis, err := openListener(1, spec)
+	if err != nil {
+		t.Fatalf("open listener error: %v", err)
+	}
+	fi, err := os.Stat(spec.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode not equal, expect: 0660, actual: %o", fi.Mode().Perm())
+	}
+
+	// socket file in use
+	if _, err := openListener(2, spec); err == nil {
+		t.Errorf("open listener on socket in use should fail")
+	}
+	lis.Close()
+
+	if err := ioutil.WriteFile(spec.address, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openListener(1, spec); err == nil {
+		t.Errorf("open listener on regular file should fail")
+	}
+}
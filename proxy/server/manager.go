@@ -70,18 +70,26 @@ func LoadAndCreateManager(cfg *models.Proxy) (*Manager, error) {
 	return mgr, nil
 }
 
-//读取所有namespace
-func loadAllNamespace(cfg *models.Proxy) (map[string]*models.Namespace, error) {
-	// get names of all namespace
-	root := cfg.FileConfigPath
+// newConfigClient create client of config store configured in proxy config
+func newConfigClient(cfg *models.Proxy) models.Client {
 	if cfg.ConfigType == models.ConfigFile {
-		root = cfg.FileConfigPath
+		return models.NewClient(models.ConfigFile, "", "", "", cfg.FileConfigPath)
 	}
+	return models.NewClient(cfg.ConfigType, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, cfg.CoordinatorRoot)
+}
 
-	client := models.NewClient(cfg.ConfigType, root)
+//读取所有namespace
+func loadAllNamespace(cfg *models.Proxy) (map[string]*models.Namespace, error) {
+	// get names of all namespace
+	client := newConfigClient(cfg)
 	store := models.NewStore(client)
 	defer store.Close()
 	var err error
+	// config written by newer version of gaea may not be understood
+	if err = store.VerifySchemaVersion(); err != nil {
+		log.Warn("verify schema version failed, err: %v", err)
+		return nil, err
+	}
 	var names []string
 	names, err = store.ListNamespace()
 	if err != nil {
@@ -89,6 +97,12 @@ func loadAllNamespace(cfg *models.Proxy) (map[string]*models.Namespace, error) {
 		return nil, err
 	}
 
+	cipher, err := cfg.Cipher()
+	if err != nil {
+		log.Warn("load encrypt key failed, err: %v", err)
+		return nil, err
+	}
+
 	// query remote namespace models in worker goroutines
 	nameC := make(chan string)
 	namespaceC := make(chan *models.Namespace)
@@ -96,12 +110,12 @@ func loadAllNamespace(cfg *models.Proxy) (map[string]*models.Namespace, error) {
 	for i := 0; i < 10; i++ {
 		wg.Add(1)
 		go func() {
-			client := models.NewClient(cfg.ConfigType, root)
+			client := newConfigClient(cfg)
 			store := models.NewStore(client)
 			defer store.Close()
 			defer wg.Done()
 			for name := range nameC {
-				namespace, e := store.LoadNamespace(cfg.EncryptKey, name)
+				namespace, e := store.LoadNamespace(cipher, name)
 				if e != nil {
 					log.Warn("load namespace %s failed, err: %v", name, err)
 					// assign extent err out of this scope
@@ -152,9 +166,7 @@ func loadAllNamespace(cfg *models.Proxy) (map[string]*models.Namespace, error) {
 //读取所有白名单
 func loadAllWhiteListConfig(cfg *models.Proxy) (map[string]*models.WhiteList, error) {
 	// get names of all namespace
-	root := cfg.FileConfigPath
-
-	client := models.NewClient(cfg.ConfigType, root)
+	client := newConfigClient(cfg)
 	store := models.NewStore(client)
 	defer store.Close()
 	var err error
@@ -172,7 +184,7 @@ func loadAllWhiteListConfig(cfg *models.Proxy) (map[string]*models.WhiteList, er
 	for i := 0; i < 10; i++ {
 		wg.Add(1)
 		go func() {
-			client := models.NewClient(cfg.ConfigType, root)
+			client := newConfigClient(cfg)
 			store := models.NewStore(client)
 			defer store.Close()
 			defer wg.Done()
@@ -222,9 +234,7 @@ func loadAllWhiteListConfig(cfg *models.Proxy) (map[string]*models.WhiteList, er
 //读取所有白名单
 func loadAllRulesConfig(cfg *models.Proxy) (map[string]*models.FilterList, error) {
 	// get names of all namespace
-	root := cfg.FileConfigPath
-
-	client := models.NewClient(cfg.ConfigType, root)
+	client := newConfigClient(cfg)
 	store := models.NewStore(client)
 	defer store.Close()
 	ruleList, err := store.LoadRuleLists()
@@ -240,7 +250,7 @@ func loadAllRulesConfig(cfg *models.Proxy) (map[string]*models.FilterList, error
 	for i := 0; i < 10; i++ {
 		wg.Add(1)
 		go func() {
-			client := models.NewClient(cfg.ConfigType, root)
+			client := newConfigClient(cfg)
 			store := models.NewStore(client)
 			defer store.Close()
 			defer wg.Done()
@@ -260,6 +270,7 @@ func loadAllRulesConfig(cfg *models.Proxy) (map[string]*models.FilterList, error
 					return
 				}
 				filterList.Name = rule.Name
+				filterList.FileName = rule.FileName
 				filterListC <- filterList
 			}
 		}()
@@ -291,9 +302,7 @@ func loadAllRulesConfig(cfg *models.Proxy) (map[string]*models.FilterList, error
 //读取所有白名单
 func loadDataBaseConfig(cfg *models.Proxy) (map[models.DBKey]*models.DataBase, error) {
 	// get names of all namespace
-	root := cfg.FileConfigPath
-
-	client := models.NewClient(cfg.ConfigType, root)
+	client := newConfigClient(cfg)
 	store := models.NewStore(client)
 	defer store.Close()
 	var err error
@@ -302,15 +311,22 @@ func loadDataBaseConfig(cfg *models.Proxy) (map[models.DBKey]*models.DataBase, e
 		log.Warn("load databaselist failed, err: %v", err)
 		return nil, err
 	}
+	cipher, err := cfg.Cipher()
+	if err != nil {
+		log.Warn("load encrypt key failed, err: %v", err)
+		return nil, err
+	}
+	databases := &models.DataBases{DBS: databaseList}
+	if err = databases.Decrypt(cipher); err != nil {
+		log.Warn("decrypt databaselist failed, err: %v", err)
+		return nil, err
+	}
 
 	// collect all namespaces
 	dblistModels := make(map[models.DBKey]*models.DataBase, 64)
 	for _, db := range databaseList {
 		newDb := db
-		dblistModels[models.DBKey{
-			Addr: db.IP + ":" + strconv.Itoa(db.Port),
-			Db:   db.MaskDatabaseName,
-		}] = &newDb
+		dblistModels[newDb.Key()] = &newDb
 	}
 	if err != nil {
 		log.Warn("get dblist failed, err:%v", err)
@@ -328,12 +344,20 @@ type Manager struct {
 	whiteList   [2]*WhiteListManager
 	rules       [2]*RuleManager
 	dbs         [2]*DBManager
+	configs     [2]*runningConfig
 	statistics  *StatisticManager
+	limiters    *limiterRegistry  // counters of resource limits, kept across reloading
+	recorder    *firewallRecorder // fingerprints recorded by firewall, kept across reloading
+
+	closing      []*Namespace  // namespaces replaced by prepared config, closed after commit
+	pending      *ReloadResult // result of prepared reload
+	reloadLock   sync.RWMutex
+	reloadResult *ReloadResult // result of last reload
 }
 
 // NewManager return empty Manager
 func NewManager() *Manager {
-	return &Manager{}
+	return &Manager{limiters: newLimiterRegistry(), recorder: newFirewallRecorder()}
 }
 
 // CreateManager create manager
@@ -355,12 +379,17 @@ func CreateManager(cfg *models.Proxy,
 	current, _, _ := m.switchIndex.Get()
 
 	// init namespace
-	m.namespaces[current] = CreateNamespaceManager(namespaceConfigs)
-	m.whiteList[current] = CreateWhiteListManager(whitelistConfigs)
-	m.rules[current] = CreateRuleManager(filetrlistConfigs)
-	m.dbs[current] = CreateDBManager(dbConfigs)
+	result := &ReloadResult{Time: time.Now(), Committed: true}
+	config := newRunningConfig()
+	m.namespaces[current], config.namespaces, _ = NewNamespaceManager().rebuildNamespaces(nil, namespaceConfigs, result)
+	m.whiteList[current], config.whiteLists = NewWhiteListManager().rebuild(nil, whitelistConfigs, result)
+	m.rules[current], config.rules = NewRuleManager().rebuild(nil, filetrlistConfigs, result)
+	m.dbs[current], config.dbs = NewDBManager().rebuild(nil, dbConfigs, result)
+	result.Items = append(result.Items, verifyMaskPolicies(m.namespaces[current], m.dbs[current])...)
+	m.configs[current] = config
+	m.setReloadResult(result)
 	// init user
-	user, err := CreateUserManager(namespaceConfigs)
+	user, err := CreateUserManager(config.namespaces)
 	if err != nil {
 		return nil, err
 	}
@@ -402,9 +431,43 @@ func (m *Manager) ReloadNamespacePrepare(namespaceConfig *models.Namespace) erro
 	newUserManager.RebuildNamespaceUsers(namespaceConfig)
 	m.users[other] = newUserManager
 
+	config := m.configs[current].clone()
+	_, exists := config.namespaces[name]
+	config.namespaces[name] = namespaceConfig
+	m.prepareUnchanged(current, other, config)
+
+	// policies of namespace failed to verify after change are rejected, unless they failed before the change
+	result := &ReloadResult{Time: time.Now()}
+	result.add(ReloadComponentNamespace, name, reloadAction(exists), nil)
+	result.Items = append(result.Items, verifyMaskPolicies(m.namespaces[other], m.dbs[other])...)
+	if err := newPolicyErrors(name, verifyMaskPolicies(m.namespaces[current], m.dbs[current]), result.Items); err != nil {
+		log.Warn("prepare config of namespace: %s failed, err: %v", name, err)
+		m.ReloadAbort()
+		return err
+	}
+	m.pending = result
+
 	return nil
 }
 
+// newPolicyErrors return error if mask policies of namespace failed to verify after change but not before
+func newPolicyErrors(name string, before, after []*ReloadItem) error {
+	failed := make(map[string]bool, len(before))
+	for _, item := range before {
+		failed[item.Name] = true
+	}
+	var errs []string
+	for _, item := range after {
+		if strings.HasPrefix(item.Name, name+"/") && !failed[item.Name] {
+			errs = append(errs, item.Name+": "+item.Error)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("verify mask policy failed, %s", strings.Join(errs, "; "))
+}
+
 // ReloadNamespaceCommit commit config
 func (m *Manager) ReloadNamespaceCommit(name string) error {
 	current, _, index := m.switchIndex.Get()
@@ -416,23 +479,54 @@ func (m *Manager) ReloadNamespaceCommit(name string) error {
 
 	m.switchIndex.Set(!index)
 
+	if m.pending != nil {
+		m.pending.Committed = true
+		m.pending.log()
+		m.setReloadResult(m.pending)
+		m.pending = nil
+	}
 	return nil
 }
 
-// ReloadNamespaceCommit commit config
+// ReloadAllNamespaceCommit commit config prepared by ReloadAllPrepare, only replaced and deleted namespaces are closed
 func (m *Manager) ReloadAllNamespaceCommit() error {
-	current, _, index := m.switchIndex.Get()
+	_, _, index := m.switchIndex.Get()
+	m.switchIndex.Set(!index)
 
-	allNamespaces := m.namespaces[current].GetNamespaces()
-	for _, currentNamespace := range allNamespaces {
-		if currentNamespace != nil {
-			go currentNamespace.Close(true)
+	for _, ns := range m.closing {
+		go ns.Close(true)
+	}
+	m.closing = nil
+
+	if m.pending != nil {
+		if m.pending.policyChanged() {
+			m.clearPlanCaches()
 		}
+		m.pending.Committed = true
+		m.pending.log()
+		m.setReloadResult(m.pending)
+		m.pending = nil
 	}
-	m.switchIndex.Set(!index)
 	return nil
 }
 
+// ReloadAbort discard config prepared by ReloadAllPrepare or ReloadNamespacePrepare,
+// namespaces created by prepare are closed and the other index is reset to the running config.
+func (m *Manager) ReloadAbort() {
+	current, other, _ := m.switchIndex.Get()
+	if m.namespaces[other] != nil && m.namespaces[other] != m.namespaces[current] {
+		for port, ns := range m.namespaces[other].GetNamespaces() {
+			if m.namespaces[current].GetNamespace(port) != ns {
+				ns.Close(false)
+			}
+		}
+	}
+	m.namespaces[other] = m.namespaces[current]
+	m.users[other] = m.users[current]
+	m.prepareUnchanged(current, other, m.configs[current])
+	m.closing, m.pending = nil, nil
+}
+
 // DeleteNamespace delete namespace
 func (m *Manager) DeleteNamespace(name string) error {
 	current, other, index := m.switchIndex.Get()
@@ -455,6 +549,10 @@ func (m *Manager) DeleteNamespace(name string) error {
 	newUserManager.ClearNamespaceUsers(name)
 	m.users[other] = newUserManager
 
+	config := m.configs[current].clone()
+	delete(config.namespaces, name)
+	m.prepareUnchanged(current, other, config)
+
 	// switch namespace manager
 	m.switchIndex.Set(!index)
 
@@ -468,28 +566,97 @@ func (m *Manager) ReloadAllPrepare(namespaceConfigs map[string]*models.Namespace
 	whitelistConfigs map[string]*models.WhiteList,
 	filetrlistConfigs map[string]*models.FilterList,
 	dbConfigs map[models.DBKey]*models.DataBase) error {
-	_, other, _ := m.switchIndex.Get()
+	current, other, _ := m.switchIndex.Get()
 
-	// reload namespace prepare
-	m.namespaces[other] = CreateNamespaceManager(namespaceConfigs)
-	m.whiteList[other] = CreateWhiteListManager(whitelistConfigs)
-	m.rules[other] = CreateRuleManager(filetrlistConfigs)
-	m.dbs[other] = CreateDBManager(dbConfigs)
+	// only changed components are rebuilt
+	result := &ReloadResult{Time: time.Now()}
+	running := m.configs[current]
+	config := newRunningConfig()
+	m.namespaces[other], config.namespaces, m.closing = m.namespaces[current].rebuildNamespaces(running.namespaces, namespaceConfigs, result)
+	m.whiteList[other], config.whiteLists = m.whiteList[current].rebuild(running.whiteLists, whitelistConfigs, result)
+	m.rules[other], config.rules = m.rules[current].rebuild(running.rules, filetrlistConfigs, result)
+	m.dbs[other], config.dbs = m.dbs[current].rebuild(running.dbs, dbConfigs, result)
+	result.Items = append(result.Items, verifyMaskPolicies(m.namespaces[other], m.dbs[other])...)
+	m.configs[other] = config
+	m.pending = result
 	// init user
-	user, err := CreateUserManager(namespaceConfigs)
+	user, err := CreateUserManager(config.namespaces)
 	if err != nil {
+		for port, ns := range m.namespaces[other].GetNamespaces() {
+			if m.namespaces[current].GetNamespace(port) != ns {
+				ns.Close(false)
+			}
+		}
+		m.closing, m.pending = nil, nil
+		m.RecordReloadError(err)
 		return err
 	}
 	m.users[other] = user
 	return nil
 }
 
+// prepareUnchanged copy components not changed by namespace reload to other index
+func (m *Manager) prepareUnchanged(current, other int32, config *runningConfig) {
+	m.whiteList[other] = m.whiteList[current]
+	m.rules[other] = m.rules[current]
+	m.dbs[other] = m.dbs[current]
+	m.configs[other] = config
+}
+
+// clearPlanCaches clear plan caches of all namespaces, plans depend on mask rules
+func (m *Manager) clearPlanCaches() {
+	for _, ns := range m.GetNamespaces() {
+		ns.ClearPlanCache()
+	}
+}
+
+// RecordReloadError record reload which failed before components are rebuilt
+func (m *Manager) RecordReloadError(err error) {
+	result := &ReloadResult{Time: time.Now(), Error: err.Error()}
+	result.log()
+	m.setReloadResult(result)
+}
+
+func (m *Manager) setReloadResult(result *ReloadResult) {
+	m.reloadLock.Lock()
+	m.reloadResult = result
+	m.reloadLock.Unlock()
+}
+
+// AddReloadItems append items to result of last reload, such as listeners failed to open after commit
+func (m *Manager) AddReloadItems(items []*ReloadItem) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	if m.reloadResult == nil {
+		m.reloadResult = &ReloadResult{Time: time.Now(), Committed: true}
+	}
+	m.reloadResult.Items = append(m.reloadResult.Items, items...)
+}
+
+// GetReloadResult return copy of result of last reload
+func (m *Manager) GetReloadResult() *ReloadResult {
+	m.reloadLock.RLock()
+	defer m.reloadLock.RUnlock()
+	if m.reloadResult == nil {
+		return nil
+	}
+	ret := *m.reloadResult
+	ret.Items = append([]*ReloadItem(nil), m.reloadResult.Items...)
+	return &ret
+}
+
 // GetNamespace return specific namespace
 func (m *Manager) GetNamespaceByName(name string) *Namespace {
 	current, _, _ := m.switchIndex.Get()
 	return m.namespaces[current].GetNamespaceByName(name)
 }
 
+// GetNamespaces return all namespaces
+func (m *Manager) GetNamespaces() map[uint32]*Namespace {
+	current, _, _ := m.switchIndex.Get()
+	return m.namespaces[current].GetNamespaces()
+}
+
 // GetNamespace return specific namespace
 func (m *Manager) GetNamespace(port uint32) *Namespace {
 	current, _, _ := m.switchIndex.Get()
@@ -528,6 +695,16 @@ func (m *Manager) GetStatisticManager() *StatisticManager {
 	return m.statistics
 }
 
+// GetLimiters return counters of resource limits
+func (m *Manager) GetLimiters() *limiterRegistry {
+	return m.limiters
+}
+
+// GetFirewallRecorder return fingerprints recorded by firewall in recording mode
+func (m *Manager) GetFirewallRecorder() *firewallRecorder {
+	return m.recorder
+}
+
 //// GetNamespaceByUser return namespace by user
 //func (m *Manager) GetNamespaceByUser(userName, password string) string {
 //	current, _, _ := m.switchIndex.Get()
@@ -659,7 +836,31 @@ func (m *Manager) recordBackendConnectPoolMetrics(namespace string) {
 	}
 }
 
+// GetMaskRule resolve mask rule of user on db, database config is found by namespace and logical db,
+// or by addresses of all backends of namespace, no backend connection is borrowed.
 func (m *Manager) GetMaskRule(namespace, db, user string) (*map[util.RuleKey]string, error) {
+	p, err := m.resolveMaskPolicy(namespace, db, user, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ruleMap := make(map[util.RuleKey]string)
+	if !p.exempt["*"] {
+		p.ruleList.addTo(ruleMap, p.exempt)
+	}
+	return &ruleMap, nil
+}
+
+// maskPolicy is mask config resolved for user on db
+type maskPolicy struct {
+	database    *DataBase
+	ruleList    *RuleList
+	whiteRecord *WhiteListRecord // white list record of user, nil if not found
+	exempt      map[string]bool  // rules exempted by white list record at the time, nil if not active
+}
+
+// resolveMaskPolicy find database config, rule list and white list record of user on db at the time
+func (m *Manager) resolveMaskPolicy(namespace, db, user string, now time.Time) (*maskPolicy, error) {
 	ns := m.GetNamespaceByName(namespace)
 	if ns == nil {
 		return nil, fmt.Errorf("cant find namespace:%s", namespace)
@@ -668,53 +869,42 @@ func (m *Manager) GetMaskRule(namespace, db, user string) (*map[util.RuleKey]str
 	if slice == nil {
 		return nil, fmt.Errorf("cant find slice")
 	}
-	pc, err := slice.GetConn(0)
-	if err == nil {
-		defer pc.Recycle()
-	}
+
+	current, _, _ := m.switchIndex.Get()
+	database, err := m.dbs[current].resolve(namespace, slice.Addrs(), db)
 	if err != nil {
 		return nil, err
 	}
-	addr := pc.GetAddr()
-	database := m.GetDataBase(models.DBKey{
-		Addr: addr,
-		Db:   db,
-	})
-	if database == nil {
-		return nil, fmt.Errorf("cant find database(%s:%s)", addr, db)
-	}
 	ruleList := m.GetRule(database.Rule)
 	if ruleList == nil {
 		return nil, fmt.Errorf("cant find rule:%s", database.Rule)
 	}
 
-	ruleMap := make(map[util.RuleKey]string)
+	p := &maskPolicy{database: database, ruleList: ruleList}
+	p.whiteRecord = m.GetWhiteList(database.WhiteList, user)
+	if p.whiteRecord != nil && now.After(p.whiteRecord.FromTime) && now.Before(p.whiteRecord.ToTime) {
+		p.exempt = p.whiteRecord.Rules
+	}
+	return p, nil
+}
 
-	whiteList := m.GetWhiteList(database.WhiteList, user)
-	allWhite := false
-	var whiteRecord map[string]bool
-	if whiteList != nil {
-		now := time.Now()
-		if now.After(whiteList.FromTime) && now.Before(whiteList.ToTime) {
-			if _, ok := whiteList.Rules["*"]; ok {
-				allWhite = true
-			}
-			whiteRecord = whiteList.Rules
-		}
+// GetAllMaskRules return rules of all rule files without white list, used when mask rule of database could not be resolved.
+// if the same column is in more than one rule file, rule file with smaller name wins.
+func (m *Manager) GetAllMaskRules() *map[util.RuleKey]string {
+	current, _, _ := m.switchIndex.Get()
+	ruleMgr := m.rules[current]
+
+	names := make([]string, 0, len(ruleMgr.rulelists))
+	for name := range ruleMgr.rulelists {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	if allWhite == false {
-		for _, v := range ruleList.rulelist {
-			if _, ok := whiteRecord[v.Name]; ok {
-				continue
-			}
-			ruleMap[util.RuleKey{
-				Table: v.Action.Mask.TableName,
-				Col:   v.Action.Mask.ColName,
-			}] = v.Action.Mask.Function
-		}
+	ruleMap := make(map[util.RuleKey]string)
+	for _, name := range names {
+		ruleMgr.rulelists[name].addTo(ruleMap, nil)
 	}
-	return &ruleMap, nil
+	return &ruleMap
 }
 
 // NamespaceManager is the manager that holds all namespaces
@@ -907,6 +1097,87 @@ func (mgr *DBManager) GetDataBase(key models.DBKey) *DataBase {
 	return nil
 }
 
+// resolve find database config of logical db in namespace whose backends are addrs.
+// configs bound to namespace are preferred, and config with address applies only if the address is a backend of namespace;
+// otherwise configs bound to backend addresses are used, and every backend must have one.
+// all configs found must have the same policy, so that masking doesn't depend on which backend is used.
+func (mgr *DBManager) resolve(namespace string, addrs []string, db string) (*DataBase, error) {
+	var found []*DataBase
+	if d := mgr.GetDataBase(models.DBKey{Namespace: namespace, Db: db}); d != nil {
+		found = append(found, d)
+	}
+	for _, addr := range addrs {
+		if d := mgr.GetDataBase(models.DBKey{Namespace: namespace, Addr: addr, Db: db}); d != nil {
+			found = append(found, d)
+		}
+	}
+
+	if len(found) == 0 {
+		var missing []string
+		for _, addr := range addrs {
+			if d := mgr.GetDataBase(models.DBKey{Addr: addr, Db: db}); d != nil {
+				found = append(found, d)
+			} else {
+				missing = append(missing, addr)
+			}
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("cant find database(%s) of namespace %s", db, namespace)
+		}
+		if len(missing) != 0 {
+			return nil, fmt.Errorf("database(%s) of namespace %s is not configured on backends: %s", db, namespace, strings.Join(missing, ","))
+		}
+	}
+
+	for _, d := range found[1:] {
+		if !d.samePolicy(found[0]) {
+			return nil, fmt.Errorf("backends of namespace %s resolve to different policies of database(%s)", namespace, db)
+		}
+	}
+	return found[0], nil
+}
+
+// logicDBs return logical databases configured for namespace whose backends are addrs
+func (mgr *DBManager) logicDBs(namespace string, addrs []string) []string {
+	isBackend := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		isBackend[addr] = true
+	}
+
+	dbs := make(map[string]bool)
+	for key := range mgr.dbs {
+		if key.Namespace == namespace || (key.Namespace == "" && isBackend[key.Addr]) {
+			dbs[key.Db] = true
+		}
+	}
+
+	ret := make([]string, 0, len(dbs))
+	for db := range dbs {
+		ret = append(ret, db)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// verifyMaskPolicies check that every backend of namespaces resolves to exactly one policy for each logical database,
+// sessions using database failed to resolve are handled by on_policy_error of namespace.
+func verifyMaskPolicies(nsMgr *NamespaceManager, dbMgr *DBManager) []*ReloadItem {
+	var items []*ReloadItem
+	for _, ns := range nsMgr.GetNamespaces() {
+		if ns == nil || ns.GetSlice() == nil {
+			continue
+		}
+		addrs := ns.GetSlice().Addrs()
+		for _, db := range dbMgr.logicDBs(ns.GetName(), addrs) {
+			if _, err := dbMgr.resolve(ns.GetName(), addrs, db); err != nil {
+				log.Warn("verify mask policy failed, namespace: %s, db: %s, err: %v", ns.GetName(), db, err)
+				items = append(items, &ReloadItem{Component: ReloadComponentMaskPolicy, Name: ns.GetName() + "/" + db, Action: ReloadActionVerify, Error: err.Error()})
+			}
+		}
+	}
+	return items
+}
+
 // UserManager means user for auth
 // username+password是全局唯一的, 而username可以对应多个namespace
 type UserManager struct {
@@ -999,14 +1270,14 @@ func (u *UserManager) CheckPassword(user string, salt, auth []byte) (bool, strin
 	return false, ""
 }
 
-//// GetNamespaceByUser return namespace by user
-//func (u *UserManager) GetNamespaceByUser(userName, password string) string {
-//	key := getUserKey(userName, password)
-//	if name, ok := u.userNamespaces[key]; ok {
-//		return name
-//	}
-//	return ""
-//}
+// GetNamespaceByUser return namespace by user
+func (u *UserManager) GetNamespaceByUser(userName, password string) string {
+	key := getUserKey(userName, password)
+	if name, ok := u.userNamespaces[key]; ok {
+		return name
+	}
+	return ""
+}
 
 func getUserKey(username, password string) string {
 	return username + ":" + password
@@ -1025,6 +1296,15 @@ const (
 	statsLabelFlowDirection = "Flowdirection"
 	statsLabelSlice         = "Slice"
 	statsLabelIPAddr        = "IPAddr"
+	statsLabelRole          = "Role"
+	statsLabelResult        = "Result"
+	statsLabelLimit         = "Limit"
+	statsLabelRule          = "Rule"
+	statsLabelAction        = "Action"
+)
+
+const (
+	recordNodeStateInterval = 10 * time.Second
 )
 
 // StatisticManager statistics manager
@@ -1049,6 +1329,14 @@ type StatisticManager struct {
 	backendConnectPoolIdleCounts     *stats.GaugesWithMultiLabels   //后端空闲连接数统计
 	backendConnectPoolInUseCounts    *stats.GaugesWithMultiLabels   //后端正在使用连接数统计
 	backendConnectPoolWaitCounts     *stats.GaugesWithMultiLabels   //后端等待队列统计
+	backendNodeAvailable             *stats.GaugesWithMultiLabels   //后端节点是否可用, 1: 可用 0: 不可用
+	backendNodeReplicationLag        *stats.GaugesWithMultiLabels   //后端从库复制延迟, 单位: 秒
+
+	planCacheCounts     *stats.CountersWithMultiLabels // 执行计划缓存命中统计
+	limitExceededCounts *stats.CountersWithMultiLabels // 超出资源限制的请求统计
+	firewallCounts      *stats.CountersWithMultiLabels // sql防火墙规则命中统计
+	rewriteCounts       *stats.CountersWithMultiLabels // sql改写规则命中统计
+	maskPolicyErrors    *stats.CountersWithMultiLabels // 脱敏规则获取失败统计
 
 	slowSQLTime int64
 	closeChan   chan bool
@@ -1133,7 +1421,24 @@ func (s *StatisticManager) Init(cfg *models.Proxy) error {
 	s.backendConnectPoolWaitCounts = stats.NewGaugesWithMultiLabels("backendConnectPoolWaitCounts",
 		"gaea proxy backend wait connect counts", []string{statsLabelCluster, statsLabelNamespace, statsLabelSlice, statsLabelIPAddr})
 
+	s.backendNodeAvailable = stats.NewGaugesWithMultiLabels("backendNodeAvailable",
+		"gaea proxy backend node available, 1 means available", []string{statsLabelCluster, statsLabelNamespace, statsLabelRole, statsLabelIPAddr})
+	s.backendNodeReplicationLag = stats.NewGaugesWithMultiLabels("backendNodeReplicationLag",
+		"gaea proxy backend node replication lag seconds", []string{statsLabelCluster, statsLabelNamespace, statsLabelRole, statsLabelIPAddr})
+
+	s.planCacheCounts = stats.NewCountersWithMultiLabels("PlanCacheCounts",
+		"gaea proxy plan cache lookup counts", []string{statsLabelCluster, statsLabelNamespace, statsLabelResult})
+	s.limitExceededCounts = stats.NewCountersWithMultiLabels("LimitExceededCounts",
+		"gaea proxy requests rejected or killed by resource limits", []string{statsLabelCluster, statsLabelNamespace, statsLabelLimit})
+	s.firewallCounts = stats.NewCountersWithMultiLabels("FirewallCounts",
+		"gaea proxy sql firewall rule match counts", []string{statsLabelCluster, statsLabelNamespace, statsLabelRule, statsLabelAction})
+	s.rewriteCounts = stats.NewCountersWithMultiLabels("RewriteCounts",
+		"gaea proxy sql rewrite rule match counts", []string{statsLabelCluster, statsLabelNamespace, statsLabelRule})
+	s.maskPolicyErrors = stats.NewCountersWithMultiLabels("MaskPolicyErrorCounts",
+		"gaea proxy mask rule resolution failures", []string{statsLabelCluster, statsLabelNamespace, statsLabelAction})
+
 	s.startClearTask()
+	s.startRecordNodeStateTask()
 	return nil
 }
 
@@ -1168,6 +1473,45 @@ func (s *StatisticManager) startClearTask() {
 	}()
 }
 
+// record health state of backend nodes periodically
+func (s *StatisticManager) startRecordNodeStateTask() {
+	go func() {
+		t := time.NewTicker(recordNodeStateInterval)
+		for {
+			select {
+			case <-s.closeChan:
+				return
+			case <-t.C:
+				s.recordNodeStates()
+			}
+		}
+	}()
+}
+
+func (s *StatisticManager) recordNodeStates() {
+	if s.manager == nil {
+		return
+	}
+
+	s.backendNodeAvailable.ResetAll()
+	s.backendNodeReplicationLag.ResetAll()
+	for _, ns := range s.manager.GetNamespaces() {
+		slice := ns.GetSlice()
+		if slice == nil {
+			continue
+		}
+		for _, state := range slice.NodeStates() {
+			statsKey := []string{s.clusterName, ns.GetName(), state.Role, state.Addr}
+			var available int64
+			if state.Available {
+				available = 1
+			}
+			s.backendNodeAvailable.Set(statsKey, available)
+			s.backendNodeReplicationLag.Set(statsKey, state.Lag)
+		}
+	}
+}
+
 func (s *StatisticManager) clearLargeCounters() {
 	s.sqlErrorCounts.ResetAll()
 	s.sqlFingerprintSlowCounts.ResetAll()
@@ -1224,6 +1568,35 @@ func (s *StatisticManager) RecordSQLForbidden(fingerprint, namespace string) {
 	s.sqlForbidenCounts.Add([]string{s.clusterName, namespace, md5}, 1)
 }
 
+// RecordPlanCache record result of plan cache lookup
+func (s *StatisticManager) RecordPlanCache(namespace string, hit bool) {
+	result := planCacheMiss
+	if hit {
+		result = planCacheHit
+	}
+	s.planCacheCounts.Add([]string{s.clusterName, namespace, result}, 1)
+}
+
+// RecordLimitExceeded record request rejected or killed by resource limit
+func (s *StatisticManager) RecordLimitExceeded(namespace, limit string) {
+	s.limitExceededCounts.Add([]string{s.clusterName, namespace, limit}, 1)
+}
+
+// RecordRewrite record sql rewritten by rule
+func (s *StatisticManager) RecordRewrite(namespace, rule string) {
+	s.rewriteCounts.Add([]string{s.clusterName, namespace, rule}, 1)
+}
+
+// RecordFirewall record sql matched by firewall rule
+func (s *StatisticManager) RecordFirewall(namespace, rule, action string) {
+	s.firewallCounts.Add([]string{s.clusterName, namespace, rule, action}, 1)
+}
+
+// RecordMaskPolicyError record failure of resolving mask rule, action is on_policy_error of namespace
+func (s *StatisticManager) RecordMaskPolicyError(namespace, action string) {
+	s.maskPolicyErrors.Add([]string{s.clusterName, namespace, action}, 1)
+}
+
 // IncrSessionCount incr session count
 func (s *StatisticManager) IncrSessionCount(namespace string) {
 	statsKey := []string{s.clusterName, namespace}
@@ -0,0 +1,358 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/mysql"
+	"github.com/ZzzYtl/MyMask/parser"
+	"github.com/ZzzYtl/MyMask/util"
+)
+
+// newMaskPolicyError create error returned to client when mask rule could not be resolved
+func newMaskPolicyError(user, db string) error {
+	return mysql.NewErrf(mysql.ErrDBaccessDenied, "Access denied for user '%s' to database '%s', mask policy unavailable", user, db)
+}
+
+// resolveMaskRule resolve mask rule of session user on db, on_policy_error of namespace decides what to do if failed:
+// deny returns error, mask_all masks columns of all rule files, allow runs without mask
+func (se *SessionExecutor) resolveMaskRule(db string) (*map[util.RuleKey]string, error) {
+	rule, err := se.manager.GetMaskRule(se.namespace, db, se.user)
+	if err == nil {
+		return rule, nil
+	}
+
+	action := models.PolicyErrorDeny
+	if ns := se.GetNamespace(); ns != nil {
+		action = ns.GetOnPolicyError()
+	}
+	se.manager.GetStatisticManager().RecordMaskPolicyError(se.namespace, action)
+
+	switch action {
+	case models.PolicyErrorMaskAll:
+		log.Warn("resolve mask rule error, mask all known columns, namespace: %s, user: %s, db: %s, err: %v", se.namespace, se.user, db, err)
+		return se.manager.GetAllMaskRules(), nil
+	case models.PolicyErrorAllow:
+		log.Warn("[AUDIT] resolve mask rule error, session runs WITHOUT MASK, namespace: %s, user: %s, db: %s, err: %v", se.namespace, se.user, db, err)
+		return nil, nil
+	default:
+		log.Warn("resolve mask rule error, access denied, namespace: %s, user: %s, db: %s, err: %v", se.namespace, se.user, db, err)
+		return nil, newMaskPolicyError(se.user, db)
+	}
+}
+
+// resolveScanError decide by on_policy_error what to do if columns of tables in db could not be loaded, select *
+// could not be expanded and masked without them: deny returns error, mask_all masks columns of all rule files and
+// expands * to columns known by rule files only, allow keeps rule resolved and runs with select * unmasked
+func (se *SessionExecutor) resolveScanError(db string, rule *map[util.RuleKey]string, scanErr error) (*map[util.RuleKey]string, *map[string][]string, error) {
+	action := models.PolicyErrorDeny
+	if ns := se.GetNamespace(); ns != nil {
+		action = ns.GetOnPolicyError()
+	}
+	se.manager.GetStatisticManager().RecordMaskPolicyError(se.namespace, action)
+
+	switch action {
+	case models.PolicyErrorMaskAll:
+		log.Warn("scan tables error, mask all known columns, namespace: %s, user: %s, db: %s, err: %v", se.namespace, se.user, db, scanErr)
+		all := se.manager.GetAllMaskRules()
+		return all, maskRuleTableDesc(all), nil
+	case models.PolicyErrorAllow:
+		log.Warn("[AUDIT] scan tables error, select * runs WITHOUT MASK, namespace: %s, user: %s, db: %s, err: %v", se.namespace, se.user, db, scanErr)
+		return rule, nil, nil
+	default:
+		log.Warn("scan tables error, access denied, namespace: %s, user: %s, db: %s, err: %v", se.namespace, se.user, db, scanErr)
+		return nil, nil, newMaskPolicyError(se.user, db)
+	}
+}
+
+// maskRuleTableDesc return table desc with columns in mask rule only, so that columns of select * are all masked
+func maskRuleTableDesc(rule *map[util.RuleKey]string) *map[string][]string {
+	tableDesc := make(map[string][]string)
+	if rule == nil {
+		return &tableDesc
+	}
+	for key := range *rule {
+		table := strings.ToUpper(key.Table)
+		tableDesc[table] = append(tableDesc[table], key.Col)
+	}
+	for _, cols := range tableDesc {
+		sort.Strings(cols)
+	}
+	return &tableDesc
+}
+
+// checkMaskPolicy refuse commands executing sql if mask rule of current db could not be resolved,
+// switching database is allowed so that session could recover.
+func (se *SessionExecutor) checkMaskPolicy(cmd byte, data []byte) error {
+	if se.maskPolicyErr == nil {
+		return nil
+	}
+	switch cmd {
+	case mysql.ComQuery:
+		sql := string(data)
+		if parser.Preview(sql) == parser.StmtUse && !(se.multiStatements && isMultiStatements(sql)) {
+			return nil
+		}
+		return se.maskPolicyErr
+	case mysql.ComStmtPrepare, mysql.ComStmtExecute, mysql.ComFieldList:
+		return se.maskPolicyErr
+	}
+	return nil
+}
+
+// effective policies of user on db
+const (
+	MaskPolicyMask    = "mask" // columns are masked by rule list bound to db unless exempted by white list
+	MaskPolicyDeny    = "deny" // access is denied
+	MaskPolicyMaskAll = models.PolicyErrorMaskAll
+	MaskPolicyAllow   = models.PolicyErrorAllow
+)
+
+// actions on column
+const (
+	MaskColumnMask   = "mask"
+	MaskColumnExempt = "exempt"
+)
+
+// MaskPolicyExplain is effective mask policy of user from client ip on db at the time
+type MaskPolicyExplain struct {
+	Namespace       string               `json:"namespace"`
+	User            string               `json:"user"`
+	IP              string               `json:"ip,omitempty"`
+	DB              string               `json:"db"`
+	Time            string               `json:"time"`
+	Policy          string               `json:"policy"`
+	Reason          string               `json:"reason,omitempty"` // why access is denied or policy is not resolved
+	Binding         *MaskBinding         `json:"binding,omitempty"`
+	WhiteListRecord *MaskWhiteListRecord `json:"whitelist_record,omitempty"`
+	Columns         []*MaskColumnPolicy  `json:"columns,omitempty"`
+}
+
+// MaskBinding is database config binding rule list and white list to db, passwords are not included
+type MaskBinding struct {
+	Namespace        string `json:"namespace,omitempty"`
+	Address          string `json:"address,omitempty"`
+	MaskDatabaseName string `json:"mask_database_name"`
+	Rule             string `json:"rule"`
+	WhiteList        string `json:"whitelist,omitempty"`
+}
+
+// MaskWhiteListRecord is white list record of user, active means it's in effect at the time
+type MaskWhiteListRecord struct {
+	WhiteList string   `json:"whitelist"`
+	User      string   `json:"user"`
+	IPList    []string `json:"ip_list"`
+	FromTime  string   `json:"from_time"`
+	ToTime    string   `json:"to_time"`
+	Rules     []string `json:"rules"`
+	Active    bool     `json:"active"`
+}
+
+// MaskColumnPolicy is action on column of one rule
+type MaskColumnPolicy struct {
+	Table    string `json:"table"`
+	Column   string `json:"column"`
+	RuleList string `json:"rule_list"`
+	Rule     string `json:"rule"`
+	Action   string `json:"action"`
+	Function string `json:"function,omitempty"`
+	ExemptBy string `json:"exempt_by,omitempty"` // white list and user of record exempting the column
+}
+
+// ExplainMaskPolicy explain mask policy taking effect when user connects from ip and uses db at the time,
+// the same checks as login and mask rule resolving of session are done. ip is not checked if empty.
+func (m *Manager) ExplainMaskPolicy(namespace, user, ip, db string, now time.Time) (*MaskPolicyExplain, error) {
+	ns := m.GetNamespaceByName(namespace)
+	if ns == nil {
+		return nil, fmt.Errorf("cant find namespace:%s", namespace)
+	}
+
+	e := &MaskPolicyExplain{
+		Namespace: namespace,
+		User:      user,
+		IP:        ip,
+		DB:        db,
+		Time:      now.Format(models.WhiteListTimeFormat),
+		Policy:    MaskPolicyDeny,
+	}
+	if _, ok := ns.userProperties[user]; !ok {
+		e.Reason = fmt.Sprintf("user %s not found in namespace", user)
+		return e, nil
+	}
+	if ip != "" {
+		clientIP := net.ParseIP(ip)
+		if clientIP == nil {
+			return nil, fmt.Errorf("invalid ip: %s", ip)
+		}
+		if !ns.IsClientIPAllowed(clientIP) {
+			e.Reason = fmt.Sprintf("ip %s not allowed by namespace", ip)
+			return e, nil
+		}
+	}
+	if !ns.IsAllowedDB(db) {
+		e.Reason = fmt.Sprintf("db %s not allowed by namespace", db)
+		return e, nil
+	}
+
+	p, err := m.resolveMaskPolicy(namespace, db, user, now)
+	if err != nil {
+		e.Reason = err.Error()
+		switch action := ns.GetOnPolicyError(); action {
+		case models.PolicyErrorMaskAll:
+			e.Policy = MaskPolicyMaskAll
+			e.Columns = m.explainAllMaskRules()
+		case models.PolicyErrorAllow:
+			e.Policy = MaskPolicyAllow
+		}
+		return e, nil
+	}
+
+	e.Policy = MaskPolicyMask
+	e.Binding = &MaskBinding{MaskDatabaseName: p.database.Db, Rule: p.database.Rule, WhiteList: p.database.WhiteList}
+	if p.database.Ip != "" {
+		e.Binding.Address = fmt.Sprintf("%s:%d", p.database.Ip, p.database.Port)
+	}
+	exemptBy := ""
+	if r := p.whiteRecord; r != nil {
+		e.WhiteListRecord = &MaskWhiteListRecord{
+			WhiteList: p.database.WhiteList,
+			User:      r.User,
+			IPList:    r.IpList,
+			FromTime:  r.FromTime.Format(models.WhiteListTimeFormat),
+			ToTime:    r.ToTime.Format(models.WhiteListTimeFormat),
+			Active:    p.exempt != nil,
+		}
+		for rule := range r.Rules {
+			e.WhiteListRecord.Rules = append(e.WhiteListRecord.Rules, rule)
+		}
+		sort.Strings(e.WhiteListRecord.Rules)
+		exemptBy = p.database.WhiteList + "/" + r.User
+	}
+	for _, f := range p.ruleList.filters() {
+		c := newMaskColumnPolicy(p.ruleList.name, f)
+		if p.exempt["*"] || p.exempt[f.Name] {
+			c.Action, c.Function, c.ExemptBy = MaskColumnExempt, "", exemptBy
+		}
+		e.Columns = append(e.Columns, c)
+	}
+	return e, nil
+}
+
+// explainAllMaskRules explain columns masked when on_policy_error is mask_all, the same as GetAllMaskRules
+func (m *Manager) explainAllMaskRules() []*MaskColumnPolicy {
+	current, _, _ := m.switchIndex.Get()
+	ruleMgr := m.rules[current]
+
+	names := make([]string, 0, len(ruleMgr.rulelists))
+	for name := range ruleMgr.rulelists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var columns []*MaskColumnPolicy
+	masked := make(map[util.RuleKey]bool)
+	for _, name := range names {
+		for _, f := range ruleMgr.rulelists[name].filters() {
+			key := util.RuleKey{Table: f.Action.Mask.TableName, Col: f.Action.Mask.ColName}
+			if masked[key] {
+				continue
+			}
+			masked[key] = true
+			columns = append(columns, newMaskColumnPolicy(name, f))
+		}
+	}
+	return columns
+}
+
+func newMaskColumnPolicy(ruleList string, f *models.Filter) *MaskColumnPolicy {
+	return &MaskColumnPolicy{
+		Table:    f.Action.Mask.TableName,
+		Column:   f.Action.Mask.ColName,
+		RuleList: ruleList,
+		Rule:     f.Name,
+		Action:   MaskColumnMask,
+		Function: f.Action.Mask.Function,
+	}
+}
+
+// MaskConfigDump is mask config loaded by proxy
+type MaskConfigDump struct {
+	RuleLists  []*MaskConfigItem `json:"rule_lists"`
+	WhiteLists []*MaskConfigItem `json:"whitelists"`
+	DataBases  []*MaskConfigItem `json:"databases"`
+}
+
+// MaskConfigItem is one loaded config with its source in config store, version is md5 of config
+type MaskConfigItem struct {
+	Name    string      `json:"name"`
+	Source  string      `json:"source"`
+	Version string      `json:"version"`
+	Config  interface{} `json:"config"`
+}
+
+// DumpMaskConfig return rule lists, white lists and database bindings in use, passwords of databases are not included
+func (m *Manager) DumpMaskConfig() *MaskConfigDump {
+	dump := &MaskConfigDump{}
+	current, _, _ := m.switchIndex.Get()
+	config := m.configs[current]
+	if config == nil {
+		return dump
+	}
+
+	for name, rule := range config.rules {
+		dump.RuleLists = append(dump.RuleLists, newMaskConfigItem(name, rule.FileName, rule))
+	}
+	for name, whiteList := range config.whiteLists {
+		dump.WhiteLists = append(dump.WhiteLists, newMaskConfigItem(name, "white_list/"+name, whiteList))
+	}
+	for key, db := range config.dbs {
+		binding := &MaskBinding{
+			Namespace:        key.Namespace,
+			Address:          key.Addr,
+			MaskDatabaseName: db.MaskDatabaseName,
+			Rule:             db.Security.Rule,
+			WhiteList:        db.WhiteList.File,
+		}
+		var parts []string
+		for _, part := range []string{key.Namespace, key.Addr, key.Db} {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		name := strings.Join(parts, "/")
+		dump.DataBases = append(dump.DataBases, newMaskConfigItem(name, models.DataBasesName, binding))
+	}
+
+	for _, items := range [][]*MaskConfigItem{dump.RuleLists, dump.WhiteLists, dump.DataBases} {
+		sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	}
+	return dump
+}
+
+func newMaskConfigItem(name, source string, config interface{}) *MaskConfigItem {
+	b, _ := json.Marshal(config)
+	sum := md5.Sum(b)
+	return &MaskConfigItem{Name: name, Source: source, Version: hex.EncodeToString(sum[:]), Config: config}
+}
@@ -0,0 +1,317 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/backend"
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/mysql"
+	"github.com/ZzzYtl/MyMask/stats"
+	"github.com/ZzzYtl/MyMask/util"
+)
+
+func newTestFilter(name, table, col, function string) models.Filter {
+	return models.Filter{Name: name, Action: models.Action{Mask: models.Mask{TableName: table, ColName: col, Function: function}}}
+}
+
+func newTestMaskManager() *Manager {
+	newPool := func(addr string) *backend.ConnectionPool {
+		return backend.NewConnectionPool(addr, "u", "p", "", 1, 1, time.Minute, "utf8", mysql.DefaultCollationID)
+	}
+	slice := &backend.Slice{
+		Master: newPool("127.0.0.1:3306"),
+		Slave:  []*backend.ConnectionPool{newPool("127.0.0.1:3307")},
+	}
+
+	m := NewManager()
+	current, _, _ := m.switchIndex.Get()
+	m.namespaces[current] = NewNamespaceManager()
+	m.namespaces[current].namespaces[3306] = &Namespace{name: "ns1", slice: slice}
+	m.rules[current] = CreateRuleManager(map[string]*models.FilterList{
+		"r1.xml": {Name: "r1.xml", Filters: []models.Filter{
+			newTestFilter("f1", "user", "phone", "MASK_PHONE"),
+		}},
+		"r2.xml": {Name: "r2.xml", Filters: []models.Filter{
+			newTestFilter("f2", "user", "phone", "MASK_ALL"),
+			newTestFilter("f3", "user", "email", "MASK_EMAIL"),
+		}},
+	})
+	m.dbs[current] = CreateDBManager(map[models.DBKey]*models.DataBase{
+		{Namespace: "ns1", Db: "db1"}: {Namespace: "ns1", MaskDatabaseName: "db1", Security: models.SecurityR{Rule: "r2.xml"}},
+		{Namespace: "ns1", Db: "db2"}: {Namespace: "ns1", MaskDatabaseName: "db2", Security: models.SecurityR{Rule: "missing.xml"}},
+	})
+	m.whiteList[current] = NewWhiteListManager()
+	return m
+}
+
+func TestGetMaskRule(t *testing.T) {
+	m := newTestMaskManager()
+
+	rule, err := m.GetMaskRule("ns1", "db1", "u1")
+	if err != nil {
+		t.Fatalf("get mask rule error: %v", err)
+	}
+	if len(*rule) != 2 || (*rule)[util.RuleKey{Table: "user", Col: "phone"}] != "MASK_ALL" {
+		t.Errorf("mask rule not equal, actual: %v", *rule)
+	}
+
+	if _, err := m.GetMaskRule("ns1", "db2", "u1"); err == nil {
+		t.Errorf("get mask rule should fail when rule file is missing")
+	}
+	if _, err := m.GetMaskRule("ns1", "db3", "u1"); err == nil {
+		t.Errorf("get mask rule should fail when database is not configured")
+	}
+
+	all := m.GetAllMaskRules()
+	if len(*all) != 2 || (*all)[util.RuleKey{Table: "user", Col: "phone"}] != "MASK_PHONE" {
+		t.Errorf("all mask rules not equal, actual: %v", *all)
+	}
+}
+
+func TestResolveDataBase(t *testing.T) {
+	newDB := func(rule string) *models.DataBase {
+		return &models.DataBase{Security: models.SecurityR{Rule: rule}}
+	}
+	addrs := []string{"127.0.0.1:3306", "127.0.0.1:3307"}
+	mgr := CreateDBManager(map[models.DBKey]*models.DataBase{
+		// bound to namespace wins
+		{Namespace: "ns1", Db: "db1"}:       newDB("r1"),
+		{Addr: "127.0.0.1:3306", Db: "db1"}: newDB("r2"),
+		// bound to other cluster is ignored
+		{Namespace: "ns1", Addr: "127.0.0.1:3308", Db: "db2"}: newDB("r3"),
+		// bound to addresses of all backends
+		{Addr: "127.0.0.1:3306", Db: "db3"}: newDB("r1"),
+		{Addr: "127.0.0.1:3307", Db: "db3"}: newDB("r1"),
+		// not configured on slave
+		{Addr: "127.0.0.1:3306", Db: "db4"}: newDB("r1"),
+		// different policies on backends
+		{Namespace: "ns1", Db: "db5"}:                         newDB("r1"),
+		{Namespace: "ns1", Addr: "127.0.0.1:3307", Db: "db5"}: newDB("r2"),
+	})
+
+	tests := []struct {
+		db   string
+		rule string // empty means error
+	}{
+		{"db1", "r1"},
+		{"db2", ""},
+		{"db3", "r1"},
+		{"db4", ""},
+		{"db5", ""},
+	}
+	for _, test := range tests {
+		d, err := mgr.resolve("ns1", addrs, test.db)
+		if test.rule == "" {
+			if err == nil {
+				t.Errorf("resolve %s should fail", test.db)
+			}
+			continue
+		}
+		if err != nil || d.Rule != test.rule {
+			t.Errorf("resolve %s not equal, expect: %s, actual: %v, err: %v", test.db, test.rule, d, err)
+		}
+	}
+
+	if dbs := mgr.logicDBs("ns1", addrs); len(dbs) != 5 {
+		t.Errorf("logic dbs of namespace not equal, actual: %v", dbs)
+	}
+	if dbs := mgr.logicDBs("ns2", []string{"127.0.0.1:3309"}); len(dbs) != 0 {
+		t.Errorf("logic dbs of namespace not equal, actual: %v", dbs)
+	}
+}
+
+func TestCheckMaskPolicy(t *testing.T) {
+	se := newSessionExecutor(nil)
+	if err := se.checkMaskPolicy(mysql.ComQuery, []byte("select 1")); err != nil {
+		t.Errorf("sql should be allowed if mask rule resolved, err: %v", err)
+	}
+
+	se.maskPolicyErr = newMaskPolicyError("u1", "db1")
+	tests := []struct {
+		cmd     byte
+		data    string
+		allowed bool
+	}{
+		{mysql.ComQuery, "select * from user", false},
+		{mysql.ComQuery, "use db2", true},
+		{mysql.ComStmtPrepare, "select * from user where id = ?", false},
+		{mysql.ComStmtExecute, "", false},
+		{mysql.ComFieldList, "user", false},
+		{mysql.ComInitDB, "db2", true},
+		{mysql.ComPing, "", true},
+	}
+	for _, test := range tests {
+		err := se.checkMaskPolicy(test.cmd, []byte(test.data))
+		if (err == nil) != test.allowed {
+			t.Errorf("check mask policy not equal, cmd: %d, data: %s, err: %v", test.cmd, test.data, err)
+		}
+	}
+
+	// use with other statements could not bypass policy
+	se.multiStatements = true
+	if err := se.checkMaskPolicy(mysql.ComQuery, []byte("use db2; select * from user")); err == nil {
+		t.Errorf("multi statements should be refused")
+	}
+}
+
+func TestHandleUseDBScanError(t *testing.T) {
+	m := newTestMaskManager()
+	m.statistics = &StatisticManager{maskPolicyErrors: stats.NewCountersWithMultiLabels("", "", []string{statsLabelCluster, statsLabelNamespace, statsLabelAction})}
+	ns := m.GetNamespace(3306)
+	ns.allowedDBs = map[string]bool{"db1": true}
+	// connection pools are not opened, so scanning tables fails
+	newSession := func() *SessionExecutor {
+		se := newSessionExecutor(m)
+		se.namespace, se.user, se.connectProxyPort = "ns1", "u1", 3306
+		se.db = "db0"
+		se.tableDesc = &map[string][]string{"T0": {"c0"}}
+		return se
+	}
+
+	se := newSession()
+	if err := se.handleUseDB("db1"); err == nil {
+		t.Fatalf("use db should be denied if tables could not be scanned")
+	}
+	if se.db != "db0" || (*se.tableDesc)["T0"] == nil {
+		t.Errorf("session should be kept unchanged, db: %s, table desc: %v", se.db, *se.tableDesc)
+	}
+
+	ns.onPolicyError = models.PolicyErrorMaskAll
+	se = newSession()
+	if err := se.handleUseDB("db1"); err != nil {
+		t.Fatalf("use db should succeed with mask_all, err: %v", err)
+	}
+	if len(*se.maskRule) != 2 {
+		t.Errorf("all mask rules should be used, actual: %v", *se.maskRule)
+	}
+	if cols := (*se.tableDesc)["USER"]; len(*se.tableDesc) != 1 || strings.Join(cols, ",") != "email,phone" {
+		t.Errorf("only masked columns should be in table desc, actual: %v", *se.tableDesc)
+	}
+
+	ns.onPolicyError = models.PolicyErrorAllow
+	se = newSession()
+	if err := se.handleUseDB("db1"); err != nil {
+		t.Fatalf("use db should succeed with allow, err: %v", err)
+	}
+	if se.db != "db1" || se.tableDesc != nil || (*se.maskRule)[util.RuleKey{Table: "user", Col: "phone"}] != "MASK_ALL" {
+		t.Errorf("resolved rule should be kept without table desc, rule: %v, table desc: %v", *se.maskRule, se.tableDesc)
+	}
+}
+
+func TestExplainMaskPolicy(t *testing.T) {
+	m := newTestMaskManager()
+	current, _, _ := m.switchIndex.Get()
+	m.dbs[current] = CreateDBManager(map[models.DBKey]*models.DataBase{
+		{Namespace: "ns1", Db: "db1"}: {Namespace: "ns1", MaskDatabaseName: "db1", Security: models.SecurityR{Rule: "r2.xml"},
+			WhiteList: models.WhiteListR{File: "w1"}},
+		{Namespace: "ns1", Db: "db2"}: {Namespace: "ns1", MaskDatabaseName: "db2", Security: models.SecurityR{Rule: "missing.xml"}},
+	})
+	m.whiteList[current] = CreateWhiteListManager(map[string]*models.WhiteList{
+		"w1": {Name: "w1", Records: []models.WhiteListRecord{
+			{User: "u2", FromTime: "2020-01-01 00:00:00", ToTime: "2020-12-31 00:00:00", Rules: "f2"},
+		}},
+	})
+	ip, _ := util.ParseIPInfo("127.0.0.1")
+	ns := m.GetNamespaceByName("ns1")
+	ns.allowips = []util.IPInfo{ip}
+	ns.allowedDBs = map[string]bool{"db1": true, "db2": true}
+	ns.userProperties = map[string]*UserProperty{"u1": {}, "u2": {}}
+
+	inWindow := time.Date(2020, 6, 1, 0, 0, 0, 0, time.Local)
+	outWindow := time.Date(2021, 6, 1, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		user, ip, db string
+		now          time.Time
+		policy       string
+		columns      string // table.column:action:function:exempt_by of columns
+	}{
+		{"u3", "", "db1", inWindow, MaskPolicyDeny, ""},
+		{"u1", "10.0.0.1", "db1", inWindow, MaskPolicyDeny, ""},
+		{"u1", "127.0.0.1", "db3", inWindow, MaskPolicyDeny, ""},
+		{"u1", "127.0.0.1", "db1", inWindow, MaskPolicyMask, "user.email:mask:MASK_EMAIL: user.phone:mask:MASK_ALL:"},
+		{"u2", "", "db1", inWindow, MaskPolicyMask, "user.email:mask:MASK_EMAIL: user.phone:exempt::w1/u2"},
+		{"u2", "", "db1", outWindow, MaskPolicyMask, "user.email:mask:MASK_EMAIL: user.phone:mask:MASK_ALL:"},
+		{"u1", "", "db2", inWindow, MaskPolicyDeny, ""},
+	}
+	for _, test := range tests {
+		e, err := m.ExplainMaskPolicy("ns1", test.user, test.ip, test.db, test.now)
+		if err != nil {
+			t.Fatalf("explain mask policy error: %v", err)
+		}
+		var columns []string
+		for _, c := range e.Columns {
+			columns = append(columns, c.Table+"."+c.Column+":"+c.Action+":"+c.Function+":"+c.ExemptBy)
+		}
+		if e.Policy != test.policy || strings.Join(columns, " ") != test.columns {
+			t.Errorf("explain of %s %s %s not equal, actual: %s %v, reason: %s", test.user, test.ip, test.db, e.Policy, columns, e.Reason)
+		}
+	}
+
+	if e, _ := m.ExplainMaskPolicy("ns1", "u2", "", "db1", outWindow); e.WhiteListRecord == nil || e.WhiteListRecord.Active {
+		t.Errorf("white list record should be inactive, actual: %v", e.WhiteListRecord)
+	}
+
+	ns.onPolicyError = models.PolicyErrorMaskAll
+	e, _ := m.ExplainMaskPolicy("ns1", "u1", "", "db2", inWindow)
+	if e.Policy != MaskPolicyMaskAll || len(e.Columns) != 2 || e.Columns[0].RuleList != "r1.xml" || e.Columns[0].Function != "MASK_PHONE" {
+		t.Errorf("explain of mask_all not equal, actual: %s %v", e.Policy, e.Columns)
+	}
+
+	if _, err := m.ExplainMaskPolicy("ns2", "u1", "", "db1", inWindow); err == nil {
+		t.Errorf("explain should fail if namespace not found")
+	}
+	if _, err := m.ExplainMaskPolicy("ns1", "u1", "invalid", "db1", inWindow); err == nil {
+		t.Errorf("explain should fail if ip is invalid")
+	}
+}
+
+func TestDumpMaskConfig(t *testing.T) {
+	m := newTestMaskManager()
+	if dump := m.DumpMaskConfig(); len(dump.RuleLists) != 0 {
+		t.Errorf("dump should be empty if no config loaded, actual: %v", dump)
+	}
+
+	current, _, _ := m.switchIndex.Get()
+	config := newRunningConfig()
+	config.rules["r2"] = &models.FilterList{Name: "r2", FileName: "r2.xml", Filters: []models.Filter{newTestFilter("f1", "user", "phone", "MASK_PHONE")}}
+	config.rules["r1"] = &models.FilterList{Name: "r1", FileName: "r1.xml"}
+	config.whiteLists["w1"] = &models.WhiteList{Name: "w1"}
+	config.dbs[models.DBKey{Namespace: "ns1", Db: "db1"}] = &models.DataBase{Namespace: "ns1", MaskDatabaseName: "db1",
+		UserName: "root", PW: "secret", Security: models.SecurityR{Rule: "r1"}}
+	m.configs[current] = config
+
+	dump := m.DumpMaskConfig()
+	if len(dump.RuleLists) != 2 || dump.RuleLists[0].Name != "r1" || dump.RuleLists[1].Source != "r2.xml" {
+		t.Errorf("rule lists of dump not equal, actual: %v", dump.RuleLists)
+	}
+	if dump.RuleLists[0].Version == "" || dump.RuleLists[0].Version == dump.RuleLists[1].Version {
+		t.Errorf("versions of rule lists should differ, actual: %v", dump.RuleLists)
+	}
+	if len(dump.WhiteLists) != 1 || dump.WhiteLists[0].Source != "white_list/w1" {
+		t.Errorf("white lists of dump not equal, actual: %v", dump.WhiteLists)
+	}
+	if len(dump.DataBases) != 1 || dump.DataBases[0].Name != "ns1/db1" || dump.DataBases[0].Source != models.DataBasesName {
+		t.Fatalf("databases of dump not equal, actual: %v", dump.DataBases)
+	}
+	b, _ := json.Marshal(dump)
+	if strings.Contains(string(b), "secret") || strings.Contains(string(b), "root") {
+		t.Errorf("dump should not contain user or password of database: %s", b)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -30,6 +31,7 @@ import (
 	//"github.com/ZzzYtl/MyMask/proxy/router"
 	"github.com/ZzzYtl/MyMask/util"
 	"github.com/ZzzYtl/MyMask/util/cache"
+	"github.com/ZzzYtl/MyMask/util/sync2"
 )
 
 const (
@@ -48,6 +50,7 @@ type UserProperty struct {
 	RWFlag        int
 	RWSplit       int
 	OtherProperty int
+	Limits        *models.Limits
 }
 
 // Namespace is struct driected used by server
@@ -63,12 +66,22 @@ type Namespace struct {
 	userProperties     map[string]*UserProperty // key: user name ,value: user's properties
 	defaultCharset     string
 	defaultCollationID mysql.CollationID
+	backendPrepare     bool // execute prepared statements on backend mysql instead of emulating them
+	listenNetwork      string
+	listenAddr         string
+	socketMode         os.FileMode
+	limits             *models.Limits // limits of namespace, nil means no limit
+	firewall           *Firewall      // nil means no firewall
+	rewriteRules       []*plan.RewriteRule
+	onPolicyError      string // action when mask rule could not be resolved, see models.PolicyErrorXXX
 
 	slowSQLCache         *cache.LRUCache
 	errorSQLCache        *cache.LRUCache
 	backendSlowSQLCache  *cache.LRUCache
 	backendErrorSQLCache *cache.LRUCache
 	planCache            *cache.LRUCache
+	planCacheHits        sync2.AtomicInt64
+	planCacheMisses      sync2.AtomicInt64
 }
 
 // DumpToJSON  means easy encode json
@@ -82,6 +95,11 @@ func NewNamespace(namespaceConfig *models.Namespace) (*Namespace, error) {
 	namespace := &Namespace{
 		name:                 namespaceConfig.Name,
 		proxyPort:            namespaceConfig.ProxyPort,
+		backendPrepare:       namespaceConfig.BackendPrepare,
+		listenNetwork:        namespaceConfig.ListenNetwork,
+		listenAddr:           namespaceConfig.ListenAddr,
+		limits:               namespaceConfig.Limits,
+		onPolicyError:        namespaceConfig.OnPolicyError,
 		sqls:                 make(map[string]string, 16),
 		userProperties:       make(map[string]*UserProperty, 2),
 		slowSQLCache:         cache.NewLRUCache(defaultSQLCacheCapacity),
@@ -97,9 +115,20 @@ func NewNamespace(namespaceConfig *models.Namespace) (*Namespace, error) {
 		}
 	}()
 
+	namespace.socketMode, err = namespaceConfig.GetSocketMode()
+	if err != nil {
+		return nil, err
+	}
+
 	// init black sql
 	namespace.sqls = parseBlackSqls(namespaceConfig.BlackSQL)
 
+	// init sql firewall
+	namespace.firewall, err = NewFirewall(namespaceConfig.Firewall)
+	if err != nil {
+		return nil, fmt.Errorf("init firewall error: %v", err)
+	}
+
 	// init session slow sql time
 	namespace.slowSQLTime, err = parseSlowSQLTime(namespaceConfig.SlowSQLTime)
 	if err != nil {
@@ -122,6 +151,15 @@ func NewNamespace(namespaceConfig *models.Namespace) (*Namespace, error) {
 		return nil, fmt.Errorf("parse defaultPhyDBs error: %v", err)
 	}
 
+	// init rewrite rules
+	for _, r := range namespaceConfig.RewriteRules {
+		rule, err := plan.NewRewriteRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("init rewrite rules error: %v", err)
+		}
+		namespace.rewriteRules = append(namespace.rewriteRules, rule)
+	}
+
 	// init allow ip
 	allowips, err := parseAllowIps(namespaceConfig.AllowedIP)
 	if err != nil {
@@ -136,7 +174,7 @@ func NewNamespace(namespaceConfig *models.Namespace) (*Namespace, error) {
 
 	// init user properties
 	for _, user := range namespaceConfig.Users {
-		up := &UserProperty{}
+		up := &UserProperty{RWFlag: user.RWFlag, RWSplit: user.GetRWSplit(), Limits: user.Limits}
 		namespace.userProperties[user.UserName] = up
 	}
 
@@ -183,6 +221,11 @@ func (n *Namespace) GetProxyPort() uint32 {
 	return n.proxyPort
 }
 
+// GetListen return listen config of namespace, empty value means not specified
+func (n *Namespace) GetListen() (network, addr string, socketMode os.FileMode) {
+	return n.listenNetwork, n.listenAddr, n.socketMode
+}
+
 // GetRouter return router of namespace
 //func (n *Namespace) GetRouter() *router.Router {
 //	return n.router
@@ -211,12 +254,14 @@ func (n *Namespace) getSessionSlowSQLTime() int64 {
 
 // IsAllowWrite check if user allow to write
 func (n *Namespace) IsAllowWrite(user string) bool {
-	return n.userProperties[user].RWFlag == models.ReadWrite
+	up, ok := n.userProperties[user]
+	return ok && up.RWFlag == models.ReadWrite
 }
 
 // IsRWSplit chekc if read write split
 func (n *Namespace) IsRWSplit(user string) bool {
-	return n.userProperties[user].RWSplit == models.ReadWriteSplit
+	up, ok := n.userProperties[user]
+	return ok && up.RWSplit == models.ReadWriteSplit
 }
 
 // IsStatisticUser check if user is used to statistic
@@ -225,6 +270,42 @@ func (n *Namespace) IsStatisticUser(user string) bool {
 	return false
 }
 
+// IsBackendPrepare check if prepared statements are executed on backend mysql
+func (n *Namespace) IsBackendPrepare() bool {
+	return n.backendPrepare
+}
+
+// GetFirewall return sql firewall of namespace, nil means no firewall
+func (n *Namespace) GetFirewall() *Firewall {
+	return n.firewall
+}
+
+// GetRewriteRules return sql rewrite rules of namespace
+func (n *Namespace) GetRewriteRules() []*plan.RewriteRule {
+	return n.rewriteRules
+}
+
+// GetOnPolicyError return action when mask rule could not be resolved, deny by default
+func (n *Namespace) GetOnPolicyError() string {
+	if n.onPolicyError == "" {
+		return models.PolicyErrorDeny
+	}
+	return n.onPolicyError
+}
+
+// GetLimits return resource limits of namespace, nil means no limit
+func (n *Namespace) GetLimits() *models.Limits {
+	return n.limits
+}
+
+// GetUserLimits return resource limits of user, nil means no limit
+func (n *Namespace) GetUserLimits(user string) *models.Limits {
+	if up, ok := n.userProperties[user]; ok {
+		return up.Limits
+	}
+	return nil
+}
+
 // GetUserProperty return user information
 func (n *Namespace) GetUserProperty(user string) int {
 	return n.userProperties[user].OtherProperty
@@ -287,18 +368,50 @@ func (n *Namespace) GetDefaultCollationID() mysql.CollationID {
 	return n.defaultCollationID
 }
 
-// GetCachedPlan get plan in cache
-func (n *Namespace) GetCachedPlan(db, sql string) (plan.Plan, bool) {
-	v, ok := n.planCache.Get(db + "|" + sql)
+// GetCachedPlan get parameterized plan in cache, nil plan with true means sql is known to be uncacheable
+func (n *Namespace) GetCachedPlan(key string) (*plan.CachedPlan, bool) {
+	v, ok := n.planCache.Get(key)
 	if !ok {
+		n.planCacheMisses.Add(1)
 		return nil, false
 	}
-	return v.(plan.Plan), true
+	p, _ := v.(*plan.CachedPlan)
+	if p == nil {
+		n.planCacheMisses.Add(1)
+	} else {
+		n.planCacheHits.Add(1)
+	}
+	return p, true
 }
 
-// SetCachedPlan set plan in cache
-func (n *Namespace) SetCachedPlan(db, sql string, p plan.Plan) {
-	n.planCache.SetIfAbsent(db+"|"+sql, p)
+// SetCachedPlan set parameterized plan in cache, nil plan marks sql as uncacheable
+func (n *Namespace) SetCachedPlan(key string, p *plan.CachedPlan) {
+	if p == nil {
+		n.planCache.SetIfAbsent(key, uncacheablePlan{})
+		return
+	}
+	n.planCache.SetIfAbsent(key, p)
+}
+
+// ClearPlanCache remove all cached plans, it's called when mask policy or schema is changed
+func (n *Namespace) ClearPlanCache() {
+	n.planCache.Clear()
+}
+
+// GetPlanCacheStats return statistics of plan cache
+func (n *Namespace) GetPlanCacheStats() *PlanCacheStats {
+	length, _, capacity, evictions, _ := n.planCache.Stats()
+	stats := &PlanCacheStats{
+		Length:    length,
+		Capacity:  capacity,
+		Evictions: evictions,
+		Hits:      n.planCacheHits.Get(),
+		Misses:    n.planCacheMisses.Get(),
+	}
+	if total := stats.Hits + stats.Misses; total != 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
 }
 
 // SetSlowSQLFingerprint store slow sql fingerprint
@@ -414,6 +527,7 @@ func (n *Namespace) Close(delay bool) {
 	n.errorSQLCache.Clear()
 	n.backendSlowSQLCache.Clear()
 	n.backendErrorSQLCache.Clear()
+	n.planCache.Clear()
 }
 
 func parseSlice(cfg *models.Slice, charset string, collationID mysql.CollationID) (*backend.Slice, error) {
@@ -421,22 +535,22 @@ func parseSlice(cfg *models.Slice, charset string, collationID mysql.CollationID
 	s := new(backend.Slice)
 	s.Cfg = *cfg
 	s.SetCharsetInfo(charset, collationID)
+	s.SetHealthCheck(cfg.HealthCheck)
 
 	// parse master
-	//err = s.ParseMaster(cfg.Master)
-	//if err != nil {
-	//	return nil, err
-	//}
+	err = s.ParseMaster(cfg.Master)
+	if err != nil {
+		return nil, err
+	}
 
 	// parse slaves
-	if len(cfg.Master) != 0 {
-		cfg.Slaves = append(cfg.Slaves, cfg.Master)
-	}
 	err = s.ParseSlave(cfg.Slaves)
 	if err != nil {
 		return nil, err
 	}
 
+	s.StartHealthCheck()
+
 	// parse statistic slaves
 	//err = s.ParseStatisticSlave(cfg.StatisticSlaves)
 	//if err != nil {
@@ -0,0 +1,120 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/parser"
+	"github.com/ZzzYtl/MyMask/proxy/plan"
+	"github.com/ZzzYtl/MyMask/util"
+)
+
+// results of plan cache lookup
+const (
+	planCacheHit  = "hit"
+	planCacheMiss = "miss"
+)
+
+// PlanCacheStats means statistics of plan cache of namespace
+type PlanCacheStats struct {
+	Length    int64   `json:"length"`
+	Capacity  int64   `json:"capacity"`
+	Evictions int64   `json:"evictions"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRate   float64 `json:"hit_rate"`
+}
+
+// uncacheablePlan is put into plan cache for sql which can't be parameterized, so it's not tried again
+type uncacheablePlan struct{}
+
+func (uncacheablePlan) Size() int {
+	return 1
+}
+
+// planCacheKey return key of plan cache, plans are shared by sessions with the same db, mask policy and schema
+func (se *SessionExecutor) planCacheKey(db, normalizedSQL string) string {
+	if se.planContext == "" || se.planContextRule != se.maskRule || se.planContextDesc != se.tableDesc {
+		se.planContextRule = se.maskRule
+		se.planContextDesc = se.tableDesc
+		se.planContext = planContextDigest(se.maskRule, se.tableDesc)
+	}
+	return db + "|" + se.planContext + "|" + normalizedSQL
+}
+
+// planContextDigest return md5 of mask rule and table desc which the plan depends on
+func planContextDigest(maskRule *map[util.RuleKey]string, tableDesc *map[string][]string) string {
+	h := md5.New()
+	if maskRule != nil {
+		rules := make([]string, 0, len(*maskRule))
+		for k, v := range *maskRule {
+			rules = append(rules, fmt.Sprintf("%s.%s=%s", k.Table, k.Col, v))
+		}
+		sort.Strings(rules)
+		fmt.Fprintf(h, "rule:%s\n", strings.Join(rules, ","))
+	}
+	if tableDesc != nil {
+		tables := make([]string, 0, len(*tableDesc))
+		for table := range *tableDesc {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			// order of columns matters when expanding wildcard
+			fmt.Fprintf(h, "table:%s(%s)\n", table, strings.Join((*tableDesc)[table], ","))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getCachedPlan return plan from cache, plan is built and cached if not found
+func (se *SessionExecutor) getCachedPlan(ns *Namespace, db string, sql string) (plan.Plan, error) {
+	normalizedSQL, params, ok := parser.ParameterizeSQL(sql)
+	if !ok {
+		ns.planCacheMisses.Add(1)
+		se.manager.GetStatisticManager().RecordPlanCache(ns.GetName(), false)
+		return se.getPlan(ns, db, sql)
+	}
+
+	key := se.planCacheKey(db, normalizedSQL)
+	cp, ok := ns.GetCachedPlan(key)
+	se.manager.GetStatisticManager().RecordPlanCache(ns.GetName(), cp != nil)
+	if !ok {
+		var err error
+		cp, err = se.buildCachedPlan(ns, db, normalizedSQL, len(params))
+		if err != nil {
+			log.Debug("sql could not be cached, sql: %s, err: %v", normalizedSQL, err)
+		}
+		ns.SetCachedPlan(key, cp)
+	}
+	if cp == nil {
+		return se.getPlan(ns, db, sql)
+	}
+	return cp.CreatePlan(params)
+}
+
+func (se *SessionExecutor) buildCachedPlan(ns *Namespace, db, normalizedSQL string, paramLen int) (*plan.CachedPlan, error) {
+	n, err := se.Parse(normalizedSQL)
+	if err != nil {
+		return nil, err
+	}
+	return plan.BuildCachedPlan(n, paramLen, ns.GetPhysicalDBs(), db, se.maskRule, se.tableDesc)
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/ZzzYtl/MyMask/parser"
+	"github.com/ZzzYtl/MyMask/proxy/plan"
+	"github.com/ZzzYtl/MyMask/util"
+)
+
+func TestCachedPlan(t *testing.T) {
+	se := newSessionExecutor(nil)
+	se.maskRule = &map[util.RuleKey]string{{Table: "user", Col: "phone"}: "mask_phone"}
+	se.tableDesc = &map[string][]string{"USER": {"id", "name", "phone"}}
+	ns := &Namespace{defaultPhyDBs: map[string]string{"db1": "db1_0"}}
+
+	sqls := []string{
+		"select * from user where id = 1 and name = 'a\\'b'",
+		"select phone, 'x' as c from db1.user where id in (1, 2) limit 10 offset 20",
+		"insert into user(id, name) values (3, \"c\")",
+		"update user set name = 'd' where id > -1.5",
+	}
+	for _, sql := range sqls {
+		n, err := se.Parse(sql)
+		if err != nil {
+			t.Fatalf("parse sql error: %v", err)
+		}
+		expect, err := plan.BuildPlan(n, ns.GetPhysicalDBs(), "db1", sql, se.maskRule, se.tableDesc)
+		if err != nil {
+			t.Fatalf("build plan error: %v", err)
+		}
+
+		normalizedSQL, params, ok := parser.ParameterizeSQL(sql)
+		if !ok {
+			t.Fatalf("sql %s should be parameterized", sql)
+		}
+		cp, err := se.buildCachedPlan(ns, "db1", normalizedSQL, len(params))
+		if err != nil {
+			t.Fatalf("build cached plan error, sql: %s, err: %v", sql, err)
+		}
+		actual, err := cp.CreatePlan(params)
+		if err != nil {
+			t.Fatalf("create plan error: %v", err)
+		}
+
+		expectSQL, actualSQL := expect.(*plan.UnshardPlan).GetSQL(), actual.(*plan.UnshardPlan).GetSQL()
+		if expectSQL != actualSQL {
+			t.Errorf("sql %s, plan not equal, expect: %s, actual: %s", sql, expectSQL, actualSQL)
+		}
+	}
+}
+
+func TestPlanCacheKey(t *testing.T) {
+	se := newSessionExecutor(nil)
+	key1 := se.planCacheKey("db1", "select ?")
+
+	rule := map[util.RuleKey]string{{Table: "user", Col: "phone"}: "mask_phone"}
+	se.maskRule = &rule
+	key2 := se.planCacheKey("db1", "select ?")
+	if key1 == key2 {
+		t.Errorf("plan cache key should be changed with mask rule")
+	}
+
+	// equal policy shares the same key
+	other := newSessionExecutor(nil)
+	otherRule := map[util.RuleKey]string{{Table: "user", Col: "phone"}: "mask_phone"}
+	other.maskRule = &otherRule
+	if other.planCacheKey("db1", "select ?") != key2 {
+		t.Errorf("plan cache key should be equal with the same mask rule")
+	}
+
+	se.tableDesc = &map[string][]string{"USER": {"id", "phone"}}
+	if se.planCacheKey("db1", "select ?") == key2 {
+		t.Errorf("plan cache key should be changed with table desc")
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/log"
+	"github.com/ZzzYtl/MyMask/models"
+)
+
+// components of config which could be reloaded
+const (
+	ReloadComponentNamespace = "namespace"
+	ReloadComponentWhiteList = "whitelist"
+	ReloadComponentRuleList  = "rulelist"
+	ReloadComponentDataBase  = "database"
+
+	ReloadComponentMaskPolicy = "mask_policy" // policy resolved by namespace and database, only verified
+)
+
+// actions of reloaded component
+const (
+	ReloadActionAdd    = "add"
+	ReloadActionUpdate = "update"
+	ReloadActionDelete = "delete"
+	ReloadActionVerify = "verify"
+)
+
+// ReloadItem means reload result of one component
+type ReloadItem struct {
+	Component string `json:"component"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	Error     string `json:"error,omitempty"` // the running config is kept if error occurs
+}
+
+// ReloadResult means result of one config reload
+type ReloadResult struct {
+	Time      time.Time     `json:"time"`
+	Committed bool          `json:"committed"`
+	Error     string        `json:"error,omitempty"`
+	Items     []*ReloadItem `json:"items"`
+}
+
+func (r *ReloadResult) add(component, name, action string, err error) {
+	item := &ReloadItem{Component: component, Name: name, Action: action}
+	if err != nil {
+		item.Error = err.Error()
+	}
+	r.Items = append(r.Items, item)
+}
+
+// policyChanged check if mask policy may be changed, namespaces are rebuilt with new plan cache
+func (r *ReloadResult) policyChanged() bool {
+	for _, item := range r.Items {
+		if item.Component != ReloadComponentNamespace && item.Error == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ReloadResult) log() {
+	if r.Error != "" {
+		log.Warn("reload config failed, err: %s", r.Error)
+		return
+	}
+	if len(r.Items) == 0 {
+		log.Notice("reload config, nothing changed")
+		return
+	}
+	for _, item := range r.Items {
+		if item.Error != "" {
+			log.Warn("reload %s %s, action: %s, committed: %v, err: %s", item.Component, item.Name, item.Action, r.Committed, item.Error)
+		} else {
+			log.Notice("reload %s %s, action: %s, committed: %v", item.Component, item.Name, item.Action, r.Committed)
+		}
+	}
+}
+
+// runningConfig keeps config of components which are running, used to find changed components when reloading
+type runningConfig struct {
+	namespaces map[string]*models.Namespace
+	whiteLists map[string]*models.WhiteList
+	rules      map[string]*models.FilterList
+	dbs        map[models.DBKey]*models.DataBase
+}
+
+func newRunningConfig() *runningConfig {
+	return &runningConfig{
+		namespaces: make(map[string]*models.Namespace, 64),
+		whiteLists: make(map[string]*models.WhiteList, 64),
+		rules:      make(map[string]*models.FilterList, 64),
+		dbs:        make(map[models.DBKey]*models.DataBase, 64),
+	}
+}
+
+func (rc *runningConfig) clone() *runningConfig {
+	ret := newRunningConfig()
+	for k, v := range rc.namespaces {
+		ret.namespaces[k] = v
+	}
+	for k, v := range rc.whiteLists {
+		ret.whiteLists[k] = v
+	}
+	for k, v := range rc.rules {
+		ret.rules[k] = v
+	}
+	for k, v := range rc.dbs {
+		ret.dbs[k] = v
+	}
+	return ret
+}
+
+func reloadAction(exists bool) string {
+	if exists {
+		return ReloadActionUpdate
+	}
+	return ReloadActionAdd
+}
+
+// rebuildNamespaces rebuild changed namespaces only, unchanged namespaces keep their backend connection pools.
+// replaced and deleted namespaces are returned and should be closed after commit.
+func (n *NamespaceManager) rebuildNamespaces(running map[string]*models.Namespace, configs map[string]*models.Namespace,
+	result *ReloadResult) (*NamespaceManager, map[string]*models.Namespace, []*Namespace) {
+	nsMgr := ShallowCopyNamespaceManager(n)
+	effective := make(map[string]*models.Namespace, len(configs))
+	var closing []*Namespace
+
+	// delete first, the port may be reused by other namespace
+	for name := range running {
+		if _, ok := configs[name]; ok {
+			continue
+		}
+		if ns := nsMgr.GetNamespaceByName(name); ns != nil {
+			delete(nsMgr.namespaces, ns.proxyPort)
+			closing = append(closing, ns)
+		}
+		result.add(ReloadComponentNamespace, name, ReloadActionDelete, nil)
+	}
+
+	for name, cfg := range configs {
+		old, exists := running[name]
+		if exists && reflect.DeepEqual(old, cfg) {
+			effective[name] = old
+			continue
+		}
+
+		namespace, err := NewNamespace(cfg)
+		if err == nil {
+			if ns := nsMgr.GetNamespace(cfg.ProxyPort); ns != nil && ns.name != name {
+				namespace.Close(false)
+				err = fmt.Errorf("port %d is used by namespace %s", cfg.ProxyPort, ns.name)
+			}
+		}
+		result.add(ReloadComponentNamespace, name, reloadAction(exists), err)
+		if err != nil {
+			if exists {
+				effective[name] = old
+			}
+			continue
+		}
+
+		if ns := nsMgr.GetNamespaceByName(name); ns != nil {
+			delete(nsMgr.namespaces, ns.proxyPort)
+			closing = append(closing, ns)
+		}
+		nsMgr.namespaces[namespace.proxyPort] = namespace
+		effective[name] = cfg
+	}
+	return nsMgr, effective, closing
+}
+
+func (mgr *WhiteListManager) rebuild(running, configs map[string]*models.WhiteList, result *ReloadResult) (*WhiteListManager, map[string]*models.WhiteList) {
+	newMgr := NewWhiteListManager()
+	effective := make(map[string]*models.WhiteList, len(configs))
+	for name := range running {
+		if _, ok := configs[name]; !ok {
+			result.add(ReloadComponentWhiteList, name, ReloadActionDelete, nil)
+		}
+	}
+	for name, cfg := range configs {
+		old, exists := running[name]
+		if exists && reflect.DeepEqual(old, cfg) {
+			if wl, ok := mgr.whitelists[name]; ok {
+				newMgr.whitelists[name] = wl
+			}
+			effective[name] = old
+			continue
+		}
+
+		whitelist, err := NewWhiteList(cfg)
+		result.add(ReloadComponentWhiteList, name, reloadAction(exists), err)
+		if err != nil {
+			if wl, ok := mgr.whitelists[name]; ok && exists {
+				newMgr.whitelists[name] = wl
+				effective[name] = old
+			}
+			continue
+		}
+		newMgr.whitelists[whitelist.name] = whitelist
+		effective[name] = cfg
+	}
+	return newMgr, effective
+}
+
+func (mgr *RuleManager) rebuild(running, configs map[string]*models.FilterList, result *ReloadResult) (*RuleManager, map[string]*models.FilterList) {
+	newMgr := NewRuleManager()
+	effective := make(map[string]*models.FilterList, len(configs))
+	for name := range running {
+		if _, ok := configs[name]; !ok {
+			result.add(ReloadComponentRuleList, name, ReloadActionDelete, nil)
+		}
+	}
+	for name, cfg := range configs {
+		old, exists := running[name]
+		if exists && reflect.DeepEqual(old, cfg) {
+			if rl, ok := mgr.rulelists[name]; ok {
+				newMgr.rulelists[name] = rl
+			}
+			effective[name] = old
+			continue
+		}
+
+		rulelist, err := NewRuleList(cfg)
+		result.add(ReloadComponentRuleList, name, reloadAction(exists), err)
+		if err != nil {
+			if rl, ok := mgr.rulelists[name]; ok && exists {
+				newMgr.rulelists[name] = rl
+				effective[name] = old
+			}
+			continue
+		}
+		newMgr.rulelists[rulelist.name] = rulelist
+		effective[name] = cfg
+	}
+	return newMgr, effective
+}
+
+func (mgr *DBManager) rebuild(running, configs map[models.DBKey]*models.DataBase, result *ReloadResult) (*DBManager, map[models.DBKey]*models.DataBase) {
+	newMgr := NewDBManager()
+	effective := make(map[models.DBKey]*models.DataBase, len(configs))
+	for key := range running {
+		if _, ok := configs[key]; !ok {
+			result.add(ReloadComponentDataBase, dbKeyName(key), ReloadActionDelete, nil)
+		}
+	}
+	for key, cfg := range configs {
+		old, exists := running[key]
+		if exists && reflect.DeepEqual(old, cfg) {
+			if db, ok := mgr.dbs[key]; ok {
+				newMgr.dbs[key] = db
+			}
+			effective[key] = old
+			continue
+		}
+
+		db, err := NewDB(cfg)
+		result.add(ReloadComponentDataBase, dbKeyName(key), reloadAction(exists), err)
+		if err != nil {
+			if db, ok := mgr.dbs[key]; ok && exists {
+				newMgr.dbs[key] = db
+				effective[key] = old
+			}
+			continue
+		}
+		newMgr.dbs[key] = db
+		effective[key] = cfg
+	}
+	return newMgr, effective
+}
+
+func dbKeyName(key models.DBKey) string {
+	switch {
+	case key.Namespace == "":
+		return key.Addr + "/" + key.Db
+	case key.Addr == "":
+		return key.Namespace + "/" + key.Db
+	default:
+		return key.Namespace + "@" + key.Addr + "/" + key.Db
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/util/cache"
+)
+
+func newTestWhiteList(name, user, fromTime string) *models.WhiteList {
+	return &models.WhiteList{
+		Name: name,
+		Records: []models.WhiteListRecord{
+			{User: user, FromTime: fromTime, ToTime: "2099-01-01 00:00:00", Rules: "*"},
+		},
+	}
+}
+
+func TestWhiteListManagerRebuild(t *testing.T) {
+	running := map[string]*models.WhiteList{
+		"keep":   newTestWhiteList("keep", "u1", "2019-01-01 00:00:00"),
+		"update": newTestWhiteList("update", "u2", "2019-01-01 00:00:00"),
+		"bad":    newTestWhiteList("bad", "u3", "2019-01-01 00:00:00"),
+		"delete": newTestWhiteList("delete", "u4", "2019-01-01 00:00:00"),
+	}
+	result := &ReloadResult{Time: time.Now()}
+	mgr, _ := NewWhiteListManager().rebuild(nil, running, result)
+	if len(result.Items) != 4 {
+		t.Fatalf("create items not equal, expect: 4, actual: %d", len(result.Items))
+	}
+
+	configs := map[string]*models.WhiteList{
+		"keep":   newTestWhiteList("keep", "u1", "2019-01-01 00:00:00"),
+		"update": newTestWhiteList("update", "u2", "2020-01-01 00:00:00"),
+		"bad":    newTestWhiteList("bad", "u3", "not a time"),
+		"add":    newTestWhiteList("add", "u5", "2019-01-01 00:00:00"),
+	}
+	result = &ReloadResult{Time: time.Now()}
+	newMgr, effective := mgr.rebuild(running, configs, result)
+
+	if newMgr.whitelists["keep"] != mgr.whitelists["keep"] {
+		t.Errorf("unchanged whitelist should not be rebuilt")
+	}
+	if newMgr.whitelists["update"] == mgr.whitelists["update"] {
+		t.Errorf("changed whitelist should be rebuilt")
+	}
+	if newMgr.whitelists["bad"] != mgr.whitelists["bad"] || effective["bad"] != running["bad"] {
+		t.Errorf("running whitelist should be kept if rebuild failed")
+	}
+	if _, ok := newMgr.whitelists["delete"]; ok {
+		t.Errorf("deleted whitelist should be removed")
+	}
+	if _, ok := newMgr.whitelists["add"]; !ok {
+		t.Errorf("added whitelist should be created")
+	}
+
+	actions := make(map[string]*ReloadItem)
+	for _, item := range result.Items {
+		actions[item.Name] = item
+	}
+	expects := map[string]string{
+		"update": ReloadActionUpdate,
+		"bad":    ReloadActionUpdate,
+		"delete": ReloadActionDelete,
+		"add":    ReloadActionAdd,
+	}
+	if len(actions) != len(expects) {
+		t.Fatalf("reload items not equal, expect: %v, actual: %v", expects, actions)
+	}
+	for name, action := range expects {
+		if actions[name] == nil || actions[name].Action != action {
+			t.Errorf("reload item %s not equal, expect: %s, actual: %v", name, action, actions[name])
+		}
+	}
+	if actions["bad"].Error == "" {
+		t.Errorf("reload item bad should have error")
+	}
+}
+
+func TestReloadAbort(t *testing.T) {
+	newNamespace := func(name string) *Namespace {
+		return &Namespace{
+			name:                 name,
+			slowSQLCache:         cache.NewLRUCache(defaultSQLCacheCapacity),
+			errorSQLCache:        cache.NewLRUCache(defaultSQLCacheCapacity),
+			backendSlowSQLCache:  cache.NewLRUCache(defaultSQLCacheCapacity),
+			backendErrorSQLCache: cache.NewLRUCache(defaultSQLCacheCapacity),
+			planCache:            cache.NewLRUCache(defaultPlanCacheCapacity),
+		}
+	}
+	m := newTestMaskManager()
+	current, other, index := m.switchIndex.Get()
+	m.users[current] = NewUserManager()
+	m.configs[current] = newRunningConfig()
+
+	// namespace ns2 is created by prepare
+	prepared := ShallowCopyNamespaceManager(m.namespaces[current])
+	prepared.namespaces[3307] = newNamespace("ns2")
+	prepared.namespaces[3307].planCache.Set("select 1", uncacheablePlan{})
+	m.namespaces[other] = prepared
+	m.rules[other] = CreateRuleManager(nil)
+	m.pending = &ReloadResult{Time: time.Now()}
+
+	m.ReloadAbort()
+	if m.namespaces[other] != m.namespaces[current] || m.rules[other] != m.rules[current] || m.pending != nil {
+		t.Errorf("other index should be reset to running config")
+	}
+	if prepared.namespaces[3307].planCache.Size() != 0 {
+		t.Errorf("namespace created by prepare should be closed")
+	}
+	if _, _, i := m.switchIndex.Get(); i != index {
+		t.Errorf("index should not be switched")
+	}
+}
+
+func TestReloadNamespacePrepare(t *testing.T) {
+	m := newTestMaskManager()
+	current, _, _ := m.switchIndex.Get()
+	m.users[current] = NewUserManager()
+	m.configs[current] = newRunningConfig()
+	// db3 bound to addresses has the same policy on backends of ns1, but different one on 127.0.0.1:3308
+	m.dbs[current] = CreateDBManager(map[models.DBKey]*models.DataBase{
+		{Addr: "127.0.0.1:3306", Db: "db3"}: {Security: models.SecurityR{Rule: "r1.xml"}},
+		{Addr: "127.0.0.1:3307", Db: "db3"}: {Security: models.SecurityR{Rule: "r1.xml"}},
+		{Addr: "127.0.0.1:3308", Db: "db3"}: {Security: models.SecurityR{Rule: "r2.xml"}},
+	})
+	newConfig := func(slave string) *models.Namespace {
+		return &models.Namespace{Name: "ns1", ProxyPort: 3306, Slice: &models.Slice{
+			UserName: "u", Password: "p", Master: "127.0.0.1:3306", Slaves: []string{slave}, Capacity: 1, MaxCapacity: 1, IdleTimeout: 60,
+		}}
+	}
+
+	// policy of db3 conflicts after slave is changed, prepare is rejected
+	if err := m.ReloadNamespacePrepare(newConfig("127.0.0.1:3308")); err == nil || !strings.Contains(err.Error(), "ns1/db3") {
+		t.Fatalf("prepare should fail by conflicted policy, err: %v", err)
+	}
+	_, other, _ := m.switchIndex.Get()
+	if m.namespaces[other] != m.namespaces[current] || m.pending != nil {
+		t.Errorf("rejected prepare should be aborted")
+	}
+
+	// policies verified are recorded in reload result after commit
+	if err := m.ReloadNamespacePrepare(newConfig("127.0.0.1:3307")); err != nil {
+		t.Fatalf("prepare error: %v", err)
+	}
+	if err := m.ReloadNamespaceCommit("ns1"); err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	r := m.GetReloadResult()
+	if r == nil || !r.Committed || m.pending != nil {
+		t.Fatalf("reload result should be committed, actual: %v", r)
+	}
+	if len(r.Items) != 1 || r.Items[0].Component != ReloadComponentNamespace || r.Items[0].Action != ReloadActionAdd {
+		t.Errorf("reload items not equal, actual: %v", r.Items)
+	}
+}
+
+func TestCheckConfigPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := models.NewStore(models.NewClient(models.ConfigFile, "", "", "", dir))
+	s := &Server{configStore: store}
+
+	if s.checkConfigPending(false) {
+		t.Errorf("nothing should be pending without config change")
+	}
+
+	// change is left to rollout holding the lock
+	if err := store.LockRollout("r1"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.checkConfigPending(true) || !s.configPending {
+		t.Errorf("config change should be pending while rollout is locked")
+	}
+	if !s.checkConfigPending(false) {
+		t.Errorf("config change should be still pending while rollout is locked")
+	}
+}
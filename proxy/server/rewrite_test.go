@@ -0,0 +1,181 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/proxy/plan"
+	"github.com/ZzzYtl/MyMask/stats"
+	"github.com/ZzzYtl/MyMask/util"
+)
+
+func TestRewriteSQL(t *testing.T) {
+	cfgs := []*models.RewriteRule{
+		{Name: "add_limit", Match: models.RewriteMatchPattern, Pattern: "select * from user where name = ?",
+			Replacement: "select * from user where name = ? limit 100"},
+		{Name: "force_index", Match: models.RewriteMatchPattern, DB: "db1", Pattern: "select id from orders where status = 1 and uid = ?",
+			Replacement: "select id from orders force index(idx_uid) where status = 1 and uid = ?"},
+		{Name: "replace_func", Match: models.RewriteMatchFingerprint, Pattern: "select id from t where ctime > now() - 1",
+			Replacement: "select id from t where ctime > current_timestamp() - ?"},
+	}
+	var rules []*plan.RewriteRule
+	for _, cfg := range cfgs {
+		r, err := plan.NewRewriteRule(cfg)
+		if err != nil {
+			t.Fatalf("create rewrite rule %s error: %v", cfg.Name, err)
+		}
+		rules = append(rules, r)
+	}
+
+	se := newSessionExecutor(nil)
+	tests := []struct {
+		db     string
+		sql    string
+		rule   string
+		expect string
+	}{
+		{"db1", "SELECT *   FROM user WHERE name='a''b'", "add_limit", "SELECT * FROM `user` WHERE `name`='a''b' LIMIT 100"},
+		{"db1", "select * from user where name = 'a' limit 1", "", ""},
+		{"db1", "select id from orders where status = 1 and uid = 10", "force_index", "SELECT `id` FROM `orders` FORCE INDEX (`idx_uid`) WHERE `status`=1 AND `uid`=10"},
+		{"db1", "select id from orders where status = 2 and uid = 10", "", ""},
+		{"db2", "select id from orders where status = 1 and uid = 10", "", ""},
+		{"db2", "select id from t where ctime > NOW() - 3600", "replace_func", "SELECT `id` FROM `t` WHERE `ctime`>CURRENT_TIMESTAMP()-3600"},
+	}
+	for _, test := range tests {
+		rewritten, rule := plan.RewriteSQL(rules, test.db, test.sql, se.Parse)
+		if test.rule == "" {
+			if rule != nil || rewritten != test.sql {
+				t.Errorf("sql %s should not be rewritten, rule: %s, rewritten: %s", test.sql, rule.GetName(), rewritten)
+			}
+			continue
+		}
+		if rule == nil || rule.GetName() != test.rule {
+			t.Errorf("sql %s should be rewritten by rule %s", test.sql, test.rule)
+			continue
+		}
+		if rewritten != test.expect {
+			t.Errorf("rewritten sql not equal, sql: %s, expect: %s, actual: %s", test.sql, test.expect, rewritten)
+		}
+	}
+}
+
+func TestRewriteSQLMasked(t *testing.T) {
+	r, err := plan.NewRewriteRule(&models.RewriteRule{Name: "add_limit", Match: models.RewriteMatchPattern,
+		Pattern: "select * from user", Replacement: "select * from user limit 10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	se := newSessionExecutor(nil)
+	se.maskRule = &map[util.RuleKey]string{{Table: "user", Col: "phone"}: "mask_phone"}
+	se.tableDesc = &map[string][]string{"USER": {"id", "phone"}}
+	ns := &Namespace{defaultPhyDBs: map[string]string{"db1": "db1_0"}}
+
+	sql, _ := plan.RewriteSQL([]*plan.RewriteRule{r}, "db1", "select * from user", se.Parse)
+	p, err := se.getPlan(ns, "db1", sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := se.getPlan(ns, "db1", "select * from user limit 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := p.(*plan.UnshardPlan).GetSQL(); actual != expect.(*plan.UnshardPlan).GetSQL() {
+		t.Errorf("rewritten sql should be masked, expect: %s, actual: %s", expect.(*plan.UnshardPlan).GetSQL(), actual)
+	}
+}
+
+func TestRewriteStmt(t *testing.T) {
+	r, err := plan.NewRewriteRule(&models.RewriteRule{Name: "add_limit", Match: models.RewriteMatchPattern,
+		Pattern: "select * from user where name = ?", Replacement: "select * from user where name = ? limit 10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager()
+	m.statistics = &StatisticManager{rewriteCounts: stats.NewCountersWithMultiLabels("", "", []string{statsLabelCluster, statsLabelNamespace, "Rule"})}
+	se := newSessionExecutor(m)
+	se.db = "db1"
+	se.maskRule = &map[util.RuleKey]string{{Table: "user", Col: "phone"}: "mask_phone"}
+	se.tableDesc = &map[string][]string{"USER": {"id", "phone"}}
+	ns := &Namespace{defaultPhyDBs: map[string]string{"db1": "db1_0"}, rewriteRules: []*plan.RewriteRule{r}}
+
+	p, err := se.getStmtPlan(ns, &Stmt{sql: "select * from user where name = ?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := se.getPlan(ns, "db1", "select * from user where name = ? limit 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := p.(*plan.UnshardPlan).GetSQL(); actual != expect.(*plan.UnshardPlan).GetSQL() {
+		t.Errorf("prepared sql should be rewritten and masked, expect: %s, actual: %s", expect.(*plan.UnshardPlan).GetSQL(), actual)
+	}
+}
+
+func TestRewriteSQLParamMarker(t *testing.T) {
+	cfgs := []*models.RewriteRule{
+		{Name: "keep_order", Match: models.RewriteMatchPattern, Pattern: "select * from t where a = ? and b = ?",
+			Replacement: "select * from t force index(idx_ab) where a = ? and b = ?"},
+		{Name: "drop_cond", Match: models.RewriteMatchPattern, Pattern: "select * from t where c = ? and d = ?",
+			Replacement: "select * from t where c = ?"},
+	}
+	var rules []*plan.RewriteRule
+	for _, cfg := range cfgs {
+		r, err := plan.NewRewriteRule(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+
+	se := newSessionExecutor(nil)
+	tests := []struct {
+		sql    string
+		expect string
+	}{
+		{"select * from t where a = ? and b = 1", "SELECT * FROM `t` FORCE INDEX (`idx_ab`) WHERE `a`=? AND `b`=1"},
+		{"select * from t where a = ? and b = ?", "SELECT * FROM `t` FORCE INDEX (`idx_ab`) WHERE `a`=? AND `b`=?"},
+		// param marker could not be dropped, params are bound by position
+		{"select * from t where c = 1 and d = ?", ""},
+		{"select * from t where c = ? and d = 2", "SELECT * FROM `t` WHERE `c`=?"},
+	}
+	for _, test := range tests {
+		rewritten, rule := plan.RewriteSQL(rules, "db1", test.sql, se.Parse)
+		if test.expect == "" {
+			if rule != nil {
+				t.Errorf("sql %s should not be rewritten, rewritten: %s", test.sql, rewritten)
+			}
+			continue
+		}
+		if rewritten != test.expect {
+			t.Errorf("rewritten sql not equal, sql: %s, expect: %s, actual: %s", test.sql, test.expect, rewritten)
+		}
+	}
+}
+
+func TestNewRewriteRuleError(t *testing.T) {
+	cfgs := []*models.RewriteRule{
+		{Name: "bad_pattern", Match: models.RewriteMatchPattern, Pattern: "select from", Replacement: "select 1"},
+		{Name: "too_many_params", Match: models.RewriteMatchPattern, Pattern: "select ?", Replacement: "select ?, ?"},
+	}
+	for _, cfg := range cfgs {
+		if _, err := plan.NewRewriteRule(cfg); err == nil {
+			t.Errorf("create rewrite rule %s should fail", cfg.Name)
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package server
 
-import "github.com/ZzzYtl/MyMask/models"
+import (
+	"sort"
+
+	"github.com/ZzzYtl/MyMask/models"
+	"github.com/ZzzYtl/MyMask/util"
+)
 
 type RuleList struct {
 	name     string
@@ -16,3 +21,38 @@ func NewRuleList(config *models.FilterList) (*RuleList, error) {
 	}
 	return rulelist, nil
 }
+
+// addTo add mask functions of rules not in white list to ruleMap, columns already in ruleMap are kept
+func (r *RuleList) addTo(ruleMap map[util.RuleKey]string, whiteRecord map[string]bool) {
+	for _, v := range r.rulelist {
+		if _, ok := whiteRecord[v.Name]; ok {
+			continue
+		}
+		key := util.RuleKey{
+			Table: v.Action.Mask.TableName,
+			Col:   v.Action.Mask.ColName,
+		}
+		if _, ok := ruleMap[key]; !ok {
+			ruleMap[key] = v.Action.Mask.Function
+		}
+	}
+}
+
+// filters return rules sorted by table, column and name
+func (r *RuleList) filters() []*models.Filter {
+	filters := make([]*models.Filter, 0, len(r.rulelist))
+	for _, v := range r.rulelist {
+		filters = append(filters, v)
+	}
+	sort.Slice(filters, func(i, j int) bool {
+		a, b := filters[i], filters[j]
+		if a.Action.Mask.TableName != b.Action.Mask.TableName {
+			return a.Action.Mask.TableName < b.Action.Mask.TableName
+		}
+		if a.Action.Mask.ColName != b.Action.Mask.ColName {
+			return a.Action.Mask.ColName < b.Action.Mask.ColName
+		}
+		return a.Name < b.Name
+	})
+	return filters
+}
@@ -16,10 +16,10 @@ package server
 
 import (
 	"net"
-	"os"
-	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"fmt"
@@ -27,8 +27,8 @@ import (
 	"github.com/ZzzYtl/MyMask/models"
 	"github.com/ZzzYtl/MyMask/mysql"
 	"github.com/ZzzYtl/MyMask/util"
+	"github.com/ZzzYtl/MyMask/util/proxyproto"
 	"github.com/ZzzYtl/MyMask/util/sync2"
-	"github.com/howeyc/fsnotify"
 )
 
 var (
@@ -36,15 +36,22 @@ var (
 	timeWheelBucketsNum = 3600
 )
 
-type Listener struct {
-	listener net.Listener
-	ch       chan interface{}
-}
+const (
+	defaultDrainTimeout  = 30 * time.Second
+	drainCheckInterval   = 100 * time.Millisecond
+	drainRecycleWaitTime = 5 * time.Second // time to wait for killed sessions to recycle resources
+
+	proxyProtocolHeaderTimeout = 5 * time.Second
+
+	rolloutLockCheckInterval = 10 * time.Second // interval of checking rollout lock while config change is pending
+)
 
 // Server means proxy that serve client request
 type Server struct {
-	closed    sync2.AtomicBool
-	listeners map[uint32]*Listener
+	closed       sync2.AtomicBool
+	draining     sync2.AtomicBool
+	listeners    map[uint32]*Listener // key: proxy port of namespace
+	listenerLock sync.Mutex
 
 	sessionTimeout time.Duration
 	tw             *util.TimeWheel
@@ -52,8 +59,16 @@ type Server struct {
 	manager        *Manager
 	cfg            *models.Proxy
 	EncryptKey     string
-	watcher        *fsnotify.Watcher
-	pipe           map[interface{}]chan interface{}
+	configEvents   <-chan string // paths of changed config, sent by watch of config store
+	configStore    *models.Store // store watched, closed when server is shut down
+	reloadLock     sync.Mutex    // serializes reloading triggered by watch and by admin api
+	prepared       bool          // config prepared by admin api and waiting for commit
+	configPending  bool          // config changed while rollout lock is held, reloaded after it's released
+	sessions       *sessionRegistry
+	drainTimeout   time.Duration
+	shutdownOnce   sync.Once
+	proxyProtocol  []util.IPInfo // trusted load balancers sending PROXY protocol header
+	done           chan struct{} // closed when server is shut down
 }
 
 // NewServer create new server
@@ -65,7 +80,12 @@ func NewServer(cfg *models.Proxy, manager *Manager) (*Server, error) {
 	s.EncryptKey = cfg.EncryptKey
 	s.cfg = cfg
 	s.manager = manager
-	s.pipe = make(map[interface{}]chan interface{}, 64)
+	s.sessions = newSessionRegistry()
+	s.done = make(chan struct{})
+	s.drainTimeout = defaultDrainTimeout
+	if cfg.DrainTimeout > 0 {
+		s.drainTimeout = time.Duration(cfg.DrainTimeout) * time.Second
+	}
 	// if error occurs, recycle the resources during creation.
 	defer func() {
 		if e := recover(); e != nil {
@@ -79,6 +99,11 @@ func NewServer(cfg *models.Proxy, manager *Manager) (*Server, error) {
 
 	s.closed = sync2.NewAtomicBool(false)
 
+	s.proxyProtocol, err = parseProxyProtocolTrusted(cfg.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
 	err = s.NewListeners()
 	if err != nil {
 		return nil, err
@@ -104,28 +129,9 @@ func NewServer(cfg *models.Proxy, manager *Manager) (*Server, error) {
 		return nil, err
 	}
 	s.adminServer = adminServer
-	s.watcher, err = fsnotify.NewWatcher()
+	s.configStore, s.configEvents, err = watchConfig(cfg, s.done)
 	if err != nil {
-		log.Fatal("new file watcher fail")
-		return nil, err
-	}
-	err = filepath.Walk(cfg.FileConfigPath, func(path string, info os.FileInfo, err error) error {
-		//这里判断是否为目录，只需监控目录即可
-		//目录下的文件也在监控范围内，不需要我们一个一个加
-		if info.IsDir() {
-			path, err := filepath.Abs(path)
-			if err != nil {
-				return err
-			}
-			err = s.watcher.Watch(path)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		log.Fatal(fmt.Sprintf("watcher file(%s) error, quit. error: %s", cfg.FileConfigPath, err.Error()))
+		log.Fatal(fmt.Sprintf("watch config(%s) error, quit. error: %s", cfg.ConfigType, err.Error()))
 		return nil, err
 	}
 	log.Notice("server start succ, netProtoType: %s, addr: %s", cfg.ProtoType, cfg.ProxyAddr)
@@ -137,8 +143,18 @@ func (s *Server) Listeners() map[uint32]*Listener {
 	return s.listeners
 }
 
-func (s *Server) onConn(c net.Conn) {
-	cc := newSession(s, c) //新建一个conn
+func (s *Server) onConn(c net.Conn, port uint32) {
+	if s.isProxyProtocolTrusted(c.RemoteAddr()) {
+		pc, err := proxyproto.Accept(c, proxyProtocolHeaderTimeout)
+		if err != nil {
+			log.Warn("[server] read proxy protocol header error, remoteAddr: %s, err: %v", c.RemoteAddr().String(), err)
+			c.Close()
+			return
+		}
+		c = pc
+	}
+
+	cc := newSession(s, c, port) //新建一个conn
 	defer func() {
 		err := recover()
 		if err != nil {
@@ -150,6 +166,7 @@ func (s *Server) onConn(c net.Conn) {
 
 		// close session finally
 		cc.Close()
+		s.sessions.remove(cc)
 	}()
 
 	if err := cc.Handshake(); err != nil {
@@ -169,10 +186,44 @@ func (s *Server) onConn(c net.Conn) {
 
 	// added into time wheel
 	s.tw.Add(s.sessionTimeout, cc, cc.Close)
-	s.pipe[cc] = cc.pipe
+	cc.updateProcessIdle()
+	s.sessions.add(cc)
 	cc.Run()
 }
 
+func parseProxyProtocolTrusted(cidrs string) ([]util.IPInfo, error) {
+	var trusted []util.IPInfo
+	for _, v := range strings.Split(cidrs, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		info, err := util.ParseIPInfo(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_protocol_trusted_cidrs %s: %v", v, err)
+		}
+		trusted = append(trusted, info)
+	}
+	return trusted, nil
+}
+
+// isProxyProtocolTrusted check if connection comes from trusted load balancer
+func (s *Server) isProxyProtocolTrusted(addr net.Addr) bool {
+	if len(s.proxyProtocol) == 0 {
+		return false
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, info := range s.proxyProtocol {
+		if info.Match(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
 // Run proxy run and serve client request
 func (s *Server) Run() error {
 	// start AdminServer first
@@ -180,96 +231,244 @@ func (s *Server) Run() error {
 	go s.CheckConfig()
 	// start Server
 	s.closed.Set(false)
-	for _, listener := range s.listeners {
-		go func(lis *Listener) {
-			for s.closed.Get() != true {
-				conn, err := lis.listener.Accept()
-				if err != nil {
-					log.Warn("[server] listener accept error: %s", err.Error())
-					return
-				}
-				go s.onConn(conn)
-			}
-		}(listener)
+	s.listenerLock.Lock()
+	for _, lis := range s.listeners {
+		go s.serve(lis)
 	}
+	s.listenerLock.Unlock()
 	return nil
 }
 
-// Close close proxy server
+// Close close proxy server immediately, running queries and transactions are interrupted
 func (s *Server) Close() error {
-	if s.adminServer != nil {
-		s.adminServer.Close()
-	}
+	s.shutdownOnce.Do(func() {
+		s.closeListeners()
+		s.close()
+	})
+	return nil
+}
+
+// Shutdown close proxy server gracefully. New connections are refused at once, idle sessions are closed,
+// running statements and transactions could go on until drain timeout, then backend pools are closed.
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		log.Notice("[server] drain begin, timeout: %v, sessions: %d", s.drainTimeout, s.sessions.count())
+		s.draining.Set(true)
+		s.closeListeners()
+		s.drain(s.drainTimeout)
+		log.Notice("[server] drain end, sessions left: %d", s.sessions.count())
+		s.close()
+	})
+}
+
+// IsDraining check if server is shutting down gracefully
+func (s *Server) IsDraining() bool {
+	return s.draining.Get()
+}
 
-	s.closed.Set(true)
-	for _, v := range s.listeners {
-		if v.listener != nil {
-			err := v.listener.Close()
-			if err != nil {
-				return err
+// Done return channel closed after server is shut down
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// drain wait for sessions until timeout, sessions not finished are killed
+func (s *Server) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for s.sessions.count() > 0 && time.Now().Before(deadline) {
+		// idle sessions are closed, active sessions are closed by themselves after command or transaction finished
+		for _, cc := range s.sessions.list() {
+			if cc.executor.process.isIdle() {
+				cc.c.Close()
 			}
 		}
+		time.Sleep(drainCheckInterval)
 	}
 
-	s.manager.Close()
-	return nil
+	if s.sessions.count() == 0 {
+		return
+	}
+
+	for _, cc := range s.sessions.list() {
+		log.Warn("[server] kill session when drain timeout, connId: %d", cc.c.GetConnectionID())
+		cc.Kill()
+	}
+	deadline = time.Now().Add(drainRecycleWaitTime)
+	for s.sessions.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainCheckInterval)
+	}
 }
 
-func (s *Server) NewListeners() error {
-	s.listeners = make(map[uint32]*Listener)
-	ports := s.manager.GetProxyPorts()
-	for _, v := range ports {
-		s.listeners[v] = &Listener{
-			listener: nil,
-			ch:       make(chan interface{}),
-		}
-		listener, err := net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", v))
-		if err != nil {
-			return err
-		}
-		s.listeners[v].listener = listener
+func (s *Server) close() {
+	if s.adminServer != nil {
+		s.adminServer.Close()
 	}
-	return nil
+	if s.manager != nil {
+		s.manager.Close()
+	}
+	close(s.done)
 }
 
+// watchConfig watch changes of config in config store until done is closed
+func watchConfig(cfg *models.Proxy, done <-chan struct{}) (*models.Store, <-chan string, error) {
+	client := newConfigClient(cfg)
+	if client == nil {
+		return nil, nil, fmt.Errorf("create client of config type %s failed", cfg.ConfigType)
+	}
+	store := models.NewStore(client)
+	events, err := store.Watch(done)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	go func() {
+		<-done
+		store.Close()
+	}()
+	return store, events, nil
+}
+
+// CheckConfig reload all config when config changed, changes in one second are reloaded together.
+// rollout records, rollout lock and proxy registrations are not config. while cc holds rollout lock, it drives
+// proxies to prepare and commit the change, so changes are not reloaded by watch until the lock is released.
 func (s *Server) CheckConfig() {
+	var recheck <-chan time.Time
 	for {
 		select {
-		case <-s.watcher.Event:
-			if s.ReloadCfgPrepare() == nil {
-				s.ReloadCfgCommit()
-				s.CheckListener()
+		case path, ok := <-s.configEvents:
+			if !ok {
+				return
+			}
+			changed := s.configStore.IsConfigPath(path)
+			if changed {
+				log.Notice("config changed, path: %s", path)
+			} else if !s.configStore.IsRolloutLockPath(path) {
+				continue
+			}
+			time.Sleep(time.Duration(1 * time.Second))
+			for drained := false; !drained; {
+				select {
+				case path, ok := <-s.configEvents:
+					drained = !ok
+					changed = changed || ok && s.configStore.IsConfigPath(path)
+				default:
+					drained = true
+				}
+			}
+			if s.checkConfigPending(changed) {
+				recheck = time.After(rolloutLockCheckInterval)
+			} else {
+				recheck = nil
+			}
+		case <-recheck:
+			// cc may crash and leave the lock, which expires after models.RolloutLockExpire
+			if s.checkConfigPending(false) {
+				recheck = time.After(rolloutLockCheckInterval)
+			} else {
+				recheck = nil
 			}
-		case err := <-s.watcher.Error:
-			log.Warn("error:", err)
 		}
-		time.Sleep(time.Duration(1 * time.Second))
 	}
 }
 
+// checkConfigPending reload all config if config changed or pending, it returns true if config is still pending
+// because rollout lock is held
+func (s *Server) checkConfigPending(changed bool) bool {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	if !changed && !s.configPending {
+		return false
+	}
+	locked, err := s.configStore.RolloutLocked()
+	if err != nil {
+		log.Warn("check rollout lock failed, %v", err)
+	}
+	if locked {
+		log.Notice("rollout is running, config change is left to it")
+		s.configPending = true
+		return true
+	}
+
+	s.configPending = false
+	if s.reloadCfgPrepare() == nil && s.reloadCfgCommit() == nil {
+		if failed := s.CheckListener(); len(failed) != 0 {
+			s.manager.AddReloadItems(failed)
+		}
+	}
+	// config prepared by admin api is replaced by newer one
+	s.prepared = false
+	return false
+}
+
+// ReloadCfgPrepare prepare phase of reloading all config, it's called by admin api
 func (s *Server) ReloadCfgPrepare() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	err := s.reloadCfgPrepare()
+	s.prepared = err == nil
+	return err
+}
+
+// ReloadCfgCommit commit phase of reloading all config, it does nothing if no config prepared,
+// because config changed after prepare phase is already reloaded by watch.
+func (s *Server) ReloadCfgCommit() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	if !s.prepared {
+		log.Notice("no prepared config to commit, skip")
+		return nil
+	}
+	s.prepared = false
+	if err := s.reloadCfgCommit(); err != nil {
+		return err
+	}
+	// change pending during rollout is committed by cc
+	s.configPending = false
+	if failed := s.CheckListener(); len(failed) != 0 {
+		return listenerError(failed)
+	}
+	return nil
+}
+
+// ReloadCfgAbort discard config prepared by admin api, it's called when any proxy failed to prepare
+func (s *Server) ReloadCfgAbort() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	if !s.prepared {
+		return nil
+	}
+	s.prepared = false
+	s.manager.ReloadAbort()
+	log.Notice("prepared config aborted")
+	return nil
+}
+
+func (s *Server) reloadCfgPrepare() error {
 	log.Notice("prepare config of all begin")
 	namespaceConfigs, err := loadAllNamespace(s.cfg)
 	if err != nil {
 		log.Warn("reload namespace cfg failed, %v", err)
+		s.manager.RecordReloadError(err)
 		return err
 	}
 
 	whiteListConfigs, err := loadAllWhiteListConfig(s.cfg)
 	if err != nil {
 		log.Warn("reload whitelist cfg failed, %v", err)
+		s.manager.RecordReloadError(err)
 		return err
 	}
 
 	rulesConfigs, err := loadAllRulesConfig(s.cfg)
 	if err != nil {
 		log.Warn("reload maskrules cfg failed, %v", err)
+		s.manager.RecordReloadError(err)
 		return err
 	}
 
 	databaseConfigs, err := loadDataBaseConfig(s.cfg)
 	if err != nil {
 		log.Warn("reload database cfg failed %v", err)
+		s.manager.RecordReloadError(err)
 		return err
 	}
 
@@ -282,69 +481,60 @@ func (s *Server) ReloadCfgPrepare() error {
 	return nil
 }
 
-func (s *Server) ReloadCfgCommit() error {
+func (s *Server) reloadCfgCommit() error {
 	log.Notice("commit config  begin")
-	defer func() {
-		recover()
-	}()
 	if err := s.manager.ReloadAllNamespaceCommit(); err != nil {
 		log.Warn("Manager ReloadNamespaceCommit error: %v", err)
 		return err
 	}
 
-	for _, c := range s.pipe {
-		c <- nil
-	}
+	s.sessions.notifyConfigChanged()
 
 	log.Notice("commit config end")
 	return nil
 }
 
-func (s *Server) CheckListener() {
-	ports := s.manager.GetProxyPorts()
-	mapPorts := make(map[uint32]bool)
-	for _, port := range ports {
-		mapPorts[uint32(port)] = true
-	}
-	for k, v := range s.listeners {
-		if _, ok := mapPorts[k]; !ok {
-			v.listener.Close()
-			delete(s.listeners, k)
-		} else {
-			delete(mapPorts, k)
+// ProcessList return state of sessions, sessions of all namespaces are returned if namespace is empty
+func (s *Server) ProcessList(namespace string) []*ProcessInfo {
+	var infos []*ProcessInfo
+	for _, cc := range s.sessions.list() {
+		if namespace != "" && cc.namespace != namespace {
+			continue
 		}
+		infos = append(infos, cc.ProcessInfo())
 	}
+	return infos
+}
 
-	for port, _ := range mapPorts {
-		s.listeners[port] = &Listener{
-			listener: nil,
-			ch:       make(chan interface{}),
-		}
-		listener, err := net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", port))
-		if err != nil {
-			return
-		}
-		s.listeners[port].listener = listener
-
-		go func(lis *Listener) {
-			for s.closed.Get() != true {
-				conn, err := lis.listener.Accept()
-				if err != nil {
-					log.Warn("[server] listener accept error: %s", err.Error())
-					return
-				}
-				go s.onConn(conn)
-			}
-		}(s.listeners[port])
+// KillSession kill session with connection id, only running query is killed if query is true
+func (s *Server) KillSession(id uint32, query bool) error {
+	cc := s.sessions.get(id)
+	if cc == nil {
+		return fmt.Errorf("session %d not found", id)
+	}
+
+	if query {
+		log.Notice("kill query of session, connId: %d", id)
+		return cc.KillQuery()
 	}
+	log.Notice("kill session, connId: %d", id)
+	return cc.Kill()
 }
 
 // ReloadNamespacePrepare config change prepare phase
 func (s *Server) ReloadNamespacePrepare(name string, client models.Client) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	s.prepared = false
+
 	// get namespace conf from etcd
 	log.Notice("prepare config of namespace: %s begin", name)
+	cipher, err := s.cfg.Cipher()
+	if err != nil {
+		return err
+	}
 	store := models.NewStore(client)
-	namespaceConfig, err := store.LoadNamespace(s.EncryptKey, name)
+	namespaceConfig, err := store.LoadNamespace(cipher, name)
 	if err != nil {
 		return err
 	}
@@ -354,6 +544,7 @@ func (s *Server) ReloadNamespacePrepare(name string, client models.Client) error
 		return err
 	}
 
+	s.prepared = true
 	log.Notice("prepare config of namespace: %s end", name)
 	return nil
 }
@@ -361,12 +552,26 @@ func (s *Server) ReloadNamespacePrepare(name string, client models.Client) error
 // ReloadNamespaceCommit config change commit phase
 // commit namespace does not need lock
 func (s *Server) ReloadNamespaceCommit(name string) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	if !s.prepared {
+		log.Notice("no prepared config of namespace: %s to commit, skip", name)
+		return nil
+	}
+	s.prepared = false
+
 	log.Notice("commit config of namespace: %s begin", name)
 
 	if err := s.manager.ReloadNamespaceCommit(name); err != nil {
 		log.Warn("Manager ReloadNamespaceCommit error: %v", err)
 		return err
 	}
+	s.configPending = false
+	s.sessions.notifyConfigChanged()
+
+	if failed := s.CheckListener(); len(failed) != 0 {
+		return listenerError(failed)
+	}
 
 	log.Notice("commit config of namespace: %s end", name)
 	return nil
@@ -374,12 +579,21 @@ func (s *Server) ReloadNamespaceCommit(name string) error {
 
 // DeleteNamespace delete namespace in namespace manager
 func (s *Server) DeleteNamespace(name string) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	s.prepared = false
+
 	log.Notice("delete namespace begin: %s", name)
 
 	if err := s.manager.DeleteNamespace(name); err != nil {
 		log.Warn("Manager DeleteNamespace error: %v", err)
 		return err
 	}
+	s.sessions.notifyConfigChanged()
+
+	if failed := s.CheckListener(); len(failed) != 0 {
+		return listenerError(failed)
+	}
 
 	log.Notice("delete namespace end: %s", name)
 	return nil
@@ -18,20 +18,22 @@ import (
 	"fmt"
 	"net"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 
 	"github.com/ZzzYtl/MyMask/log"
 	"github.com/ZzzYtl/MyMask/mysql"
 	"github.com/ZzzYtl/MyMask/util"
+	"github.com/ZzzYtl/MyMask/util/sync2"
 )
 
 // DefaultCapability means default capability
 var DefaultCapability = mysql.ClientLongPassword | mysql.ClientLongFlag |
 	mysql.ClientConnectWithDB | mysql.ClientProtocol41 |
-	mysql.ClientTransactions | mysql.ClientSecureConnection
+	mysql.ClientTransactions | mysql.ClientSecureConnection |
+	mysql.ClientMultiStatements | mysql.ClientMultiResults
 
 var baseConnID uint32 = 10000
 
@@ -41,8 +43,9 @@ const initClientConnStatus = mysql.ServerStatusAutocommit
 type Session struct {
 	sync.Mutex
 
-	c     *ClientConn
-	proxy *Server
+	c       *ClientConn
+	rawConn syscall.Conn // socket of client, used to check if client goes away while query running
+	proxy   *Server
 
 	manager *Manager
 
@@ -54,28 +57,31 @@ type Session struct {
 
 	closed atomic.Value
 
-	pipe chan interface{}
+	configChanged sync2.AtomicBool // mask rule should be rebuilt because config is reloaded
 }
 
 // create session between client<->proxy
-func newSession(s *Server, co net.Conn) *Session {
+func newSession(s *Server, co net.Conn, port uint32) *Session {
 	cc := new(Session)
-	tcpConn := co.(*net.TCPConn)
+	cc.connectPort = port
 
 	//SetNoDelay controls whether the operating system should delay packet transmission
 	// in hopes of sending fewer packets (Nagle's algorithm).
 	// The default is true (no delay),
 	// meaning that data is sent as soon as possible after a Write.
 	//I set this option false.
-	tcpConn.SetNoDelay(true)
-	cc.c = NewClientConn(mysql.NewConn(tcpConn), s.manager)
+	if c, ok := co.(interface{ SetNoDelay(bool) error }); ok {
+		c.SetNoDelay(true)
+	}
+	cc.c = NewClientConn(mysql.NewConn(co), s.manager)
+	cc.rawConn = rawClientConn(co)
 	cc.proxy = s
 	cc.manager = s.manager
 
 	cc.c.SetConnectionID(atomic.AddUint32(&baseConnID, 1))
 
 	cc.executor = newSessionExecutor(s.manager)
-	cc.pipe = make(chan interface{}, 1)
+	cc.executor.sessions = s.sessions
 	cc.closed.Store(false)
 
 	return cc
@@ -180,16 +186,72 @@ func (cc *Session) handleHandshakeResponse(info HandshakeResponseInfo) error {
 	// set database
 	cc.executor.SetDatabase(info.Database)
 
+	// multi statements is enabled only if client asks for it
+	cc.executor.multiStatements = info.Capability&mysql.ClientMultiStatements > 0
+
 	// set namespace
-	_, portStr, _ := net.SplitHostPort(cc.c.LocalAddr().String())
-	port, _ := strconv.Atoi(portStr)
-	cc.connectPort = uint32(port)
 	namespace := cc.manager.GetNamespace(cc.connectPort)
 	cc.namespace = namespace.name
 	cc.executor.namespace = namespace.name
 	cc.executor.connectProxyPort = cc.connectPort
 	cc.c.namespace = namespace.name // TODO: remove it when refactor is done
-	return nil
+
+	if err := cc.executor.acquireSessionLimit(); err != nil {
+		return err
+	}
+
+	// mask rule of database in handshake must be resolved, or the session runs without mask
+	return cc.executor.refreshMaskRule()
+}
+
+// handleChangeUser re-authenticate client with new user, session state is reset and mask rule is rebuilt for new user
+func (cc *Session) handleChangeUser(data []byte) Response {
+	info, err := cc.c.readChangeUser(data)
+	if err != nil {
+		log.Warn("read change user error, connId: %d, err: %v", cc.c.GetConnectionID(), err)
+		return CreateErrorResponse(cc.executor.GetStatus(), err)
+	}
+
+	user := info.User
+	if !cc.manager.CheckUser(user) {
+		return CreateErrorResponse(cc.executor.GetStatus(), mysql.NewDefaultError(mysql.ErrAccessDenied, user, cc.c.RemoteAddr().String(), "Yes"))
+	}
+
+	succ, _ := cc.manager.CheckPassword(user, info.Salt, info.AuthResponse)
+	if !succ {
+		return CreateErrorResponse(cc.executor.GetStatus(), mysql.NewDefaultError(mysql.ErrAccessDenied, user, cc.c.RemoteAddr().String(), "Yes"))
+	}
+
+	if info.CollationID != 0 {
+		collationName, ok := mysql.Collations[info.CollationID]
+		if !ok {
+			return CreateErrorResponse(cc.executor.GetStatus(), mysql.NewError(mysql.ErrInternal, "invalid collation"))
+		}
+		charset, ok := mysql.CollationNameToCharset[collationName]
+		if !ok {
+			return CreateErrorResponse(cc.executor.GetStatus(), mysql.NewError(mysql.ErrInternal, "invalid collation"))
+		}
+		cc.executor.SetCollationID(info.CollationID)
+		cc.executor.SetCharset(charset)
+	}
+
+	if err := cc.executor.resetSession(); err != nil {
+		log.Warn("reset session error when change user, connId: %d, err: %v", cc.c.GetConnectionID(), err)
+	}
+	cc.executor.user = user
+	cc.executor.SetDatabase(info.Database)
+
+	// session slot is moved to new user
+	cc.executor.releaseSessionLimit()
+	if err := cc.executor.acquireSessionLimit(); err != nil {
+		return CreateErrorResponse(cc.executor.GetStatus(), err)
+	}
+
+	if err := cc.executor.refreshMaskRule(); err != nil {
+		return CreateErrorResponse(cc.executor.GetStatus(), err)
+	}
+
+	return CreateOKResponse(cc.executor.GetStatus())
 }
 
 // Close close session with it's resources
@@ -201,12 +263,41 @@ func (cc *Session) Close() {
 	if err := cc.executor.rollback(); err != nil {
 		log.Warn("executor rollback error when Session close: %v", err)
 	}
+	cc.executor.releaseSessionLimit()
 	cc.c.Close()
 	log.Debug("client closed, %d", cc.c.GetConnectionID())
 
 	return
 }
 
+// KillQuery kill query of session running on backend mysql
+func (cc *Session) KillQuery() error {
+	return cc.executor.process.killQuery()
+}
+
+// Kill kill running query and close client connection, resources of session are recycled by session goroutine
+func (cc *Session) Kill() error {
+	if err := cc.KillQuery(); err != nil {
+		log.Warn("kill query error when kill session, connId: %d, err: %v", cc.c.GetConnectionID(), err)
+	}
+	cc.c.Close()
+	return nil
+}
+
+func (cc *Session) updateProcessIdle() {
+	se := cc.executor
+	se.process.idle(se.user, se.db, se.maskStatus(), se.isInTransaction())
+}
+
+// ProcessInfo return state of session
+func (cc *Session) ProcessInfo() *ProcessInfo {
+	info := cc.executor.process.info()
+	info.ID = cc.c.GetConnectionID()
+	info.ClientAddr = cc.c.RemoteAddr().String()
+	info.Namespace = cc.namespace
+	return info
+}
+
 // IsClosed check if closed
 func (cc *Session) IsClosed() bool {
 	return cc.closed.Load().(bool)
@@ -225,17 +316,16 @@ func (cc *Session) Run() {
 		}
 		cc.Close()
 		cc.proxy.tw.Remove(cc)
-		close(cc.pipe)
 		cc.manager.GetStatisticManager().DescSessionCount(cc.namespace)
 	}()
 
 	cc.manager.GetStatisticManager().IncrSessionCount(cc.namespace)
 
 	for !cc.IsClosed() {
-		select {
-		case <-cc.pipe:
-			cc.executor.handleUseDB(cc.executor.db)
-		default:
+		if cc.configChanged.CompareAndSwap(true, false) {
+			if err := cc.executor.refreshMaskRule(); err != nil {
+				log.Warn("refresh mask rule error, connId: %d, err: %v", cc.c.GetConnectionID(), err)
+			}
 		}
 
 		cc.c.SetSequence(0)
@@ -249,16 +339,45 @@ func (cc *Session) Run() {
 
 		cmd := data[0]
 		data = data[1:]
-		rs := cc.executor.ExecuteCommand(cmd, data)
+		cc.executor.process.begin(commandName(cmd), cc.executor.commandSQL(cmd, data))
+
+		// new command out of transaction is refused when proxy is draining, the client should retry on other proxy
+		if cc.proxy.IsDraining() && !cc.executor.isInTransaction() {
+			cc.c.RecycleReadPacket()
+			if cmd != mysql.ComQuit {
+				cc.c.writeErrorPacket(mysql.NewDefaultError(mysql.ErrServerShutdown))
+			}
+			cc.Close()
+			return
+		}
+
+		var rs Response
+		if cmd == mysql.ComChangeUser {
+			rs = cc.handleChangeUser(data)
+		} else if isQueryCommand(cmd) {
+			stopWatch := cc.watchClient()
+			rs = cc.executor.ExecuteCommandWithLimits(cmd, data)
+			stopWatch()
+		} else {
+			rs = cc.executor.ExecuteCommandWithLimits(cmd, data)
+		}
 		cc.c.RecycleReadPacket()
 
-		if err = cc.writeResponse(rs); err != nil {
+		err = cc.writeResponse(rs)
+		cc.updateProcessIdle()
+		if err != nil {
 			log.Warn("Session write response error, connId: %d, err: %v", cc.c.GetConnectionID(), err)
 			cc.Close()
 			return
 		}
 
-		if cmd == mysql.ComQuit {
+		// like mysql, connection is closed if change user failed
+		if cmd == mysql.ComQuit || (cmd == mysql.ComChangeUser && rs.RespType == RespError) {
+			cc.Close()
+		}
+
+		// transaction finished when proxy is draining
+		if cc.proxy.IsDraining() && !cc.executor.isInTransaction() {
 			cc.Close()
 		}
 	}
@@ -299,6 +418,17 @@ func (cc *Session) writeResponse(r Response) error {
 			return rs
 		}
 		return nil
+	case RespMulti:
+		rs := r.Data.([]Response)
+		for i, sub := range rs {
+			if i != len(rs)-1 {
+				sub.Status |= mysql.ServerMoreResultsExists
+			}
+			if err := cc.writeResponse(sub); err != nil {
+				return err
+			}
+		}
+		return nil
 	case RespOK:
 		return cc.c.writeOK(r.Status)
 	case RespNoop:
@@ -0,0 +1,261 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/backend"
+	"github.com/ZzzYtl/MyMask/mysql"
+)
+
+// mask status of session
+const (
+	MaskStatusMasked = "masked" // mask rules are applied to results
+	MaskStatusExempt = "exempt" // all mask rules are exempted by whitelist
+	MaskStatusNone   = "none"   // no database selected or no mask rule found
+)
+
+const processCommandSleep = "Sleep"
+
+// names of commands like mysql SHOW PROCESSLIST
+var commandNames = map[byte]string{
+	mysql.ComQuit:             "Quit",
+	mysql.ComInitDB:           "Init DB",
+	mysql.ComQuery:            "Query",
+	mysql.ComFieldList:        "Field List",
+	mysql.ComPing:             "Ping",
+	mysql.ComChangeUser:       "Change user",
+	mysql.ComStmtPrepare:      "Prepare",
+	mysql.ComStmtExecute:      "Execute",
+	mysql.ComStmtSendLongData: "Long Data",
+	mysql.ComStmtClose:        "Close stmt",
+	mysql.ComStmtReset:        "Reset stmt",
+	mysql.ComSetOption:        "Set option",
+	mysql.ComResetConnection:  "Reset connection",
+}
+
+func commandName(cmd byte) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("Command %d", cmd)
+}
+
+// ProcessInfo means state of one session, like a row of SHOW PROCESSLIST
+type ProcessInfo struct {
+	ID          uint32 `json:"id"`
+	User        string `json:"user"`
+	ClientAddr  string `json:"client_addr"`
+	Namespace   string `json:"namespace"`
+	DB          string `json:"db"`
+	Command     string `json:"command"`
+	Time        int64  `json:"time"` // seconds in current command
+	SQL         string `json:"sql"`
+	MaskStatus  string `json:"mask_status"`
+	BackendAddr string `json:"backend_addr,omitempty"`
+}
+
+// processState is updated by session goroutine and read by admin api, so it's protected by lock
+type processState struct {
+	sync.Mutex
+	user       string
+	db         string
+	maskStatus string
+	command    string
+	sql        string
+	startTime  time.Time
+	inTx       bool // session is in transaction when idle
+
+	backendConn   *backend.PooledConnection // backend connection running the query
+	backendConnID uint32
+	interrupted   bool // current command is killed, statements not sent to backend yet are not executed
+}
+
+// begin is called before command is executed
+func (p *processState) begin(command, sql string) {
+	p.Lock()
+	p.command = command
+	p.sql = sql
+	p.startTime = time.Now()
+	p.interrupted = false
+	p.Unlock()
+}
+
+// idle is called after command is executed, session state may be changed by the command
+func (p *processState) idle(user, db, maskStatus string, inTx bool) {
+	p.Lock()
+	p.user = user
+	p.db = db
+	p.maskStatus = maskStatus
+	p.inTx = inTx
+	p.command = processCommandSleep
+	p.sql = ""
+	p.startTime = time.Now()
+	p.backendConn = nil
+	p.backendConnID = 0
+	p.Unlock()
+}
+
+// setBackend set backend connection running the query, nil means query finished.
+// ErrQueryInterrupted is returned if current command has been killed before the query is sent to backend.
+func (p *processState) setBackend(pc *backend.PooledConnection) error {
+	var connID uint32
+	if pc != nil {
+		connID = pc.GetConnectionID()
+	}
+	p.Lock()
+	defer p.Unlock()
+	if pc != nil && p.interrupted {
+		return mysql.NewDefaultError(mysql.ErrQueryInterrupted)
+	}
+	p.backendConn = pc
+	p.backendConnID = connID
+	return nil
+}
+
+// isIdle check if session is waiting for next command without transaction, it could be closed safely
+func (p *processState) isIdle() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.command == processCommandSleep && !p.inTx
+}
+
+// killBackendQuery send KILL QUERY of backend connection, it's replaced in tests
+var killBackendQuery = func(pc *backend.PooledConnection, connID uint32) error {
+	return pc.KillQuery(connID)
+}
+
+// killQuery kill query running on backend, and statements of current command not sent to backend yet are skipped.
+// the lock is held while killing, so the query could not finish and its connection could not be recycled and
+// taken by other session before KILL QUERY is sent, which would kill query of other session.
+func (p *processState) killQuery() error {
+	p.Lock()
+	defer p.Unlock()
+	p.interrupted = true
+	if p.backendConn == nil {
+		return nil
+	}
+	return killBackendQuery(p.backendConn, p.backendConnID)
+}
+
+func (p *processState) info() *ProcessInfo {
+	p.Lock()
+	defer p.Unlock()
+	info := &ProcessInfo{
+		User:       p.user,
+		DB:         p.db,
+		Command:    p.command,
+		Time:       int64(time.Since(p.startTime) / time.Second),
+		SQL:        p.sql,
+		MaskStatus: p.maskStatus,
+	}
+	if p.backendConn != nil {
+		info.BackendAddr = p.backendConn.GetAddr()
+	}
+	return info
+}
+
+// commandSQL return sql of command shown in process list
+func (se *SessionExecutor) commandSQL(cmd byte, data []byte) string {
+	switch cmd {
+	case mysql.ComQuery, mysql.ComStmtPrepare:
+		return string(data)
+	case mysql.ComInitDB:
+		return "use " + string(data)
+	case mysql.ComStmtExecute:
+		if len(data) < 4 {
+			return ""
+		}
+		if s, ok := se.stmts[binary.LittleEndian.Uint32(data[0:4])]; ok {
+			return s.sql
+		}
+	}
+	return ""
+}
+
+func (se *SessionExecutor) maskStatus() string {
+	if se.maskRule == nil {
+		return MaskStatusNone
+	}
+	if len(*se.maskRule) == 0 {
+		return MaskStatusExempt
+	}
+	return MaskStatusMasked
+}
+
+// sessionRegistry keeps all alive sessions, it's safe for concurrent use
+type sessionRegistry struct {
+	sync.RWMutex
+	sessions map[uint32]*Session // key: connection id
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[uint32]*Session, 64)}
+}
+
+func (r *sessionRegistry) add(cc *Session) {
+	r.Lock()
+	r.sessions[cc.c.GetConnectionID()] = cc
+	r.Unlock()
+}
+
+func (r *sessionRegistry) remove(cc *Session) {
+	r.Lock()
+	if r.sessions[cc.c.GetConnectionID()] == cc {
+		delete(r.sessions, cc.c.GetConnectionID())
+	}
+	r.Unlock()
+}
+
+func (r *sessionRegistry) get(id uint32) *Session {
+	r.RLock()
+	defer r.RUnlock()
+	return r.sessions[id]
+}
+
+// list return sessions ordered by connection id
+func (r *sessionRegistry) list() []*Session {
+	r.RLock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, cc := range r.sessions {
+		sessions = append(sessions, cc)
+	}
+	r.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].c.GetConnectionID() < sessions[j].c.GetConnectionID()
+	})
+	return sessions
+}
+
+func (r *sessionRegistry) count() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.sessions)
+}
+
+// notifyConfigChanged tell sessions to rebuild mask rule before next command
+func (r *sessionRegistry) notifyConfigChanged() {
+	r.RLock()
+	defer r.RUnlock()
+	for _, cc := range r.sessions {
+		cc.configChanged.Set(true)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ZzzYtl/MyMask/backend"
+	"github.com/ZzzYtl/MyMask/mysql"
+	"github.com/ZzzYtl/MyMask/util"
+	"github.com/ZzzYtl/MyMask/util/sync2"
+)
+
+func newTestSession(id uint32) *Session {
+	cc := &Session{c: &ClientConn{Conn: &mysql.Conn{}}, executor: newSessionExecutor(nil)}
+	cc.c.SetConnectionID(id)
+	return cc
+}
+
+func TestSessionRegistry(t *testing.T) {
+	r := newSessionRegistry()
+	var wg sync.WaitGroup
+	for i := 10; i > 0; i-- {
+		wg.Add(1)
+		go func(id uint32) {
+			defer wg.Done()
+			r.add(newTestSession(id))
+		}(uint32(i))
+	}
+	wg.Wait()
+
+	sessions := r.list()
+	if len(sessions) != 10 {
+		t.Fatalf("session count not equal, expect: 10, actual: %d", len(sessions))
+	}
+	for i, cc := range sessions {
+		if cc.c.GetConnectionID() != uint32(i+1) {
+			t.Errorf("session not ordered, expect: %d, actual: %d", i+1, cc.c.GetConnectionID())
+		}
+	}
+
+	r.notifyConfigChanged()
+	for _, cc := range sessions {
+		if !cc.configChanged.Get() {
+			t.Errorf("session %d should be notified", cc.c.GetConnectionID())
+		}
+	}
+
+	// remove session replaced by other one with same id has no effect
+	r.remove(newTestSession(1))
+	if r.get(1) == nil {
+		t.Errorf("session 1 should not be removed")
+	}
+	r.remove(sessions[0])
+	if r.get(1) != nil {
+		t.Errorf("session 1 should be removed")
+	}
+}
+
+func TestProcessState(t *testing.T) {
+	cc := newTestSession(1)
+	cc.executor.process.idle("u1", "db1", MaskStatusNone, false)
+	cc.executor.process.begin(commandName(mysql.ComQuery), "select 1")
+
+	info := cc.executor.process.info()
+	if info.User != "u1" || info.DB != "db1" || info.Command != "Query" || info.SQL != "select 1" {
+		t.Errorf("process info not equal, actual: %+v", info)
+	}
+
+	rule := make(map[util.RuleKey]string)
+	cc.executor.maskRule = &rule
+	cc.executor.process.idle("u1", "db2", cc.executor.maskStatus(), false)
+	info = cc.executor.process.info()
+	if info.Command != processCommandSleep || info.SQL != "" || info.DB != "db2" || info.MaskStatus != MaskStatusExempt {
+		t.Errorf("process info not equal, actual: %+v", info)
+	}
+
+	// nothing to kill if no query is running on backend
+	if err := cc.executor.process.killQuery(); err != nil {
+		t.Errorf("kill query error: %v", err)
+	}
+	if !cc.executor.process.interrupted {
+		t.Errorf("process should be interrupted after killed")
+	}
+	cc.executor.process.begin(commandName(mysql.ComQuery), "select 1")
+	if cc.executor.process.interrupted {
+		t.Errorf("interrupted should be reset by next command")
+	}
+}
+
+func TestKillQueryOwnsBackend(t *testing.T) {
+	defer func(f func(*backend.PooledConnection, uint32) error) { killBackendQuery = f }(killBackendQuery)
+
+	p := &processState{}
+	pc := &backend.PooledConnection{}
+	p.backendConn, p.backendConnID = pc, 7
+
+	// query finishes and its connection is recycled while KILL QUERY is being sent
+	var killed []uint32
+	finished := make(chan struct{})
+	killBackendQuery = func(conn *backend.PooledConnection, connID uint32) error {
+		if conn != pc {
+			t.Errorf("connection to kill not equal")
+		}
+		killed = append(killed, connID)
+		go func() {
+			p.setBackend(nil)
+			close(finished)
+		}()
+		select {
+		case <-finished:
+			t.Errorf("query should not finish before it's killed")
+		case <-time.After(50 * time.Millisecond):
+		}
+		return nil
+	}
+	if err := p.killQuery(); err != nil {
+		t.Fatalf("kill query error: %v", err)
+	}
+	<-finished
+	if len(killed) != 1 || killed[0] != 7 {
+		t.Errorf("killed connections not equal, actual: %v", killed)
+	}
+
+	// connection recycled is not killed any more
+	if err := p.killQuery(); err != nil || len(killed) != 1 {
+		t.Errorf("recycled connection should not be killed, err: %v, killed: %v", err, killed)
+	}
+
+	p.backendConn, p.backendConnID = pc, 8
+	p.idle("u1", "db1", MaskStatusNone, false)
+	if p.backendConn != nil || p.backendConnID != 0 {
+		t.Errorf("backend should be cleared when idle, actual id: %d", p.backendConnID)
+	}
+}
+
+func TestClientAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	raw := rawClientConn(&unixConn{Conn: server})
+	if raw == nil {
+		t.Fatalf("socket of tcp connection should be unwrapped")
+	}
+	if !isClientAlive(raw) {
+		t.Errorf("client should be alive")
+	}
+
+	// pipelined data is not consumed
+	client.Write([]byte{1})
+	if !isClientAlive(raw) {
+		t.Errorf("client should be alive when data pending")
+	}
+	buf := make([]byte, 1)
+	if _, err := server.Read(buf); err != nil || buf[0] != 1 {
+		t.Errorf("pending data should not be consumed, err: %v", err)
+	}
+
+	client.Close()
+	time.Sleep(50 * time.Millisecond)
+	if isClientAlive(raw) {
+		t.Errorf("client should be gone after closed")
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	s := &Server{sessions: newSessionRegistry()}
+	newPipeSession := func(id uint32) *Session {
+		server, client := net.Pipe()
+		cc := &Session{c: &ClientConn{Conn: mysql.NewConn(server)}, executor: newSessionExecutor(nil)}
+		cc.c.SetConnectionID(id)
+		cc.updateProcessIdle()
+		s.sessions.add(cc)
+		// session goroutine exits when client connection is closed
+		go func() {
+			cc.c.ReadEphemeralPacket()
+			s.sessions.remove(cc)
+			client.Close()
+		}()
+		return cc
+	}
+
+	newPipeSession(1)
+	busy := newPipeSession(2)
+	busy.executor.process.begin(commandName(mysql.ComQuery), "select sleep(10)")
+
+	start := time.Now()
+	s.drain(200 * time.Millisecond)
+	if s.sessions.count() != 0 {
+		t.Fatalf("sessions should be closed after drain, left: %d", s.sessions.count())
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > drainRecycleWaitTime {
+		t.Errorf("busy session should be killed after drain timeout, elapsed: %v", elapsed)
+	}
+}
+
+func TestNamespaceChangeNotifySessions(t *testing.T) {
+	m := newTestMaskManager()
+	current, _, _ := m.switchIndex.Get()
+	m.users[current] = NewUserManager()
+	m.configs[current] = newRunningConfig()
+	s := &Server{sessions: newSessionRegistry(), manager: m}
+	// listeners are not checked after server closed
+	s.closed = sync2.NewAtomicBool(true)
+	cc := newTestSession(1)
+	s.sessions.add(cc)
+
+	if err := s.DeleteNamespace("ns1"); err != nil {
+		t.Fatalf("delete namespace error: %v", err)
+	}
+	if !cc.configChanged.Get() {
+		t.Errorf("session should be notified after namespace deleted")
+	}
+
+	cc.configChanged.Set(false)
+	s.prepared = true
+	if err := s.ReloadNamespaceCommit("ns1"); err != nil {
+		t.Fatalf("commit namespace error: %v", err)
+	}
+	if !cc.configChanged.Get() {
+		t.Errorf("session should be notified after namespace committed")
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// EnvelopePrefix is prefix of values encrypted by Envelope
+const EnvelopePrefix = "enc:v1:"
+
+// dataKeySize is size of data key generated for each value, aes-256 is used
+const dataKeySize = 32
+
+// KeyProvider provide master keys by key id
+type KeyProvider interface {
+	// CurrentKeyID return id of key used to encrypt new values
+	CurrentKeyID() string
+	// Key return master key of id
+	Key(id string) ([]byte, error)
+}
+
+// staticKeys is master keys loaded from key file or environment variable
+type staticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+// ParseKeys parse master keys, each key is `<key id>:<base64 key>`, separated by new line or comma.
+// empty lines and lines starting with # are ignored. the last key is the current key, so a key is
+// rotated by appending a new one and keeping old ones until all values are encrypted again.
+func ParseKeys(data string) (KeyProvider, error) {
+	p := &staticKeys{keys: make(map[string][]byte)}
+	fields := strings.FieldsFunc(data, func(r rune) bool { return r == '\n' || r == ',' })
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		if f == "" || strings.HasPrefix(f, "#") {
+			continue
+		}
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid key, should be <key id>:<base64 key>")
+		}
+		id := kv[0]
+		if _, ok := p.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key id %s", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s, %v", id, err)
+		}
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return nil, fmt.Errorf("invalid key %s, length should be 16, 24 or 32, actual: %d", id, len(key))
+		}
+		p.keys[id] = key
+		p.current = id
+	}
+	if p.current == "" {
+		return nil, fmt.Errorf("no key found")
+	}
+	return p, nil
+}
+
+// NewFileKeyProvider load master keys from file, see ParseKeys for format
+func NewFileKeyProvider(path string) (KeyProvider, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParseKeys(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// NewEnvKeyProvider load master keys from environment variable, see ParseKeys for format
+func NewEnvKeyProvider(name string) (KeyProvider, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s not set", name)
+	}
+	p, err := ParseKeys(v)
+	if err != nil {
+		return nil, fmt.Errorf("environment variable %s: %v", name, err)
+	}
+	return p, nil
+}
+
+func (p *staticKeys) CurrentKeyID() string {
+	return p.current
+}
+
+func (p *staticKeys) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found", id)
+	}
+	return key, nil
+}
+
+// Envelope encrypt values with envelope encryption: each value is encrypted by a random data key in gcm mode,
+// and the data key is encrypted by master key. encrypted value is
+// enc:v1:<key id>:<base64 encrypted data key>:<base64 encrypted value>
+type Envelope struct {
+	keys KeyProvider
+}
+
+// NewEnvelope constructor of Envelope
+func NewEnvelope(keys KeyProvider) *Envelope {
+	return &Envelope{keys: keys}
+}
+
+// IsEncrypted return true if value is encrypted by Envelope
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, EnvelopePrefix)
+}
+
+// KeyID return id of master key used to encrypt value, empty if value is not encrypted
+func KeyID(value string) string {
+	if !IsEncrypted(value) {
+		return ""
+	}
+	return strings.SplitN(strings.TrimPrefix(value, EnvelopePrefix), ":", 2)[0]
+}
+
+// Encrypt encrypt value with current master key
+func (e *Envelope) Encrypt(value string) (string, error) {
+	id := e.keys.CurrentKeyID()
+	key, err := e.keys.Key(id)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	// key id is authenticated, so that encrypted data key could not be moved to another key id
+	wrapped, err := EncryptGCM(key, dataKey, []byte(id))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := EncryptGCM(dataKey, []byte(value), []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return EnvelopePrefix + id + ":" + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypt value encrypted by Encrypt
+func (e *Envelope) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return "", fmt.Errorf("value is not encrypted")
+	}
+	parts := strings.Split(strings.TrimPrefix(value, EnvelopePrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid encrypted value")
+	}
+	id := parts[0]
+	key, err := e.keys.Key(id)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid data key, %v", err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value, %v", err)
+	}
+
+	dataKey, err := DecryptGCM(key, wrapped, []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("decrypt data key with key %s failed, %v", id, err)
+	}
+	data, err := DecryptGCM(dataKey, sealed, []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("decrypt value with key %s failed, %v", id, err)
+	}
+	return string(data), nil
+}
+
+// Rotate encrypt value again with current master key, value not encrypted is encrypted,
+// value already encrypted by current master key is returned as it is
+func (e *Envelope) Rotate(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return e.Encrypt(value)
+	}
+	if KeyID(value) == e.keys.CurrentKeyID() {
+		return value, nil
+	}
+	data, err := e.Decrypt(value)
+	if err != nil {
+		return "", err
+	}
+	return e.Encrypt(data)
+}
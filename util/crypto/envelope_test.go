@@ -0,0 +1,105 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "k1:MTIzNGFiY2Q1Njc4ZWZnKjEyMzRhYmNkNTY3OGVmZyo="
+	testKey2 = "k2:YWJjZGVmZ2hpamtsbW5vcA=="
+)
+
+func TestParseKeys(t *testing.T) {
+	p, err := ParseKeys("# old key\n" + testKey1 + "\n\n" + testKey2 + "\n")
+	if err != nil {
+		t.Fatalf("parse keys error: %v", err)
+	}
+	if p.CurrentKeyID() != "k2" {
+		t.Errorf("current key should be the last one, actual: %s", p.CurrentKeyID())
+	}
+	if _, err := p.Key("k1"); err != nil {
+		t.Errorf("get old key error: %v", err)
+	}
+
+	for _, data := range []string{"", "k1", ":MTIz", "k1:not-base64", "k1:MTIz", testKey1 + "," + testKey1} {
+		if _, err := ParseKeys(data); err == nil {
+			t.Errorf("parse %q should fail", data)
+		}
+	}
+
+	os.Setenv("GAEA_TEST_KEYS", testKey1+","+testKey2)
+	defer os.Unsetenv("GAEA_TEST_KEYS")
+	if p, err := NewEnvKeyProvider("GAEA_TEST_KEYS"); err != nil || p.CurrentKeyID() != "k2" {
+		t.Errorf("load keys from environment variable failed, err: %v", err)
+	}
+	if _, err := NewEnvKeyProvider("GAEA_TEST_KEYS_NOT_SET"); err == nil {
+		t.Errorf("load keys from unset environment variable should fail")
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	old, _ := ParseKeys(testKey1)
+	e := NewEnvelope(old)
+	encrypted, err := e.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	if !IsEncrypted(encrypted) || KeyID(encrypted) != "k1" || strings.Contains(encrypted, "secret") {
+		t.Fatalf("invalid encrypted value: %s", encrypted)
+	}
+	if again, _ := e.Encrypt("secret"); again == encrypted {
+		t.Errorf("encrypted values of the same data should be different")
+	}
+	if data, err := e.Decrypt(encrypted); err != nil || data != "secret" {
+		t.Errorf("decrypt not equal, actual: %s, err: %v", data, err)
+	}
+
+	// tampered value or key id is rejected
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-2] + "BB"
+	}
+	if _, err := e.Decrypt(tampered); err == nil {
+		t.Errorf("decrypt tampered value should fail")
+	}
+	both, _ := ParseKeys(testKey1 + "," + strings.Replace(testKey1, "k1", "k3", 1))
+	if _, err := NewEnvelope(both).Decrypt(strings.Replace(encrypted, ":k1:", ":k3:", 1)); err == nil {
+		t.Errorf("decrypt value with changed key id should fail")
+	}
+
+	// rotate to new key, old key is still needed to decrypt old values
+	rotated, _ := ParseKeys(testKey1 + "," + testKey2)
+	e = NewEnvelope(rotated)
+	value, err := e.Rotate(encrypted)
+	if err != nil || KeyID(value) != "k2" {
+		t.Fatalf("rotate failed, value: %s, err: %v", value, err)
+	}
+	if same, _ := e.Rotate(value); same != value {
+		t.Errorf("value encrypted by current key should not be changed")
+	}
+	if data, err := e.Decrypt(value); err != nil || data != "secret" {
+		t.Errorf("decrypt rotated value not equal, actual: %s, err: %v", data, err)
+	}
+	if value, err := e.Rotate("plain"); err != nil || KeyID(value) != "k2" {
+		t.Errorf("rotate plain value should encrypt it, value: %s, err: %v", value, err)
+	}
+	if _, err := NewEnvelope(old).Decrypt(value); err == nil {
+		t.Errorf("decrypt with missing key should fail")
+	}
+}
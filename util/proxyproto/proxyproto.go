@@ -0,0 +1,194 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxyproto implements receiver of PROXY protocol v1 and v2,
+// see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 // including CRLF
+
+	v2HeaderLength = 16
+	v2Version      = 0x20
+	v2CmdLocal     = 0x00
+	v2CmdProxy     = 0x01
+	v2FamilyInet   = 0x10
+	v2FamilyInet6  = 0x20
+	v2AddrLenInet  = 12
+	v2AddrLenInet6 = 36
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	// ErrNoHeader means connection does not begin with PROXY protocol header
+	ErrNoHeader = errors.New("proxy protocol header not found")
+	// ErrInvalidHeader means PROXY protocol header is malformed
+	ErrInvalidHeader = errors.New("invalid proxy protocol header")
+)
+
+// Conn is net.Conn with remote address carried by PROXY protocol header
+type Conn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr return source address of client in front of load balancer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// SetNoDelay set TCP_NODELAY of underlying connection if it's a tcp connection
+func (c *Conn) SetNoDelay(noDelay bool) error {
+	if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+		return tcpConn.SetNoDelay(noDelay)
+	}
+	return nil
+}
+
+// Accept read PROXY protocol header from conn within timeout, the returned connection reports
+// source address in header as remote address. Address of conn is kept for LOCAL or UNKNOWN header,
+// which is sent by health check of load balancer.
+func Accept(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+	}
+	addr, err := ReadHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+	return &Conn{Conn: conn, remoteAddr: addr}, nil
+}
+
+// ReadHeader read PROXY protocol v1 or v2 header, no byte after header is read.
+// nil address is returned for LOCAL command and UNKNOWN protocol.
+func ReadHeader(r io.Reader) (net.Addr, error) {
+	// "PROXY UNKNOWN\r\n" is the shortest header, v1 and v2 could be distinguished by the first 8 bytes
+	buf := make([]byte, 8, v2HeaderLength)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(buf, []byte(v1Prefix)) {
+		return readV1(r, buf)
+	}
+	if bytes.Equal(buf, v2Signature[:8]) {
+		return readV2(r, buf)
+	}
+	return nil, ErrNoHeader
+}
+
+// PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n
+func readV1(r io.Reader, buf []byte) (net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) >= v1MaxLength {
+			return nil, ErrInvalidHeader
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+	}
+
+	fields := strings.Split(string(buf[len(v1Prefix):len(buf)-2]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if len(fields) != 5 {
+		return nil, ErrInvalidHeader
+	}
+
+	ip := net.ParseIP(fields[1])
+	if ip == nil || (fields[0] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrInvalidHeader
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r io.Reader, buf []byte) (net.Addr, error) {
+	buf = buf[:v2HeaderLength]
+	if _, err := io.ReadFull(r, buf[8:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:len(v2Signature)], v2Signature) || buf[12]&0xF0 != v2Version {
+		return nil, ErrInvalidHeader
+	}
+
+	// addresses and TLVs, TLVs are ignored
+	data := make([]byte, binary.BigEndian.Uint16(buf[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	switch buf[12] & 0x0F {
+	case v2CmdLocal:
+		return nil, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol command: %d", buf[12]&0x0F)
+	}
+
+	switch buf[13] & 0xF0 {
+	case v2FamilyInet:
+		if len(data) < v2AddrLenInet {
+			return nil, ErrInvalidHeader
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, data[0:4])
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case v2FamilyInet6:
+		if len(data) < v2AddrLenInet6 {
+			return nil, ErrInvalidHeader
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, data[0:16])
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	default:
+		// AF_UNSPEC and AF_UNIX carry no useful address
+		return nil, nil
+	}
+}
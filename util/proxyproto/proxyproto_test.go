@@ -0,0 +1,104 @@
+// Copyright 2019 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyproto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd, family byte, addr []byte) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, v2Version|cmd, family|0x01, byte(len(addr)>>8), byte(len(addr)))
+	return append(h, addr...)
+}
+
+func TestReadHeader(t *testing.T) {
+	inet := []byte{10, 0, 0, 1, 192, 168, 0, 1, 0x30, 0x39, 0x0c, 0xea}
+	inet6 := make([]byte, v2AddrLenInet6)
+	inet6[15] = 1
+	inet6[32], inet6[33] = 0x30, 0x39
+
+	tests := []struct {
+		header string
+		expect string // empty means address is not carried
+		err    bool
+	}{
+		{"PROXY TCP4 10.0.0.1 192.168.0.1 12345 3306\r\n", "10.0.0.1:12345", false},
+		{"PROXY TCP6 ::1 ::2 12345 3306\r\n", "[::1]:12345", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+		{"PROXY TCP4 ::1 192.168.0.1 12345 3306\r\n", "", true},
+		{"PROXY TCP4 10.0.0.1 192.168.0.1 123456 3306\r\n", "", true},
+		{"PROXY TCP4 10.0.0.1\r\n", "", true},
+		{"PROXY TCP4 " + string(bytes.Repeat([]byte("1"), 120)), "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+		{string(v2Header(v2CmdProxy, v2FamilyInet, inet)), "10.0.0.1:12345", false},
+		{string(v2Header(v2CmdProxy, v2FamilyInet6, inet6)), "[::1]:12345", false},
+		{string(v2Header(v2CmdLocal, 0, nil)), "", false},
+		{string(v2Header(v2CmdProxy, v2FamilyInet, inet[:4])), "", true},
+	}
+	for _, test := range tests {
+		// bytes after header must not be consumed
+		r := bytes.NewBufferString(test.header + "mysql")
+		addr, err := ReadHeader(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("header %q should return error", test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("header %q, unexpected error: %v", test.header, err)
+			continue
+		}
+		actual := ""
+		if addr != nil {
+			actual = addr.String()
+		}
+		if actual != test.expect {
+			t.Errorf("header %q, address not equal, expect: %s, actual: %s", test.header, test.expect, actual)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "mysql" {
+			t.Errorf("header %q, data after header not equal, actual: %q", test.header, rest)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go client.Write([]byte("PROXY TCP4 10.0.0.1 192.168.0.1 12345 3306\r\n"))
+	conn, err := Accept(server, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "10.0.0.1:12345" {
+		t.Errorf("remote address not equal, expect: 10.0.0.1:12345, actual: %s", conn.RemoteAddr())
+	}
+
+	// no header within timeout
+	server2, client2 := net.Pipe()
+	defer server2.Close()
+	defer client2.Close()
+	if _, err := Accept(server2, 10*time.Millisecond); err == nil {
+		t.Errorf("accept should fail without header")
+	}
+}
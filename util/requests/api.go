@@ -16,6 +16,7 @@ package requests
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -39,10 +40,12 @@ const (
 
 // default global client，safe for concurrent use by multiple goroutines
 var defaultClient *http.Client
+var defaultTransport *http.Transport
 
 func init() {
 	var dials uint64
 	tr := &http.Transport{}
+	defaultTransport = tr
 	tr.Dial = func(network, addr string) (net.Conn, error) {
 		c, err := net.DialTimeout(network, addr, time.Second*10)
 		if err == nil {
@@ -62,6 +65,11 @@ func init() {
 	}()
 }
 
+// SetTLSConfig set tls config of https requests sent by default client, it should be called before sending requests
+func SetTLSConfig(c *tls.Config) {
+	defaultTransport.TLSClientConfig = c
+}
+
 // Request request info
 type Request struct {
 	User     string
@@ -192,8 +200,13 @@ func SendGet(url, user, password string) (*Response, error) {
 
 // EncodeURL encode url
 func EncodeURL(host string, format string, args ...interface{}) string {
+	return EncodeURLWithScheme("http", host, format, args...)
+}
+
+// EncodeURLWithScheme encode url with scheme, http or https
+func EncodeURLWithScheme(scheme, host string, format string, args ...interface{}) string {
 	var u url.URL
-	u.Scheme = "http"
+	u.Scheme = scheme
 	u.Host = host
 	u.Path = fmt.Sprintf(format, args...)
 	return u.String()